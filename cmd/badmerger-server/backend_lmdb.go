@@ -0,0 +1,5 @@
+//go:build cgo && !no_lmdb
+
+package main
+
+import _ "github.com/kill-2/badmerger/storage/lmdb"
@@ -0,0 +1,128 @@
+// Command badmerger-server keeps databases for badmerger runs on other machines
+// that pass -s grpc://host:port[/database], see storage/grpc.
+//
+//	badmerger-server -d ROOT [-l :7070] [-s badgerdb] [--gc-interval 10m]
+//		[--flatten-interval 0] [--trim-interval 0] [--audit FILE]
+//
+// The intervals set the background maintenance of the databases, see
+// grpc.Maintenance; each run is logged to stderr and the totals are logged on exit.
+// --audit appends a JSON line per call to FILE, or to stderr for -, see grpc.AuditEntry.
+// SIGHUP reloads the open databases whose ROOT/DATABASE symlink was switched to a
+// rebuilt directory, see grpc.Server.Reload.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kill-2/badmerger/lib"
+	"github.com/kill-2/badmerger/storage/grpc"
+)
+
+func main() {
+	listen, root, store, audit := ":7070", "", "badgerdb", ""
+	maint := grpc.Maintenance{GCInterval: 10 * time.Minute, Report: logMaintenance}
+	intervals := map[string]*time.Duration{
+		"--gc-interval":      &maint.GCInterval,
+		"--flatten-interval": &maint.FlattenInterval,
+		"--trim-interval":    &maint.TrimInterval,
+	}
+	for i := 1; i < len(os.Args); i++ {
+		if interval, ok := intervals[os.Args[i]]; ok && i+1 < len(os.Args) {
+			d, err := time.ParseDuration(os.Args[i+1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "bad %v %v\n", os.Args[i], os.Args[i+1])
+				os.Exit(2)
+			}
+			*interval = d
+			i++
+			continue
+		}
+		if os.Args[i] == "-l" && i+1 < len(os.Args) {
+			listen = os.Args[i+1]
+			i++
+		} else if os.Args[i] == "-d" && i+1 < len(os.Args) {
+			root = os.Args[i+1]
+			i++
+		} else if os.Args[i] == "-s" && i+1 < len(os.Args) {
+			store = os.Args[i+1]
+			i++
+		} else if os.Args[i] == "--audit" && i+1 < len(os.Args) {
+			audit = os.Args[i+1]
+			i++
+		}
+	}
+	if root == "" {
+		fmt.Fprintln(os.Stderr, "-d ROOT is required")
+		os.Exit(2)
+	}
+
+	srv, err := grpc.NewServer(root, store, lib.StorageConfig{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to create server %v\n", err)
+		os.Exit(1)
+	}
+	if audit == "-" {
+		srv.SetAudit(grpc.AuditTo(os.Stderr))
+	} else if audit != "" {
+		f, err := os.OpenFile(audit, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fail to open audit log %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		srv.SetAudit(grpc.AuditTo(f))
+	}
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to listen %v\n", err)
+		os.Exit(1)
+	}
+
+	srv.StartMaintenance(maint)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := srv.Reload(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			fmt.Fprintln(os.Stderr, "reloaded")
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		<-stop
+		if err := srv.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if b, err := json.Marshal(srv.MaintenanceStats()); err == nil {
+			fmt.Fprintf(os.Stderr, "maintenance %s\n", b)
+		}
+	}()
+	if err := srv.Serve(lis); err != nil {
+		fmt.Fprintf(os.Stderr, "fail to serve %v\n", err)
+		os.Exit(1)
+	}
+	// Serve returns as soon as Close stops listening, wait for the databases
+	<-closed
+}
+
+func logMaintenance(task, database string, took time.Duration, err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to %v %v after %v: %v\n", task, database, took, err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%v %v took %v\n", task, database, took)
+}
@@ -0,0 +1,5 @@
+//go:build duckdb
+
+package main
+
+import _ "github.com/kill-2/badmerger/storage/duckdb"
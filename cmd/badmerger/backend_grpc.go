@@ -0,0 +1,5 @@
+//go:build !no_grpc
+
+package main
+
+import _ "github.com/kill-2/badmerger/storage/grpc"
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// runBackup handles `badmerger backup -d DIR [-o FILE]`, writing a backup of the
+// database to FILE or stdout, see lib.DbWrapper.Backup.
+func runBackup(args []string) error {
+	var dir, out string
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-d" {
+			dir = args[i+1]
+			i++
+		} else if args[i] == "-o" {
+			out = args[i+1]
+			i++
+		}
+	}
+	if dir == "" {
+		return fmt.Errorf("-d DIR is required")
+	}
+	if !lib.IsDatabase(dir) {
+		return fmt.Errorf("no database in %v", dir)
+	}
+
+	opts := []lib.StorageOpt{lib.WithDir(dir)}
+	if path, ok := flagValue("--encryption-key-file"); ok {
+		opts = append(opts, encryptionKey(path))
+	}
+	dbW, err := lib.Open(opts...)
+	if err != nil {
+		return err
+	}
+	defer dbW.Close()
+
+	w := os.Stdout
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriterSize(w, 1<<20)
+	if err := dbW.Backup(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return w.Sync()
+}
+
+// runRestore handles `badmerger restore -d DIR [-i FILE]`, reading a backup from
+// FILE or stdin into a new database in DIR, see lib.Restore.
+func runRestore(args []string) error {
+	var dir, in string
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-d" {
+			dir = args[i+1]
+			i++
+		} else if args[i] == "-i" {
+			in = args[i+1]
+			i++
+		}
+	}
+	if dir == "" {
+		return fmt.Errorf("-d DIR is required")
+	}
+
+	r := os.Stdin
+	if in != "" {
+		f, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var opts []lib.StorageOpt
+	if path, ok := flagValue("--encryption-key-file"); ok {
+		opts = append(opts, encryptionKey(path))
+	}
+	return lib.Restore(bufio.NewReaderSize(r, 1<<20), dir, opts...)
+}
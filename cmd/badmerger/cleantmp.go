@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// runCleanTmp handles `badmerger clean-tmp [--older-than DURATION] [--dry-run]`,
+// removing the temp dirs and files left by crashed runs, 24h old by default.
+func runCleanTmp(args []string) error {
+	olderThan := 24 * time.Hour
+	dryRun := false
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--older-than" && i+1 < len(args) {
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d < 0 {
+				return fmt.Errorf("bad --older-than %v", args[i+1])
+			}
+			olderThan = d
+			i++
+		} else if args[i] == "--dry-run" {
+			dryRun = true
+		}
+	}
+
+	orphans, err := lib.OrphanedTemp(olderThan)
+	if err != nil {
+		return err
+	}
+	for _, path := range orphans {
+		if dryRun {
+			fmt.Println("would remove", path)
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("fail to remove %v: %v", path, err)
+		}
+		fmt.Println("removed", path)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+type compactResult struct {
+	BytesBefore int64         `json:"bytes_before"`
+	BytesAfter  int64         `json:"bytes_after"`
+	Took        time.Duration `json:"took_ns"`
+}
+
+// runCompact handles `badmerger compact DIR` (or -d DIR), compacting the database
+// and collecting its garbage, see lib.DbWrapper.Compact, and printing the size of
+// the directory before and after as JSON.
+func runCompact(args []string) error {
+	var dir string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-d" && i+1 < len(args) {
+			dir = args[i+1]
+			i++
+		} else if dir == "" {
+			dir = args[i]
+		}
+	}
+	if dir == "" {
+		return fmt.Errorf("a database dir is required")
+	}
+	if !lib.IsDatabase(dir) {
+		return fmt.Errorf("no database in %v", dir)
+	}
+
+	dbW, err := lib.Open(lib.WithDir(dir))
+	if err != nil {
+		return err
+	}
+	res := compactResult{BytesBefore: dbW.Usage().DirBytes}
+	if err := dbW.Compact(); err != nil {
+		dbW.Close()
+		return err
+	}
+	if err := dbW.Close(); err != nil {
+		return err
+	}
+	res.BytesAfter = dbW.Usage().DirBytes
+	res.Took = dbW.Usage().CompactionTime
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// runDelete handles `badmerger delete -d DIR --where FIELD=VALUE [--where ...]`,
+// deleting the rows whose leading key fields have the given values, see
+// lib.DeleteWhere. Values are read as JSON where they parse, so a string key
+// holding digits is given as --where 'id="42"'.
+func runDelete(args []string) error {
+	var dir string
+	key := make(map[string]any)
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-d" && i+1 < len(args) {
+			dir = args[i+1]
+			i++
+		} else if args[i] == "--where" && i+1 < len(args) {
+			if err := parseWhere(args[i+1], key); err != nil {
+				return err
+			}
+			i++
+		}
+	}
+	if dir == "" {
+		return fmt.Errorf("-d DIR is required")
+	}
+	if !lib.IsDatabase(dir) {
+		return fmt.Errorf("no database in %v", dir)
+	}
+
+	dbW, err := lib.Open(lib.WithDir(dir))
+	if err != nil {
+		return err
+	}
+	if err := dbW.DeleteWhere(key); err != nil {
+		dbW.Close()
+		return err
+	}
+	return dbW.Close()
+}
+
+// parseWhere adds the FIELD=VALUE of a --where to key, reading VALUE as JSON where
+// it parses and as a string otherwise.
+func parseWhere(arg string, key map[string]any) error {
+	name, raw, ok := strings.Cut(arg, "=")
+	if !ok {
+		return fmt.Errorf("bad --where %v, want FIELD=VALUE", arg)
+	}
+	var v any
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		v = raw
+	}
+	key[name] = v
+	return nil
+}
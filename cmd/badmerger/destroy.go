@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// runDestroy handles `badmerger destroy -d DIR [-d DIR ...] [--force]`. Each DIR may
+// be a glob pattern like /data/tenant-*; every match must be a database, otherwise
+// nothing is removed. Without --force the dirs are listed and removed only once
+// confirmed on stdin.
+func runDestroy(args []string) error {
+	var patterns []string
+	force := false
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-d" && i+1 < len(args) {
+			patterns = append(patterns, args[i+1])
+			i++
+		} else if args[i] == "--force" {
+			force = true
+		}
+	}
+	if len(patterns) == 0 {
+		return fmt.Errorf("want -d DIR")
+	}
+
+	var dirs []string
+	seen := map[string]bool{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("bad pattern %v", pattern)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("no dir matches %v", pattern)
+		}
+		for _, dir := range matches {
+			if !lib.IsDatabase(dir) {
+				return fmt.Errorf("%v is not a database, nothing removed", dir)
+			}
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+
+	if !force {
+		for _, dir := range dirs {
+			fmt.Println("will remove", dir)
+		}
+		fmt.Printf("remove %d databases? [y/N] ", len(dirs))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return fmt.Errorf("not confirmed, nothing removed")
+		}
+	}
+	for _, dir := range dirs {
+		if err := lib.Destroy(dir); err != nil {
+			return err
+		}
+		fmt.Println("removed", dir)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// runExport handles `badmerger export -d DIR [--where FIELD=VALUE ...]`, printing
+// the stored rows of the groups given like in delete, or every row, as JSON lines
+// in no particular order, see lib.Export.
+func runExport(args []string) error {
+	var dir string
+	key := make(map[string]any)
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-d" && i+1 < len(args) {
+			dir = args[i+1]
+			i++
+		} else if args[i] == "--where" && i+1 < len(args) {
+			if err := parseWhere(args[i+1], key); err != nil {
+				return err
+			}
+			i++
+		}
+	}
+	if dir == "" {
+		return fmt.Errorf("-d DIR is required")
+	}
+	if !lib.IsDatabase(dir) {
+		return fmt.Errorf("no database in %v", dir)
+	}
+
+	dbW, err := lib.Open(lib.WithDir(dir))
+	if err != nil {
+		return err
+	}
+	defer dbW.Close()
+
+	out := bufio.NewWriter(os.Stdout)
+	err = dbW.Export(key, func(record map[string]any) error {
+		b, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		out.Write(b)
+		return out.WriteByte('\n')
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
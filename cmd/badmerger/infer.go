@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+type inferredField struct {
+	Name  string   `json:"name"`
+	Kind  string   `json:"kind"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+	Nulls int64    `json:"nulls"`
+
+	kinds map[string]bool
+}
+
+// runInfer handles `badmerger infer < input.jsonl`, recommending a kind for every
+// field seen in the input, with the narrowest int kind that holds the observed range.
+func runInfer() error {
+	fields := make(map[string]*inferredField)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("fail to parse as JSON: %v", err)
+		}
+		for name, val := range record {
+			f, ok := fields[name]
+			if !ok {
+				f = &inferredField{Name: name, kinds: make(map[string]bool)}
+				fields[name] = f
+			}
+			f.observe(val)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := fields[name]
+		f.Kind = f.recommend()
+		b, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+	return nil
+}
+
+func (f *inferredField) observe(val any) {
+	switch v := val.(type) {
+	case nil:
+		f.Nulls++
+	case bool:
+		f.kinds["bool"] = true
+	case string:
+		f.kinds["string"] = true
+	case float64:
+		if v == math.Trunc(v) {
+			f.kinds["int"] = true
+		} else {
+			f.kinds["float"] = true
+		}
+		if f.Min == nil || v < *f.Min {
+			f.Min = &v
+		}
+		if f.Max == nil || v > *f.Max {
+			f.Max = &v
+		}
+	default:
+		f.kinds["json"] = true
+	}
+}
+
+func (f *inferredField) recommend() string {
+	switch {
+	case len(f.kinds) == 0:
+		return "json"
+	case len(f.kinds) == 1 && f.kinds["bool"]:
+		return "bool"
+	case len(f.kinds) == 1 && f.kinds["string"]:
+		return "string"
+	case len(f.kinds) == 1 && f.kinds["int"]:
+		for _, k := range []struct {
+			kind string
+			bits int
+		}{{"int8", 8}, {"int16", 16}, {"int32", 32}} {
+			lo, hi := -math.Exp2(float64(k.bits-1)), math.Exp2(float64(k.bits-1))-1
+			if *f.Min >= lo && *f.Max <= hi {
+				return k.kind
+			}
+		}
+		return "int64"
+	case !f.kinds["bool"] && !f.kinds["string"] && !f.kinds["json"]:
+		return "float64"
+	}
+	return "json"
+}
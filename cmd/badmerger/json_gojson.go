@@ -0,0 +1,25 @@
+//go:build gojson
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	gojson "github.com/goccy/go-json"
+)
+
+// unmarshalJSON decodes input lines with goccy/go-json, which is roughly twice as fast
+// as encoding/json on typical input, keeping numbers as json.Number like encoding/json.
+func unmarshalJSON(data []byte, v any) error {
+	d := gojson.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return fmt.Errorf("invalid data after top-level value")
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !gojson
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// unmarshalJSON decodes input lines, keeping numbers as json.Number so that decimal
+// and bigint fields get their exact text. Build with -tags gojson to swap in a
+// faster decoder.
+func unmarshalJSON(data []byte, v any) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return fmt.Errorf("invalid data after top-level value")
+	}
+	return nil
+}
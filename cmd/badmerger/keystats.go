@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+type groupRows struct {
+	Key  map[string]any `json:"key"`
+	Rows int64          `json:"rows"`
+}
+
+type levelStats struct {
+	Depth   int         `json:"depth"`
+	Keys    []string    `json:"keys"`
+	Groups  int64       `json:"groups"`
+	Rows    int64       `json:"rows"`
+	Largest []groupRows `json:"largest"`
+
+	last []byte
+}
+
+// runKeystats handles `badmerger keystats -d DIR [--depth N] [--top N]`, reporting
+// group and row counts for each key prefix up to depth, with the largest groups.
+func runKeystats(args []string) error {
+	var dir string
+	depth, top := 1, 5
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-d" && i+1 < len(args) {
+			dir = args[i+1]
+			i++
+		} else if args[i] == "--depth" && i+1 < len(args) {
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("bad --depth %v", args[i+1])
+			}
+			depth = n
+			i++
+		} else if args[i] == "--top" && i+1 < len(args) {
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("bad --top %v", args[i+1])
+			}
+			top = n
+			i++
+		}
+	}
+	if dir == "" {
+		return fmt.Errorf("-d DIR is required")
+	}
+	if !lib.IsDatabase(dir) {
+		return fmt.Errorf("no database in %v", dir)
+	}
+
+	dbW, err := lib.Open(lib.WithDir(dir))
+	if err != nil {
+		return err
+	}
+	defer dbW.Close()
+
+	keys := dbW.Keys()
+	if depth > len(keys) {
+		depth = len(keys)
+	}
+
+	// a single scan grouped by the deepest prefix; shallower groups are
+	// contiguous runs of it since keys are sorted
+	levels := make([]*levelStats, depth)
+	opts := []lib.IteratorOpt{lib.WithAgg("_rows_", "count()")}
+	for d := range levels {
+		levels[d] = &levelStats{Depth: d + 1}
+		for _, k := range keys[:d+1] {
+			levels[d].Keys = append(levels[d].Keys, k.Name)
+		}
+		opts = append(opts, lib.WithPartialKey(keys[d].Name))
+	}
+
+	err = dbW.NewIterator(opts...).Iter(func(res map[string]any) error {
+		rows := res["_rows_"].(int64)
+		for _, level := range levels {
+			key := make(map[string]any, len(level.Keys))
+			for _, name := range level.Keys {
+				key[name] = res[name]
+			}
+			b, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			level.Rows += rows
+			if string(b) != string(level.last) || level.Groups == 0 {
+				level.Groups++
+				level.last = b
+				level.Largest = append(level.Largest, groupRows{Key: key, Rows: rows})
+			} else {
+				level.Largest[len(level.Largest)-1].Rows += rows
+			}
+			if len(level.Largest) > 4*top+1 {
+				level.truncate(top, false)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, level := range levels {
+		level.truncate(top, true)
+		b, err := json.Marshal(level)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+	return nil
+}
+
+// truncate keeps the top largest groups. Unless final, the last group is
+// still being counted and is kept regardless.
+func (l *levelStats) truncate(top int, final bool) {
+	done := l.Largest
+	if !final {
+		done = l.Largest[:len(l.Largest)-1]
+	}
+	current := l.Largest[len(done):]
+
+	sort.SliceStable(done, func(i, j int) bool { return done[i].Rows > done[j].Rows })
+	if len(done) > top {
+		done = done[:top]
+	}
+	l.Largest = append(done, current...)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// runList handles `badmerger list storages|kinds|aggs|transforms`, printing the name, form
+// and description of what this build can use, including plugin-provided entries.
+func runList(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: badmerger list storages|kinds|aggs|transforms")
+	}
+	var entries []lib.Entry
+	switch args[0] {
+	case "storages":
+		entries = lib.Storages()
+	case "kinds":
+		entries = lib.Kinds()
+	case "aggs":
+		entries = lib.Aggregations()
+	case "transforms":
+		entries = lib.ValueTransforms()
+	default:
+		return fmt.Errorf("unknown list %q, want storages, kinds, aggs or transforms", args[0])
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, e := range entries {
+		if e.Form == e.Name {
+			fmt.Fprintf(w, "%s\t\t%s\n", e.Name, e.Doc)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", e.Name, e.Form, e.Doc)
+		}
+	}
+	return w.Flush()
+}
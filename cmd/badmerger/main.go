@@ -0,0 +1,799 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		if err := runSnapshot(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to snapshot: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "infer" {
+		if err := runInfer(); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to infer schema: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "clean-tmp" {
+		if err := runCleanTmp(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to clean temp: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "destroy" {
+		if err := runDestroy(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to destroy: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "delete" {
+		if err := runDelete(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to delete: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to export: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "upload" {
+		if err := runUpload(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to upload: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "list" {
+		if err := runList(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to list: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		if err := runTop(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to find top keys: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		if err := runStats(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to collect stats: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compact" {
+		if err := runCompact(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to compact: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		if err := runBackup(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to back up: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		if err := runRestore(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to restore: %v\n", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keystats" {
+		if err := runKeystats(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to collect key stats: %v\n", err)
+		}
+		return
+	}
+
+	cleanup, err := fetchRemoteDirs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to download db %v\n", err)
+		return
+	}
+	defer cleanup()
+
+	if hasFlag("--snapshot") && len(flagValues("-d")) != 1 {
+		fmt.Fprintln(os.Stderr, "--snapshot needs a single -d DIR")
+		return
+	}
+
+	var dbW *lib.DbWrapper
+	if dirs := flagValues("-d"); len(dirs) > 1 {
+		// several dirs are queried as one, see lib.OpenUnion
+		dbW, err = lib.OpenUnion(dirs, storageOpts()...)
+	} else {
+		dbW, err = lib.Open(storageOpts()...)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to open db %v\n", err)
+		return
+	}
+
+	if _, ok := flagValue("-d"); !ok {
+		// runs without -d merge in a temp dir nobody reopens, see clean-tmp for crashed ones
+		defer dbW.Destroy()
+	}
+
+	summary := &runSummary{}
+	if hasFlag("--summary-json") {
+		defer printSummary(summary, dbW)
+	}
+	// --snapshot NAME copies the database into a snapshot once the input is
+	// ingested and the database closed
+	ingested := false
+	if name, ok := flagValue("--snapshot"); ok {
+		dir, _ := flagValue("-d")
+		defer func() {
+			if !ingested {
+				return
+			}
+			if err := lib.CreateCheckpoint(dir, name); err != nil {
+				fmt.Fprintf(os.Stderr, "fail to snapshot: %v\n", err)
+			}
+		}()
+	}
+	defer dbW.Close(closeOpts()...)
+
+	stdinEmpty, err := isStdinEmpty()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to check stdin: %v\n", err)
+		return
+	}
+
+	if !stdinEmpty {
+		ch := make(chan map[string]any, 100)
+		go readStdin(ch)
+		if err := dbW.Recv(ch); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to Recv: %v\n", err)
+			return
+		}
+		for name, n := range dbW.Usage().OutOfRange {
+			fmt.Fprintf(os.Stderr, "warning: %d values of %v were out of range for its kind\n", n, name)
+		}
+		for name, n := range dbW.Usage().Oversized {
+			fmt.Fprintf(os.Stderr, "warning: %d values of %v were too long for its kind\n", n, name)
+		}
+		if n := dbW.Usage().EarlyCommits; n > 0 {
+			fmt.Fprintf(os.Stderr, "warning: committed early %d times past the memory watermark\n", n)
+		}
+	}
+
+	ingested = true
+
+	itOpts, err := iteratorOpts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to parse query options: %v\n", err)
+		return
+	}
+	if err := checkKeyRange(dbW.Keys()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	stOpts, closeState, err := stateOpts()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer func() {
+		if err := closeState(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	itOpts = append(itOpts, stOpts...)
+
+	// --diff-snapshot prints the groups that are new or changed since the snapshot,
+	// then the groups of the snapshot whose key is gone
+	var diff *snapshotDiff
+	if name, ok := flagValue("--diff-snapshot"); ok {
+		if hasFlag("--limit") || hasFlag("--offset") || hasFlag("--page-size") {
+			fmt.Fprintln(os.Stderr, "--diff-snapshot can not be combined with --limit, --offset or --page-size")
+			return
+		}
+		dir, _ := flagValue("-d")
+		if diff, err = newSnapshotDiff(dir, name, storageOpts(), itOpts); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to query snapshot: %v\n", err)
+			return
+		}
+		itOpts = append(itOpts, lib.WithFingerprint("_fingerprint_"))
+	}
+
+	itW := dbW.NewIterator(itOpts...)
+	if hasFlag("--reverse") {
+		itW.Reverse()
+	}
+	if hasFlag("--metadata") {
+		if err := printMetadata(itW, os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+	if hasFlag("--header") {
+		b, err := json.Marshal(map[string]any{"_schema_": itW.Columns()})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fail to marshal header into json: %v\n", err)
+			return
+		}
+		fmt.Println(string(b))
+	}
+	summary.Seed = itW.Seed()
+	defer func() {
+		trace := itW.Trace()
+		summary.Trace = &trace
+	}()
+	if size, ok := flagValue("--page-size"); ok {
+		n, _ := strconv.Atoi(size)
+		token, _ := flagValue("--page-token")
+		if err := printPage(itW, n, token); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to iterate: %v\n", err)
+		}
+		return
+	}
+	printRes := func(res map[string]any) error {
+		summary.GroupsEmitted++
+		b, err := json.Marshal(res)
+		if err != nil {
+			return fmt.Errorf("fail to marshal result into json: %v", err)
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	err = itW.Iter(func(res map[string]any) error {
+		if diff != nil && !diff.changed(res) {
+			return nil
+		}
+		return printRes(res)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to iterate: %v\n", err)
+		return
+	}
+	if diff != nil {
+		for _, res := range diff.deleted() {
+			if err := printRes(res); err != nil {
+				fmt.Fprintf(os.Stderr, "fail to iterate: %v\n", err)
+				return
+			}
+		}
+	}
+}
+
+// printPage prints one page of groups, followed by {"_next_": TOKEN} when more
+// groups follow, to be passed back with --page-token.
+func printPage(itW *lib.IterWrapper, size int, token string) error {
+	page, err := itW.Page(size, token)
+	if err != nil {
+		return err
+	}
+	for _, res := range page.Rows {
+		b, err := json.Marshal(res)
+		if err != nil {
+			return fmt.Errorf("fail to marshal result into json: %v", err)
+		}
+		fmt.Println(string(b))
+	}
+	if page.Next != "" {
+		b, _ := json.Marshal(map[string]string{"_next_": page.Next})
+		fmt.Println(string(b))
+	}
+	return nil
+}
+
+func isStdinEmpty() (bool, error) {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// Check if stdin is a terminal (interactive) or a pipe/file
+	if (stat.Mode() & os.ModeCharDevice) != 0 {
+		// If stdin is a terminal, it's typically "empty" unless user types something
+		return true, nil
+	}
+
+	// For pipes or redirected files, check if size is 0
+	if stat.Size() == 0 {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// maxLineSize bounds an input line, lines used to be dropped silently past 64KB.
+const maxLineSize = 256 << 20
+
+type rawLine struct {
+	seq  int32
+	data []byte
+}
+
+type parsedLine struct {
+	seq    int32
+	record map[string]any
+	err    error
+}
+
+// readStdin reads JSON lines from stdin and sends the parsed records to ch in input order.
+// Lines are unmarshaled by a pool of workers, one per CPU, and reordered by sequence number.
+func readStdin(ch chan map[string]any) {
+	defer close(ch)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	lines := make(chan rawLine, 1024)
+	parsed := make(chan parsedLine, 1024)
+
+	go func() {
+		defer close(lines)
+
+		var i int32
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(nil, maxLineSize)
+		for scanner.Scan() {
+			data := append([]byte(nil), scanner.Bytes()...)
+			select {
+			case lines <- rawLine{seq: i, data: data}:
+			case <-done:
+				return
+			}
+			i += 1
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "fail to read line %d: %v\n", i+1, err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for line := range lines {
+				record := lib.NewRecord()
+				err := unmarshalJSON(line.data, &record)
+				select {
+				case parsed <- parsedLine{seq: line.seq, record: record, err: err}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(parsed)
+	}()
+
+	pending := make(map[int32]parsedLine)
+	var next int32
+	for p := range parsed {
+		pending[p.seq] = p
+		for {
+			p, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			if p.err != nil {
+				fmt.Fprintf(os.Stderr, "fail to parse as JSON: %v\n", p.err)
+				return
+			}
+			p.record["_i_"] = next
+			ch <- p.record
+			next += 1
+		}
+	}
+}
+
+// hasFlag reports whether flag is among the arguments.
+func hasFlag(flag string) bool {
+	for _, arg := range os.Args[1:] {
+		if arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// flagValues returns the values following every occurrence of flag in the arguments.
+func flagValues(flag string) []string {
+	var values []string
+	for i := 1; i+1 < len(os.Args); i++ {
+		if os.Args[i] == flag {
+			values = append(values, os.Args[i+1])
+			i++
+		}
+	}
+	return values
+}
+
+// parseSize parses a byte count like lib.ParseSize, returning -1 for anything else
+// so that the option taking it fails.
+func parseSize(s string) int64 {
+	n, err := lib.ParseSize(s)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// flagValue returns the value following the last occurrence of flag in the arguments.
+func flagValue(flag string) (string, bool) {
+	var value string
+	var found bool
+	for i := 1; i+1 < len(os.Args); i++ {
+		if os.Args[i] == flag {
+			value, found = os.Args[i+1], true
+			i++
+		}
+	}
+	return value, found
+}
+
+// encryptionKey reads the hex encoded key of --encryption-key-file, e.g. made
+// with openssl rand -hex 32, so the key stays out of the process list.
+func encryptionKey(path string) lib.StorageOpt {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return func(*lib.DbWrapper) error { return fmt.Errorf("fail to read encryption key %v", err) }
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return func(*lib.DbWrapper) error { return fmt.Errorf("encryption key in %v is not hex", path) }
+	}
+	return lib.WithEncryptionKey(key)
+}
+
+func storageOpts() []lib.StorageOpt {
+	// readStdin takes every record from lib.NewRecord
+	opts := []lib.StorageOpt{lib.WithStorage(defaultStorage()), lib.WithRecycledRecords()}
+
+	for i := 1; i < len(os.Args); i++ {
+		if os.Args[i] == "-k" && i+1 < len(os.Args) {
+			parts := strings.SplitN(os.Args[i+1], ":", 2)
+			if len(parts) == 2 && !isKeyTransform(parts[1]) && !isKeyBucket(parts[1]) && !isKeyValue(parts[1]) {
+				opts = append(opts, lib.WithKey(parts[0], parts[1]))
+			}
+			i++
+		} else if os.Args[i] == "-v" && i+1 < len(os.Args) {
+			parts := strings.SplitN(os.Args[i+1], ":", 2)
+			if len(parts) == 2 {
+				opts = append(opts, lib.WithValue(parts[0], parts[1]))
+			}
+			i++
+		} else if os.Args[i] == "-m" && i+1 < len(os.Args) {
+			input, name, _ := strings.Cut(os.Args[i+1], "=")
+			opts = append(opts, lib.WithFieldMapping(input, name))
+			i++
+		} else if os.Args[i] == "-s" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithStorage(os.Args[i+1]))
+			i++
+		} else if os.Args[i] == "-d" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithDir(os.Args[i+1]))
+			i++
+		} else if os.Args[i] == "--overflow" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithOverflowPolicy(lib.OverflowPolicy(os.Args[i+1])))
+			i++
+		} else if os.Args[i] == "--size-policy" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithSizePolicy(lib.SizePolicy(os.Args[i+1])))
+			i++
+		} else if os.Args[i] == "--max-key-size" && i+1 < len(os.Args) {
+			n, _ := strconv.Atoi(os.Args[i+1])
+			opts = append(opts, lib.WithMaxKeySize(n))
+			i++
+		} else if os.Args[i] == "--format" && i+1 < len(os.Args) {
+			n, _ := strconv.Atoi(os.Args[i+1])
+			opts = append(opts, lib.WithFormat(n))
+			i++
+		} else if os.Args[i] == "--encryption-key-file" && i+1 < len(os.Args) {
+			opts = append(opts, encryptionKey(os.Args[i+1]))
+			i++
+		} else if os.Args[i] == "--namespace" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithNamespace(os.Args[i+1]))
+			i++
+		} else if os.Args[i] == "--compression" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithCompression(os.Args[i+1]))
+			i++
+		} else if os.Args[i] == "--job-id" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithJobID(os.Args[i+1]))
+			i++
+		} else if os.Args[i] == "--memory-watermark" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithMemoryWatermark(parseSize(os.Args[i+1])))
+			i++
+		} else if os.Args[i] == "--max-memory" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithMaxMemory(parseSize(os.Args[i+1])))
+			i++
+		} else if os.Args[i] == "--in-memory" {
+			opts = append(opts, lib.WithInMemory())
+		} else if os.Args[i] == "--max-open-files" && i+1 < len(os.Args) {
+			n, err := strconv.Atoi(os.Args[i+1])
+			if err != nil {
+				value := os.Args[i+1]
+				opts = append(opts, func(*lib.DbWrapper) error { return fmt.Errorf("bad --max-open-files %v", value) })
+			} else {
+				opts = append(opts, lib.WithMaxOpenFiles(n))
+			}
+			i++
+		} else if os.Args[i] == "--storage-option" && i+1 < len(os.Args) {
+			key, value, _ := strings.Cut(os.Args[i+1], "=")
+			opts = append(opts, lib.WithStorageOption(key, value))
+			i++
+		}
+	}
+	// after every -k and -v, as exploded fields must be declared first
+	for _, name := range flagValues("--explode") {
+		opts = append(opts, lib.WithExplode(name))
+	}
+	opts = append(opts, lib.WithKey("_i_", "int32"))
+
+	return opts
+}
+
+// defaultStorage returns badgerdb, or the first storage compiled in when it was
+// left out with the no_badgerdb build tag.
+func defaultStorage() string {
+	if _, ok := lib.Registration["badgerdb"]; ok {
+		return "badgerdb"
+	}
+	names := make([]string, 0, len(lib.Registration))
+	for name := range lib.Registration {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return "badgerdb"
+	}
+	return names[0]
+}
+
+func closeOpts() []lib.CloseOpt {
+	var opts []lib.CloseOpt
+
+	for i := 1; i < len(os.Args); i++ {
+		if os.Args[i] == "--compact" {
+			opts = append(opts, lib.WithFlushAndCompact())
+		} else if os.Args[i] == "--gc" {
+			opts = append(opts, lib.WithRunGC())
+		}
+	}
+
+	return opts
+}
+
+// isKeyTransform reports whether the part after the name in `-k name:...` is a
+// query time key transform such as mod:16 rather than a kind. Such keys must
+// already exist in the database.
+func isKeyTransform(spec string) bool {
+	name, _, _ := strings.Cut(spec, ":")
+	return name == "mod" || name == "prefix" || name == "substr"
+}
+
+// isKeyBucket reports whether the part after the name in `-k name:...` buckets a
+// timestamp or date key, e.g. -k ts:bucket:1h, rather than a kind.
+func isKeyBucket(spec string) bool {
+	return strings.HasPrefix(spec, "bucket:")
+}
+
+// isKeyValue reports whether the part after the name in `-k name:...` is a JSON
+// value the key must have, e.g. -k user:42 or -k day:'"2024-01-01"', rather than
+// a kind. No kind parses as JSON.
+func isKeyValue(spec string) bool {
+	var value any
+	return json.Unmarshal([]byte(spec), &value) == nil
+}
+
+func iteratorOpts() ([]lib.IteratorOpt, error) {
+	var opts []lib.IteratorOpt
+
+	for i := 1; i < len(os.Args); i++ {
+		if os.Args[i] == "-k" && i+1 < len(os.Args) {
+			parts := strings.SplitN(os.Args[i+1], ":", 2)
+			if len(parts) == 2 && isKeyTransform(parts[1]) {
+				opts = append(opts, lib.WithPartialKeyTransform(parts[0], parts[1]))
+			} else if len(parts) == 2 && isKeyBucket(parts[1]) {
+				opts = append(opts, lib.WithPartialKeyBucketed(parts[0], strings.TrimPrefix(parts[1], "bucket:")))
+			} else if len(parts) == 2 && isKeyValue(parts[1]) {
+				var value any
+				json.Unmarshal([]byte(parts[1]), &value)
+				opts = append(opts, lib.WithPartialKeyValue(parts[0], value))
+			} else if len(parts) == 2 {
+				opts = append(opts, lib.WithPartialKey(parts[0]))
+			}
+			i++
+		} else if os.Args[i] == "-a" && i+1 < len(os.Args) {
+			parts := strings.Split(os.Args[i+1], ":")
+			operation := strings.Replace(strings.Replace(parts[1], "}", ")", -1), "{", "(", -1)
+			if len(parts) == 2 {
+				opts = append(opts, lib.WithAgg(parts[0], operation))
+			}
+			i++
+		} else if os.Args[i] == "-f" && i+1 < len(os.Args) {
+			field, op, value, err := lib.ParseCondition(os.Args[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad -f %v", err)
+			}
+			opts = append(opts, lib.WithFilter(field, op, value))
+			i++
+		} else if os.Args[i] == "--limit" && i+1 < len(os.Args) {
+			n, _ := strconv.Atoi(os.Args[i+1])
+			opts = append(opts, lib.WithLimit(n))
+			i++
+		} else if os.Args[i] == "--offset" && i+1 < len(os.Args) {
+			n, _ := strconv.Atoi(os.Args[i+1])
+			opts = append(opts, lib.WithOffset(n))
+			i++
+		} else if os.Args[i] == "--select" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithSelect(strings.Split(os.Args[i+1], ",")...))
+			i++
+		} else if os.Args[i] == "--sort-by" && i+1 < len(os.Args) {
+			name, order, _ := strings.Cut(os.Args[i+1], ":")
+			if order != "" && order != "asc" && order != "desc" {
+				return nil, fmt.Errorf("bad --sort-by %v, order is asc or desc", os.Args[i+1])
+			}
+			opts = append(opts, lib.WithSortBy(name, order == "desc"))
+			i++
+		} else if os.Args[i] == "--having" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithHaving(os.Args[i+1]))
+			i++
+		} else if os.Args[i] == "--seed" && i+1 < len(os.Args) {
+			seed, err := strconv.ParseUint(os.Args[i+1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad --seed %v: %v", os.Args[i+1], err)
+			}
+			opts = append(opts, lib.WithSeed(seed))
+			i++
+		} else if os.Args[i] == "--prefetch" && i+1 < len(os.Args) {
+			n, err := strconv.Atoi(os.Args[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad --prefetch %v: %v", os.Args[i+1], err)
+			}
+			opts = append(opts, lib.WithPrefetch(n))
+			i++
+		} else if os.Args[i] == "--skip-bad-groups" {
+			opts = append(opts, lib.WithSkipBadGroups(func(key map[string]any, err error) {
+				fmt.Fprintf(os.Stderr, "skip bad group %v: %v\n", key, err)
+			}))
+		} else if os.Args[i] == "--numeric-mode" && i+1 < len(os.Args) {
+			opts = append(opts, lib.WithNumericMode(lib.NumericMode(os.Args[i+1])))
+			i++
+		} else if os.Args[i] == "--rollup" {
+			opts = append(opts, lib.WithRollup())
+		} else if os.Args[i] == "--emit-empty" {
+			opts = append(opts, lib.WithEmitEmpty())
+		} else if os.Args[i] == "--group-sample" && i+1 < len(os.Args) {
+			n, _ := strconv.Atoi(os.Args[i+1])
+			opts = append(opts, lib.WithGroupSample(n))
+			i++
+		} else if os.Args[i] == "--as" && i+1 < len(os.Args) {
+			alias, name, _ := strings.Cut(os.Args[i+1], "=")
+			opts = append(opts, lib.WithAlias(name, alias))
+			i++
+		} else if os.Args[i] == "--transform" && i+1 < len(os.Args) {
+			name, transform, _ := strings.Cut(os.Args[i+1], ":")
+			opts = append(opts, lib.WithValueTransform(name, transform))
+			i++
+		} else if os.Args[i] == "--spill" && i+1 < len(os.Args) {
+			n, _ := strconv.Atoi(os.Args[i+1])
+			opts = append(opts, lib.WithSpill(n))
+			i++
+		} else if os.Args[i] == "--fingerprint" {
+			opts = append(opts, lib.WithFingerprint("_fingerprint_"))
+		} else if os.Args[i] == "--changed-since" && i+1 < len(os.Args) {
+			fingerprints, err := readFingerprints(os.Args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, lib.WithFingerprint("_fingerprint_"), lib.WithChangedSince(fingerprints...))
+			i++
+		}
+	}
+	// every --from and every --to give one leading key field of the bound
+	from, err := keyBound(flagValues("--from"))
+	if err != nil {
+		return nil, fmt.Errorf("bad --from %v", err)
+	}
+	to, err := keyBound(flagValues("--to"))
+	if err != nil {
+		return nil, fmt.Errorf("bad --to %v", err)
+	}
+	if from != nil || to != nil {
+		opts = append(opts, lib.WithKeyRange(from, to))
+	}
+
+	return opts, nil
+}
+
+// keyBound reads the values of --from or --to, each FIELD=VALUE with the value read
+// as JSON where it parses and as a string otherwise, e.g. day=2024-01-01 or
+// user=42, into one end of a key range, see lib.WithKeyRange.
+func keyBound(specs []string) (map[string]any, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	bound := make(map[string]any, len(specs))
+	for _, spec := range specs {
+		name, raw, ok := strings.Cut(spec, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q, want FIELD=VALUE", spec)
+		}
+		var value any
+		if err := json.Unmarshal([]byte(raw), &value); err != nil {
+			value = raw
+		}
+		bound[name] = value
+	}
+	return bound, nil
+}
+
+// checkKeyRange refuses --from and --to on string and bytes keys, whose stored
+// order puts shorter values first, and on signed integer keys unless both bounds
+// are given and not negative, as negative integers are stored after the others.
+func checkKeyRange(keys []lib.Column) error {
+	from, _ := keyBound(flagValues("--from"))
+	to, _ := keyBound(flagValues("--to"))
+	for _, key := range keys {
+		lower, inFrom := from[key.Name]
+		upper, inTo := to[key.Name]
+		if !inFrom && !inTo {
+			continue
+		}
+		switch key.Kind {
+		case "string", "bytes":
+			return fmt.Errorf("--from and --to can not range over %v key %v", key.Kind, key.Name)
+		case "int8", "int16", "int32", "int64":
+			if !inFrom || !inTo || isNegative(lower) || isNegative(upper) {
+				return fmt.Errorf("--from and --to over %v key %v need both bounds, neither negative", key.Kind, key.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func isNegative(v any) bool {
+	f, ok := v.(float64)
+	return ok && f < 0
+}
+
+// readFingerprints collects the _fingerprint_ column of a previous output file.
+func readFingerprints(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open previous output: %v", err)
+	}
+	defer f.Close()
+
+	var fingerprints []string
+	scanner := bufio.NewScanner(f)
+	// groups with large collect or tally results make long output lines
+	scanner.Buffer(nil, maxLineSize)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("fail to parse previous output as JSON: %v", err)
+		}
+		if fp, ok := record["_fingerprint_"].(string); ok {
+			fingerprints = append(fingerprints, fp)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("fail to read previous output: %v", err)
+	}
+	return fingerprints, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+type metadata struct {
+	Version    string   `json:"version"`
+	Revision   string   `json:"revision,omitempty"`
+	SchemaHash string   `json:"schema_hash"`
+	Query      []string `json:"query"`
+	Seed       uint64   `json:"seed"`
+	Created    string   `json:"created"`
+}
+
+// printMetadata writes a _metadata_ record describing how the output was produced,
+// so archived results can be traced back to the tool, schema and query.
+func printMetadata(itW *lib.IterWrapper, args []string) error {
+	m := metadata{
+		Version:    "(devel)",
+		SchemaHash: itW.Hash(),
+		Query:      args,
+		Seed:       itW.Seed(),
+		Created:    time.Now().UTC().Format(time.RFC3339),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Version != "" {
+			m.Version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				m.Revision = setting.Value
+			}
+		}
+	}
+
+	b, err := json.Marshal(map[string]any{"_metadata_": m})
+	if err != nil {
+		return fmt.Errorf("fail to marshal metadata into json: %v", err)
+	}
+	fmt.Println(string(b))
+	return nil
+}
@@ -0,0 +1,58 @@
+//go:build !no_objstore
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kill-2/badmerger/lib"
+	"github.com/kill-2/badmerger/objstore"
+)
+
+// runUpload handles `badmerger upload -d DIR URI`, copying a database to an object store.
+func runUpload(args []string) error {
+	var dir, uri string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-d" && i+1 < len(args) {
+			dir = args[i+1]
+			i++
+		} else {
+			uri = args[i]
+		}
+	}
+	if dir == "" || uri == "" {
+		return fmt.Errorf("usage: badmerger upload -d DIR URI")
+	}
+	return objstore.Upload(context.Background(), dir, uri)
+}
+
+// fetchRemoteDirs downloads the databases given as -d URI into temp dirs and points
+// the arguments at them. It returns a function removing the temp dirs.
+func fetchRemoteDirs() (func(), error) {
+	var tmpDirs []string
+	cleanup := func() {
+		for _, dir := range tmpDirs {
+			os.RemoveAll(dir)
+		}
+	}
+	for i := 1; i+1 < len(os.Args); i++ {
+		if os.Args[i] != "-d" || !objstore.IsURI(os.Args[i+1]) {
+			continue
+		}
+		dir, err := os.MkdirTemp("", lib.TempPrefix+"download-")
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		tmpDirs = append(tmpDirs, dir)
+		if err := objstore.Download(context.Background(), os.Args[i+1], dir); err != nil {
+			cleanup()
+			return nil, err
+		}
+		os.Args[i+1] = dir
+		i++
+	}
+	return cleanup, nil
+}
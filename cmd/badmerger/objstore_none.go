@@ -0,0 +1,13 @@
+//go:build no_objstore
+
+package main
+
+import "fmt"
+
+func runUpload(args []string) error {
+	return fmt.Errorf("built without object store support")
+}
+
+func fetchRemoteDirs() (func(), error) {
+	return func() {}, nil
+}
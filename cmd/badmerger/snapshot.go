@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// runSnapshot handles `badmerger snapshot create|list -d DIR [--name NAME]`.
+func runSnapshot(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: badmerger snapshot create|list -d DIR [--name NAME]")
+	}
+
+	var dir, name string
+	for i := 1; i < len(args); i++ {
+		if args[i] == "-d" && i+1 < len(args) {
+			dir = args[i+1]
+			i++
+		} else if args[i] == "--name" && i+1 < len(args) {
+			name = args[i+1]
+			i++
+		}
+	}
+	if dir == "" {
+		return fmt.Errorf("-d DIR is required")
+	}
+
+	switch args[0] {
+	case "create":
+		return lib.CreateCheckpoint(dir, name)
+	case "list":
+		names, err := lib.ListCheckpoints(dir)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			fmt.Println(n)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown snapshot command %v", args[0])
+}
+
+// snapshotDiff holds the groups of a query against a snapshot, to compare the
+// groups of the same query against the database with.
+type snapshotDiff struct {
+	keys         []string
+	fingerprints map[string]bool
+	// groups are the snapshot groups by key, order their keys in key order
+	groups map[string]map[string]any
+	order  []string
+}
+
+// newSnapshotDiff runs the query against the named snapshot of dir, opened with
+// the options of the database such as its encryption key.
+func newSnapshotDiff(dir, name string, stOpts []lib.StorageOpt, itOpts []lib.IteratorOpt) (*snapshotDiff, error) {
+	snapDir := lib.CheckpointDir(dir, name)
+	if snapDir == "" {
+		return nil, fmt.Errorf("bad snapshot name %q", name)
+	}
+	if _, err := os.Stat(snapDir); err != nil {
+		return nil, fmt.Errorf("no such snapshot %v: %v", name, err)
+	}
+
+	dbW, err := lib.Open(append(stOpts, lib.WithDir(snapDir))...)
+	if err != nil {
+		return nil, err
+	}
+	defer dbW.Close()
+
+	opts := append(append([]lib.IteratorOpt{}, itOpts...), lib.WithFingerprint("_fingerprint_"))
+	itW := dbW.NewIterator(opts...)
+	d := &snapshotDiff{fingerprints: make(map[string]bool), groups: make(map[string]map[string]any)}
+	for _, c := range itW.Columns() {
+		if c.Key {
+			d.keys = append(d.keys, c.Name)
+		}
+	}
+	err = itW.Iter(func(res map[string]any) error {
+		fp, _ := res["_fingerprint_"].(string)
+		d.fingerprints[fp] = true
+		key := d.keyOf(res)
+		if _, ok := d.groups[key]; !ok {
+			d.order = append(d.order, key)
+		}
+		d.groups[key] = res
+		return nil
+	})
+	return d, err
+}
+
+func (d *snapshotDiff) keyOf(res map[string]any) string {
+	values := make([]any, len(d.keys))
+	for i, name := range d.keys {
+		values[i] = res[name]
+	}
+	b, _ := json.Marshal(values)
+	return string(b)
+}
+
+// changed reports whether the group res of the database differs from its group
+// in the snapshot, or is new, and marks its key as still there.
+func (d *snapshotDiff) changed(res map[string]any) bool {
+	delete(d.groups, d.keyOf(res))
+	fp, _ := res["_fingerprint_"].(string)
+	return !d.fingerprints[fp]
+}
+
+// deleted returns the snapshot groups whose key changed never saw, marked with
+// "_deleted_": true.
+func (d *snapshotDiff) deleted() []map[string]any {
+	var groups []map[string]any
+	for _, key := range d.order {
+		if res, ok := d.groups[key]; ok {
+			res["_deleted_"] = true
+			groups = append(groups, res)
+		}
+	}
+	return groups
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// stateOpts handles --state-in FILE (repeatable, oldest first), --state-since WINDOW
+// and --state-out FILE with --window WINDOW. It returns a function closing the
+// state output, to be called once the iteration is done.
+func stateOpts() ([]lib.IteratorOpt, func() error, error) {
+	var opts []lib.IteratorOpt
+	since, _ := flagValue("--state-since")
+	for i := 1; i+1 < len(os.Args); i++ {
+		if os.Args[i] == "--state-in" {
+			states, err := readStates(os.Args[i+1], since)
+			if err != nil {
+				return nil, nil, err
+			}
+			opts = append(opts, lib.WithStateMerge(states...))
+			i++
+		}
+	}
+
+	path, ok := flagValue("--state-out")
+	if !ok {
+		return opts, func() error { return nil }, nil
+	}
+	window, _ := flagValue("--window")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to create state file: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	opts = append(opts, lib.WithStateExport(window, func(state lib.GroupState) error {
+		return enc.Encode(state)
+	}))
+	return opts, func() error {
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return fmt.Errorf("fail to write state file: %v", err)
+		}
+		return f.Close()
+	}, nil
+}
+
+// readStates reads the states of a --state-out file whose window is not before since.
+func readStates(path, since string) ([]lib.GroupState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open state file: %v", err)
+	}
+	defer f.Close()
+
+	var states []lib.GroupState
+	dec := json.NewDecoder(bufio.NewReader(f))
+	dec.UseNumber()
+	for dec.More() {
+		var state lib.GroupState
+		if err := dec.Decode(&state); err != nil {
+			return nil, fmt.Errorf("fail to parse state file %v: %v", path, err)
+		}
+		if state.Window >= since {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
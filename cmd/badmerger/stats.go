@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// runStats handles `badmerger stats -d DIR`, printing the row count and size of the
+// database as JSON, see lib.Stats.
+func runStats(args []string) error {
+	var dir string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-d" && i+1 < len(args) {
+			dir = args[i+1]
+			i++
+		}
+	}
+	if dir == "" {
+		return fmt.Errorf("-d DIR is required")
+	}
+	if !lib.IsDatabase(dir) {
+		return fmt.Errorf("no database in %v", dir)
+	}
+
+	dbW, err := lib.Open(lib.WithDir(dir))
+	if err != nil {
+		return err
+	}
+	defer dbW.Close()
+
+	st, err := dbW.Stats()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
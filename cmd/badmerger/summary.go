@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+type runSummary struct {
+	lib.Usage
+	Seed          uint64 `json:"seed"`
+	GroupsEmitted int64  `json:"groups_emitted"`
+	PeakRSSBytes  int64  `json:"peak_rss_bytes"`
+	GCCount       uint32 `json:"gc_count"`
+	GCPauseNs     uint64 `json:"gc_pause_ns"`
+	// Trace counts the work of the query, if one ran
+	Trace *lib.Trace `json:"trace,omitempty"`
+}
+
+// printSummary writes the run summary as one JSON line to stderr.
+func printSummary(s *runSummary, dbW *lib.DbWrapper) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	s.Usage = dbW.Usage()
+	s.PeakRSSBytes = peakRSS()
+	s.GCCount = mem.NumGC
+	s.GCPauseNs = mem.PauseTotalNs
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to marshal summary into json: %v\n", err)
+		return
+	}
+	fmt.Fprintln(os.Stderr, string(b))
+}
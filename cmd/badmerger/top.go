@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// runTop handles `badmerger top -d DIR --key FIELD [--key ...] [--top N] [--weight AGG]`,
+// printing the heaviest values of the key fields across the whole database, heaviest
+// first, see lib.TopK. AGG is written like -a, e.g. --weight 'sum{bytes}'.
+func runTop(args []string) error {
+	var dir, weight string
+	var names []string
+	top := 10
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-d" && i+1 < len(args) {
+			dir = args[i+1]
+			i++
+		} else if args[i] == "--key" && i+1 < len(args) {
+			names = append(names, args[i+1])
+			i++
+		} else if args[i] == "--top" && i+1 < len(args) {
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("bad --top %v", args[i+1])
+			}
+			top = n
+			i++
+		} else if args[i] == "--weight" && i+1 < len(args) {
+			weight = strings.Replace(strings.Replace(args[i+1], "}", ")", -1), "{", "(", -1)
+			i++
+		}
+	}
+	if dir == "" {
+		return fmt.Errorf("-d DIR is required")
+	}
+	if !lib.IsDatabase(dir) {
+		return fmt.Errorf("no database in %v", dir)
+	}
+
+	dbW, err := lib.Open(lib.WithDir(dir))
+	if err != nil {
+		return err
+	}
+	defer dbW.Close()
+
+	hits, err := dbW.TopK(top, names, weight)
+	if err != nil {
+		return err
+	}
+	for _, hit := range hits {
+		b, err := json.Marshal(hit)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+	return nil
+}
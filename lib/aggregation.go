@@ -2,14 +2,21 @@ package lib
 
 import (
 	"fmt"
+	"math/big"
+	"math/rand/v2"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type aggregator interface {
 	on(collection []map[string]any) any
+	// kind reports the kind of the result given the kinds of the value fields.
+	kind(kinds map[string]string) string
 }
 
-func chooseAggregator(op string) aggregator {
+func chooseAggregator(op string) (aggregator, error) {
 	var operator aggregator
 	if strings.HasPrefix(op, "first(") {
 		operator = first{name: strings.ReplaceAll(strings.ReplaceAll(op, "first(", ""), ")", "")}
@@ -17,12 +24,19 @@ func chooseAggregator(op string) aggregator {
 		operator = firstNotNull{name: strings.ReplaceAll(strings.ReplaceAll(op, "first_not_null(", ""), ")", "")}
 	} else if strings.HasPrefix(op, "sum(") {
 		operator = sum{name: strings.ReplaceAll(strings.ReplaceAll(op, "sum(", ""), ")", "")}
+	} else if strings.HasPrefix(op, "map_sum(") {
+		operator = mapSum{name: strings.ReplaceAll(strings.ReplaceAll(op, "map_sum(", ""), ")", "")}
 	} else if strings.HasPrefix(op, "count(") {
-		operator = count{name: strings.ReplaceAll(strings.ReplaceAll(op, "count(", ""), ")", "")}
+		name := strings.TrimSpace(strings.ReplaceAll(strings.ReplaceAll(op, "count(", ""), ")", ""))
+		if name == "" || name == "*" {
+			operator = groupSize{}
+		} else {
+			operator = count{name: name}
+		}
 	} else if strings.HasPrefix(op, "count_distinct(") {
 		operator = countDistinct{name: strings.ReplaceAll(strings.ReplaceAll(op, "count_distinct(", ""), ")", "")}
 	} else if strings.HasPrefix(op, "tally(") {
-		operator = tally{name: strings.ReplaceAll(strings.ReplaceAll(op, "tally(", ""), ")", "")}
+		return chooseTally(splitArgs(strings.ReplaceAll(strings.ReplaceAll(op, "tally(", ""), ")", "")))
 	} else if strings.HasPrefix(op, "min(") {
 		operator = min{name: strings.ReplaceAll(strings.ReplaceAll(op, "min(", ""), ")", "")}
 	} else if strings.HasPrefix(op, "max(") {
@@ -31,8 +45,97 @@ func chooseAggregator(op string) aggregator {
 		operator = last{name: strings.ReplaceAll(strings.ReplaceAll(op, "last(", ""), ")", "")}
 	} else if strings.HasPrefix(op, "last_not_null(") {
 		operator = lastNotNull{name: strings.ReplaceAll(strings.ReplaceAll(op, "last_not_null(", ""), ")", "")}
+	} else if strings.HasPrefix(op, "sample(") {
+		args := splitArgs(strings.ReplaceAll(strings.ReplaceAll(op, "sample(", ""), ")", ""))
+		n, err := strconv.Atoi(args[len(args)-1])
+		if len(args) != 2 || err != nil || n <= 0 {
+			return nil, fmt.Errorf("sample needs a field and a positive size, got %q", op)
+		}
+		operator = &sample{name: args[0], n: n}
+	} else if strings.HasPrefix(op, "median(") {
+		operator = median{name: strings.ReplaceAll(strings.ReplaceAll(op, "median(", ""), ")", "")}
+	} else if strings.HasPrefix(op, "collect(") {
+		operator = collect{name: strings.ReplaceAll(strings.ReplaceAll(op, "collect(", ""), ")", "")}
+	} else if strings.HasPrefix(op, "earliest(") {
+		args := splitArgs(strings.ReplaceAll(strings.ReplaceAll(op, "earliest(", ""), ")", ""))
+		if len(args) != 2 {
+			return nil, fmt.Errorf("earliest needs a field and a timestamp field, got %q", op)
+		}
+		operator = earliest{name: args[0], ts: args[1]}
+	} else if strings.HasPrefix(op, "latest(") {
+		args := splitArgs(strings.ReplaceAll(strings.ReplaceAll(op, "latest(", ""), ")", ""))
+		if len(args) != 2 {
+			return nil, fmt.Errorf("latest needs a field and a timestamp field, got %q", op)
+		}
+		operator = latest{name: args[0], ts: args[1]}
+	} else {
+		return nil, fmt.Errorf("unknown aggregation %q", op)
+	}
+	return operator, nil
+}
+
+func splitArgs(args string) []string {
+	parts := strings.Split(args, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+// compareValues orders two field values, numbers numerically and strings
+// lexicographically. It reports false when the values are not comparable.
+func compareValues(a, b any) (int, bool) {
+	if isExact(a) || isExact(b) {
+		ad, aok := toDecimal(a)
+		bd, bok := toDecimal(b)
+		if aok && bok {
+			return ad.Cmp(bd), true
+		}
+		return 0, false
 	}
-	return operator
+	if ai, ok := toInt64(a); ok {
+		if bi, ok := toInt64(b); ok {
+			switch {
+			case ai < bi:
+				return -1, true
+			case ai > bi:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if af, ok := toFloat64(a); ok {
+		if bf, ok := toFloat64(b); ok {
+			switch {
+			case af < bf:
+				return -1, true
+			case af > bf:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if as, ok := a.(string); ok {
+		if bs, ok := b.(string); ok {
+			return strings.Compare(as, bs), true
+		}
+	}
+	if at, ok := a.(time.Time); ok {
+		if bt, ok := b.(time.Time); ok {
+			return at.Compare(bt), true
+		}
+	}
+	return 0, false
+}
+
+// isExact reports whether v is a Decimal or a *big.Int, which compare and sum
+// with exact arithmetic.
+func isExact(v any) bool {
+	switch v.(type) {
+	case Decimal, *big.Int:
+		return true
+	}
+	return false
 }
 
 type first struct {
@@ -46,6 +149,10 @@ func (a first) on(collection []map[string]any) any {
 	return collection[0][a.name]
 }
 
+func (a first) kind(kinds map[string]string) string {
+	return kinds[a.name]
+}
+
 type firstNotNull struct {
 	name string
 }
@@ -59,6 +166,10 @@ func (a firstNotNull) on(collection []map[string]any) any {
 	return nil
 }
 
+func (a firstNotNull) kind(kinds map[string]string) string {
+	return kinds[a.name]
+}
+
 type last struct {
 	name string
 }
@@ -70,6 +181,10 @@ func (a last) on(collection []map[string]any) any {
 	return collection[len(collection)-1][a.name]
 }
 
+func (a last) kind(kinds map[string]string) string {
+	return kinds[a.name]
+}
+
 type lastNotNull struct {
 	name string
 }
@@ -83,110 +198,167 @@ func (a lastNotNull) on(collection []map[string]any) any {
 	return nil
 }
 
-type min struct {
+func (a lastNotNull) kind(kinds map[string]string) string {
+	return kinds[a.name]
+}
+
+type earliest struct {
 	name string
+	ts   string
 }
 
-func (a min) on(collection []map[string]any) any {
-	if len(collection) == 0 {
-		return nil
+func (a earliest) on(collection []map[string]any) any {
+	var result, minTs any
+	for _, item := range collection {
+		ts, ok := item[a.ts]
+		if !ok || ts == nil {
+			continue
+		}
+		if c, ok := compareValues(ts, minTs); minTs == nil || (ok && c < 0) {
+			minTs = ts
+			result = item[a.name]
+		}
 	}
-	var minVal int64
-	first := true
+	return result
+}
+
+func (a earliest) kind(kinds map[string]string) string {
+	return kinds[a.name]
+}
+
+type latest struct {
+	name string
+	ts   string
+}
+
+func (a latest) on(collection []map[string]any) any {
+	var result, maxTs any
 	for _, item := range collection {
-		if val, ok := item[a.name]; ok {
-			switch v := val.(type) {
-			case int8:
-				if first || int64(v) < minVal {
-					minVal = int64(v)
-					first = false
-				}
-			case int16:
-				if first || int64(v) < minVal {
-					minVal = int64(v)
-					first = false
-				}
-			case int32:
-				if first || int64(v) < minVal {
-					minVal = int64(v)
-					first = false
-				}
-			case int64:
-				if first || v < minVal {
-					minVal = v
-					first = false
-				}
-			case int:
-				if first || int64(v) < minVal {
-					minVal = int64(v)
-					first = false
-				}
-			default:
-				continue
-			}
+		ts, ok := item[a.ts]
+		if !ok || ts == nil {
+			continue
+		}
+		if c, ok := compareValues(ts, maxTs); maxTs == nil || (ok && c >= 0) {
+			maxTs = ts
+			result = item[a.name]
 		}
 	}
-	if first {
-		return nil
+	return result
+}
+
+func (a latest) kind(kinds map[string]string) string {
+	return kinds[a.name]
+}
+
+type min struct {
+	name string
+}
+
+func (a min) on(collection []map[string]any) any {
+	var minVal any
+	for _, item := range collection {
+		val, ok := numeric(item[a.name])
+		if !ok {
+			continue
+		}
+		if c, _ := compareValues(val, minVal); minVal == nil || c < 0 {
+			minVal = val
+		}
 	}
 	return minVal
 }
 
+func (a min) kind(kinds map[string]string) string {
+	return numericKind(kinds[a.name])
+}
+
 type max struct {
 	name string
 }
 
 func (a max) on(collection []map[string]any) any {
-	if len(collection) == 0 {
-		return nil
+	var maxVal any
+	for _, item := range collection {
+		val, ok := numeric(item[a.name])
+		if !ok {
+			continue
+		}
+		if c, _ := compareValues(val, maxVal); maxVal == nil || c > 0 {
+			maxVal = val
+		}
 	}
-	var maxVal int64
-	first := true
+	return maxVal
+}
+
+func (a max) kind(kinds map[string]string) string {
+	return numericKind(kinds[a.name])
+}
+
+// median is the exact median of the numeric values of a group, the mean of the
+// two middle values for an even count.
+type median struct {
+	name string
+}
+
+func (a median) on(collection []map[string]any) any {
+	values := make([]float64, 0, len(collection))
 	for _, item := range collection {
-		if val, ok := item[a.name]; ok {
-			switch v := val.(type) {
-			case int8:
-				if first || int64(v) > maxVal {
-					maxVal = int64(v)
-					first = false
-				}
-			case int16:
-				if first || int64(v) > maxVal {
-					maxVal = int64(v)
-					first = false
-				}
-			case int32:
-				if first || int64(v) > maxVal {
-					maxVal = int64(v)
-					first = false
-				}
-			case int64:
-				if first || v > maxVal {
-					maxVal = v
-					first = false
-				}
-			case int:
-				if first || int64(v) > maxVal {
-					maxVal = int64(v)
-					first = false
-				}
-			default:
-				continue
-			}
+		if f, ok := toFloat64(item[a.name]); ok {
+			values = append(values, f)
 		}
 	}
-	if first {
+	if len(values) == 0 {
 		return nil
 	}
-	return maxVal
+	sort.Float64s(values)
+	return (values[(len(values)-1)/2] + values[len(values)/2]) / 2
+}
+
+func (a median) kind(kinds map[string]string) string {
+	return "float64"
+}
+
+// numericKind reports the kind numeric widens a field kind to.
+func numericKind(kind string) string {
+	switch kind {
+	case "int8", "int16", "int32", "int64":
+		return "int64"
+	case "float32", "float64":
+		return "float64"
+	}
+	return kind
+}
+
+// numeric widens integers to int64 and floats to float64, keeping decimals exact.
+func numeric(val any) (any, bool) {
+	if isExact(val) {
+		return val, true
+	}
+	if i, ok := toInt64(val); ok {
+		return i, true
+	}
+	if f, ok := toFloat64(val); ok {
+		return f, true
+	}
+	return nil, false
 }
 
 type sum struct {
 	name string
+	mode NumericMode
 }
 
 func (a sum) on(collection []map[string]any) any {
+	if a.mode != NumericAuto {
+		return sumIn(a.mode, a.name, collection)
+	}
 	var total int64
+	var floatTotal float64
+	var isFloat bool
+	var decimalTotal Decimal
+	var isDecimal bool
+	bigTotal := new(big.Int)
+	var isBig bool
 	for _, item := range collection {
 		if val, ok := item[a.name]; ok {
 			switch v := val.(type) {
@@ -200,14 +372,48 @@ func (a sum) on(collection []map[string]any) any {
 				total += v
 			case int:
 				total += int64(v)
+			case float32:
+				floatTotal += float64(v)
+				isFloat = true
+			case float64:
+				floatTotal += v
+				isFloat = true
+			case Decimal:
+				decimalTotal = decimalTotal.Add(v)
+				isDecimal = true
+			case *big.Int:
+				bigTotal.Add(bigTotal, v)
+				isBig = true
 			default:
 				continue
 			}
 		}
 	}
+	if isDecimal {
+		rest, _ := toDecimal(floatTotal)
+		exact, _ := toDecimal(bigTotal.Add(bigTotal, big.NewInt(total)))
+		return decimalTotal.Add(rest).Add(exact)
+	}
+	if isBig && !isFloat {
+		return bigTotal.Add(bigTotal, big.NewInt(total))
+	}
+	if isBig {
+		f, _ := new(big.Float).SetInt(bigTotal).Float64()
+		floatTotal += f
+	}
+	if isFloat {
+		return floatTotal + float64(total)
+	}
 	return total
 }
 
+func (a sum) kind(kinds map[string]string) string {
+	if kind := modeKind(a.mode); kind != "" {
+		return kind
+	}
+	return numericKind(kinds[a.name])
+}
+
 type count struct {
 	name string
 }
@@ -222,6 +428,97 @@ func (a count) on(collection []map[string]any) any {
 	return total
 }
 
+func (a count) kind(kinds map[string]string) string {
+	return "int64"
+}
+
+// sample keeps a uniform random sample of up to n values per group using
+// reservoir sampling. Its randomness comes from the iteration seed, see WithSeed.
+type sample struct {
+	name string
+	n    int
+	rng  *rand.Rand
+}
+
+func (a *sample) on(collection []map[string]any) any {
+	reservoir := make([]any, 0, a.n)
+	seen := 0
+	for _, item := range collection {
+		val, ok := item[a.name]
+		if !ok || val == nil {
+			continue
+		}
+		seen++
+		if len(reservoir) < a.n {
+			reservoir = append(reservoir, val)
+		} else if j := a.rng.IntN(seen); j < a.n {
+			reservoir[j] = val
+		}
+	}
+	return reservoir
+}
+
+func (a *sample) kind(kinds map[string]string) string {
+	return arrayOf(kinds[a.name])
+}
+
+// arrayOf returns the kind of an array holding values of kind.
+func arrayOf(kind string) string {
+	if kind == "" {
+		return "array"
+	}
+	return "array<" + kind + ">"
+}
+
+// collect gathers all non-null values of a group into one array. Values of an
+// array<T> field are concatenated rather than nested, so the result is an array<T> too.
+type collect struct {
+	name string
+}
+
+func (a collect) on(collection []map[string]any) any {
+	values := make([]any, 0, len(collection))
+	for _, item := range collection {
+		switch val := item[a.name].(type) {
+		case nil:
+		case []any:
+			values = append(values, val...)
+		default:
+			values = append(values, val)
+		}
+	}
+	return values
+}
+
+func (a collect) kind(kinds map[string]string) string {
+	if _, ok := arrayElemKind(kinds[a.name]); ok {
+		return kinds[a.name]
+	}
+	return arrayOf(kinds[a.name])
+}
+
+// seedAggregator hands a random source derived from seed to every
+// randomized aggregator within agg.
+func seedAggregator(agg aggregator, seed uint64) {
+	switch a := agg.(type) {
+	case *sample:
+		a.rng = rand.New(rand.NewPCG(seed, 0))
+	case binaryExpr:
+		seedAggregator(a.left, seed)
+		seedAggregator(a.right, seed)
+	}
+}
+
+type groupSize struct{}
+
+func (a groupSize) on(collection []map[string]any) any {
+	return int64(len(collection))
+}
+
+func (a groupSize) kind(kinds map[string]string) string {
+	return "int64"
+}
+
 type countDistinct struct {
 	name string
 }
@@ -230,14 +527,51 @@ func (a countDistinct) on(collection []map[string]any) any {
 	seen := make(map[any]struct{})
 	for _, item := range collection {
 		if val, ok := item[a.name]; ok && val != nil {
+			switch v := val.(type) {
+			case []byte:
+				val = string(v)
+			case Decimal:
+				val = v.rat.RatString()
+			case map[string]any, []any:
+				val = fmt.Sprintf("%v", v)
+			}
 			seen[val] = struct{}{}
 		}
 	}
 	return int64(len(seen))
 }
 
+func (a countDistinct) kind(kinds map[string]string) string {
+	return "int64"
+}
+
 type tally struct {
 	name string
+	top  int
+	min  int64
+}
+
+// chooseTally builds a tally from its arguments: the field name optionally
+// followed by top=N, keeping only the N most frequent values, and min=N,
+// dropping values seen fewer than N times.
+func chooseTally(args []string) (aggregator, error) {
+	t := tally{name: args[0]}
+	for _, arg := range args[1:] {
+		opt, val, ok := strings.Cut(arg, "=")
+		n, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("bad tally option %q, want top=N or min=N", arg)
+		}
+		switch strings.TrimSpace(opt) {
+		case "top":
+			t.top = int(n)
+		case "min":
+			t.min = n
+		default:
+			return nil, fmt.Errorf("unknown tally option %q", arg)
+		}
+	}
+	return t, nil
 }
 
 func (a tally) on(collection []map[string]any) any {
@@ -252,5 +586,33 @@ func (a tally) on(collection []map[string]any) any {
 			seen[valStr] = (times + 1)
 		}
 	}
+
+	if a.min > 0 {
+		for valStr, times := range seen {
+			if times < a.min {
+				delete(seen, valStr)
+			}
+		}
+	}
+
+	if a.top > 0 && len(seen) > a.top {
+		ranked := make([]string, 0, len(seen))
+		for valStr := range seen {
+			ranked = append(ranked, valStr)
+		}
+		sort.Slice(ranked, func(i, j int) bool {
+			if seen[ranked[i]] != seen[ranked[j]] {
+				return seen[ranked[i]] > seen[ranked[j]]
+			}
+			return ranked[i] < ranked[j]
+		})
+		for _, valStr := range ranked[a.top:] {
+			delete(seen, valStr)
+		}
+	}
 	return seen
 }
+
+func (a tally) kind(kinds map[string]string) string {
+	return "map"
+}
@@ -0,0 +1,29 @@
+package lib_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+	_ "github.com/kill-2/badmerger/storage/bolt"
+)
+
+func TestBadAggregation(t *testing.T) {
+	db := openPages(t)
+	for op, want := range map[string]string{
+		"summ(v)":            "unknown aggregation",
+		"sum(v)+":            "unexpected end",
+		"tally(v, top=x)":    "bad tally option",
+		"tally(v, most=1)":   "unknown tally option",
+		"sample(v)":          "sample needs a field and a positive size",
+		"sample(v, 0)":       "sample needs a field and a positive size",
+		"earliest(v)":        "earliest needs a field and a timestamp field",
+		"latest(v, ts, now)": "latest needs a field and a timestamp field",
+	} {
+		it := db.NewIterator(lib.WithPartialKey("g"), lib.WithAgg("s", op))
+		err := it.Iter(func(map[string]any) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%v: got error %v, want %v", op, err, want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package lib
+
+import "fmt"
+
+// WithAlias renames a partial key or aggregation in the merged output maps and in
+// Columns, e.g. to match the fixed column names of a downstream table. Aliases apply
+// last, so options such as WithChangedSince still see the original names. Aliases
+// that collide with each other or with other output names make Iter fail.
+func WithAlias(name, alias string) IteratorOpt {
+	return func(itW *IterWrapper) {
+		if itW.aliases == nil {
+			itW.aliases = make(map[string]string)
+		}
+		itW.aliases[name] = alias
+	}
+}
+
+// Columns is like Merger.Columns, limited to the fields of WithSelect and with the
+// names given by WithAlias.
+func (itW *IterWrapper) Columns() []Column {
+	columns := itW.selectColumns(itW.Merger.Columns())
+	for i, c := range columns {
+		if alias, ok := itW.aliases[c.Name]; ok {
+			columns[i].Name = alias
+		}
+	}
+	return columns
+}
+
+// checkAliases verifies that every alias renames an output field and that the
+// renamed outputs are unique.
+func (itW *IterWrapper) checkAliases() error {
+	names := make(map[string]bool)
+	for _, c := range itW.Merger.Columns() {
+		names[c.Name] = true
+	}
+	for name := range itW.aliases {
+		if !names[name] {
+			return fmt.Errorf("no output field %v to alias", name)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, c := range itW.Columns() {
+		if seen[c.Name] {
+			return fmt.Errorf("alias %v collides with another output field", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return nil
+}
+
+// withAliases renames the fields of every output map before passing it to fn.
+func (itW *IterWrapper) withAliases(fn func(res map[string]any) error) func(res map[string]any) error {
+	return func(res map[string]any) error {
+		renamed := make(map[string]any, len(itW.aliases))
+		for name, alias := range itW.aliases {
+			if v, ok := res[name]; ok {
+				renamed[alias] = v
+				delete(res, name)
+			}
+		}
+		for alias, v := range renamed {
+			res[alias] = v
+		}
+		return fn(res)
+	}
+}
@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Backuper is implemented by storages with a backup format of their own, like
+// badger's stream backup, which Backup prefers to copying rows one by one. Load
+// reads such a backup into the freshly opened, empty storage.
+type Backuper interface {
+	Backup(w io.Writer) error
+	Load(r io.Reader) error
+}
+
+// backupHeader starts a backup, followed by the rows.
+type backupHeader struct {
+	Version int    `json:"version"`
+	Store   string `json:"store"`
+	// Native rows are in the format of Backuper up to the end of the stream,
+	// others are framed by writeRow.
+	Native bool `json:"native,omitempty"`
+	// Files are the files of the database next to the storage, like the schema.
+	Files map[string][]byte `json:"files"`
+}
+
+const backupVersion = 1
+
+// Backup writes the database to w as one zstd stream, see NewStreamWriter, which
+// Restore turns back into a database in a directory, e.g. on another machine.
+// Storages implementing Backuper write their own format, others a portable copy
+// of their rows, which may be taken while the database is open. Values of databases
+// encrypted by lib stay encrypted in the backup, while storages that encrypt their
+// files, like badger, back up their rows in clear. A namespace is backed up alone,
+// as a portable copy that restores to a database without namespaces.
+func (db *DbWrapper) Backup(w io.Writer) error {
+	header := backupHeader{Version: backupVersion, Store: db.store, Files: make(map[string][]byte)}
+	for _, path := range []string{schemaFile(db.schemaDir()), dictionaryFile(db.schemaDir())} {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("fail to read %v", err)
+		}
+		header.Files[filepath.Base(path)] = data
+	}
+	b, ok := db.db.(Backuper)
+	header.Native = ok
+
+	sw, err := NewStreamWriter(w, CodecZstd)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(sw)
+	data, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("fail to marshal backup header: %v", err)
+	}
+	if err := writeChunk(bw, data); err != nil {
+		return fmt.Errorf("fail to write backup header: %v", err)
+	}
+	if header.Native {
+		if err := b.Backup(bw); err != nil {
+			return fmt.Errorf("fail to back up %v", err)
+		}
+	} else {
+		err := Scan(db.db, func(keyPayload, valuePayload []byte) error {
+			return writeRow(bw, keyPayload, valuePayload)
+		})
+		if err != nil {
+			return fmt.Errorf("fail to back up %v", err)
+		}
+		if err := bw.WriteByte(0); err != nil {
+			return fmt.Errorf("fail to back up %v", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("fail to back up %v", err)
+	}
+	return sw.Close()
+}
+
+// Restore reads a backup written by Backup into a new database in dir, which must
+// not hold a database yet. opts are the settings to open it with, e.g.
+// WithEncryptionKey; the schema and storage come from the backup. On failure the
+// directory is removed if Restore created it.
+func Restore(r io.Reader, dir string, opts ...StorageOpt) (err error) {
+	if IsDatabase(dir) {
+		return fmt.Errorf("%v already holds a database", dir)
+	}
+	if _, statErr := os.Stat(dir); os.IsNotExist(statErr) {
+		defer func() {
+			if err != nil {
+				os.RemoveAll(dir)
+			}
+		}()
+	}
+
+	sr, err := NewStreamReader(r)
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+	br := bufio.NewReader(sr)
+	data, err := readChunk(br)
+	if err != nil {
+		return fmt.Errorf("fail to read backup header: %v", err)
+	}
+	var header backupHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("fail to unmarshal backup header: %v", err)
+	}
+	if header.Version != backupVersion {
+		return fmt.Errorf("unknown backup version %d", header.Version)
+	}
+	if _, ok := header.Files[filepath.Base(schemaFile(dir))]; !ok {
+		return fmt.Errorf("backup has no schema")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("fail to create dir %v", err)
+	}
+	for name, data := range header.Files {
+		if name != filepath.Base(name) {
+			return fmt.Errorf("bad file name %q in backup", name)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return fmt.Errorf("fail to write %v", err)
+		}
+	}
+
+	db, err := Open(append([]StorageOpt{WithDir(dir)}, opts...)...)
+	if err != nil {
+		return err
+	}
+	if header.Native {
+		b, ok := db.db.(Backuper)
+		if !ok {
+			db.Close()
+			return fmt.Errorf("storage %v can not load the backup of %v", db.store, header.Store)
+		}
+		if err := b.Load(br); err != nil {
+			db.Close()
+			return fmt.Errorf("fail to load backup %v", err)
+		}
+		// the footer is only checked once the stream is read to its end
+		if _, err := io.Copy(io.Discard, br); err != nil {
+			db.Close()
+			return err
+		}
+		return db.Close()
+	}
+
+	ins := db.db.NewInserter()
+	for {
+		keyPayload, valuePayload, err := readRow(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("fail to read backup %v", err)
+		}
+		if err := ins.Insert(keyPayload, valuePayload); err != nil {
+			db.Close()
+			return fmt.Errorf("fail to insert %v", err)
+		}
+	}
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		db.Close()
+		return err
+	}
+	if err := ins.Commit(); err != nil {
+		db.Close()
+		return fmt.Errorf("fail to commit %v", err)
+	}
+	return db.Close()
+}
+
+func writeChunk(w *bufio.Writer, b []byte) error {
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(b)))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readChunk(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeRow frames a row behind a 1 byte, the rows end with a 0 byte.
+func writeRow(w *bufio.Writer, keyPayload, valuePayload []byte) error {
+	if err := w.WriteByte(1); err != nil {
+		return err
+	}
+	if err := writeChunk(w, keyPayload); err != nil {
+		return err
+	}
+	return writeChunk(w, valuePayload)
+}
+
+// readRow reads a row framed by writeRow, io.EOF after the last one.
+func readRow(r *bufio.Reader) ([]byte, []byte, error) {
+	more, err := r.ReadByte()
+	if err == io.EOF {
+		return nil, nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if more == 0 {
+		return nil, nil, io.EOF
+	}
+	keyPayload, err := readChunk(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	valuePayload, err := readChunk(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyPayload, valuePayload, nil
+}
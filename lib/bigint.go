@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Big integers are stored as a sign byte followed by the length and bytes of
+// their magnitude, with both complemented for negatives, so their bytes sort
+// numerically: more magnitude bytes mean a larger positive or smaller negative.
+// Input may be an integer, an integral float or a decimal string, which is the
+// only way to pass values beyond 2^53 through JSON exactly. They decode to *big.Int.
+const (
+	bigIntNegative = 0
+	bigIntZero     = 1
+	bigIntPositive = 2
+)
+
+func toBigInt(v any) (*big.Int, bool) {
+	switch n := v.(type) {
+	case *big.Int:
+		return n, true
+	case string:
+		return new(big.Int).SetString(strings.TrimSpace(n), 10)
+	case json.Number:
+		return new(big.Int).SetString(n.String(), 10)
+	case float32, float64:
+		f, _ := toFloat64(n)
+		if math.IsInf(f, 0) || math.IsNaN(f) || f != math.Trunc(f) {
+			return nil, false
+		}
+		i, _ := new(big.Float).SetFloat64(f).Int(nil)
+		return i, true
+	}
+	if i, ok := toInt64(v); ok {
+		return big.NewInt(i), true
+	}
+	return nil, false
+}
+
+func toBigIntBinary(anyInt any) []byte {
+	i, ok := toBigInt(anyInt)
+	if !ok || i.Sign() == 0 {
+		return []byte{bigIntZero}
+	}
+	magnitude := i.Bytes()
+	b := make([]byte, 3, 3+len(magnitude))
+	binary.BigEndian.PutUint16(b[1:], uint16(len(magnitude)))
+	b = append(b, magnitude...)
+	if i.Sign() > 0 {
+		b[0] = bigIntPositive
+		return b
+	}
+	b[0] = bigIntNegative
+	for j := 1; j < len(b); j++ {
+		b[j] = ^b[j]
+	}
+	return b
+}
+
+func fromBigIntBinary(b []byte) (any, int) {
+	if b[0] == bigIntZero {
+		return new(big.Int), 1
+	}
+	negative := b[0] == bigIntNegative
+	header := binary.BigEndian.Uint16(b[1:3])
+	if negative {
+		header = ^header
+	}
+	limit := 3 + int(header)
+	magnitude := append([]byte(nil), b[3:limit]...)
+	if negative {
+		for j := range magnitude {
+			magnitude[j] = ^magnitude[j]
+		}
+	}
+	i := new(big.Int).SetBytes(magnitude)
+	if negative {
+		i.Neg(i)
+	}
+	return i, limit
+}
+
+func checkBigInt(v any) error {
+	i, ok := toBigInt(v)
+	if !ok {
+		return fmt.Errorf("%v (%T) is not an integer", v, v)
+	}
+	if len(i.Bytes()) > math.MaxUint16 {
+		return fmt.Errorf("integer of %d bytes exceeds %d", len(i.Bytes()), math.MaxUint16)
+	}
+	return nil
+}
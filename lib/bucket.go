@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// bucket turns numbers into the integers stored for a bucketed int kind such as
+// "int32/scale:100" or "int64/floor". The input is scaled and then rounded with
+// exact decimal arithmetic, so 19.99 with scale:100 is always stored as 1999.
+// Without a bucket, fractional input is truncated by the int encoders.
+type bucket struct {
+	spec  string
+	scale *big.Rat
+	mode  string
+}
+
+// parseKind splits a kind into its base kind and optional bucket, which is a
+// list of slash separated transforms: scale:N multiplies the input by N, and
+// floor, round or ceil choose how the result is rounded, round by default.
+func parseKind(kind string) (string, *bucket, error) {
+	base, spec, ok := strings.Cut(kind, "/")
+	if !ok {
+		return kind, nil, nil
+	}
+	if !isIntKind(base) {
+		return "", nil, fmt.Errorf("can not bucket into %s", base)
+	}
+
+	b := &bucket{spec: spec, scale: big.NewRat(1, 1), mode: "round"}
+	for _, transform := range strings.Split(spec, "/") {
+		name, arg, _ := strings.Cut(transform, ":")
+		switch name {
+		case "floor", "round", "ceil":
+			b.mode = name
+		case "scale":
+			scale, ok := new(big.Rat).SetString(arg)
+			if !ok || scale.Sign() <= 0 {
+				return "", nil, fmt.Errorf("bad scale %q in %s", arg, kind)
+			}
+			b.scale = scale
+		default:
+			return "", nil, fmt.Errorf("unknown transform %q in %s", transform, kind)
+		}
+	}
+	return base, b, nil
+}
+
+// apply returns the bucketed value of v as an int64, or v itself when it is
+// not a number. Results beyond int64 are returned as float64 so that range
+// checks still see them.
+func (b *bucket) apply(v any) any {
+	d, ok := toDecimal(v)
+	if !ok || d.rat == nil {
+		return v
+	}
+	r := new(big.Rat).Mul(d.rat, b.scale)
+
+	// Euclidean division leaves rem >= 0, so quo is the floor of r.
+	quo, rem := new(big.Int).DivMod(r.Num(), r.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		switch b.mode {
+		case "ceil":
+			quo.Add(quo, big.NewInt(1))
+		case "round":
+			// half away from zero, like math.Round
+			c := new(big.Int).Lsh(rem, 1).Cmp(r.Denom())
+			if c > 0 || (c == 0 && r.Sign() > 0) {
+				quo.Add(quo, big.NewInt(1))
+			}
+		}
+	}
+	if !quo.IsInt64() {
+		f, _ := new(big.Float).SetInt(quo).Float64()
+		return f
+	}
+	return quo.Int64()
+}
+
+// fullKind returns the kind of the field as declared, including its bucket.
+func (f field) fullKind() string {
+	if f.bucket == nil {
+		return f.kind
+	}
+	return f.kind + "/" + f.bucket.spec
+}
+
+// applyBuckets replaces the values of bucketed fields in record by their buckets.
+func (s *Schema) applyBuckets(record map[string]any) {
+	for _, f := range s.keys {
+		f.applyBucket(record)
+	}
+	for _, f := range s.values {
+		f.applyBucket(record)
+	}
+}
+
+func (f field) applyBucket(record map[string]any) {
+	if f.bucket == nil {
+		return
+	}
+	if v, ok := f.lookup(record); ok && v != nil {
+		f.set(record, f.bucket.apply(v))
+	}
+}
+
+// bucketed reports whether any field of the schema is bucketed.
+func (s *Schema) bucketed() bool {
+	for _, f := range s.keys {
+		if f.bucket != nil {
+			return true
+		}
+	}
+	for _, f := range s.values {
+		if f.bucket != nil {
+			return true
+		}
+	}
+	return false
+}
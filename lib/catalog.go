@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"sort"
+)
+
+// Entry describes an available storage, kind or aggregation, for listings such as
+// `badmerger list`. Form shows how it is written where it takes arguments.
+type Entry struct {
+	Name string `json:"name"`
+	Form string `json:"form"`
+	Doc  string `json:"doc"`
+}
+
+// StorageDocs holds one-line descriptions of storages, set next to their entry in
+// Registration. Storages without one are listed undescribed.
+var StorageDocs = make(map[string]string)
+
+// KindDocs holds one-line descriptions of kinds added by RegisterKind.
+var KindDocs = make(map[string]string)
+
+var builtinKinds = []Entry{
+	{"int8", "int8", "8-bit integer"},
+	{"int16", "int16", "16-bit integer"},
+	{"int32", "int32", "32-bit integer, bucketed with int32/scale:N/floor|round|ceil"},
+	{"int64", "int64", "64-bit integer, bucketed like int32"},
+	{"float32", "float32", "32-bit float"},
+	{"float64", "float64", "64-bit float"},
+	{"bool", "bool", "true or false"},
+	{"timestamp", "timestamp", "RFC 3339 time or unix seconds, stored with nanoseconds"},
+	{"date", "date", "YYYY-MM-DD day"},
+	{"uuid", "uuid", "canonical UUID string"},
+	{"ip", "ip", "IPv4 or IPv6 address"},
+	{"bytes", "bytes", "base64 encoded bytes"},
+	{"decimal", "decimal", "exact decimal number"},
+	{"bigint", "bigint", "arbitrary precision integer"},
+	{"string", "string", "UTF-8 text"},
+	{"dict_string", "dict_string", "text stored as ids into a per-field dictionary"},
+	{"json", "json", "any JSON value"},
+	{"json_zstd", "json_zstd", "any JSON value, zstd compressed"},
+	{"map", "map", "JSON object, e.g. counters by name for map_sum"},
+	{"array", "array<T>", "array of values of kind T"},
+}
+
+var builtinAggregations = []Entry{
+	{"first", "first(f)", "first value of the group"},
+	{"first_not_null", "first_not_null(f)", "first non-null value"},
+	{"last", "last(f)", "last value of the group"},
+	{"last_not_null", "last_not_null(f)", "last non-null value"},
+	{"earliest", "earliest(f, ts)", "value of the row with the smallest ts"},
+	{"latest", "latest(f, ts)", "value of the row with the largest ts"},
+	{"min", "min(f)", "smallest value"},
+	{"max", "max(f)", "largest value"},
+	{"sum", "sum(f)", "sum of numeric values"},
+	{"median", "median(f)", "exact median of numeric values"},
+	{"count", "count(f) | count(*)", "non-null values of f, or rows of the group"},
+	{"count_distinct", "count_distinct(f)", "distinct non-null values"},
+	{"tally", "tally(f[, top=N][, min=N])", "occurrences of each value"},
+	{"map_sum", "map_sum(f)", "sum of the numeric values of map fields per map key"},
+	{"sample", "sample(f, n)", "uniform random sample of up to n values"},
+	{"collect", "collect(f)", "array of all non-null values"},
+}
+
+// Storages lists the registered storages by name.
+func Storages() []Entry {
+	entries := make([]Entry, 0, len(Registration))
+	for name := range Registration {
+		entries = append(entries, Entry{Name: name, Form: name, Doc: StorageDocs[name]})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Kinds lists the builtin kinds followed by those added by RegisterKind.
+func Kinds() []Entry {
+	entries := append([]Entry(nil), builtinKinds...)
+	custom := make([]Entry, 0, len(customKinds))
+	for name := range customKinds {
+		custom = append(custom, Entry{Name: name, Form: name, Doc: KindDocs[name]})
+	}
+	sort.Slice(custom, func(i, j int) bool { return custom[i].Name < custom[j].Name })
+	return append(entries, custom...)
+}
+
+// Aggregations lists the aggregations WithAgg takes. They combine into arithmetic
+// expressions such as sum(errors)/count(requests).
+func Aggregations() []Entry {
+	return append([]Entry(nil), builtinAggregations...)
+}
@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type checkpointMeta struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+func checkpointRoot(dir string) string {
+	return filepath.Clean(dir) + ".snapshots"
+}
+
+// CheckpointDir returns the directory holding the named checkpoint of the database in dir.
+// The returned directory can be passed to WithDir to query the checkpoint like any database.
+// It returns "" for names CreateCheckpoint refuses.
+func CheckpointDir(dir, name string) string {
+	if checkCheckpointName(name) != nil {
+		return ""
+	}
+	return filepath.Join(checkpointRoot(dir), name)
+}
+
+// checkCheckpointName refuses names that are not a single path element, which
+// would put the checkpoint outside the checkpoints of the database.
+func checkCheckpointName(name string) error {
+	if name == "" {
+		return fmt.Errorf("checkpoint name is required")
+	}
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return fmt.Errorf("bad checkpoint name %q", name)
+	}
+	return nil
+}
+
+// CreateCheckpoint copies the database in dir into a checkpoint with the given name,
+// so it can later be queried or diffed against. The database must not be open. The
+// name must not contain path separators or be . or ..
+func CreateCheckpoint(dir, name string) error {
+	if err := checkCheckpointName(name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(schemaFile(dir)); err != nil {
+		return fmt.Errorf("%v is not a badmerger database: %w", dir, err)
+	}
+
+	target := CheckpointDir(dir, name)
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("checkpoint %v already exists", name)
+	}
+
+	if err := copyDir(dir, target); err != nil {
+		os.RemoveAll(target)
+		return fmt.Errorf("fail to copy %v: %w", dir, err)
+	}
+
+	meta, err := json.Marshal(checkpointMeta{Name: name, Created: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+	return os.WriteFile(filepath.Join(checkpointRoot(dir), name+".json"), meta, 0644)
+}
+
+// ListCheckpoints returns the names of all checkpoints of the database in dir,
+// oldest first.
+func ListCheckpoints(dir string) ([]string, error) {
+	entries, err := os.ReadDir(checkpointRoot(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var metas []checkpointMeta
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(checkpointRoot(dir), e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var meta checkpointMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal checkpoint %v: %w", e.Name(), err)
+		}
+		metas = append(metas, meta)
+	}
+
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Created.Before(metas[j].Created) })
+	names := make([]string, len(metas))
+	for i, meta := range metas {
+		names[i] = meta.Name
+	}
+	return names, nil
+}
+
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,38 @@
+package lib_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+	_ "github.com/kill-2/badmerger/storage/bolt"
+)
+
+func TestCheckpointName(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	db, err := lib.Open(lib.WithStorage("bolt"), lib.WithDir(dir), lib.WithKey("g", "string"), lib.WithValue("v", "int64"))
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	db.Close()
+
+	for _, name := range []string{"", ".", "..", "../x", "a/b", `a\b`} {
+		if err := lib.CreateCheckpoint(dir, name); err == nil {
+			t.Errorf("checkpoint %q created", name)
+		}
+		if got := lib.CheckpointDir(dir, name); got != "" {
+			t.Errorf("got dir %v for checkpoint %q", got, name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "x")); err == nil {
+		t.Errorf("checkpoint written outside its database")
+	}
+
+	if err := lib.CreateCheckpoint(dir, "s1"); err != nil {
+		t.Fatalf("fail to create checkpoint: %v", err)
+	}
+	if _, err := os.Stat(lib.CheckpointDir(dir, "s1")); err != nil {
+		t.Errorf("no checkpoint dir: %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codec selects the compression of export and backup streams.
+type Codec string
+
+const (
+	CodecNone Codec = "none"
+	CodecZstd Codec = "zstd"
+	CodecLZ4  Codec = "lz4"
+	CodecGzip Codec = "gzip"
+)
+
+// ParseCodec checks a codec name, "" meaning CodecZstd.
+func ParseCodec(name string) (Codec, error) {
+	switch Codec(name) {
+	case "":
+		return CodecZstd, nil
+	case CodecNone, CodecZstd, CodecLZ4, CodecGzip:
+		return Codec(name), nil
+	}
+	return "", fmt.Errorf("unknown codec %q", name)
+}
+
+// A stream starts with streamMagic and the codec name in clear, followed by the
+// compressed payload, which ends with a footer of footerMagic, the payload length
+// and its CRC-32C. The footer is compressed along, so a truncated stream fails
+// to decompress or misses its footer either way.
+var (
+	streamMagic = []byte("BMS1")
+	footerMagic = []byte("BMSF")
+)
+
+const footerSize = 4 + 8 + 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// NewStreamWriter compresses everything written to it into w with codec. Close
+// writes the integrity footer and flushes, it does not close w.
+func NewStreamWriter(w io.Writer, codec Codec) (io.WriteCloser, error) {
+	if _, err := ParseCodec(string(codec)); err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(nil), streamMagic...), byte(len(codec)))
+	if _, err := w.Write(append(header, codec...)); err != nil {
+		return nil, fmt.Errorf("fail to write stream header: %v", err)
+	}
+
+	sw := &streamWriter{crc: crc32.New(castagnoli)}
+	switch codec {
+	case CodecNone:
+		sw.w = nopWriteCloser{w}
+	case CodecZstd:
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		sw.w = enc
+	case CodecLZ4:
+		sw.w = lz4.NewWriter(w)
+	case CodecGzip:
+		sw.w = gzip.NewWriter(w)
+	}
+	return sw, nil
+}
+
+type streamWriter struct {
+	w   io.WriteCloser
+	crc hash.Hash32
+	n   uint64
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	n, err := sw.w.Write(p)
+	sw.crc.Write(p[:n])
+	sw.n += uint64(n)
+	return n, err
+}
+
+func (sw *streamWriter) Close() error {
+	footer := append([]byte(nil), footerMagic...)
+	footer = binary.BigEndian.AppendUint64(footer, sw.n)
+	footer = binary.BigEndian.AppendUint32(footer, sw.crc.Sum32())
+	if _, err := sw.w.Write(footer); err != nil {
+		return fmt.Errorf("fail to write stream footer: %v", err)
+	}
+	return sw.w.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// NewStreamReader decompresses a stream written by NewStreamWriter, whatever its
+// codec. Reading it to the end verifies the footer; a mismatch is returned as the
+// error of the last Read instead of io.EOF.
+func NewStreamReader(r io.Reader) (io.ReadCloser, error) {
+	header := make([]byte, len(streamMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("fail to read stream header: %v", err)
+	}
+	if !bytes.Equal(header[:len(streamMagic)], streamMagic) {
+		return nil, fmt.Errorf("not a badmerger stream")
+	}
+	name := make([]byte, header[len(streamMagic)])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, fmt.Errorf("fail to read stream header: %v", err)
+	}
+	codec, err := ParseCodec(string(name))
+	if err != nil || len(name) == 0 {
+		return nil, fmt.Errorf("unknown stream codec %q", name)
+	}
+
+	sr := &streamReader{crc: crc32.New(castagnoli), close: func() error { return nil }}
+	switch codec {
+	case CodecNone:
+		sr.r = r
+	case CodecZstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		sr.r, sr.close = dec, func() error { dec.Close(); return nil }
+	case CodecLZ4:
+		sr.r = lz4.NewReader(r)
+	case CodecGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read gzip header: %v", err)
+		}
+		sr.r, sr.close = gz, gz.Close
+	}
+	return sr, nil
+}
+
+// streamReader holds back the last footerSize bytes it read, which are the footer
+// once the payload ends.
+type streamReader struct {
+	r       io.Reader
+	close   func() error
+	crc     hash.Hash32
+	n       uint64
+	tail    []byte
+	err     error
+	checked bool
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	for sr.err == nil && len(sr.tail) <= footerSize {
+		buf := make([]byte, len(p)+footerSize)
+		n, err := sr.r.Read(buf)
+		sr.tail = append(sr.tail, buf[:n]...)
+		sr.err = err
+	}
+	if len(sr.tail) > footerSize {
+		n := copy(p, sr.tail[:len(sr.tail)-footerSize])
+		sr.crc.Write(p[:n])
+		sr.n += uint64(n)
+		sr.tail = sr.tail[n:]
+		return n, nil
+	}
+	if sr.err == io.EOF && !sr.checked {
+		sr.checked = true
+		if err := sr.verify(); err != nil {
+			sr.err = err
+		}
+	}
+	return 0, sr.err
+}
+
+// verify checks the footer against the payload, all of which went out through Read.
+func (sr *streamReader) verify() error {
+	if len(sr.tail) != footerSize || !bytes.Equal(sr.tail[:4], footerMagic) {
+		return fmt.Errorf("fail to verify stream: footer is missing, the stream is truncated")
+	}
+	if n := binary.BigEndian.Uint64(sr.tail[4:12]); n != sr.n {
+		return fmt.Errorf("fail to verify stream: %d bytes instead of %d", sr.n, n)
+	}
+	if sum := binary.BigEndian.Uint32(sr.tail[12:]); sum != sr.crc.Sum32() {
+		return fmt.Errorf("fail to verify stream: checksum mismatch")
+	}
+	return nil
+}
+
+func (sr *streamReader) Close() error {
+	return sr.close()
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// Value compressions of WithCompression.
+const (
+	CompressionNone   = "none"
+	CompressionSnappy = "snappy"
+	CompressionZstd   = "zstd"
+)
+
+// WithCompression returns a configuration function that compresses the value
+// payloads of a new database with snappy or zstd, for merges whose wide string and
+// json values dominate the disk. Keys stay as they are, so seeks and key order are
+// unaffected. It applies to every storage, rows are compressed before Insert and
+// decompressed before they are decoded. Like the format, the compression is part
+// of the stored schema, so databases reopened from their dir keep theirs. Snappy is
+// cheap enough to leave on; zstd compresses better at more CPU per row.
+func WithCompression(compression string) StorageOpt {
+	return func(w *DbWrapper) error {
+		switch compression {
+		case CompressionNone:
+			w.compression = ""
+		case CompressionSnappy, CompressionZstd:
+			w.compression = compression
+		default:
+			return fmt.Errorf("unknown compression %q", compression)
+		}
+		return nil
+	}
+}
+
+// Compression returns the compression of the value payloads, CompressionNone when
+// they are stored as they are.
+func (s *Schema) Compression() string {
+	if s.compression == "" {
+		return CompressionNone
+	}
+	return s.compression
+}
+
+func compressValue(compression string, valuePayload []byte) []byte {
+	switch compression {
+	case CompressionSnappy:
+		return snappy.Encode(nil, valuePayload)
+	case CompressionZstd:
+		return zstdEncoder().EncodeAll(valuePayload, nil)
+	}
+	return valuePayload
+}
+
+// decompressValue reverses compressValue, panicking on corrupt payloads like the
+// decoders of the fields do.
+func decompressValue(compression string, valuePayload []byte) []byte {
+	var b []byte
+	var err error
+	switch compression {
+	case CompressionSnappy:
+		b, err = snappy.Decode(nil, valuePayload)
+	case CompressionZstd:
+		b, err = zstdDecoder().DecodeAll(valuePayload, nil)
+	default:
+		return valuePayload
+	}
+	if err != nil {
+		panic(fmt.Sprintf("fail to decompress value: %v", err))
+	}
+	return b
+}
@@ -3,19 +3,67 @@ package lib
 import (
 	"encoding/json"
 	"fmt"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-var Registration = make(map[string]func(string) (Storage, error))
+// Registration maps storage names to builders, which open a storage in a directory.
+var Registration = make(map[string]func(dir string, cfg StorageConfig) (Storage, error))
+
+// StorageConfig carries settings that builders honor where their storage supports them.
+type StorageConfig struct {
+	// MaxOpenFiles caps the files the storage keeps open, 0 means its default.
+	MaxOpenFiles int
+	// InMemory keeps the rows in memory instead of the dir, they are lost on Close.
+	InMemory bool
+	// EncryptionKey encrypts the storage at rest, see WithEncryptionKey.
+	EncryptionKey []byte
+	// URI is the storage name when it was given as SCHEME://..., e.g. grpc://host:port,
+	// which opens the storage registered as SCHEME.
+	URI string
+	// Options are tuning options of the storage by key, see WithStorageOption.
+	Options map[string]string
+}
 
 type DbWrapper struct {
-	store  string
-	dir    string
-	db     Storage
-	keys   []key
-	values []value
-	masks  int
+	Schema
+	store string
+	dir   string
+	db    Storage
+	usage Usage
+
+	settings  settings
+	intFields []field
+	// sizedFields have a length header, see checkSizes
+	sizedFields []sizedField
+	// parsedFields are read from text, see checkFormats
+	parsedFields []field
+}
+
+// settings are options that shape ingestion without being part of the stored schema,
+// so they survive schema recovery in Open.
+type settings struct {
+	overflow   OverflowPolicy
+	size       SizePolicy
+	maxKeySize int
+	jobID      string
+	storage    StorageConfig
+	namespace  string
+	mappings   []fieldMapping
+
+	memoryWatermark int64
+	maxMemory       int64
+	recycleRecords  bool
+}
+
+func withSettings(s settings) StorageOpt {
+	return func(w *DbWrapper) error {
+		w.settings = s
+		return nil
+	}
 }
 
 type StorageOpt func(w *DbWrapper) error
@@ -30,17 +78,50 @@ type value struct {
 
 type field struct {
 	name   string
+	path   []string
 	kind   string
-	encode encoder
-	decode decoder
+	encode Encoder
+	decode Decoder
+	check  validator
+	bucket *bucket
+	dict   *dictionary
+	// explode ingests arrays as one row per element, see WithExplode
+	explode bool
 }
 
+// Storage keeps the encoded rows. Iterate feeds every stored row in key order to
+// the merger, starting at and stopping before the keys of Merger.Bounds where it can.
 type Storage interface {
 	NewInserter() Inserter
 	Iterate(*Merger, func(res map[string]any) error) error
 	Close() error
 }
 
+// Compacter is implemented by storages that can flush buffered writes and
+// compact their files, e.g. before handing the directory to other readers.
+type Compacter interface {
+	Compact() error
+}
+
+// GarbageCollector is implemented by storages that can reclaim space held by
+// overwritten or deleted values.
+type GarbageCollector interface {
+	RunGC() error
+}
+
+// SchemaReceiver is implemented by storages that need the schema of the rows they
+// store, e.g. to lay them out as columns. Open calls SetSchema before any row is
+// written or read.
+type SchemaReceiver interface {
+	SetSchema(*Schema) error
+}
+
+// Destroyer is implemented by storages that keep rows outside their dir, like the
+// memory storage. DbWrapper.Destroy calls it so they drop those rows too.
+type Destroyer interface {
+	Destroy() error
+}
+
 type Inserter interface {
 	Insert(keyPayload, valuePayload []byte) error
 	Commit() error
@@ -50,8 +131,20 @@ func schemaFile(dir string) string {
 	return filepath.Join(dir, "schema.json")
 }
 
-func recoverSchema(dir string) ([]StorageOpt, error) {
-	data, err := os.ReadFile(schemaFile(dir))
+// IsDatabase reports whether dir holds a badmerger database, or the namespaces of
+// several, see WithNamespace.
+func IsDatabase(dir string) bool {
+	if _, err := os.Stat(namespaceFile(dir)); err == nil {
+		return true
+	}
+	_, err := os.Stat(schemaFile(dir))
+	return err == nil
+}
+
+// recoverSchema reads the schema of the database in dir from schemaDir, which is
+// dir unless the database is a namespace.
+func recoverSchema(dir, schemaDir string) ([]StorageOpt, error) {
+	data, err := os.ReadFile(schemaFile(schemaDir))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read schema file: %w", err)
 	}
@@ -62,12 +155,26 @@ func recoverSchema(dir string) ([]StorageOpt, error) {
 	}
 
 	opts := []StorageOpt{WithStorage(schema.Store), WithDir(dir)}
+	if schema.Format != 0 {
+		opts = append(opts, WithFormat(schema.Format))
+	}
+	if schema.Compression != "" {
+		opts = append(opts, WithCompression(schema.Compression))
+	}
+	if schema.KeyCheck != "" {
+		opts = append(opts, withKeyCheck(schema.KeyCheck))
+	}
 	for _, key := range schema.Keys {
 		opts = append(opts, WithKey(key.Name, key.Kind))
 	}
 	for _, val := range schema.Values {
 		opts = append(opts, WithValue(val.Name, val.Kind))
 	}
+	for _, f := range append(schema.Keys, schema.Values...) {
+		if f.Explode {
+			opts = append(opts, WithExplode(f.Name))
+		}
+	}
 
 	return opts, nil
 }
@@ -85,12 +192,15 @@ func Open(opts ...StorageOpt) (*DbWrapper, error) {
 	}
 
 	if w.dir != "" {
-		if _, err := os.Stat(schemaFile(w.dir)); !os.IsNotExist(err) {
-			recoveredOpts, err := recoverSchema(w.dir)
+		if err := w.checkNamespace(); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(schemaFile(w.schemaDir())); !os.IsNotExist(err) {
+			recoveredOpts, err := recoverSchema(w.dir, w.schemaDir())
 			if err != nil {
 				return nil, fmt.Errorf("fail to recover options from %v: %v", w.dir, err)
 			}
-			opts = recoveredOpts
+			opts = append(recoveredOpts, withSettings(w.settings))
 		}
 	}
 
@@ -106,26 +216,92 @@ func open(opts ...StorageOpt) (*DbWrapper, error) {
 	}
 
 	if w.dir == "" {
-		tmpDir, err := os.MkdirTemp("", "badmerger-")
+		tmpDir, err := createTempDir(w.settings.jobID)
 		if err != nil {
 			return nil, fmt.Errorf("fail to create db %v", err)
 		}
 		w.dir = tmpDir
 	}
 
+	cfg := w.settings.storage
 	storageBuilder, ok := Registration[w.store]
+	if scheme, _, isURI := strings.Cut(w.store, "://"); !ok && isURI {
+		storageBuilder, ok = Registration[scheme]
+		cfg.URI = w.store
+	}
 	if !ok {
 		return nil, fmt.Errorf("no such storage: %v", w.store)
 	}
 
-	db, err := storageBuilder(w.dir)
+	if err := checkOpenFiles(w.settings.storage.MaxOpenFiles); err != nil {
+		return nil, err
+	}
+	if err := w.checkMappings(); err != nil {
+		return nil, err
+	}
+
+	build := func() (Storage, error) {
+		return storageBuilder(w.dir, cfg)
+	}
+	var db Storage
+	var err error
+	if w.settings.namespace != "" {
+		db, err = w.openNamespace(build)
+	} else {
+		db, err = build()
+	}
 	if err != nil {
 		return nil, fmt.Errorf("fail to open db %v", err)
 	}
 
 	w.db = db
 
-	w.masks = (len(w.values) / 8) + 1
+	w.masks = maskSize(len(w.values))
+	for _, k := range w.keys {
+		if isIntKind(k.kind) {
+			w.intFields = append(w.intFields, k.field)
+		}
+	}
+	for _, v := range w.values {
+		if isIntKind(v.kind) {
+			w.intFields = append(w.intFields, v.field)
+		}
+	}
+	for _, k := range w.keys {
+		if isParsedKind(k.kind) {
+			w.parsedFields = append(w.parsedFields, k.field)
+		}
+	}
+	for _, v := range w.values {
+		if isParsedKind(v.kind) {
+			w.parsedFields = append(w.parsedFields, v.field)
+		}
+	}
+	w.applyFormat()
+	for _, k := range w.keys {
+		if hasLengthHeader(k.kind) {
+			w.sizedFields = append(w.sizedFields, sizedField{k.field, headerLimit(w.format, false)})
+		}
+	}
+	for _, v := range w.values {
+		if hasLengthHeader(v.kind) {
+			w.sizedFields = append(w.sizedFields, sizedField{v.field, headerLimit(w.format, true)})
+		}
+	}
+
+	if err := w.setupEncryption(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := w.loadDictionaries(w.schemaDir()); err != nil {
+		return nil, fmt.Errorf("fail to load dictionaries: %v", err)
+	}
+	if s, ok := db.(SchemaReceiver); ok {
+		if err := s.SetSchema(&w.Schema); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("fail to set schema: %v", err)
+		}
+	}
 
 	if err := w.lockSchema(); err != nil {
 		return nil, fmt.Errorf("fail to lock schema: %v", err)
@@ -153,66 +329,104 @@ func WithDir(dir string) StorageOpt {
 	}
 }
 
+// WithInMemory returns a configuration function that asks the storage to keep its
+// rows in memory only, for merges that are ingested and queried in one go. Only the
+// schema is written to the dir. Storages without an in-memory mode ignore it.
+func WithInMemory() StorageOpt {
+	return func(w *DbWrapper) error {
+		w.settings.storage.InMemory = true
+		return nil
+	}
+}
+
 // WithKey returns a configuration function that adds a key field to the dbWrapper.
 // The key consists of a name and type (e.g., "id", "int32").
+// A dotted name such as "user.id" reads the field from nested objects.
 // This is used to define the structure of keys in the database.
 func WithKey(name, kind string) StorageOpt {
 	return func(w *DbWrapper) error {
 		if w.keys == nil {
 			w.keys = make([]key, 0)
 		}
-		toBytes, fromBytes, err := chooseEncoder(kind)
+		f, err := newField(name, kind)
 		if err != nil {
 			return err
 		}
-		w.keys = append(w.keys, key{field: field{name: name, kind: kind, encode: toBytes, decode: fromBytes}})
+		w.keys = append(w.keys, key{field: f})
 		return nil
 	}
 }
 
 // WithValue returns a configuration function that adds a value field to the dbWrapper.
 // The value consists of a name and type (e.g., "name", "string").
+// A dotted name such as "user.name" reads the field from nested objects.
 // This is used to define the structure of values in the database.
 func WithValue(name, kind string) StorageOpt {
 	return func(w *DbWrapper) error {
 		if w.values == nil {
 			w.values = make([]value, 0)
 		}
-		toBytes, fromBytes, err := chooseEncoder(kind)
+		f, err := newField(name, kind)
 		if err != nil {
 			return err
 		}
-		w.values = append(w.values, value{field: field{name: name, kind: kind, encode: toBytes, decode: fromBytes}})
+		w.values = append(w.values, value{field: f})
 		return nil
 	}
 }
 
+func newField(name, kind string) (field, error) {
+	kind, bucket, err := parseKind(kind)
+	if err != nil {
+		return field{}, err
+	}
+	f := field{name: name, path: fieldPath(name), kind: kind, check: chooseValidator(kind), bucket: bucket}
+	if kind == "dict_string" {
+		f.dict = newDictionary()
+		f.encode, f.decode = f.dict.encode, f.dict.decode
+		return f, nil
+	}
+	if f.encode, f.decode, err = chooseEncoder(kind); err != nil {
+		return field{}, err
+	}
+	return f, nil
+}
+
 type fixedSchema struct {
-	Store  string             `json:"store"`
-	Keys   []fixedSchemaField `json:"keys"`
-	Values []fixedSchemaField `json:"values"`
+	Store       string             `json:"store"`
+	Format      int                `json:"format,omitempty"`
+	Compression string             `json:"compression,omitempty"`
+	KeyCheck    string             `json:"key_check,omitempty"`
+	Keys        []fixedSchemaField `json:"keys"`
+	Values      []fixedSchemaField `json:"values"`
 }
 
 type fixedSchemaField struct {
-	Name string `json:"name"`
-	Kind string `json:"kind"`
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Explode bool   `json:"explode,omitempty"`
 }
 
 func (db *DbWrapper) lockSchema() error {
 	schema := fixedSchema{
-		Store:  db.store,
-		Keys:   make([]fixedSchemaField, len(db.keys)),
-		Values: make([]fixedSchemaField, len(db.values)),
+		Store:       db.store,
+		Format:      db.format,
+		Compression: db.compression,
+		KeyCheck:    db.keyCheck,
+		Keys:        make([]fixedSchemaField, len(db.keys)),
+		Values:      make([]fixedSchemaField, len(db.values)),
 	}
 
 	for i, k := range db.keys {
 		schema.Keys[i].Name = k.name
-		schema.Keys[i].Kind = k.kind
+		schema.Keys[i].Kind = k.fullKind()
+		schema.Keys[i].Explode = k.explode
 	}
 
 	for i, v := range db.values {
 		schema.Values[i].Name = v.name
-		schema.Values[i].Kind = v.kind
+		schema.Values[i].Kind = v.fullKind()
+		schema.Values[i].Explode = v.explode
 	}
 
 	jsonData, err := json.Marshal(schema)
@@ -220,7 +434,7 @@ func (db *DbWrapper) lockSchema() error {
 		return fmt.Errorf("failed to marshal schema: %w", err)
 	}
 
-	filePath := schemaFile(db.dir)
+	filePath := schemaFile(db.schemaDir())
 	err = os.WriteFile(filePath, jsonData, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write schema file: %w", err)
@@ -232,6 +446,30 @@ func (db *DbWrapper) lockSchema() error {
 type IterWrapper struct {
 	*DbWrapper
 	*Merger
+	unchanged   map[string]struct{}
+	emitEmpty   bool
+	optErr      error
+	stateWindow string
+	stateExport func(GroupState) error
+	stateMerge  []GroupState
+	aliases     map[string]string
+	// keyValues are the values of WithPartialKeyValue
+	keyValues map[string]any
+	// having are the conditions of WithHaving
+	having []condition
+	// limit and offset slice the merged groups, see WithLimit
+	limit, offset int
+	// sortBy orders the merged groups, see WithSortBy
+	sortBy []sortColumn
+	// selected are the output fields of WithSelect
+	selected []string
+	// rollup adds subtotals, see WithRollup
+	rollup bool
+	// trace and groupsEmitted count the work of Iter, see Trace
+	trace         Trace
+	groupsEmitted int64
+	// release releases the view of Snapshot
+	release func() error
 }
 
 // NewIterator initializes a new iterWrapper
@@ -239,13 +477,20 @@ func (db *DbWrapper) NewIterator(itOpts ...IteratorOpt) *IterWrapper {
 	itW := &IterWrapper{
 		DbWrapper: db,
 		Merger: &Merger{
-			masks:     db.masks,
-			allValues: db.values,
+			masks:       db.masks,
+			compression: db.compression,
+			cipher:      db.cipher,
+			allValues:   db.values,
+			seed:        rand.Uint64(),
 		},
 	}
 	for _, opt := range itOpts {
 		opt(itW)
 	}
+	for i, agg := range itW.aggs {
+		itW.aggs[i].aggregator = withNumericMode(agg.aggregator, itW.numericMode)
+		seedAggregator(itW.aggs[i].aggregator, itW.seed)
+	}
 	return itW
 }
 
@@ -267,10 +512,67 @@ func WithPartialKey(name string) IteratorOpt {
 // WithAgg creates an iterator option that adds an aggregation operation
 // to be performed during iteration. The aggregation is specified by:
 // - name: the field name to aggregate
-// - op: the aggregation operation (e.g., "sum", "avg", "count")
+// - op: the aggregation operation (e.g., "sum", "avg", "count"), or an arithmetic
+// expression over aggregations (e.g., "sum(errors)/count(requests)")
+//
+// An unknown or malformed op makes Iter fail.
 func WithAgg(name, op string) IteratorOpt {
 	return func(itW *IterWrapper) {
-		itW.aggs = append(itW.aggs, namedAggregation{name: name, aggregator: chooseAggregator(op)})
+		operator, err := parseAggregation(op)
+		if err != nil {
+			itW.optErr = fmt.Errorf("bad aggregation %v: %v", name, err)
+			return
+		}
+		itW.aggs = append(itW.aggs, namedAggregation{name: name, aggregator: operator})
+	}
+}
+
+// WithSeed creates an iterator option that fixes the seed of the random source
+// used by randomized aggregators such as sample, making runs reproducible.
+// Without it a random seed is chosen, which Seed reports.
+func WithSeed(seed uint64) IteratorOpt {
+	return func(itW *IterWrapper) {
+		itW.seed = seed
+	}
+}
+
+// WithPrefetch creates an iterator option that sets how many items storage
+// iterators read ahead, trading memory for fewer disk round trips on large scans.
+func WithPrefetch(n int) IteratorOpt {
+	return func(itW *IterWrapper) {
+		itW.prefetch = n
+	}
+}
+
+// WithSkipBadGroups creates an iterator option that skips groups whose keys or values fail
+// to decode or whose aggregation panics, reporting each one to report instead of
+// aborting the whole iteration.
+func WithSkipBadGroups(report func(key map[string]any, err error)) IteratorOpt {
+	return func(itW *IterWrapper) {
+		itW.onBadGroup = report
+	}
+}
+
+// WithFingerprint creates an iterator option that adds a column with the given
+// name holding a stable hash of each group's merged output, so results of
+// successive runs can be diffed cheaply to find which groups changed.
+func WithFingerprint(name string) IteratorOpt {
+	return func(itW *IterWrapper) {
+		itW.fingerprint = name
+	}
+}
+
+// WithChangedSince creates an iterator option that skips groups whose fingerprint
+// is among the given ones, typically collected from the output of a previous run,
+// so only groups whose underlying rows changed since then are emitted.
+func WithChangedSince(fingerprints ...string) IteratorOpt {
+	return func(itW *IterWrapper) {
+		if itW.unchanged == nil {
+			itW.unchanged = make(map[string]struct{}, len(fingerprints))
+		}
+		for _, fp := range fingerprints {
+			itW.unchanged[fp] = struct{}{}
+		}
 	}
 }
 
@@ -279,7 +581,212 @@ func WithAgg(name, op string) IteratorOpt {
 // fn: Callback function that receives each aggregated result map
 // Returns error if any iteration or aggregation operation fails
 func (itW *IterWrapper) Iter(fn func(res map[string]any) error) error {
-	return itW.db.Iterate(itW.Merger, fn)
+	start := time.Now()
+	defer func() {
+		itW.endTrace(start)
+		itW.usage.RowsRead += itW.rowsRead
+		itW.usage.BytesRead += itW.bytesRead
+		itW.rowsRead, itW.bytesRead = 0, 0
+	}()
+
+	if itW.optErr != nil {
+		return itW.optErr
+	}
+	if len(itW.buckets) > 0 {
+		if name := itW.bucketBeforeKeys(); name != "" {
+			switch {
+			case itW.rollup:
+				return fmt.Errorf("rollup can not be combined with key %v bucketed before other partial keys", name)
+			case itW.groupSample > 0:
+				return fmt.Errorf("group sample can not be combined with key %v bucketed before other partial keys", name)
+			case itW.spillRows > 0:
+				return fmt.Errorf("spill can not be combined with key %v bucketed before other partial keys", name)
+			}
+		}
+		itW.applyBuckets()
+	}
+	if itW.groupSample > 0 && len(itW.transforms) > 0 {
+		return fmt.Errorf("group sample can not be combined with key transforms")
+	}
+	if itW.filtered() && itW.spillRows > 0 {
+		return fmt.Errorf("filters can not be combined with spill")
+	}
+	if len(itW.keyValues) > 0 {
+		if err := itW.applyKeyValues(); err != nil {
+			return err
+		}
+	}
+	fn = itW.countEmitted(fn)
+	if itW.limit > 0 || itW.offset > 0 {
+		fn = itW.withLimit(fn)
+	}
+	if len(itW.aliases) > 0 {
+		if err := itW.checkAliases(); err != nil {
+			return err
+		}
+		fn = itW.withAliases(fn)
+	}
+	if len(itW.selected) > 0 {
+		var err error
+		if fn, err = itW.withSelect(fn); err != nil {
+			return err
+		}
+	}
+	// wrappers added later see the output maps first, so sort and having see every
+	// field by its name before WithSelect and WithAlias
+	emitSorted := func() error { return nil }
+	if len(itW.sortBy) > 0 {
+		var err error
+		if fn, emitSorted, err = itW.withSort(fn); err != nil {
+			return err
+		}
+	}
+	if len(itW.having) > 0 {
+		var err error
+		if fn, err = itW.withHaving(fn); err != nil {
+			return err
+		}
+	}
+
+	if len(itW.unchanged) > 0 {
+		emit := fn
+		fn = func(res map[string]any) error {
+			fp, ok := res[itW.fingerprint].(string)
+			if !ok {
+				fp = fingerprintOf(res)
+			}
+			if _, seen := itW.unchanged[fp]; seen {
+				return nil
+			}
+			return emit(res)
+		}
+	}
+	emitRollup := func() error { return nil }
+	if itW.rollup {
+		var err error
+		if fn, emitRollup, err = itW.withRollup(fn); err != nil {
+			return err
+		}
+	}
+	emitStates := func() error { return nil }
+	if itW.stateExport != nil || len(itW.stateMerge) > 0 {
+		var err error
+		if fn, emitStates, err = itW.withStates(fn); err != nil {
+			return err
+		}
+	}
+	if err := itW.iterate(fn); err != nil {
+		itW.pending = nil
+		return limited(err)
+	}
+	if err := itW.flush(fn); err != nil {
+		return limited(err)
+	}
+	if err := emitStates(); err != nil {
+		return limited(err)
+	}
+	if itW.emitEmpty && itW.rowsRead == itW.rowsFiltered && len(itW.stateMerge) == 0 {
+		empty := make(map[string]any, len(itW.partialKeys)+len(itW.aggs))
+		for _, k := range itW.partialKeys {
+			empty[k.name] = nil
+		}
+		if err := itW.emit(empty, nil, fn); err != nil {
+			return limited(err)
+		}
+	}
+	if err := emitRollup(); err != nil {
+		return limited(err)
+	}
+	return limited(emitSorted())
+}
+
+// WithEmitEmpty creates an iterator option that makes a scan without any rows
+// emit a single group with null partial keys and aggregations over no values,
+// e.g. a count of 0, like an SQL aggregate without GROUP BY. Without it such a
+// scan emits nothing.
+func WithEmitEmpty() IteratorOpt {
+	return func(itW *IterWrapper) {
+		itW.emitEmpty = true
+	}
+}
+
+// OverflowPolicy decides what Recv does with integer values that do not fit their kind.
+type OverflowPolicy string
+
+const (
+	// OverflowWrap stores the low bits of the value, which is what the encoders do on their own.
+	OverflowWrap OverflowPolicy = "wrap"
+	// OverflowClamp stores the nearest value the kind can hold.
+	OverflowClamp OverflowPolicy = "clamp"
+	// OverflowError makes Recv fail on the offending record.
+	OverflowError OverflowPolicy = "error"
+)
+
+// WithOverflowPolicy returns a configuration function that sets how integer values
+// outside the range of their kind are ingested. Either way they are counted in
+// Usage.OutOfRange. The default is OverflowWrap.
+func WithOverflowPolicy(policy OverflowPolicy) StorageOpt {
+	return func(w *DbWrapper) error {
+		switch policy {
+		case OverflowWrap, OverflowClamp, OverflowError:
+			w.settings.overflow = policy
+			return nil
+		}
+		return fmt.Errorf("unknown overflow policy %q", policy)
+	}
+}
+
+// checkRanges counts integer field values that do not fit their declared kind,
+// which the encoders would otherwise wrap silently, and applies the overflow policy.
+func (db *DbWrapper) checkRanges(record map[string]any) error {
+	for _, f := range db.intFields {
+		v, ok := f.lookup(record)
+		if !ok || v == nil {
+			continue
+		}
+		err := f.check(v)
+		if err == nil {
+			continue
+		}
+
+		if db.usage.OutOfRange == nil {
+			db.usage.OutOfRange = make(map[string]int64)
+		}
+		db.usage.OutOfRange[f.name]++
+
+		switch db.settings.overflow {
+		case OverflowError:
+			return fmt.Errorf("field %v: %w", f.name, err)
+		case OverflowClamp:
+			f.set(record, clampInt(f.kind, v))
+		}
+	}
+	return nil
+}
+
+// isParsedKind reports whether the values of kind are parsed, the encoders storing
+// those they can not read as the zero value of the kind.
+func isParsedKind(kind string) bool {
+	switch kind {
+	case "bool", "timestamp", "date", "uuid", "ip":
+		return true
+	}
+	return false
+}
+
+// checkFormats makes Recv fail on values a parsed kind can not read, which the
+// encoders would store as the epoch, the zero uuid, false or ::.
+func (db *DbWrapper) checkFormats(record map[string]any) error {
+	for _, f := range db.parsedFields {
+		v, ok := f.lookup(record)
+		if !ok || v == nil {
+			continue
+		}
+		if err := f.validate(v); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Destroy cleans up the database by removing all temporary files.
@@ -289,56 +796,178 @@ func (db *DbWrapper) Destroy() error {
 	if db.dir == "" {
 		return nil
 	}
+	if db.settings.namespace != "" {
+		return fmt.Errorf("refuse to destroy namespace %v with the other namespaces of %v", db.settings.namespace, db.dir)
+	}
+	if d, ok := db.db.(Destroyer); ok {
+		if err := d.Destroy(); err != nil {
+			return fmt.Errorf("fail to destroy db %v", err)
+		}
+	}
+	return Destroy(db.dir)
+}
 
-	if err := os.RemoveAll(db.dir); err != nil {
+// Destroy removes the closed database in dir, with all its namespaces. Dirs without
+// a schema.json or namespaces.json are refused, so a path given by mistake is never wiped.
+func Destroy(dir string) error {
+	if !IsDatabase(dir) {
+		return fmt.Errorf("refuse to destroy %v, it is not a database", dir)
+	}
+	if err := os.RemoveAll(dir); err != nil {
 		return fmt.Errorf("fail to destroy db %v", err)
 	}
 	return nil
 }
 
-func (db *DbWrapper) Close() error {
+type CloseOpt func(c *closeConfig)
+
+type closeConfig struct {
+	compact bool
+	gc      bool
+}
+
+// WithFlushAndCompact returns a close option that flushes and compacts the storage
+// before closing it, for storages implementing Compacter.
+func WithFlushAndCompact() CloseOpt {
+	return func(c *closeConfig) {
+		c.compact = true
+	}
+}
+
+// WithRunGC returns a close option that reclaims space from obsolete values before
+// closing the storage, for storages implementing GarbageCollector.
+func WithRunGC() CloseOpt {
+	return func(c *closeConfig) {
+		c.gc = true
+	}
+}
+
+// Compact compacts the storage and collects its garbage, for storages implementing
+// Compacter and GarbageCollector, so directories of long-lived databases that take
+// repeated ingests or deletes give back the space of overwritten rows. It may run
+// on an open database between ingests; the time it takes is counted in
+// Usage.CompactionTime.
+func (db *DbWrapper) Compact() error {
+	start := time.Now()
+	defer func() {
+		db.usage.CompactionTime += time.Since(start)
+	}()
+	if s, ok := db.db.(Compacter); ok {
+		if err := s.Compact(); err != nil {
+			return fmt.Errorf("fail to compact db %v", err)
+		}
+	}
+	if s, ok := db.db.(GarbageCollector); ok {
+		if err := s.RunGC(); err != nil {
+			return fmt.Errorf("fail to gc db %v", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying storage, optionally compacting it and running
+// garbage collection first so the directory is left compact for later readers.
+func (db *DbWrapper) Close(opts ...CloseOpt) error {
+	var c closeConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	start := time.Now()
+	if c.compact {
+		if s, ok := db.db.(Compacter); ok {
+			if err := s.Compact(); err != nil {
+				db.db.Close()
+				return fmt.Errorf("fail to compact db %v", err)
+			}
+		}
+	}
+	if c.gc {
+		if s, ok := db.db.(GarbageCollector); ok {
+			if err := s.RunGC(); err != nil {
+				db.db.Close()
+				return fmt.Errorf("fail to gc db %v", err)
+			}
+		}
+	}
+	db.usage.CompactionTime += time.Since(start)
 	return db.db.Close()
 }
 
 // Recv continuously receives records from the provided channel and writes them to the database.
 // It creates a new write transaction and processes records until the channel is closed.
 // Each record is added to the transaction using TxnWrapper.Add().
-// The transaction is automatically committed when the channel closes (via defer).
+// The transaction is committed when the channel closes, and any commit error is returned.
+// Records are recycled by NewRecord once inserted only with WithRecycledRecords.
 func (db *DbWrapper) Recv(ch chan map[string]any) error {
 	ins := db.db.NewInserter()
-	defer ins.Commit()
+	exploded := db.exploded()
 
-	for record := range ch {
-		keys, values := db.extractKeysAndValues(record)
-		if err := ins.Insert(keys, values); err != nil {
-			return err
+	for input := range ch {
+		if len(db.settings.mappings) > 0 {
+			db.applyMappings(input)
+		}
+		rows := []map[string]any{input}
+		if len(exploded) > 0 {
+			rows = explode(input, exploded)
+			if db.settings.recycleRecords {
+				releaseRecord(input)
+			}
+		}
+		for _, record := range rows {
+			if err := db.insert(ins, record); err != nil {
+				return err
+			}
+			// exploded rows are copies of the input, which belong to Recv
+			if len(exploded) > 0 || db.settings.recycleRecords {
+				releaseRecord(record)
+			}
+			if db.settings.watchesMemory() && db.usage.RecordsWritten%memoryCheckInterval == 0 {
+				var err error
+				if ins, err = db.checkMemory(ins); err != nil {
+					db.commit(ins)
+					return fmt.Errorf("record %d: %w", db.usage.RecordsWritten, err)
+				}
+			}
 		}
 	}
-	return nil
+	return db.commit(ins)
 }
 
-func (dbW *DbWrapper) extractKeysAndValues(record map[string]any) ([]byte, []byte) {
-	keyPayload := make([]byte, 0)
-	for _, f := range dbW.keys {
-		fieldValue := record[f.name]
-		fieldValueBin := f.encode(fieldValue)
-		keyPayload = append(keyPayload, fieldValueBin...)
-		delete(record, f.name)
+// insert writes one record, committing what was written before on failure.
+func (db *DbWrapper) insert(ins Inserter, record map[string]any) error {
+	db.applyBuckets(record)
+	if err := db.checkRanges(record); err != nil {
+		db.commit(ins)
+		return fmt.Errorf("record %d: %w", db.usage.RecordsWritten, err)
 	}
-
-	var valuePayload []byte
-	if len(dbW.values) > 0 {
-		valuePayload = make([]byte, dbW.masks)
-		for i, f := range dbW.values {
-			fieldValue, ok := record[f.name]
-			if !ok || (fieldValue == nil) {
-				valuePayload[i/8] |= (1 << (7 - (i % 8)))
-				continue
-			}
-			fieldValueBin := f.encode(fieldValue)
-			valuePayload = append(valuePayload, fieldValueBin...)
-		}
+	if err := db.checkSizes(record); err != nil {
+		db.commit(ins)
+		return fmt.Errorf("record %d: %w", db.usage.RecordsWritten, err)
 	}
+	if err := db.checkFormats(record); err != nil {
+		db.commit(ins)
+		return fmt.Errorf("record %d: %w", db.usage.RecordsWritten, err)
+	}
+	keys, values := db.encode(record)
+	if err := db.checkKeySize(keys); err != nil {
+		db.commit(ins)
+		return fmt.Errorf("record %d: %w", db.usage.RecordsWritten, err)
+	}
+	db.usage.RecordsWritten++
+	db.usage.BytesWritten += int64(len(keys) + len(values))
+	if err := ins.Insert(keys, values); err != nil {
+		db.commit(ins)
+		return err
+	}
+	return nil
+}
 
-	return keyPayload, valuePayload
+// commit persists new dictionary codes before committing the rows that use them.
+func (db *DbWrapper) commit(ins Inserter) error {
+	if err := db.saveDictionaries(db.schemaDir()); err != nil {
+		ins.Commit()
+		return err
+	}
+	return ins.Commit()
 }
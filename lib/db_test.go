@@ -0,0 +1,129 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kill-2/badmerger/lib"
+	_ "github.com/kill-2/badmerger/storage/bolt"
+)
+
+func TestRecvBadFormat(t *testing.T) {
+	for kind, v := range map[string]any{
+		"bool":      "true",
+		"timestamp": "yesterday",
+		"date":      "2024-13-01",
+		"uuid":      "not-a-uuid",
+		"ip":        "1.2.3",
+	} {
+		db, err := lib.Open(lib.WithStorage("bolt"), lib.WithDir(t.TempDir()), lib.WithKey("g", "string"), lib.WithValue("v", kind))
+		if err != nil {
+			t.Fatalf("fail to open db: %v", err)
+		}
+		ch := make(chan map[string]any, 1)
+		ch <- map[string]any{"g": "a", "v": v}
+		close(ch)
+		err = db.Recv(ch)
+		if err == nil || !strings.Contains(err.Error(), "field v") {
+			t.Errorf("%v %q: got error %v, want field v rejected", kind, v, err)
+		}
+		db.Close()
+	}
+}
+
+func TestRecvKeepsRecords(t *testing.T) {
+	for _, explode := range []bool{false, true} {
+		opts := []lib.StorageOpt{lib.WithStorage("bolt"), lib.WithDir(t.TempDir()), lib.WithKey("g", "string"), lib.WithValue("v", "int64")}
+		if explode {
+			opts = append(opts, lib.WithExplode("v"))
+		}
+		db, err := lib.Open(opts...)
+		if err != nil {
+			t.Fatalf("fail to open db: %v", err)
+		}
+		records := []map[string]any{{"g": "a", "v": int64(1)}, {"g": "b", "v": int64(2)}}
+		if explode {
+			records = []map[string]any{{"g": "a", "v": []any{int64(1)}}, {"g": "b", "v": []any{int64(2)}}}
+		}
+		ch := make(chan map[string]any, len(records))
+		for _, record := range records {
+			ch <- record
+		}
+		close(ch)
+		if err := db.Recv(ch); err != nil {
+			t.Fatalf("fail to Recv: %v", err)
+		}
+		db.Close()
+		for _, record := range records {
+			if len(record) != 2 {
+				t.Errorf("explode %v: Recv changed the record of the caller to %v", explode, record)
+			}
+		}
+	}
+}
+
+func TestRecvTypedArray(t *testing.T) {
+	db, err := lib.Open(lib.WithStorage("bolt"), lib.WithDir(t.TempDir()), lib.WithSizePolicy(lib.SizeTruncate),
+		lib.WithKey("g", "string"), lib.WithValue("v", "array<int64>"))
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	defer db.Close()
+	ch := make(chan map[string]any, 2)
+	ch <- map[string]any{"g": "a", "v": []int64{1, 2}}
+	ch <- map[string]any{"g": "b", "v": make([]int64, 40000)}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+	if n := db.Usage().Oversized["v"]; n != 1 {
+		t.Errorf("got %d oversized values, want 1", n)
+	}
+
+	lengths := map[any]int{}
+	err = db.NewIterator(lib.WithPartialKey("g"), lib.WithAgg("v", "last(v)")).Iter(func(res map[string]any) error {
+		arr, _ := res["v"].([]any)
+		lengths[res["g"]] = len(arr)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("fail to iterate: %v", err)
+	}
+	if lengths["a"] != 2 || lengths["b"] != 32767 {
+		t.Errorf("got array lengths %v, want 2 and 32767", lengths)
+	}
+}
+
+func TestRecvTimestampRange(t *testing.T) {
+	for _, v := range []any{"2300-01-01T00:00:00Z", "1600-01-01T00:00:00Z", json.Number("1e10"), -1e10} {
+		db, err := lib.Open(lib.WithStorage("bolt"), lib.WithDir(t.TempDir()), lib.WithKey("g", "string"), lib.WithValue("v", "timestamp"))
+		if err != nil {
+			t.Fatalf("fail to open db: %v", err)
+		}
+		ch := make(chan map[string]any, 1)
+		ch <- map[string]any{"g": "a", "v": v}
+		close(ch)
+		if err := db.Recv(ch); err == nil || !strings.Contains(err.Error(), "timestamp range") {
+			t.Errorf("%v: got error %v, want it out of range", v, err)
+		}
+		db.Close()
+	}
+
+	schema, err := lib.NewSchema(lib.WithKey("ts", "timestamp"))
+	if err != nil {
+		t.Fatalf("fail to create schema: %v", err)
+	}
+	key, _, err := lib.EncodeRecord(schema, map[string]any{"ts": json.Number("1700000000.123456789")})
+	if err != nil {
+		t.Fatalf("fail to encode: %v", err)
+	}
+	record, err := lib.DecodeRecord(schema, key, nil)
+	if err != nil {
+		t.Fatalf("fail to decode: %v", err)
+	}
+	if got := record["ts"].(time.Time).UnixNano(); got != 1700000000123456789 {
+		t.Errorf("got %d nanoseconds, want 1700000000123456789", got)
+	}
+}
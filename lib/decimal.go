@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal is an exact decimal number, as decoded from the decimal kind.
+// It is emitted as a plain JSON number with all of its digits.
+type Decimal struct {
+	rat   *big.Rat
+	scale int
+}
+
+// ParseDecimal parses a decimal literal such as "-12.340".
+func ParseDecimal(s string) (Decimal, error) {
+	s = strings.TrimSpace(s)
+	rat, ok := new(big.Rat).SetString(s)
+	if !ok || strings.ContainsAny(s, "/eE") {
+		return Decimal{}, fmt.Errorf("%q is not a decimal", s)
+	}
+	scale := 0
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		scale = len(s) - i - 1
+	}
+	return Decimal{rat: rat, scale: scale}, nil
+}
+
+func toDecimal(val any) (Decimal, bool) {
+	switch v := val.(type) {
+	case Decimal:
+		return v, true
+	case *big.Int:
+		return Decimal{rat: new(big.Rat).SetInt(v)}, true
+	case string:
+		d, err := ParseDecimal(v)
+		return d, err == nil
+	case json.Number:
+		d, err := ParseDecimal(v.String())
+		return d, err == nil
+	case float32:
+		d, err := ParseDecimal(strconv.FormatFloat(float64(v), 'f', -1, 32))
+		return d, err == nil
+	case float64:
+		d, err := ParseDecimal(strconv.FormatFloat(v, 'f', -1, 64))
+		return d, err == nil
+	}
+	if i, ok := toInt64(val); ok {
+		return Decimal{rat: new(big.Rat).SetInt64(i)}, true
+	}
+	return Decimal{}, false
+}
+
+func (d Decimal) String() string {
+	if d.rat == nil {
+		return "0"
+	}
+	return d.rat.FloatString(d.scale)
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Add returns the exact sum of d and o, keeping the larger scale.
+func (d Decimal) Add(o Decimal) Decimal {
+	sum := new(big.Rat)
+	if d.rat != nil {
+		sum.Add(sum, d.rat)
+	}
+	if o.rat != nil {
+		sum.Add(sum, o.rat)
+	}
+	scale := d.scale
+	if o.scale > scale {
+		scale = o.scale
+	}
+	return Decimal{rat: sum, scale: scale}
+}
+
+// Cmp compares d and o numerically, returning -1, 0 or +1.
+func (d Decimal) Cmp(o Decimal) int {
+	a, b := d.rat, o.rat
+	if a == nil {
+		a = new(big.Rat)
+	}
+	if b == nil {
+		b = new(big.Rat)
+	}
+	return a.Cmp(b)
+}
+
+// Float64 returns the nearest float64 to d.
+func (d Decimal) Float64() float64 {
+	if d.rat == nil {
+		return 0
+	}
+	f, _ := d.rat.Float64()
+	return f
+}
+
+// Decimals are stored so that their bytes sort numerically: a sign byte, then
+// the exponent E and the significant digits D of 0.D × 10^E, followed by a zero
+// byte ending the digits and the scale, the digits after the point kept for
+// output. Exponent, digits and scale are complemented for negatives, so larger
+// magnitudes sort first there.
+const (
+	decimalNegative = 0
+	decimalZero     = 1
+	decimalPositive = 2
+)
+
+func toDecimalBinary(anyDecimal any) []byte {
+	d, _ := toDecimal(anyDecimal)
+	scale := make([]byte, 2)
+	binary.BigEndian.PutUint16(scale, uint16(d.scale))
+
+	text, negative := strings.CutPrefix(d.String(), "-")
+	intPart, frac, _ := strings.Cut(text, ".")
+	all := intPart + frac
+	digits := strings.TrimLeft(all, "0")
+	exp := len(intPart) - (len(all) - len(digits))
+	digits = strings.TrimRight(digits, "0")
+	if digits == "" {
+		return append([]byte{decimalZero}, scale...)
+	}
+
+	b := make([]byte, 5, 5+len(digits)+3)
+	binary.BigEndian.PutUint32(b[1:], uint32(int32(exp))^(1<<31))
+	b = append(b, digits...)
+	b = append(b, 0)
+	b = append(b, scale...)
+	if !negative {
+		b[0] = decimalPositive
+		return b
+	}
+	b[0] = decimalNegative
+	for i := 1; i < len(b); i++ {
+		b[i] = ^b[i]
+	}
+	return b
+}
+
+func fromDecimalBinary(b []byte) (any, int) {
+	if b[0] == decimalZero {
+		scale := int(binary.BigEndian.Uint16(b[1:3]))
+		return Decimal{rat: new(big.Rat), scale: scale}, 3
+	}
+	end := 5
+	for b[end] != 0 && b[end] != 0xff {
+		end++
+	}
+	step := end + 3
+	body := append([]byte(nil), b[1:step]...)
+	if b[0] == decimalNegative {
+		for i := range body {
+			body[i] = ^body[i]
+		}
+	}
+	exp := int(int32(binary.BigEndian.Uint32(body) ^ (1 << 31)))
+	digits := string(body[4 : end-1])
+	scale := int(binary.BigEndian.Uint16(body[end:]))
+
+	// the trimmed zeros come back as the digits up to the scale
+	unscaled, _ := new(big.Int).SetString(digits+strings.Repeat("0", exp+scale-len(digits)), 10)
+	if b[0] == decimalNegative {
+		unscaled.Neg(unscaled)
+	}
+	denom := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	return Decimal{rat: new(big.Rat).SetFrac(unscaled, denom), scale: scale}, step
+}
+
+func checkDecimal(v any) error {
+	d, ok := toDecimal(v)
+	if !ok {
+		return fmt.Errorf("%v (%T) is not a decimal", v, v)
+	}
+	if d.scale > math.MaxUint16 {
+		return fmt.Errorf("%v has more than %d digits after the point", v, math.MaxUint16)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package lib
+
+import "fmt"
+
+// Deleter is implemented by storages that can delete rows, see DeleteWhere.
+type Deleter interface {
+	// DeletePrefix deletes every row whose key starts with prefix.
+	DeletePrefix(prefix []byte) error
+}
+
+// DeleteWhere deletes the rows of one group, given by the values of leading key
+// fields like in Get, so stale groups can be dropped from a persistent database
+// instead of rebuilding it. {"day": "2024-01-01"} deletes every row of that day
+// whatever the key fields after day. At least one key field must be given.
+func (db *DbWrapper) DeleteWhere(key map[string]any) error {
+	if len(key) == 0 {
+		return fmt.Errorf("no key fields to delete by")
+	}
+	d, ok := db.db.(Deleter)
+	if !ok {
+		return fmt.Errorf("storage %v can not delete", db.store)
+	}
+	prefix, _, found, err := db.keyPrefix(key)
+	if err != nil || !found {
+		return err
+	}
+	if err := d.DeletePrefix(prefix); err != nil {
+		return fmt.Errorf("fail to delete %v", err)
+	}
+	return nil
+}
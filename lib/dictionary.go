@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// dictionary maps the strings of a dict_string field to small integer codes,
+// assigned in order of first appearance and stored as uvarints, so a column
+// with a few distinct values costs one byte per row instead of the string.
+// Codes do not follow string order, so dict_string keys group but do not sort.
+type dictionary struct {
+	mu      sync.RWMutex
+	codes   map[string]uint64
+	strings []string
+	dirty   bool
+}
+
+func newDictionary() *dictionary {
+	return &dictionary{codes: make(map[string]uint64)}
+}
+
+func (d *dictionary) encode(anyString any) []byte {
+	str, _ := anyString.(string)
+
+	d.mu.RLock()
+	code, ok := d.codes[str]
+	d.mu.RUnlock()
+	if !ok {
+		d.mu.Lock()
+		if code, ok = d.codes[str]; !ok {
+			code = uint64(len(d.strings))
+			d.codes[str] = code
+			d.strings = append(d.strings, str)
+			d.dirty = true
+		}
+		d.mu.Unlock()
+	}
+	return binary.AppendUvarint(nil, code)
+}
+
+func (d *dictionary) decode(b []byte) (any, int) {
+	code, n := binary.Uvarint(b)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if n <= 0 || code >= uint64(len(d.strings)) {
+		panic(fmt.Sprintf("unknown dictionary code %d", code))
+	}
+	return d.strings[code], n
+}
+
+func dictionaryFile(dir string) string {
+	return filepath.Join(dir, "dictionaries.json")
+}
+
+// loadDictionaries restores the dictionaries of all dict_string fields from dir.
+func (s *Schema) loadDictionaries(dir string) error {
+	data, err := os.ReadFile(dictionaryFile(dir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var stored map[string][]string
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("failed to unmarshal dictionaries: %w", err)
+	}
+	for _, f := range s.dictFields() {
+		f.dict.mu.Lock()
+		f.dict.strings = stored[f.name]
+		for code, str := range f.dict.strings {
+			f.dict.codes[str] = uint64(code)
+		}
+		f.dict.mu.Unlock()
+	}
+	return nil
+}
+
+// saveDictionaries writes the dictionaries to dir if any gained new strings,
+// keeping them marked as new when the write fails.
+func (s *Schema) saveDictionaries(dir string) error {
+	fields := s.dictFields()
+	stored := make(map[string][]string, len(fields))
+	dirty := false
+	for _, f := range fields {
+		f.dict.mu.Lock()
+		stored[f.name] = append([]string(nil), f.dict.strings...)
+		dirty = dirty || f.dict.dirty
+		f.dict.dirty = false
+		f.dict.mu.Unlock()
+	}
+	if !dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dictionaries: %w", err)
+	}
+	if err := writeFileAtomic(dictionaryFile(dir), data); err != nil {
+		for _, f := range fields {
+			f.dict.mu.Lock()
+			f.dict.dirty = true
+			f.dict.mu.Unlock()
+		}
+		return fmt.Errorf("failed to write dictionaries: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data through a temp file renamed over it,
+// so a crash leaves either the old or the new content, never a torn file that
+// would make the codes of every dict_string field unreadable.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (s *Schema) dictFields() []field {
+	var fields []field
+	for _, k := range s.keys {
+		if k.dict != nil {
+			fields = append(fields, k.field)
+		}
+	}
+	for _, v := range s.values {
+		if v.dict != nil {
+			fields = append(fields, v.field)
+		}
+	}
+	return fields
+}
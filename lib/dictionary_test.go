@@ -0,0 +1,40 @@
+package lib_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+	_ "github.com/kill-2/badmerger/storage/bolt"
+)
+
+func TestSaveDictionaries(t *testing.T) {
+	dir := t.TempDir()
+	for i, g := range []string{"a", "b"} {
+		db, err := lib.Open(lib.WithStorage("bolt"), lib.WithDir(dir), lib.WithKey("g", "dict_string"), lib.WithKey("i", "int32"))
+		if err != nil {
+			t.Fatalf("fail to open db: %v", err)
+		}
+		ch := make(chan map[string]any, 1)
+		ch <- map[string]any{"g": g, "i": int32(i)}
+		close(ch)
+		if err := db.Recv(ch); err != nil {
+			t.Fatalf("fail to Recv: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("fail to close db: %v", err)
+		}
+	}
+
+	if tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmps) > 0 {
+		t.Errorf("temp files left behind: %v", tmps)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "dictionaries.json"))
+	if err != nil {
+		t.Fatalf("fail to read dictionaries: %v", err)
+	}
+	if got := string(data); got != `{"g":["a","b"]}` {
+		t.Errorf("got dictionaries %v", got)
+	}
+}
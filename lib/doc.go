@@ -0,0 +1,31 @@
+// Package lib is the embeddable core of badmerger: it ingests records into a
+// sorted key-value storage and merges rows sharing a partial key on the way out.
+//
+// # Stable surface
+//
+// The following API is stable: it only changes in backward compatible ways,
+// and anything else may be reworked between releases.
+//
+//   - DB (DbWrapper): Open and its StorageOpt options, Recv, NewIterator, Usage,
+//     Close with its CloseOpt options, and Destroy.
+//   - Iterator (IterWrapper): Iter and the IteratorOpt options.
+//   - Schema: NewSchema, Keys, Values, EncodeRecord and DecodeRecord.
+//   - Storage and Inserter, implemented by storages and registered in Registration,
+//     plus GroupRows, the loop of their iterators, and the Merger methods storages
+//     call: RestoreKey, RestoreValue, NoValue, Prefetch, Seed, Bounds, Prefix and
+//     Emit, with PrefixEnd to turn a prefix into an upper bound. The optional
+//     interfaces storages may implement, such as Compacter or ReverseIterator, are
+//     not part of it yet.
+//   - Scan and ScanRange, which read the stored payloads of a Storage.
+//   - Kinds: the kind names accepted by WithKey and WithValue, RegisterKind,
+//     Encoder and Decoder.
+//   - Checkpoints: CreateCheckpoint, ListCheckpoints and CheckpointDir.
+//
+// The on-disk format of a database created by one release can be opened by later ones.
+package lib
+
+// DB is the stable name of a database handle, see Open.
+type DB = DbWrapper
+
+// Iterator is the stable name of a query over a DB, see DbWrapper.NewIterator.
+type Iterator = IterWrapper
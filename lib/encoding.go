@@ -1,15 +1,54 @@
 package lib
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"reflect"
+	"strings"
+	"time"
 )
 
-type encoder func(anyNum any) []byte
-type decoder func(b []byte) (any, int)
+// Encoder turns a field value into its binary form. Values arrive as decoded from
+// JSON input or as passed to Recv, and anything unexpected should still encode,
+// e.g. as a zero value. Encodings of key fields sort like their values.
+type Encoder func(v any) []byte
 
-func chooseEncoder(kind string) (encoder, decoder, error) {
+// Decoder restores a value from the start of b and reports how many bytes it used,
+// since the encoding of the next field follows directly.
+type Decoder func(b []byte) (any, int)
+
+type kindCodec struct {
+	enc Encoder
+	dec Decoder
+}
+
+var customKinds = make(map[string]kindCodec)
+
+// RegisterKind makes a custom kind usable in WithKey and WithValue, e.g. for
+// protobuf messages or fixed-point numbers. Like Registration it is meant to be
+// called from init, as databases recovered from disk need the same kinds.
+// It panics when the name is already taken by a builtin or registered kind.
+func RegisterKind(name string, enc Encoder, dec Decoder) {
+	if enc == nil || dec == nil {
+		panic("lib: RegisterKind with nil encoder or decoder for " + name)
+	}
+	if strings.ContainsAny(name, "/<>:") {
+		panic("lib: RegisterKind with reserved characters in " + name)
+	}
+	if _, _, err := chooseEncoder(name); err == nil || name == "dict_string" {
+		panic("lib: RegisterKind called twice or with a builtin name " + name)
+	}
+	customKinds[name] = kindCodec{enc, dec}
+}
+
+func chooseEncoder(kind string) (Encoder, Decoder, error) {
 	switch kind {
 	case "int8":
 		return toInt8Binary, fromInt8Binary, nil
@@ -19,15 +58,299 @@ func chooseEncoder(kind string) (encoder, decoder, error) {
 		return toInt32Binary, fromInt32Binary, nil
 	case "int64":
 		return toInt64Binary, fromInt64Binary, nil
+	case "float32":
+		return toFloat32Binary, fromFloat32Binary, nil
+	case "float64":
+		return toFloat64Binary, fromFloat64Binary, nil
+	case "bool":
+		return toBoolBinary, fromBoolBinary, nil
+	case "timestamp":
+		return toTimestampBinary, fromTimestampBinary, nil
+	case "date":
+		return toDateBinary, fromDateBinary, nil
+	case "uuid":
+		return toUUIDBinary, fromUUIDBinary, nil
+	case "ip":
+		return toIPBinary, fromIPBinary, nil
+	case "bytes":
+		return toBytesBinary, fromBytesBinary, nil
+	case "decimal":
+		return toDecimalBinary, fromDecimalBinary, nil
+	case "bigint":
+		return toBigIntBinary, fromBigIntBinary, nil
 	case "string":
 		return toStringBinary, fromStringBinary, nil
 	case "json":
 		return toJsonBinary, fromJsonBinary, nil
+	case "json_zstd":
+		return toJsonZstdBinary, fromJsonZstdBinary, nil
+	case "map":
+		return toJsonBinary, fromMapBinary, nil
+	}
+	if custom, ok := customKinds[kind]; ok {
+		return custom.enc, custom.dec, nil
+	}
+	if elem, ok := arrayElemKind(kind); ok {
+		toElem, fromElem, err := chooseEncoder(elem)
+		if err != nil {
+			return nil, nil, err
+		}
+		return toArrayBinary(toElem), fromArrayBinary(fromElem), nil
 	}
 
 	return nil, nil, fmt.Errorf("can not encode %s", kind)
 }
 
+// validator reports whether a value can be stored exactly in a kind.
+type validator func(v any) error
+
+func chooseValidator(kind string) validator {
+	switch kind {
+	case "int8":
+		return checkInt(math.MinInt8, math.MaxInt8)
+	case "int16":
+		return checkInt(math.MinInt16, math.MaxInt16)
+	case "int32":
+		return checkInt(math.MinInt32, math.MaxInt32)
+	case "int64":
+		return checkInt(math.MinInt64, math.MaxInt64)
+	case "float32", "float64":
+		return checkFloat
+	case "bool":
+		return checkBool
+	case "timestamp":
+		return checkTimestamp
+	case "date":
+		return checkDate
+	case "uuid":
+		return checkUUID
+	case "ip":
+		return checkIP
+	case "bytes":
+		return checkBytes
+	case "decimal":
+		return checkDecimal
+	case "bigint":
+		return checkBigInt
+	case "string", "dict_string":
+		return checkString
+	case "json":
+		return checkJson
+	case "json_zstd":
+		return checkJsonZstd
+	case "map":
+		return checkMap
+	}
+	if elem, ok := arrayElemKind(kind); ok {
+		return checkArray(chooseValidator(elem))
+	}
+	return nil
+}
+
+// arrayElemKind returns T for an array<T> kind.
+func arrayElemKind(kind string) (string, bool) {
+	if !strings.HasPrefix(kind, "array<") || !strings.HasSuffix(kind, ">") {
+		return "", false
+	}
+	return kind[len("array<") : len(kind)-1], true
+}
+
+func isIntKind(kind string) bool {
+	return kind == "int8" || kind == "int16" || kind == "int32" || kind == "int64"
+}
+
+// clampInt returns the integer of the given kind nearest to v.
+func clampInt(kind string, v any) int64 {
+	var lo, hi int64
+	switch kind {
+	case "int8":
+		lo, hi = math.MinInt8, math.MaxInt8
+	case "int16":
+		lo, hi = math.MinInt16, math.MaxInt16
+	case "int32":
+		lo, hi = math.MinInt32, math.MaxInt32
+	default:
+		lo, hi = math.MinInt64, math.MaxInt64
+	}
+
+	if i, ok := toInt64(v); ok {
+		switch {
+		case i < lo:
+			return lo
+		case i > hi:
+			return hi
+		}
+		return i
+	}
+	f := anyToFloat64(v)
+	switch {
+	case f <= float64(lo):
+		return lo
+	case f >= float64(hi):
+		return hi
+	}
+	return int64(f)
+}
+
+func checkInt(lo, hi int64) validator {
+	return func(v any) error {
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				v = i
+			} else if f, err := n.Float64(); err == nil {
+				v = f
+			}
+		}
+		if i, ok := toInt64(v); ok {
+			if i < lo || i > hi {
+				return fmt.Errorf("%v out of range [%d, %d]", v, lo, hi)
+			}
+			return nil
+		}
+		f, ok := toFloat64(v)
+		if !ok {
+			return fmt.Errorf("%v (%T) is not a number", v, v)
+		}
+		if f != math.Trunc(f) {
+			return fmt.Errorf("%v is not an integer", v)
+		}
+		// -lo is hi+1, which unlike hi is exact as a float64 even for int64
+		if f < float64(lo) || f >= -float64(lo) {
+			return fmt.Errorf("%v out of range [%d, %d]", v, lo, hi)
+		}
+		return nil
+	}
+}
+
+func checkFloat(v any) error {
+	if _, ok := toFloat64(v); ok {
+		return nil
+	}
+	if n, ok := v.(json.Number); ok {
+		_, err := n.Float64()
+		return err
+	}
+	return fmt.Errorf("%v (%T) is not a number", v, v)
+}
+
+func checkBool(v any) error {
+	if _, ok := v.(bool); !ok {
+		return fmt.Errorf("%v (%T) is not a bool", v, v)
+	}
+	return nil
+}
+
+func checkTimestamp(v any) error {
+	_, err := timestampNanos(v)
+	return err
+}
+
+func checkDate(v any) error {
+	switch t := v.(type) {
+	case time.Time:
+		return nil
+	case string:
+		if _, err := time.Parse(time.DateOnly, t); err == nil {
+			return nil
+		}
+		_, err := time.Parse(time.RFC3339Nano, t)
+		return err
+	}
+	return fmt.Errorf("%v (%T) is not a date", v, v)
+}
+
+func checkUUID(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("%v (%T) is not a uuid", v, v)
+	}
+	if !bytes.Equal(toUUIDBinary(str), make([]byte, 16)) || str == "00000000-0000-0000-0000-000000000000" {
+		return nil
+	}
+	return fmt.Errorf("%q is not a canonical uuid", str)
+}
+
+func checkIP(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("%v (%T) is not an ip", v, v)
+	}
+	addr, err := netip.ParseAddr(str)
+	if err != nil {
+		return err
+	}
+	if addr.Zone() != "" {
+		return fmt.Errorf("%q has a zone", str)
+	}
+	return nil
+}
+
+func checkBytes(v any) error {
+	var body []byte
+	switch b := v.(type) {
+	case []byte:
+		body = b
+	case string:
+		decoded, err := base64.StdEncoding.DecodeString(b)
+		if err != nil {
+			return err
+		}
+		body = decoded
+	default:
+		return fmt.Errorf("%v (%T) is not base64 bytes", v, v)
+	}
+	if len(body) > math.MaxInt16 {
+		return fmt.Errorf("bytes of %d exceeds %d", len(body), math.MaxInt16)
+	}
+	return nil
+}
+
+func checkString(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("%v (%T) is not a string", v, v)
+	}
+	if len(str) > math.MaxInt16 {
+		return fmt.Errorf("string of %d bytes exceeds %d", len(str), math.MaxInt16)
+	}
+	return nil
+}
+
+func checkJson(v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(body) > math.MaxInt16 {
+		return fmt.Errorf("json of %d bytes exceeds %d", len(body), math.MaxInt16)
+	}
+	return nil
+}
+
+func checkArray(checkElem validator) validator {
+	return func(v any) error {
+		arr, ok := toAnySlice(v)
+		if !ok {
+			return fmt.Errorf("%v (%T) is not an array", v, v)
+		}
+		if len(arr) > math.MaxInt16 {
+			return fmt.Errorf("array of %d elements exceeds %d", len(arr), math.MaxInt16)
+		}
+		for i, elem := range arr {
+			if elem == nil {
+				return fmt.Errorf("element %d is null", i)
+			}
+			if checkElem == nil {
+				continue
+			}
+			if err := checkElem(elem); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+		}
+		return nil
+	}
+}
+
 func toInt8Binary(anyNum any) []byte {
 	var num uint8
 	switch v := anyNum.(type) {
@@ -142,8 +465,13 @@ func toInt64Binary(anyNum any) []byte {
 	case int8:
 		num = uint64(v)
 	case json.Number:
-		f, _ := v.Float64()
-		num = uint64(f)
+		// integers beyond 2^53 lose precision as floats
+		if i, err := v.Int64(); err == nil {
+			num = uint64(i)
+		} else {
+			f, _ := v.Float64()
+			num = uint64(f)
+		}
 	default:
 		num = uint64(0)
 	}
@@ -156,6 +484,232 @@ func fromInt64Binary(b []byte) (any, int) {
 	return int64(binary.BigEndian.Uint64(b)), 8
 }
 
+func anyToFloat64(anyNum any) float64 {
+	switch v := anyNum.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int8:
+		return float64(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	}
+	return 0
+}
+
+// Floats are stored with the sign bit flipped for positives and all bits
+// flipped for negatives, so their big-endian bytes sort in numeric order.
+
+func toFloat32Binary(anyNum any) []byte {
+	bits := math.Float32bits(float32(anyToFloat64(anyNum)))
+	if bits&(1<<31) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 31
+	}
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, bits)
+	return b
+}
+
+func fromFloat32Binary(b []byte) (any, int) {
+	bits := binary.BigEndian.Uint32(b)
+	if bits&(1<<31) != 0 {
+		bits &^= 1 << 31
+	} else {
+		bits = ^bits
+	}
+	return math.Float32frombits(bits), 4
+}
+
+func toFloat64Binary(anyNum any) []byte {
+	bits := math.Float64bits(anyToFloat64(anyNum))
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, bits)
+	return b
+}
+
+func fromFloat64Binary(b []byte) (any, int) {
+	bits := binary.BigEndian.Uint64(b)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits), 8
+}
+
+func toBoolBinary(anyBool any) []byte {
+	b := make([]byte, 1)
+	if v, ok := anyBool.(bool); ok && v {
+		b[0] = 1
+	}
+	return b
+}
+
+func fromBoolBinary(b []byte) (any, int) {
+	return b[0] != 0, 1
+}
+
+// Timestamps are stored as nanoseconds since the epoch with the sign bit flipped,
+// so their big-endian bytes sort in time order. Input may be an RFC3339 string
+// or a number of seconds since the epoch.
+// timestampNanos returns the nanoseconds since the epoch of an RFC3339 string, a
+// time.Time or a number of seconds, which is scaled exactly rather than through
+// float64. Times that do not fit an int64, before 1677 or after 2262, fail.
+func timestampNanos(v any) (int64, error) {
+	switch t := v.(type) {
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return 0, err
+		}
+		return timeNanos(parsed)
+	case time.Time:
+		return timeNanos(t)
+	}
+	seconds, ok := new(big.Rat), false
+	if n, isNumber := v.(json.Number); isNumber {
+		// unlike toDecimal, big.Rat takes exponents such as 1.7e9
+		_, ok = seconds.SetString(n.String())
+	} else if d, isDecimal := toDecimal(v); isDecimal {
+		ok = true
+		if d.rat != nil {
+			seconds.Set(d.rat)
+		}
+	}
+	if !ok {
+		return 0, fmt.Errorf("%v (%T) is not a timestamp", v, v)
+	}
+	r := seconds.Mul(seconds, big.NewRat(int64(time.Second), 1))
+	nanos := new(big.Int).Quo(r.Num(), r.Denom())
+	if !nanos.IsInt64() {
+		return 0, fmt.Errorf("%v seconds is out of the timestamp range", v)
+	}
+	return nanos.Int64(), nil
+}
+
+var minTimestamp, maxTimestamp = time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64)
+
+func timeNanos(t time.Time) (int64, error) {
+	if t.Before(minTimestamp) || t.After(maxTimestamp) {
+		return 0, fmt.Errorf("%v is out of the timestamp range", t)
+	}
+	return t.UnixNano(), nil
+}
+
+func toTimestampBinary(anyTime any) []byte {
+	nanos, _ := timestampNanos(anyTime)
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(nanos)^(1<<63))
+	return b
+}
+
+func fromTimestampBinary(b []byte) (any, int) {
+	nanos := int64(binary.BigEndian.Uint64(b) ^ (1 << 63))
+	return time.Unix(0, nanos).UTC(), 8
+}
+
+// Dates are stored as days since the epoch with the sign bit flipped, so their
+// big-endian bytes sort in calendar order. Input may be a YYYY-MM-DD or RFC3339 string.
+func toDateBinary(anyDate any) []byte {
+	var t time.Time
+	switch v := anyDate.(type) {
+	case string:
+		if d, err := time.Parse(time.DateOnly, v); err == nil {
+			t = d
+		} else if d, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			t = d.UTC()
+		}
+	case time.Time:
+		t = v.UTC()
+	}
+	days := int32(t.Unix() / 86400)
+	if t.Unix() < 0 && t.Unix()%86400 != 0 {
+		days--
+	}
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(days)^(1<<31))
+	return b
+}
+
+func fromDateBinary(b []byte) (any, int) {
+	days := int32(binary.BigEndian.Uint32(b) ^ (1 << 31))
+	return time.Unix(int64(days)*86400, 0).UTC().Format(time.DateOnly), 4
+}
+
+// UUIDs are stored as their 16 raw bytes. Input must be a canonical
+// xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx string; anything else is stored as zeros.
+func toUUIDBinary(anyUUID any) []byte {
+	b := make([]byte, 16)
+	str, ok := anyUUID.(string)
+	if !ok || len(str) != 36 || str[8] != '-' || str[13] != '-' || str[18] != '-' || str[23] != '-' {
+		return b
+	}
+	digits := str[0:8] + str[9:13] + str[14:18] + str[19:23] + str[24:36]
+	if _, err := hex.Decode(b, []byte(digits)); err != nil {
+		return make([]byte, 16)
+	}
+	return b
+}
+
+func fromUUIDBinary(b []byte) (any, int) {
+	h := hex.EncodeToString(b[:16])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32], 16
+}
+
+// IPs are stored as 16 bytes, IPv4 addresses in their IPv4-mapped IPv6 form, so
+// addresses sort numerically with all IPv4 addresses together. Input is an IPv4
+// or IPv6 string, zone-less; anything else is stored as ::.
+func toIPBinary(anyIP any) []byte {
+	str, _ := anyIP.(string)
+	addr, err := netip.ParseAddr(str)
+	if err != nil || addr.Zone() != "" {
+		return make([]byte, 16)
+	}
+	b := addr.As16()
+	return b[:]
+}
+
+func fromIPBinary(b []byte) (any, int) {
+	return netip.AddrFrom16([16]byte(b[:16])).Unmap().String(), 16
+}
+
+// Bytes arrive as base64 strings in JSON input and are stored raw behind a length
+// header. They decode to []byte, which encoding/json emits as base64 again.
+func toBytesBinary(anyBytes any) []byte {
+	var body []byte
+	switch v := anyBytes.(type) {
+	case []byte:
+		body = v
+	case string:
+		body, _ = base64.StdEncoding.DecodeString(v)
+	}
+	header := toInt16Binary(len(body))
+	return append(header, body...)
+}
+
+func fromBytesBinary(b []byte) (any, int) {
+	l, _ := fromInt16Binary(b[:2])
+	limit := 2 + int(l.(int16))
+	return append([]byte(nil), b[2:limit]...), int(limit)
+}
+
 func toStringBinary(anyNum any) []byte {
 	var str string
 	switch v := anyNum.(type) {
@@ -171,7 +725,7 @@ func toStringBinary(anyNum any) []byte {
 
 func fromStringBinary(b []byte) (any, int) {
 	l, _ := fromInt16Binary(b[:2])
-	limit := 2 + l.(int16)
+	limit := 2 + int(l.(int16))
 	return string(b[2:limit]), int(limit)
 }
 
@@ -183,8 +737,51 @@ func toJsonBinary(anyValue any) []byte {
 
 func fromJsonBinary(b []byte) (any, int) {
 	l, _ := fromInt16Binary(b[:2])
-	limit := 2 + l.(int16)
-	var anyValue any
-	json.Unmarshal(b[2:limit], &anyValue)
-	return anyValue, int(limit)
+	limit := 2 + int(l.(int16))
+	return decodeJson(b[2:limit]), int(limit)
+}
+
+// Arrays are stored as an element count header followed by every element in
+// the encoding of the element kind, so array<int32> costs 4 bytes per element
+// instead of its JSON text. Input that is not an array is stored as empty.
+// toAnySlice returns the elements of an array value, given as []any like decoded
+// JSON or as a typed slice such as []int64.
+func toAnySlice(v any) ([]any, bool) {
+	if arr, ok := v.([]any); ok {
+		return arr, true
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil, false
+	}
+	arr := make([]any, rv.Len())
+	for i := range arr {
+		arr[i] = rv.Index(i).Interface()
+	}
+	return arr, true
+}
+
+func toArrayBinary(toElem Encoder) Encoder {
+	return func(anyArray any) []byte {
+		arr, _ := toAnySlice(anyArray)
+		b := toInt16Binary(len(arr))
+		for _, elem := range arr {
+			b = append(b, toElem(elem)...)
+		}
+		return b
+	}
+}
+
+func fromArrayBinary(fromElem Decoder) Decoder {
+	return func(b []byte) (any, int) {
+		l, _ := fromInt16Binary(b[:2])
+		arr := make([]any, l.(int16))
+		offset := 2
+		for i := range arr {
+			elem, n := fromElem(b[offset:])
+			arr[i] = elem
+			offset += n
+		}
+		return arr, offset
+	}
 }
@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// Encrypter is implemented by storages that encrypt what they write to disk
+// themselves with StorageConfig.EncryptionKey, like badger. Encrypted reports
+// whether they do for the opened database.
+type Encrypter interface {
+	Encrypted() bool
+}
+
+// WithEncryptionKey returns a configuration function that stores the database
+// encrypted at rest with an AES key of 16, 24 or 32 bytes. Storages implementing
+// Encrypter encrypt their files whole; for the others the value payloads are
+// encrypted with AES-GCM before Insert, while keys, and so dict_string
+// dictionaries, stay in clear for the storage to order them. A digest of the key is
+// kept with the schema, so reopening needs the same key and fails up front without
+// it. Existing databases created without a key can not be encrypted by reopening
+// them with one. Storages that store decoded rows, like duckdb, can not be encrypted.
+func WithEncryptionKey(key []byte) StorageOpt {
+	return func(w *DbWrapper) error {
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return fmt.Errorf("encryption key of %d bytes, want 16, 24 or 32", len(key))
+		}
+		w.settings.storage.EncryptionKey = key
+		return nil
+	}
+}
+
+// withKeyCheck is recovered from the schema of databases whose values lib encrypts.
+func withKeyCheck(check string) StorageOpt {
+	return func(w *DbWrapper) error {
+		w.keyCheck = check
+		return nil
+	}
+}
+
+// valueCipher encrypts value payloads with AES-GCM, each behind a random nonce.
+type valueCipher struct {
+	aead cipher.AEAD
+}
+
+func newValueCipher(key []byte) (*valueCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &valueCipher{aead: aead}, nil
+}
+
+// seal encrypts b, a nil cipher leaves it as it is.
+func (c *valueCipher) seal(b []byte) []byte {
+	if c == nil {
+		return b
+	}
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(b)+c.aead.Overhead())
+	rand.Read(nonce)
+	return c.aead.Seal(nonce, nonce, b, nil)
+}
+
+// open reverses seal, panicking on payloads that fail to authenticate like the
+// decoders of the fields do.
+func (c *valueCipher) open(b []byte) []byte {
+	if c == nil {
+		return b
+	}
+	n := c.aead.NonceSize()
+	if len(b) < n {
+		panic("fail to decrypt value: payload too short")
+	}
+	plain, err := c.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		panic(fmt.Sprintf("fail to decrypt value: %v", err))
+	}
+	return plain
+}
+
+// keyDigest identifies an encryption key without revealing it.
+func keyDigest(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("badmerger encryption key"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// setupEncryption checks the encryption key against the schema and, unless the
+// storage encrypts on its own, encrypts the value payloads.
+func (w *DbWrapper) setupEncryption() error {
+	key := w.settings.storage.EncryptionKey
+	if len(key) == 0 {
+		if w.keyCheck != "" {
+			return fmt.Errorf("database is encrypted, an encryption key is needed")
+		}
+		return nil
+	}
+	if e, ok := w.db.(Encrypter); ok && e.Encrypted() {
+		return nil
+	}
+	if w.keyCheck != "" && w.keyCheck != keyDigest(key) {
+		return fmt.Errorf("wrong encryption key")
+	}
+	if w.keyCheck == "" {
+		// the values already written are in clear and would no longer decrypt
+		if _, err := os.Stat(schemaFile(w.schemaDir())); err == nil {
+			return fmt.Errorf("database was created without encryption and can not be encrypted in place")
+		}
+	}
+	if _, ok := w.db.(SchemaReceiver); ok {
+		return fmt.Errorf("storage %v stores decoded rows and can not be encrypted", w.store)
+	}
+	c, err := newValueCipher(key)
+	if err != nil {
+		return fmt.Errorf("fail to set up encryption: %v", err)
+	}
+	w.cipher, w.keyCheck = c, keyDigest(key)
+	return nil
+}
@@ -0,0 +1,94 @@
+package lib_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+	_ "github.com/kill-2/badmerger/storage/bolt"
+)
+
+func TestEncryptExistingDatabase(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	open := func(opts ...lib.StorageOpt) (*lib.DB, error) {
+		return lib.Open(append([]lib.StorageOpt{lib.WithStorage("bolt"), lib.WithDir(dir)}, opts...)...)
+	}
+
+	db, err := open(lib.WithKey("g", "string"), lib.WithValue("v", "int64"))
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	ch := make(chan map[string]any, 1)
+	ch <- map[string]any{"g": "a", "v": int64(1)}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("fail to close db: %v", err)
+	}
+
+	if db, err := open(lib.WithEncryptionKey(key)); err == nil {
+		db.Close()
+		t.Fatalf("plaintext database opened with an encryption key")
+	} else if !strings.Contains(err.Error(), "created without encryption") {
+		t.Errorf("got error %v", err)
+	}
+
+	// the refused key leaves the database readable without it
+	db, err = open()
+	if err != nil {
+		t.Fatalf("fail to reopen db without key: %v", err)
+	}
+	defer db.Close()
+	var got []map[string]any
+	err = db.NewIterator(lib.WithPartialKey("g"), lib.WithAgg("v", "sum(v)")).Iter(func(res map[string]any) error {
+		got = append(got, res)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("fail to iterate: %v", err)
+	}
+	want := []map[string]any{{"g": "a", "v": int64(1)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestEncryptNewDatabase(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+
+	db, err := lib.Open(lib.WithStorage("bolt"), lib.WithDir(dir), lib.WithEncryptionKey(key),
+		lib.WithKey("g", "string"), lib.WithValue("v", "int64"))
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	ch := make(chan map[string]any, 1)
+	ch <- map[string]any{"g": "a", "v": int64(1)}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+	db.Close()
+
+	if db, err := lib.Open(lib.WithDir(dir)); err == nil {
+		db.Close()
+		t.Errorf("encrypted database opened without its key")
+	}
+	db, err = lib.Open(lib.WithDir(dir), lib.WithEncryptionKey(key))
+	if err != nil {
+		t.Fatalf("fail to reopen db with its key: %v", err)
+	}
+	defer db.Close()
+	res, err := db.Get(map[string]any{"g": "a"}, lib.WithAgg("v", "sum(v)"))
+	if err != nil {
+		t.Fatalf("fail to get: %v", err)
+	}
+	if res["v"] != int64(1) {
+		t.Errorf("got %v, want 1", res["v"])
+	}
+}
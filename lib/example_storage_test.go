@@ -0,0 +1,121 @@
+package lib_test
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+func init() {
+	lib.Registration["sorted"] = func(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
+		return &sorted{}, nil
+	}
+}
+
+type row struct {
+	key, value []byte
+}
+
+type sorted struct {
+	mu   sync.Mutex
+	rows []row
+}
+
+func (s *sorted) NewInserter() lib.Inserter {
+	return &inserter{s: s}
+}
+
+func (s *sorted) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// GroupRows groups the rows by key and emits them, next only hands them out
+	// in key order
+	i := 0
+	return lib.GroupRows(m, func() ([]byte, []byte, bool) {
+		if i == len(s.rows) {
+			return nil, nil, false
+		}
+		i++
+		return s.rows[i-1].key, s.rows[i-1].value, true
+	}, fn)
+}
+
+func (s *sorted) Close() error {
+	return nil
+}
+
+type inserter struct {
+	s     *sorted
+	batch []row
+}
+
+func (ins *inserter) Insert(keyPayload, valuePayload []byte) error {
+	ins.batch = append(ins.batch, row{
+		key:   append([]byte(nil), keyPayload...),
+		value: append([]byte(nil), valuePayload...),
+	})
+	return nil
+}
+
+func (ins *inserter) Commit() error {
+	s := ins.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range ins.batch {
+		i := sort.Search(len(s.rows), func(i int) bool { return bytes.Compare(s.rows[i].key, r.key) >= 0 })
+		if i < len(s.rows) && bytes.Equal(s.rows[i].key, r.key) {
+			s.rows[i] = r
+			continue
+		}
+		s.rows = append(s.rows, row{})
+		copy(s.rows[i+1:], s.rows[i:])
+		s.rows[i] = r
+	}
+	ins.batch = nil
+	return nil
+}
+
+// A custom storage is plugged in by registering it, here an in-memory sorted slice
+// registered as "sorted". A storage only has to keep key payloads in byte order and
+// hand the rows to GroupRows in that order.
+func Example_storage() {
+	db, err := lib.Open(
+		lib.WithStorage("sorted"),
+		lib.WithKey("word", "string"),
+		lib.WithKey("_i_", "int32"),
+	)
+	if err != nil {
+		fmt.Println("fail to open db", err)
+		return
+	}
+	defer db.Destroy()
+	defer db.Close()
+
+	ch := make(chan map[string]any)
+	go func() {
+		defer close(ch)
+		for i, word := range []string{"merge", "sort", "merge", "group", "sort", "merge"} {
+			ch <- map[string]any{"word": word, "_i_": int32(i)}
+		}
+	}()
+	if err := db.Recv(ch); err != nil {
+		fmt.Println("fail to Recv", err)
+		return
+	}
+
+	err = db.NewIterator(lib.WithPartialKey("word"), lib.WithAgg("n", "count()")).Iter(func(res map[string]any) error {
+		fmt.Println(res)
+		return nil
+	})
+	if err != nil {
+		fmt.Println("fail to iterate", err)
+	}
+	// Output:
+	// map[n:2 word:sort]
+	// map[n:1 word:group]
+	// map[n:3 word:merge]
+}
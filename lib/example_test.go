@@ -0,0 +1,148 @@
+package lib_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/kill-2/badmerger/lib"
+	_ "github.com/kill-2/badmerger/storage/bolt"
+)
+
+// A database is written once, e.g. by a batch job, and queried later by another
+// program, which recovers the schema from the directory.
+func Example() {
+	dir, err := os.MkdirTemp("", "visits")
+	if err != nil {
+		fmt.Println("fail to create dir", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := lib.Open(
+		lib.WithStorage("bolt"),
+		lib.WithDir(dir),
+		lib.WithKey("page", "string"),
+		lib.WithKey("_i_", "int32"),
+		lib.WithValue("user", "string"),
+		lib.WithValue("ms", "int32"),
+	)
+	if err != nil {
+		fmt.Println("fail to open db", err)
+		return
+	}
+	visits := []struct {
+		page, user string
+		ms         int
+	}{
+		{"/", "ann", 120},
+		{"/docs", "bob", 340},
+		{"/", "bob", 80},
+		{"/docs", "ann", 200},
+		{"/", "cat", 95},
+	}
+	ch := make(chan map[string]any)
+	go func() {
+		defer close(ch)
+		for i, v := range visits {
+			record := lib.NewRecord()
+			record["page"], record["user"], record["ms"] = v.page, v.user, v.ms
+			record["_i_"] = int32(i)
+			ch <- record
+		}
+	}()
+	if err := db.Recv(ch); err != nil {
+		fmt.Println("fail to Recv", err)
+		db.Close()
+		return
+	}
+	if err := db.Close(lib.WithFlushAndCompact()); err != nil {
+		fmt.Println("fail to close db", err)
+		return
+	}
+	fmt.Printf("wrote %d records\n", db.Usage().RecordsWritten)
+
+	db, err = lib.Open(lib.WithDir(dir))
+	if err != nil {
+		fmt.Println("fail to reopen db", err)
+		return
+	}
+	defer db.Close()
+	it := db.NewIterator(
+		lib.WithPartialKey("page"),
+		lib.WithAgg("visits", "count()"),
+		lib.WithAgg("users", "count_distinct(user)"),
+		lib.WithAgg("slowest", "max(ms)"),
+	)
+	err = it.Iter(func(res map[string]any) error {
+		b, err := json.Marshal(res)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	})
+	if err != nil {
+		fmt.Println("fail to iterate", err)
+	}
+	// Output:
+	// wrote 5 records
+	// {"page":"/","slowest":120,"users":3,"visits":3}
+	// {"page":"/docs","slowest":340,"users":2,"visits":2}
+}
+
+// Aggregations are composed from the builtin ones with arithmetic, e.g. a rate as
+// a ratio of sums, and anything beyond that is computed from their results in the
+// Iter callback.
+func ExampleWithAgg() {
+	db, err := lib.Open(
+		lib.WithStorage("bolt"),
+		lib.WithKey("host", "string"),
+		lib.WithKey("_i_", "int32"),
+		lib.WithValue("errors", "int32"),
+		lib.WithValue("requests", "int32"),
+	)
+	if err != nil {
+		fmt.Println("fail to open db", err)
+		return
+	}
+	defer db.Destroy()
+	defer db.Close()
+
+	samples := []map[string]any{
+		{"host": "a", "errors": 1, "requests": 100},
+		{"host": "a", "errors": 4, "requests": 100},
+		{"host": "b", "errors": 0, "requests": 50},
+		{"host": "b", "errors": 30, "requests": 50},
+	}
+	ch := make(chan map[string]any, len(samples))
+	for i, s := range samples {
+		s["_i_"] = int32(i)
+		ch <- s
+	}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		fmt.Println("fail to Recv", err)
+		return
+	}
+
+	it := db.NewIterator(
+		lib.WithPartialKey("host"),
+		lib.WithAgg("error_rate", "sum(errors)/sum(requests)"),
+		lib.WithAgg("worst", "max(errors)"),
+		lib.WithAgg("samples", "count()"),
+	)
+	err = it.Iter(func(res map[string]any) error {
+		// a derived aggregate: flag hosts whose error rate is above 10%
+		rate, _ := res["error_rate"].(float64)
+		res["unhealthy"] = rate > 0.1
+		fmt.Println(res)
+		return nil
+	})
+	if err != nil {
+		fmt.Println("fail to iterate", err)
+	}
+	// Output:
+	// map[error_rate:0.025 host:a samples:2 unhealthy:false worst:4]
+	// map[error_rate:0.3 host:b samples:2 unhealthy:true worst:30]
+}
@@ -0,0 +1,119 @@
+package lib
+
+import "fmt"
+
+// explodeIndex names the key holding the position of an exploded element.
+func explodeIndex(name string) string {
+	return "_" + name + "_i_"
+}
+
+// WithExplode makes an array in the input field name, declared before by WithKey or
+// WithValue with the kind of its elements, ingest as one row per element, e.g. to
+// tally the tags of records without flattening them first. The position of the
+// element is kept in an int32 key after the keys declared so far, named like
+// _tags_i_, so rows of one record never overwrite each other. Records with an empty
+// array add no rows; a missing field, null or single value is ingested as it is.
+// Several exploded fields ingest every combination of their elements.
+func WithExplode(name string) StorageOpt {
+	return func(w *DbWrapper) error {
+		f := w.field(name)
+		if f == nil {
+			return fmt.Errorf("no field %v to explode", name)
+		}
+		f.explode = true
+		for _, k := range w.keys {
+			if k.name == explodeIndex(name) {
+				// recovered with the schema
+				return nil
+			}
+		}
+		index, err := newField(explodeIndex(name), "int32")
+		if err != nil {
+			return err
+		}
+		w.keys = append(w.keys, key{field: index})
+		return nil
+	}
+}
+
+// field finds a key or value field by name.
+func (s *Schema) field(name string) *field {
+	for i := range s.keys {
+		if s.keys[i].name == name {
+			return &s.keys[i].field
+		}
+	}
+	for i := range s.values {
+		if s.values[i].name == name {
+			return &s.values[i].field
+		}
+	}
+	return nil
+}
+
+// exploded lists the exploded fields.
+func (s *Schema) exploded() []field {
+	var fields []field
+	for _, k := range s.keys {
+		if k.explode {
+			fields = append(fields, k.field)
+		}
+	}
+	for _, v := range s.values {
+		if v.explode {
+			fields = append(fields, v.field)
+		}
+	}
+	return fields
+}
+
+// explode returns the rows of a record, one per combination of the elements of the
+// exploded fields, as fresh records. The record itself is left alone.
+func explode(record map[string]any, fields []field) []map[string]any {
+	rows := []map[string]any{copyRecord(record, nil)}
+	for _, f := range fields {
+		var next []map[string]any
+		for _, row := range rows {
+			v, ok := f.lookup(row)
+			elems, isArray := v.([]any)
+			if !ok || !isArray {
+				row[explodeIndex(f.name)] = 0
+				next = append(next, row)
+				continue
+			}
+			for i, elem := range elems {
+				r := copyRecord(row, f.path)
+				f.set(r, elem)
+				r[explodeIndex(f.name)] = i
+				next = append(next, r)
+			}
+			releaseRecord(row)
+		}
+		rows = next
+	}
+	return rows
+}
+
+// copyRecord copies record into a new record, along with the nested objects on path
+// so that setting the field at path leaves record unchanged.
+func copyRecord(record map[string]any, path []string) map[string]any {
+	c := NewRecord()
+	for k, v := range record {
+		c[k] = v
+	}
+	cur := c
+	for i := 0; i+1 < len(path); i++ {
+		part := path[i]
+		obj, ok := cur[part].(map[string]any)
+		if !ok {
+			break
+		}
+		copied := make(map[string]any, len(obj))
+		for k, v := range obj {
+			copied[k] = v
+		}
+		cur[part] = copied
+		cur = copied
+	}
+	return c
+}
@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Streamer is implemented by storages that can read rows faster than Iterate when
+// their order does not matter, e.g. with several goroutines, see Export.
+type Streamer interface {
+	// Stream calls fn with the key and value payloads of every row whose key starts
+	// with prefix, in no particular order. fn is not called concurrently and must
+	// copy the payloads it keeps.
+	Stream(prefix []byte, fn func(keyPayload, valuePayload []byte) error) error
+}
+
+// Export calls fn with every row of the groups of key, given like in Get, or of the
+// whole database when key is empty, decoded into records like DecodeRecord, e.g. to
+// extract a customer's rows in bulk. Rows come in no particular order: storages
+// implementing Streamer read them at disk speed, others are scanned in key order.
+func (db *DbWrapper) Export(key map[string]any, fn func(record map[string]any) error) error {
+	prefix, _, found, err := db.keyPrefix(key)
+	if err != nil || !found {
+		return err
+	}
+	decode := func(keyPayload, valuePayload []byte) error {
+		record, err := DecodeRecord(&db.Schema, keyPayload, valuePayload)
+		if err != nil {
+			return err
+		}
+		return fn(record)
+	}
+	if s, ok := db.db.(Streamer); ok {
+		if err := s.Stream(prefix, decode); err != nil {
+			return fmt.Errorf("fail to export %v", err)
+		}
+		return nil
+	}
+	return Scan(db.db, func(keyPayload, valuePayload []byte) error {
+		if !bytes.HasPrefix(keyPayload, prefix) {
+			return nil
+		}
+		return decode(keyPayload, valuePayload)
+	})
+}
@@ -0,0 +1,263 @@
+package lib
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// parseAggregation turns an aggregation spec into an aggregator. A spec is
+// either a single aggregator call such as "sum(bytes)" or an arithmetic
+// expression combining calls and numeric literals with + - * / and
+// parentheses, e.g. "sum(errors)/count(requests)".
+func parseAggregation(op string) (aggregator, error) {
+	p := &exprParser{src: op}
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at %d in %q", p.src[p.pos], p.pos, op)
+	}
+	return node, nil
+}
+
+type exprParser struct {
+	src string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *exprParser) parseExpr() (aggregator, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		c := p.peek()
+		if c != '+' && c != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: c, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseTerm() (aggregator, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		c := p.peek()
+		if c != '*' && c != '/' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: c, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseFactor() (aggregator, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of %q", p.src)
+	case c == '(':
+		p.pos++
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' in %q", p.src)
+		}
+		p.pos++
+		return node, nil
+	case c == '-':
+		p.pos++
+		node, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr{op: '-', left: constant{value: int64(0)}, right: node}, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	case c == '_' || unicode.IsLetter(rune(c)):
+		return p.parseCall()
+	}
+	return nil, fmt.Errorf("unexpected %q at %d in %q", c, p.pos, p.src)
+}
+
+func (p *exprParser) parseNumber() (aggregator, error) {
+	start := p.pos
+	for p.pos < len(p.src) && (p.src[p.pos] == '.' || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+		p.pos++
+	}
+	text := p.src[start:p.pos]
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return constant{value: i}, nil
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad number %q in %q", text, p.src)
+	}
+	return constant{value: f}, nil
+}
+
+func (p *exprParser) parseCall() (aggregator, error) {
+	start := p.pos
+	for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+		p.pos++
+	}
+	if p.pos >= len(p.src) || p.src[p.pos] != '(' {
+		return nil, fmt.Errorf("expect '(' after %q in %q", p.src[start:p.pos], p.src)
+	}
+	depth := 0
+	for ; p.pos < len(p.src); p.pos++ {
+		if p.src[p.pos] == '(' {
+			depth++
+		} else if p.src[p.pos] == ')' {
+			depth--
+			if depth == 0 {
+				p.pos++
+				break
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("missing ')' in %q", p.src)
+	}
+	call := strings.TrimSpace(p.src[start:p.pos])
+	return chooseAggregator(call)
+}
+
+type constant struct {
+	value any
+}
+
+func (a constant) on(collection []map[string]any) any {
+	return a.value
+}
+
+func (a constant) kind(kinds map[string]string) string {
+	switch a.value.(type) {
+	case int64:
+		return "int64"
+	}
+	return "float64"
+}
+
+type binaryExpr struct {
+	op    byte
+	left  aggregator
+	right aggregator
+	mode  NumericMode
+}
+
+func (a binaryExpr) on(collection []map[string]any) any {
+	l, r := a.left.on(collection), a.right.on(collection)
+	if a.mode != NumericAuto {
+		return arithmeticIn(a.mode, a.op, l, r)
+	}
+	li, lIsInt := toInt64(l)
+	ri, rIsInt := toInt64(r)
+	if lIsInt && rIsInt && a.op != '/' {
+		switch a.op {
+		case '+':
+			return li + ri
+		case '-':
+			return li - ri
+		case '*':
+			return li * ri
+		}
+	}
+
+	lf, lok := toFloat64(l)
+	rf, rok := toFloat64(r)
+	if !lok || !rok {
+		return nil
+	}
+	switch a.op {
+	case '+':
+		return lf + rf
+	case '-':
+		return lf - rf
+	case '*':
+		return lf * rf
+	case '/':
+		if rf == 0 {
+			return nil
+		}
+		return lf / rf
+	}
+	return nil
+}
+
+func (a binaryExpr) kind(kinds map[string]string) string {
+	if kind := modeKind(a.mode); kind != "" {
+		return kind
+	}
+	if a.op != '/' && a.left.kind(kinds) == "int64" && a.right.kind(kinds) == "int64" {
+		return "int64"
+	}
+	return "float64"
+}
+
+func toInt64(val any) (int64, bool) {
+	switch v := val.(type) {
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func toFloat64(val any) (float64, bool) {
+	if i, ok := toInt64(val); ok {
+		return float64(i), true
+	}
+	switch v := val.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case Decimal:
+		return v.Float64(), true
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return f, true
+	}
+	return 0, false
+}
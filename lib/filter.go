@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// filteredKey marks the value maps of rows dropped by WithFilter until Emit
+// removes them.
+const filteredKey = "_filtered_"
+
+var filteredRow = map[string]any{filteredKey: true}
+
+// WithFilter creates an iterator option that only aggregates the rows whose field
+// compares to value with op, one of = != < <= > >=, e.g. WithFilter("status", "!=",
+// "ok"), like a WHERE clause. field is a key or value field of the schema. Several
+// filters must all hold. Numbers compare by value whatever their kind, timestamps
+// also to RFC 3339 strings, and a nil value matches missing fields with = and
+// others with !=. Rows whose field can not be compared to value only pass !=.
+// Groups without any row left are not emitted. Values are compared as stored,
+// before WithValueTransform. Filters can not be combined with spill.
+func WithFilter(field, op string, value any) IteratorOpt {
+	return func(itW *IterWrapper) {
+		c, err := newCondition(field, op, value)
+		if err != nil {
+			itW.optErr = fmt.Errorf("bad filter: %v", err)
+			return
+		}
+		for i, k := range itW.keys {
+			if k.name == field {
+				if i >= len(itW.filterKeys) {
+					itW.filterKeys = itW.keys[:i+1]
+				}
+				itW.keyFilters = append(itW.keyFilters, c)
+				return
+			}
+		}
+		for _, v := range itW.values {
+			if v.name == field {
+				itW.valueFilters = append(itW.valueFilters, c)
+				return
+			}
+		}
+		itW.optErr = fmt.Errorf("bad filter: no field %v", field)
+	}
+}
+
+// ParseCondition splits a condition like status!=ok or bytes>=1024 into field,
+// operator and value, for WithFilter and WithHaving. The value is read as JSON
+// where it parses, e.g. 42, null or "42", and as a string otherwise.
+func ParseCondition(spec string) (field, op string, value any, err error) {
+	i := strings.IndexAny(spec, "!=<>")
+	if i <= 0 {
+		return "", "", nil, fmt.Errorf("condition %q has no field and operator", spec)
+	}
+	j := i + 1
+	if j < len(spec) && spec[j] == '=' {
+		j++
+	}
+	field, op, raw := strings.TrimSpace(spec[:i]), spec[i:j], strings.TrimSpace(spec[j:])
+	d := json.NewDecoder(strings.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&value); err != nil || d.More() {
+		value = raw
+	}
+	return field, op, value, nil
+}
+
+// condition compares a field to a value.
+type condition struct {
+	field string
+	op    string
+	value any
+	// ts is value as a timestamp, to compare timestamp fields to strings
+	ts *time.Time
+}
+
+func newCondition(field, op string, value any) (condition, error) {
+	switch op {
+	case "=", "==":
+		op = "="
+	case "!=", "<", "<=", ">", ">=":
+		if value == nil && op != "!=" {
+			return condition{}, fmt.Errorf("null only compares with = and !=")
+		}
+	default:
+		return condition{}, fmt.Errorf("unknown operator %q", op)
+	}
+	c := condition{field: field, op: op, value: fromJsonNumbers(value)}
+	if s, ok := value.(string); ok {
+		if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			c.ts = &ts
+		}
+	}
+	return c, nil
+}
+
+// matches reports whether v, the value of the field, satisfies the condition.
+func (c condition) matches(v any) bool {
+	if v == nil || c.value == nil {
+		switch c.op {
+		case "=":
+			return v == nil && c.value == nil
+		case "!=":
+			return v != nil || c.value != nil
+		}
+		return false
+	}
+	value := c.value
+	if _, ok := v.(time.Time); ok && c.ts != nil {
+		value = *c.ts
+	}
+	cmp, ok := compareValues(v, value)
+	if !ok {
+		switch c.op {
+		case "=":
+			return reflect.DeepEqual(v, value)
+		case "!=":
+			return !reflect.DeepEqual(v, value)
+		}
+		return false
+	}
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+func matchAll(conditions []condition, row map[string]any) bool {
+	for _, c := range conditions {
+		if !c.matches(row[c.field]) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchKey decodes the key fields of the filters and reports whether the row of
+// keyBytes passes them.
+func (m *Merger) matchKey(keyBytes []byte) bool {
+	keyMap := make(map[string]any, len(m.filterKeys))
+	offset := 0
+	for _, k := range m.filterKeys {
+		v, step := k.decode(keyBytes[offset:])
+		keyMap[k.name] = v
+		offset += step
+	}
+	return matchAll(m.keyFilters, keyMap)
+}
+
+func (m *Merger) filtered() bool {
+	return len(m.keyFilters) > 0 || len(m.valueFilters) > 0
+}
+
+// dropFiltered removes the rows dropped by the filters from valueValues in place.
+func dropFiltered(valueValues []map[string]any) []map[string]any {
+	kept := valueValues[:0]
+	for _, v := range valueValues {
+		if _, ok := v[filteredKey]; !ok {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Value formats. Format 1 stores string, bytes, json and array values behind 16-bit
+// length headers, so they hold at most 32767 bytes or elements. Format 2 widens the
+// headers of value fields to 32 bits. Key fields keep 16-bit headers in both, as keys
+// are capped far below that by WithMaxKeySize.
+const (
+	Format1 = 1
+	Format2 = 2
+)
+
+// WithFormat returns a configuration function that sets the value format of a new
+// database. The format is part of the stored schema, so databases reopened from their
+// dir keep the format they were created with.
+func WithFormat(format int) StorageOpt {
+	return func(w *DbWrapper) error {
+		if format != Format1 && format != Format2 {
+			return fmt.Errorf("unknown format %d", format)
+		}
+		w.format = format
+		return nil
+	}
+}
+
+// applyFormat switches the value fields to the encoders of the format. It runs once
+// all options are applied, since WithFormat may follow WithValue.
+func (s *Schema) applyFormat() {
+	if s.format != Format2 {
+		return
+	}
+	for i := range s.values {
+		if enc, dec, ok := chooseWideEncoder(s.values[i].kind); ok {
+			s.values[i].encode, s.values[i].decode = enc, dec
+		}
+	}
+}
+
+// chooseWideEncoder returns the format 2 codec of kinds with a length header.
+func chooseWideEncoder(kind string) (Encoder, Decoder, bool) {
+	switch kind {
+	case "bytes":
+		return toWideBytesBinary, fromWideBytesBinary, true
+	case "string":
+		return toWideStringBinary, fromWideStringBinary, true
+	case "json":
+		return toWideJsonBinary, fromWideJsonBinary, true
+	case "map":
+		return toWideJsonBinary, fromWideMapBinary, true
+	}
+	elem, ok := arrayElemKind(kind)
+	if !ok {
+		return nil, nil, false
+	}
+	toElem, fromElem, ok := chooseWideEncoder(elem)
+	if !ok {
+		var err error
+		if toElem, fromElem, err = chooseEncoder(elem); err != nil {
+			return nil, nil, false
+		}
+	}
+	return toWideArrayBinary(toElem), fromWideArrayBinary(fromElem), true
+}
+
+// headerLimit is the longest value the length header of a kind takes in the format.
+func headerLimit(format int, isValue bool) int {
+	if format == Format2 && isValue {
+		return math.MaxInt32
+	}
+	return math.MaxInt16
+}
+
+func wideHeader(n int) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+func fromWideHeader(b []byte) int {
+	return int(binary.BigEndian.Uint32(b[:4]))
+}
+
+func toWideBytesBinary(anyBytes any) []byte {
+	var body []byte
+	switch v := anyBytes.(type) {
+	case []byte:
+		body = v
+	case string:
+		body, _ = base64.StdEncoding.DecodeString(v)
+	}
+	return append(wideHeader(len(body)), body...)
+}
+
+func fromWideBytesBinary(b []byte) (any, int) {
+	limit := 4 + fromWideHeader(b)
+	return append([]byte(nil), b[4:limit]...), limit
+}
+
+func toWideStringBinary(anyStr any) []byte {
+	str, _ := anyStr.(string)
+	return append(wideHeader(len(str)), str...)
+}
+
+func fromWideStringBinary(b []byte) (any, int) {
+	limit := 4 + fromWideHeader(b)
+	return string(b[4:limit]), limit
+}
+
+func toWideJsonBinary(anyValue any) []byte {
+	body, _ := json.Marshal(anyValue)
+	return append(wideHeader(len(body)), body...)
+}
+
+func fromWideJsonBinary(b []byte) (any, int) {
+	limit := 4 + fromWideHeader(b)
+	return decodeJson(b[4:limit]), limit
+}
+
+func toWideArrayBinary(toElem Encoder) Encoder {
+	return func(anyArray any) []byte {
+		arr, _ := toAnySlice(anyArray)
+		b := wideHeader(len(arr))
+		for _, elem := range arr {
+			b = append(b, toElem(elem)...)
+		}
+		return b
+	}
+}
+
+func fromWideArrayBinary(fromElem Decoder) Decoder {
+	return func(b []byte) (any, int) {
+		arr := make([]any, fromWideHeader(b))
+		offset := 4
+		for i := range arr {
+			elem, n := fromElem(b[offset:])
+			arr[i] = elem
+			offset += n
+		}
+		return arr, offset
+	}
+}
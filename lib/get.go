@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Get merges the group of one key, given by the values of leading key fields, with
+// the aggregations of opts, e.g. WithAgg, and returns the merged map, or nil when no
+// row has the key. Only the given key fields are grouped by, so {"user": 42} merges
+// every row of user 42 whatever the key fields after user. Storages seek to the
+// group where they can, see Merger.Bounds, others scan and skip the other groups.
+func (db *DbWrapper) Get(key map[string]any, opts ...IteratorOpt) (map[string]any, error) {
+	prefix, fields, found, err := db.keyPrefix(key)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	itW := db.NewIterator(opts...)
+	itW.partialKeys = fields
+	itW.lower, itW.upper = prefix, PrefixEnd(prefix)
+	var res map[string]any
+	err = itW.Iter(func(merged map[string]any) error {
+		res = merged
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// keyPrefix encodes the values of key, which must name the leading key fields, into
+// the prefix of the stored keys of its group. It reports false for dict_string
+// values no row was written with.
+func (s *Schema) keyPrefix(key map[string]any) ([]byte, []key, bool, error) {
+	if len(key) > len(s.keys) {
+		return nil, nil, false, fmt.Errorf("got %d key fields, the schema has %d", len(key), len(s.keys))
+	}
+	fields := s.keys[:len(key)]
+	var prefix []byte
+	for _, f := range fields {
+		v, ok := key[f.name]
+		if !ok {
+			return nil, nil, false, fmt.Errorf("missing key field %v, key fields must be given in schema order", f.name)
+		}
+		if f.bucket != nil && v != nil {
+			v = f.bucket.apply(v)
+		}
+		if err := f.validate(v); err != nil {
+			return nil, nil, false, err
+		}
+		if f.dict != nil {
+			code, ok := f.dict.lookup(v)
+			if !ok {
+				return nil, nil, false, nil
+			}
+			prefix = append(prefix, code...)
+			continue
+		}
+		prefix = append(prefix, f.encode(v)...)
+	}
+	return prefix, fields, true, nil
+}
+
+// lookup encodes a string known to the dictionary without adding new ones.
+func (d *dictionary) lookup(anyString any) ([]byte, bool) {
+	str, _ := anyString.(string)
+	d.mu.RLock()
+	code, ok := d.codes[str]
+	d.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return binary.AppendUvarint(nil, code), true
+}
+
+// PrefixEnd returns the smallest key after every key starting with prefix, or nil
+// when there is none.
+func PrefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Bounds returns the range of stored keys the iteration is limited to, from lower up
+// to but excluding upper, either nil when open. Storage iterators should seek to
+// lower and stop at upper where they can; rows outside are skipped by the merger
+// anyway, so storages that can not seek stay correct. In a namespace, see
+// WithNamespace, the bounds are those of its stored keys.
+func (m *Merger) Bounds() (lower, upper []byte) {
+	if m.namespace == nil {
+		return m.lower, m.upper
+	}
+	lower = append(bytes.Clone(m.namespace), m.lower...)
+	if m.upper == nil {
+		return lower, PrefixEnd(m.namespace)
+	}
+	return lower, append(bytes.Clone(m.namespace), m.upper...)
+}
+
+// Prefix returns the prefix shared by every key within Bounds, for storages that
+// filter by prefix rather than seek, or nil when there is none.
+func (m *Merger) Prefix() []byte {
+	lower, upper := m.Bounds()
+	if lower == nil || upper == nil {
+		return m.namespace
+	}
+	n := 0
+	for n < len(lower) && n < len(upper) && lower[n] == upper[n] {
+		n++
+	}
+	if n < len(m.namespace) {
+		return m.namespace
+	}
+	if n == 0 {
+		return nil
+	}
+	return lower[:n]
+}
+
+// bounded reports whether rows may be out of Bounds, which includes the rows of
+// other namespaces.
+func (m *Merger) bounded() bool {
+	return m.lower != nil || m.upper != nil || m.namespace != nil
+}
+
+// inBounds reports whether keyBytes is within Bounds.
+func (m *Merger) inBounds(keyBytes []byte) bool {
+	if m.namespace != nil {
+		if !bytes.HasPrefix(keyBytes, m.namespace) {
+			return false
+		}
+		keyBytes = keyBytes[len(m.namespace):]
+	}
+	if m.lower != nil && bytes.Compare(keyBytes, m.lower) < 0 {
+		return false
+	}
+	return m.upper == nil || bytes.Compare(keyBytes, m.upper) < 0
+}
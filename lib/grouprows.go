@@ -0,0 +1,64 @@
+package lib
+
+import "bytes"
+
+// GroupRows is the loop of every storage iterator: it reads rows with next, in key
+// order, or in descending order within IterateReverse, groups them by partial key
+// through RestoreKey and RestoreValue and emits each group to fn. next returns
+// false after the last row, and may return a nil value when NoValue reports true.
+// The key and value only need to stay valid until the following call to next.
+// Rows out of Bounds are skipped, and reading stops at the first row past them, so
+// storages that can not seek still stop early.
+func GroupRows(m *Merger, next func() (k, v []byte, ok bool), fn func(res map[string]any) error) error {
+	var lastKeyMap map[string]any
+	started := false
+	lastKeyBytes := []byte{}
+	valueMaps := []map[string]any{}
+
+	lower, upper := m.Bounds()
+	for {
+		k, v, ok := next()
+		if !ok {
+			break
+		}
+		if upper != nil && bytes.Compare(k, upper) >= 0 {
+			if m.reverse {
+				continue
+			}
+			break
+		}
+		if lower != nil && bytes.Compare(k, lower) < 0 {
+			if m.reverse {
+				break
+			}
+			continue
+		}
+
+		currKeyBytes, keyMap := m.RestoreKey(k)
+		if !started || !bytes.Equal(lastKeyBytes, currKeyBytes) {
+			if started {
+				if err := m.Emit(lastKeyMap, valueMaps, fn); err != nil {
+					return err
+				}
+			}
+			lastKeyBytes = append(lastKeyBytes[:0], currKeyBytes...)
+			lastKeyMap = keyMap
+			started = true
+			valueMaps = valueMaps[:0]
+		}
+		if m.keyErr != nil {
+			m.groupErr, m.keyErr = m.keyErr, nil
+		}
+
+		if m.NoValue() {
+			valueMaps = append(valueMaps, nil)
+			continue
+		}
+		valueMaps = append(valueMaps, m.RestoreValue(v))
+	}
+
+	if !started {
+		return nil
+	}
+	return m.Emit(lastKeyMap, valueMaps, fn)
+}
@@ -0,0 +1,40 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+)
+
+// WithGroupSample creates an iterator option that aggregates only about one in n
+// groups, chosen by a hash of their partial keys, to profile huge databases quickly.
+// Sampled groups are complete, so distributions over groups such as group sizes or
+// per-group aggregates stay meaningful; the same groups are chosen on every run.
+// Values of the other groups are not even decoded. It can not be combined with key
+// transforms, whose groups are only known after the scan.
+func WithGroupSample(n int) IteratorOpt {
+	return func(itW *IterWrapper) {
+		if n <= 0 {
+			itW.optErr = fmt.Errorf("group sample %d is not positive", n)
+			return
+		}
+		itW.groupSample = uint64(n)
+	}
+}
+
+// sampleKey updates whether the group of the key being restored is sampled out.
+func (m *Merger) sampleKey(keyBytes []byte, keyMap map[string]any) {
+	if m.sampledKey != nil && bytes.Equal(m.sampledKey, keyBytes) {
+		return
+	}
+	m.sampledKey = append(m.sampledKey[:0], keyBytes...)
+	m.skipGroup = !m.inGroupSample(keyMap)
+}
+
+func (m *Merger) inGroupSample(keyMap map[string]any) bool {
+	h := fnv.New64a()
+	for _, k := range m.partialKeys {
+		fmt.Fprintf(h, "%v\x00", keyMap[k.name])
+	}
+	return h.Sum64()%m.groupSample == 0
+}
@@ -0,0 +1,41 @@
+package lib
+
+import "fmt"
+
+// WithHaving creates an iterator option that drops merged groups whose output does
+// not satisfy expr, a condition like count>10 read by ParseCondition, like a HAVING
+// clause. The field is a partial key or aggregation by its name before WithAlias,
+// and compares like in WithFilter. Several conditions must all hold. Dropped groups
+// are not counted in Trace.GroupsEmitted.
+func WithHaving(expr string) IteratorOpt {
+	return func(itW *IterWrapper) {
+		field, op, value, err := ParseCondition(expr)
+		if err == nil {
+			var c condition
+			if c, err = newCondition(field, op, value); err == nil {
+				itW.having = append(itW.having, c)
+				return
+			}
+		}
+		itW.optErr = fmt.Errorf("bad having: %v", err)
+	}
+}
+
+// withHaving passes the output maps satisfying the having conditions to fn.
+func (itW *IterWrapper) withHaving(fn func(res map[string]any) error) (func(res map[string]any) error, error) {
+	names := make(map[string]bool)
+	for _, c := range itW.Merger.Columns() {
+		names[c.Name] = true
+	}
+	for _, c := range itW.having {
+		if !names[c.field] {
+			return nil, fmt.Errorf("bad having: no output field %v", c.field)
+		}
+	}
+	return func(res map[string]any) error {
+		if !matchAll(itW.having, res) {
+			return nil
+		}
+		return fn(res)
+	}, nil
+}
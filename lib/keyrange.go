@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// WithKeyRange limits the iteration to the keys from from up to but excluding to,
+// given like the key of Get as values of leading key fields, so {"day": "2024-01-01"}
+// to {"day": "2024-02-01"} reads January whatever the key fields after day. Either
+// may be nil to leave its end open. Storages seek to from and stop at to where they
+// can, see Merger.Bounds. The range follows the order of the stored keys, which puts
+// shorter strings first and negative integers after positive ones, and it can not
+// be given on dict_string keys, whose codes follow the order values were first seen.
+func WithKeyRange(from, to map[string]any) IteratorOpt {
+	return func(itW *IterWrapper) {
+		lower, err := itW.rangeBound(from)
+		if err != nil {
+			itW.optErr = fmt.Errorf("bad key range from: %v", err)
+			return
+		}
+		upper, err := itW.rangeBound(to)
+		if err != nil {
+			itW.optErr = fmt.Errorf("bad key range to: %v", err)
+			return
+		}
+		if lower != nil && (itW.lower == nil || bytes.Compare(lower, itW.lower) > 0) {
+			itW.lower = lower
+		}
+		if upper != nil && (itW.upper == nil || bytes.Compare(upper, itW.upper) < 0) {
+			itW.upper = upper
+		}
+	}
+}
+
+// rangeBound encodes one end of a key range, nil when it is open.
+func (s *Schema) rangeBound(bound map[string]any) ([]byte, error) {
+	if len(bound) == 0 {
+		return nil, nil
+	}
+	for i := 0; i < len(bound) && i < len(s.keys); i++ {
+		if s.keys[i].dict != nil {
+			return nil, fmt.Errorf("can not range over dict_string key %v", s.keys[i].name)
+		}
+	}
+	prefix, _, _, err := s.keyPrefix(bound)
+	if err != nil {
+		return nil, err
+	}
+	return prefix, nil
+}
@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// WithPartialKeyValue creates an iterator option that groups by the key field name
+// like WithPartialKey and only reads the rows where it equals value. Values must be
+// given for leading key fields in schema order, so together they make a prefix of
+// the stored keys, which storages seek to instead of scanning everything, see
+// Merger.Bounds.
+func WithPartialKeyValue(name string, value any) IteratorOpt {
+	return func(itW *IterWrapper) {
+		WithPartialKey(name)(itW)
+		if itW.keyValues == nil {
+			itW.keyValues = make(map[string]any)
+		}
+		itW.keyValues[name] = value
+	}
+}
+
+// applyKeyValues narrows the bounds to the prefix of the values given with
+// WithPartialKeyValue.
+func (itW *IterWrapper) applyKeyValues() error {
+	prefix, _, found, err := itW.keyPrefix(itW.keyValues)
+	if err != nil {
+		return fmt.Errorf("bad partial key values: %v", err)
+	}
+	if !found {
+		// no row has the value, an empty range reads nothing
+		itW.lower, itW.upper = []byte{}, []byte{}
+		return nil
+	}
+	if itW.lower == nil || bytes.Compare(prefix, itW.lower) > 0 {
+		itW.lower = prefix
+	}
+	if end := PrefixEnd(prefix); end != nil && (itW.upper == nil || bytes.Compare(end, itW.upper) < 0) {
+		itW.upper = end
+	}
+	return nil
+}
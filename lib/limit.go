@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errLimitReached = errors.New("limit reached")
+
+// WithLimit creates an iterator option that stops Iter after n merged groups, so
+// the storage stops reading too instead of scanning the rest of the keyspace. Groups
+// dropped by WithHaving or WithChangedSince do not count. With key transforms or
+// WithSortBy the whole scan still runs, as the first groups are only known at its
+// end.
+func WithLimit(n int) IteratorOpt {
+	return func(itW *IterWrapper) {
+		if n <= 0 {
+			itW.optErr = fmt.Errorf("limit %d is not positive", n)
+			return
+		}
+		itW.limit = n
+	}
+}
+
+// WithOffset creates an iterator option that skips the first n merged groups, e.g.
+// with WithLimit to show a slice of the result. The skipped groups are still read
+// and merged; Page resumes by key instead and is faster for deep offsets.
+func WithOffset(n int) IteratorOpt {
+	return func(itW *IterWrapper) {
+		if n < 0 {
+			itW.optErr = fmt.Errorf("offset %d is negative", n)
+			return
+		}
+		itW.offset = n
+	}
+}
+
+// withLimit skips the groups before the offset and stops the iteration once the
+// limit is reached.
+func (itW *IterWrapper) withLimit(fn func(res map[string]any) error) func(res map[string]any) error {
+	skipped, passed := 0, 0
+	return func(res map[string]any) error {
+		if skipped < itW.offset {
+			skipped++
+			return nil
+		}
+		if err := fn(res); err != nil {
+			return err
+		}
+		if passed++; itW.limit > 0 && passed >= itW.limit {
+			return errLimitReached
+		}
+		return nil
+	}
+}
+
+// limited turns the error that stopped an iteration at its limit into success.
+func limited(err error) error {
+	if errors.Is(err, errLimitReached) {
+		return nil
+	}
+	return err
+}
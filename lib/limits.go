@@ -0,0 +1,32 @@
+package lib
+
+import "fmt"
+
+// WithMaxOpenFiles returns a configuration function that caps the files the storage
+// keeps open, for environments with a low open file limit. Storages trade fewer
+// open files for larger files or less parallelism. Open fails up front when the cap
+// exceeds the process limit, rather than ingestion failing with "too many open files".
+// extsort, lotus and rocksdb hold to the cap, while badgerdb keeps every table open:
+// the cap only makes its tables fewer and larger, and its file count still grows by
+// about one per 64MB stored.
+func WithMaxOpenFiles(n int) StorageOpt {
+	return func(w *DbWrapper) error {
+		if n < 0 {
+			return fmt.Errorf("max open files %d is negative", n)
+		}
+		w.settings.storage.MaxOpenFiles = n
+		return nil
+	}
+}
+
+func checkOpenFiles(max int) error {
+	if max == 0 {
+		return nil
+	}
+	// leave room for the input, output and whatever else the process opens
+	const reserved = 16
+	if limit := openFileLimit(); limit > 0 && max+reserved > limit {
+		return fmt.Errorf("max open files %d plus %d reserved exceeds the process limit of %d, raise it with ulimit -n or lower the cap", max, reserved, limit)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package lib
+
+// openFileLimit is not available on this platform.
+func openFileLimit() int {
+	return 0
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package lib
+
+import "syscall"
+
+// openFileLimit returns the soft limit on open files of the process, 0 if unknown.
+func openFileLimit() int {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0
+	}
+	if rl.Cur > 1<<30 {
+		return 1 << 30
+	}
+	return int(rl.Cur)
+}
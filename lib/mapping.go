@@ -0,0 +1,51 @@
+package lib
+
+import "fmt"
+
+// fieldMapping ingests the input field from as the schema field named to.
+type fieldMapping struct {
+	from field
+	to   string
+}
+
+// WithFieldMapping returns a configuration function that makes Recv ingest the
+// input field input as the schema field name, so records whose field names differ
+// from the stored schema need no preprocessing. A dotted input reads from nested
+// objects like dotted schema names do. Mappings apply before anything else and
+// together, so two fields can swap names. Like other ingestion settings they are
+// not stored with the schema.
+func WithFieldMapping(input, name string) StorageOpt {
+	return func(w *DbWrapper) error {
+		if input == "" || name == "" {
+			return fmt.Errorf("bad field mapping %q to %q", input, name)
+		}
+		from := field{name: input, path: fieldPath(input)}
+		w.settings.mappings = append(w.settings.mappings, fieldMapping{from: from, to: name})
+		return nil
+	}
+}
+
+// checkMappings verifies that every mapping names a field of the schema.
+func (w *DbWrapper) checkMappings() error {
+	for _, m := range w.settings.mappings {
+		if w.field(m.to) == nil {
+			return fmt.Errorf("no field %v to map %v to", m.to, m.from.name)
+		}
+	}
+	return nil
+}
+
+// applyMappings renames the mapped fields of record.
+func (db *DbWrapper) applyMappings(record map[string]any) {
+	values := make([]any, len(db.settings.mappings))
+	found := make([]bool, len(db.settings.mappings))
+	for i, m := range db.settings.mappings {
+		values[i], found[i] = m.from.lookup(record)
+		delete(record, m.from.name)
+	}
+	for i, m := range db.settings.mappings {
+		if found[i] {
+			record[m.to] = values[i]
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// map values are JSON objects, stored as JSON text behind the length header of
+// json, but decoded with integers kept as int64 so counters sum exactly.
+
+func checkMap(v any) error {
+	if _, ok := v.(map[string]any); !ok {
+		return fmt.Errorf("%v (%T) is not an object", v, v)
+	}
+	return checkJson(v)
+}
+
+func fromMapBinary(b []byte) (any, int) {
+	l, _ := fromInt16Binary(b[:2])
+	limit := 2 + int(l.(int16))
+	return decodeJson(b[2:limit]), limit
+}
+
+func fromWideMapBinary(b []byte) (any, int) {
+	limit := 4 + fromWideHeader(b)
+	return decodeJson(b[4:limit]), limit
+}
+
+// decodeJson decodes JSON text keeping integers exact, see fromJsonNumbers.
+func decodeJson(body []byte) any {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var anyValue any
+	d.Decode(&anyValue)
+	return fromJsonNumbers(anyValue)
+}
+
+// fromJsonNumbers replaces the json.Number in v by int64 where they fit, float64 otherwise.
+func fromJsonNumbers(v any) any {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(t), 10, 64); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]any:
+		for k, elem := range t {
+			t[k] = fromJsonNumbers(elem)
+		}
+	case []any:
+		for i, elem := range t {
+			t[i] = fromJsonNumbers(elem)
+		}
+	}
+	return v
+}
+
+// mapSum sums the numeric values of map fields per map key, e.g. the shards of a
+// counter {"hits": 3, "misses": 1} and {"hits": 2} into {"hits": 5, "misses": 1}.
+// Values that are not numbers are skipped, like sum does.
+type mapSum struct {
+	name string
+	mode NumericMode
+}
+
+func (a mapSum) on(collection []map[string]any) any {
+	perKey := make(map[string][]map[string]any)
+	for _, item := range collection {
+		m, ok := item[a.name].(map[string]any)
+		if !ok {
+			continue
+		}
+		for k, v := range m {
+			if _, ok := numeric(v); !ok {
+				continue
+			}
+			perKey[k] = append(perKey[k], map[string]any{a.name: v})
+		}
+	}
+	if len(perKey) == 0 {
+		return nil
+	}
+	total := sum{name: a.name, mode: a.mode}
+	res := make(map[string]any, len(perKey))
+	for k, values := range perKey {
+		res[k] = total.on(values)
+	}
+	return res
+}
+
+func (a mapSum) kind(kinds map[string]string) string {
+	return "map"
+}
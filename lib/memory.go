@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"fmt"
+	"runtime/debug"
+	"runtime/metrics"
+)
+
+// Shrinker is implemented by storages that can release memory they hold for speed,
+// e.g. by flushing memtables, when ingestion passes the memory watermark.
+type Shrinker interface {
+	Shrink() error
+}
+
+// memoryCheckInterval is the number of records Recv writes between heap checks,
+// which are cheap but not free.
+const memoryCheckInterval = 4096
+
+// WithMemoryWatermark returns a configuration function that sets a soft heap limit
+// for ingestion. Past it Recv commits the rows it holds early, asks the storage to
+// shrink, see Shrinker, and returns freed memory to the OS, keeping long jobs alive
+// on busy machines before WithMaxMemory fails them. Early commits are counted in
+// Usage.EarlyCommits.
+func WithMemoryWatermark(n int64) StorageOpt {
+	return func(w *DbWrapper) error {
+		if n <= 0 {
+			return fmt.Errorf("memory watermark %d is not positive", n)
+		}
+		w.settings.memoryWatermark = n
+		return nil
+	}
+}
+
+// WithMaxMemory returns a configuration function that makes Recv fail once the heap
+// exceeds n bytes even after the measures of WithMemoryWatermark.
+func WithMaxMemory(n int64) StorageOpt {
+	return func(w *DbWrapper) error {
+		if n <= 0 {
+			return fmt.Errorf("max memory %d is not positive", n)
+		}
+		w.settings.maxMemory = n
+		return nil
+	}
+}
+
+func (s settings) watchesMemory() bool {
+	return s.memoryWatermark > 0 || s.maxMemory > 0
+}
+
+// checkMemory applies the memory watermark and limit, returning the inserter
+// to continue with.
+func (db *DbWrapper) checkMemory(ins Inserter) (Inserter, error) {
+	heap := heapBytes()
+	if wm := db.settings.memoryWatermark; wm > 0 && heap > wm {
+		db.usage.EarlyCommits++
+		if err := db.commit(ins); err != nil {
+			return ins, fmt.Errorf("fail to commit early %v", err)
+		}
+		ins = db.db.NewInserter()
+		if s, ok := db.db.(Shrinker); ok {
+			if err := s.Shrink(); err != nil {
+				return ins, fmt.Errorf("fail to shrink storage %v", err)
+			}
+		}
+		debug.FreeOSMemory()
+		heap = heapBytes()
+	}
+	if max := db.settings.maxMemory; max > 0 && heap > max {
+		return ins, fmt.Errorf("heap of %d bytes exceeds max memory of %d", heap, max)
+	}
+	return ins, nil
+}
+
+func heapBytes() int64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return int64(sample[0].Value.Uint64())
+}
@@ -1,10 +1,60 @@
 package lib
 
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
 type Merger struct {
 	masks       int
+	compression string
+	cipher      *valueCipher
 	partialKeys []key
 	allValues   []value
 	aggs        []namedAggregation
+	fingerprint string
+	prefetch    int
+	seed        uint64
+	rowsRead    int64
+	bytesRead   int64
+	// rowsFiltered, rowsDecoded and bytesDecoded feed Trace
+	rowsFiltered int64
+	rowsDecoded  int64
+	bytesDecoded int64
+	onBadGroup   func(key map[string]any, err error)
+	groupErr     error
+	numericMode  NumericMode
+	transforms   map[string]keyTransform
+	// buckets truncate timestamp and date keys, see WithPartialKeyBucketed
+	buckets map[string]time.Duration
+	// valueTransforms apply to decoded values, see WithValueTransform
+	valueTransforms map[string]ValueTransform
+	pending         map[string]*pendingGroup
+	spillRows       int
+	groupRows       int
+	spill           *spillFile
+	groupSample     uint64
+	sampledKey      []byte
+	skipGroup       bool
+	// raw hands out undecoded payloads, see Scan
+	raw bool
+	// lower and upper bound the keys read, see Bounds
+	lower, upper []byte
+	outOfBounds  bool
+	// reverse reads rows in descending key order, see IterWrapper.Reverse
+	reverse bool
+	// namespace prefixes the stored keys, see WithNamespace
+	namespace []byte
+	// keyFilters and valueFilters drop rows before aggregation, see WithFilter;
+	// filterKeys are the leading key fields to decode for them
+	keyFilters   []condition
+	valueFilters []condition
+	filterKeys   []key
+	rejected     bool
+	// keyErr is why RestoreKey failed on the last row, see GroupRows
+	keyErr error
 }
 
 type namedAggregation struct {
@@ -13,14 +63,48 @@ type namedAggregation struct {
 }
 
 func (m *Merger) NoValue() bool {
-	return len(m.allValues) == 0
+	return !m.raw && len(m.allValues) == 0 && len(m.keyFilters) == 0
+}
+
+// Seed returns the seed of the random source used by randomized aggregators,
+// so runs can be recorded and reproduced with WithSeed.
+func (m *Merger) Seed() uint64 {
+	return m.seed
+}
+
+// Prefetch returns how many items storage iterators should read ahead,
+// or 0 to keep the backend default.
+func (m *Merger) Prefetch() int {
+	return m.prefetch
 }
 
 // restoreKey decodes the keyBytes into a map of field names to their decoded values.
 // It returns the original key bytes up to the offset that was processed and a map
 // containing all the decoded key fields with their names as map keys.
-func (m *Merger) RestoreKey(keyBytes []byte) ([]byte, map[string]any) {
-	keyMap := make(map[string]any, len(m.partialKeys))
+// A key that fails to decode is returned whole as a group of its own, which
+// GroupRows marks as bad, see Emit.
+func (m *Merger) RestoreKey(keyBytes []byte) (currKeyBytes []byte, keyMap map[string]any) {
+	if m.raw {
+		return m.restoreRawKey(keyBytes)
+	}
+	m.rowsRead++
+	m.bytesRead += int64(len(keyBytes))
+	if m.bounded() {
+		// rows out of bounds are groups of their own without a key, dropped by Emit
+		if m.outOfBounds = !m.inBounds(keyBytes); m.outOfBounds {
+			m.rowsFiltered++
+			return keyBytes, nil
+		}
+		keyBytes = keyBytes[len(m.namespace):]
+	}
+	keyMap = make(map[string]any, len(m.partialKeys))
+	defer func() {
+		if r := recover(); r != nil {
+			m.keyErr = fmt.Errorf("fail to decode key: %v", r)
+			m.rejected = false
+			currKeyBytes = keyBytes
+		}
+	}()
 	keyOffset := 0
 	for _, k := range m.partialKeys {
 		var keyData any
@@ -29,14 +113,68 @@ func (m *Merger) RestoreKey(keyBytes []byte) ([]byte, map[string]any) {
 		keyMap[k.name] = keyData
 	}
 
-	currKeyBytes := keyBytes[:keyOffset]
+	currKeyBytes = keyBytes[:keyOffset]
+	if len(m.buckets) > 0 {
+		currKeyBytes = m.bucketKey(keyBytes, keyMap)
+	}
+	if len(m.keyFilters) > 0 {
+		m.rejected = !m.matchKey(keyBytes)
+	}
+	if m.groupSample > 0 {
+		m.sampleKey(currKeyBytes, keyMap)
+		if m.skipGroup {
+			m.rowsFiltered++
+		}
+	}
 	return currKeyBytes, keyMap
 }
 
 // restoreValue decodes the valueBytes into a map of field names to their decoded values.
 // It handles masked fields (where bits in valueHead indicate if a field should be skipped)
 // and returns a map containing all the decoded value fields with their names as map keys.
-func (m *Merger) RestoreValue(valueBytes []byte) map[string]any {
+// A value that fails to decode marks the current group as bad, see Emit.
+// With WithSpill, rows of a group beyond the threshold go to disk and nil is returned.
+func (m *Merger) RestoreValue(valueBytes []byte) (valueMap map[string]any) {
+	if m.raw {
+		return m.restoreRawValue(valueBytes)
+	}
+	m.bytesRead += int64(len(valueBytes))
+	if m.outOfBounds {
+		return nil
+	}
+	if m.groupSample > 0 && m.skipGroup {
+		return nil
+	}
+	if m.rejected {
+		m.rowsFiltered++
+		return filteredRow
+	}
+	if len(m.allValues) == 0 {
+		// read only for the key filters
+		return nil
+	}
+	if m.spillRows > 0 && len(m.transforms) == 0 {
+		m.groupRows++
+		if m.groupRows > m.spillRows {
+			if err := m.spillValue(valueBytes); err != nil && m.groupErr == nil {
+				m.groupErr = fmt.Errorf("fail to spill: %v", err)
+			}
+			return nil
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			m.groupErr = fmt.Errorf("fail to decode value: %v", r)
+			valueMap = nil
+		}
+	}()
+	return m.decodeValue(valueBytes)
+}
+
+func (m *Merger) decodeValue(valueBytes []byte) map[string]any {
+	m.rowsDecoded++
+	m.bytesDecoded += int64(len(valueBytes))
+	valueBytes = decompressValue(m.compression, m.cipher.open(valueBytes))
 	valueHead := valueBytes[:m.masks]
 	valueBody := valueBytes[m.masks:]
 	valueMap := make(map[string]any, len(m.allValues))
@@ -50,6 +188,13 @@ func (m *Merger) RestoreValue(valueBytes []byte) map[string]any {
 		valueMap[f.name] = valueData
 		offset += step
 	}
+	if len(m.valueFilters) > 0 && !matchAll(m.valueFilters, valueMap) {
+		m.rowsFiltered++
+		return filteredRow
+	}
+	if len(m.valueTransforms) > 0 {
+		m.applyValueTransforms(valueMap)
+	}
 	return valueMap
 }
 
@@ -61,5 +206,126 @@ func (m *Merger) Merge(keyValue map[string]any, valueValues []map[string]any) ma
 	for _, agg := range m.aggs {
 		keyValue[agg.name] = agg.on(valueValues)
 	}
+	if m.fingerprint != "" {
+		keyValue[m.fingerprint] = fingerprintOf(keyValue)
+	}
 	return keyValue
 }
+
+// Column describes one field of the merged output. Key marks the partial keys,
+// whose values tell the groups apart.
+type Column struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	Key  bool   `json:"key,omitempty"`
+}
+
+// Columns describes the fields of every merged output map, in the order
+// of the partial keys followed by the aggregations.
+func (m *Merger) Columns() []Column {
+	kinds := make(map[string]string, len(m.allValues))
+	for _, v := range m.allValues {
+		kinds[v.name] = v.kind
+		if _, ok := m.valueTransforms[v.name]; ok {
+			kinds[v.name] = "any"
+		}
+	}
+
+	columns := make([]Column, 0, len(m.partialKeys)+len(m.aggs)+1)
+	for _, k := range m.partialKeys {
+		columns = append(columns, Column{Name: k.name, Kind: k.kind, Key: true})
+	}
+	for _, agg := range m.aggs {
+		kind := "any"
+		if agg.aggregator != nil {
+			kind = agg.kind(kinds)
+		}
+		if kind == "" {
+			kind = "any"
+		}
+		columns = append(columns, Column{Name: agg.name, Kind: kind})
+	}
+	if m.fingerprint != "" {
+		columns = append(columns, Column{Name: m.fingerprint, Kind: "string"})
+	}
+	return columns
+}
+
+// Emit merges a group and passes the result to fn. A group whose values failed to
+// decode or whose aggregation panics is reported through the handler set by
+// WithSkipBadGroups and skipped; without a handler Emit returns an error naming the key.
+//
+// With key transforms, see WithPartialKeyTransform, groups are buffered instead
+// and emitted once the storage is done. With WithGroupSample, groups out of the
+// sample are dropped, as are rows out of Bounds and those dropped by WithFilter.
+func (m *Merger) Emit(keyValue map[string]any, valueValues []map[string]any, fn func(res map[string]any) error) error {
+	if m.raw {
+		return m.emitRaw(keyValue, valueValues, fn)
+	}
+	defer m.closeSpill()
+	if m.reverse {
+		reverseRows(valueValues)
+	}
+	if keyValue == nil && m.bounded() {
+		m.groupErr = nil
+		return nil
+	}
+	if m.groupSample > 0 && !m.inGroupSample(keyValue) {
+		m.groupErr = nil
+		return nil
+	}
+	if m.filtered() {
+		if valueValues = dropFiltered(valueValues); len(valueValues) == 0 {
+			m.groupErr = nil
+			return nil
+		}
+	}
+	if len(m.transforms) > 0 && m.groupErr == nil {
+		if keyValue != nil {
+			m.buffer(keyValue, valueValues)
+		}
+		return nil
+	}
+	return m.emit(keyValue, valueValues, fn)
+}
+
+func (m *Merger) emit(keyValue map[string]any, valueValues []map[string]any, fn func(res map[string]any) error) error {
+	res, err := m.safeMerge(keyValue, valueValues)
+	if err != nil {
+		if m.onBadGroup == nil {
+			return fmt.Errorf("bad group %v: %w", keyValue, err)
+		}
+		m.onBadGroup(keyValue, err)
+		return nil
+	}
+	return fn(res)
+}
+
+func (m *Merger) safeMerge(keyValue map[string]any, valueValues []map[string]any) (res map[string]any, err error) {
+	if m.groupErr != nil {
+		err, m.groupErr = m.groupErr, nil
+		return nil, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("fail to merge: %v", r)
+		}
+	}()
+	if m.spill != nil {
+		return m.mergeSpilled(keyValue, valueValues)
+	}
+	return m.Merge(keyValue, valueValues), nil
+}
+
+// fingerprintOf hashes the merged map into a stable hex string. Map keys are
+// serialized in sorted order, so equal groups always produce equal fingerprints.
+func fingerprintOf(merged map[string]any) string {
+	b, err := json.Marshal(merged)
+	if err != nil {
+		b = fmt.Appendf(nil, "%v", merged)
+	}
+	h := fnv.New64a()
+	h.Write(b)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
@@ -0,0 +1,70 @@
+package lib_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+	_ "github.com/kill-2/badmerger/storage/bolt"
+)
+
+// TestBadKey loses the dictionary of a dict_string key, so only its first string
+// can still be decoded.
+func TestBadKey(t *testing.T) {
+	dir := t.TempDir()
+	db, err := lib.Open(lib.WithStorage("bolt"), lib.WithDir(dir), lib.WithKey("g", "dict_string"), lib.WithValue("v", "int64"))
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	ch := make(chan map[string]any, 3)
+	for _, g := range []string{"a", "b", "c"} {
+		ch <- map[string]any{"g": g, "v": int64(1)}
+	}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("fail to close db: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dictionaries.json"), []byte(`{"g":["a"]}`), 0o644); err != nil {
+		t.Fatalf("fail to truncate dictionary: %v", err)
+	}
+
+	db, err = lib.Open(lib.WithDir(dir))
+	if err != nil {
+		t.Fatalf("fail to reopen db: %v", err)
+	}
+	defer db.Close()
+	iter := func(opts ...lib.IteratorOpt) ([]map[string]any, error) {
+		var got []map[string]any
+		opts = append(opts, lib.WithPartialKey("g"), lib.WithAgg("v", "sum(v)"))
+		err := db.NewIterator(opts...).Iter(func(res map[string]any) error {
+			got = append(got, res)
+			return nil
+		})
+		return got, err
+	}
+
+	if _, err := iter(); err == nil || !strings.Contains(err.Error(), "unknown dictionary code") {
+		t.Errorf("got error %v, want an unknown dictionary code", err)
+	}
+
+	var bad []error
+	got, err := iter(lib.WithSkipBadGroups(func(_ map[string]any, err error) {
+		bad = append(bad, err)
+	}))
+	if err != nil {
+		t.Fatalf("fail to iterate: %v", err)
+	}
+	want := []map[string]any{{"g": "a", "v": int64(1)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(bad) != 2 {
+		t.Errorf("got bad groups %v, want 2", bad)
+	}
+}
@@ -0,0 +1,284 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WithNamespace returns a configuration function that opens one of several datasets
+// sharing the storage of a dir, each with a schema of its own. Every key is stored
+// behind the 4 byte ID of the namespace, so iterations seek to their namespace and
+// never see the rows of the others. The schema and dictionaries of a namespace are
+// kept in dir/namespaces/NAME, the IDs in dir/namespaces.json. A dir holds either
+// namespaces or a single database opened without one. Namespaces opened at the same
+// time in one process share the opened storage, with the settings of the first.
+// Storages that store decoded rows, like duckdb, can not hold namespaces.
+func WithNamespace(name string) StorageOpt {
+	return func(w *DbWrapper) error {
+		if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			return fmt.Errorf("bad namespace name %q", name)
+		}
+		w.settings.namespace = name
+		return nil
+	}
+}
+
+// Namespace returns the namespace of the database, empty when it has none.
+func (db *DbWrapper) Namespace() string {
+	return db.settings.namespace
+}
+
+func namespaceFile(dir string) string {
+	return filepath.Join(dir, "namespaces.json")
+}
+
+// schemaDir returns the dir of the schema and dictionaries, dir itself unless the
+// database is a namespace.
+func (w *DbWrapper) schemaDir() string {
+	if w.settings.namespace == "" {
+		return w.dir
+	}
+	return filepath.Join(w.dir, "namespaces", w.settings.namespace)
+}
+
+// checkNamespace refuses to mix namespaces with a database without one in a dir.
+func (w *DbWrapper) checkNamespace() error {
+	if w.settings.namespace != "" {
+		if _, err := os.Stat(schemaFile(w.dir)); err == nil {
+			return fmt.Errorf("%v holds a database without namespaces", w.dir)
+		}
+		return nil
+	}
+	if _, err := os.Stat(namespaceFile(w.dir)); err == nil {
+		return fmt.Errorf("%v holds namespaces, open one with WithNamespace", w.dir)
+	}
+	return nil
+}
+
+// namespaceRegistry is the content of namespaces.json.
+type namespaceRegistry struct {
+	Store string            `json:"store"`
+	IDs   map[string]uint32 `json:"ids"`
+}
+
+// namespaceID returns the ID of the namespace in dir, registering new ones. IDs
+// start at 1 and are never reused.
+func namespaceID(dir, name, store string) (uint32, error) {
+	registry := namespaceRegistry{Store: store, IDs: make(map[string]uint32)}
+	data, err := os.ReadFile(namespaceFile(dir))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("fail to read namespaces %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &registry); err != nil {
+			return 0, fmt.Errorf("fail to unmarshal namespaces %v", err)
+		}
+	}
+	if registry.Store != store {
+		return 0, fmt.Errorf("namespaces of %v are stored in %v, not %v", dir, registry.Store, store)
+	}
+	if id, ok := registry.IDs[name]; ok {
+		return id, nil
+	}
+
+	var id uint32
+	for _, other := range registry.IDs {
+		if other > id {
+			id = other
+		}
+	}
+	id++
+	registry.IDs[name] = id
+	if data, err = json.Marshal(registry); err != nil {
+		return 0, fmt.Errorf("fail to marshal namespaces %v", err)
+	}
+	if err := os.WriteFile(namespaceFile(dir), data, 0644); err != nil {
+		return 0, fmt.Errorf("fail to write namespaces %v", err)
+	}
+	return id, nil
+}
+
+// shared holds the storages opened for namespaces by dir.
+var shared = struct {
+	sync.Mutex
+	storages map[string]*sharedStorage
+}{storages: make(map[string]*sharedStorage)}
+
+// sharedStorage is a storage opened once for the namespaces of its dir and
+// closed with the last of them.
+type sharedStorage struct {
+	Storage
+	store string
+	dir   string
+	key   []byte
+	refs  int
+}
+
+// openNamespace opens the storage of dir for the namespace of w, or shares the one
+// already opened, and registers the namespace.
+func (w *DbWrapper) openNamespace(build func() (Storage, error)) (Storage, error) {
+	dir, err := filepath.Abs(w.dir)
+	if err != nil {
+		return nil, fmt.Errorf("fail to resolve dir %v", err)
+	}
+	shared.Lock()
+	defer shared.Unlock()
+
+	if err := os.MkdirAll(w.schemaDir(), 0755); err != nil {
+		return nil, fmt.Errorf("fail to create namespace dir %v", err)
+	}
+	id, err := namespaceID(dir, w.settings.namespace, w.store)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := shared.storages[dir]
+	if ok && !bytes.Equal(s.key, w.settings.storage.EncryptionKey) {
+		return nil, fmt.Errorf("namespaces of %v are open with another encryption key", w.dir)
+	}
+	if !ok {
+		db, err := build()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := db.(SchemaReceiver); ok {
+			db.Close()
+			return nil, fmt.Errorf("storage %v stores decoded rows and can not hold namespaces", w.store)
+		}
+		s = &sharedStorage{Storage: db, store: w.store, dir: dir, key: w.settings.storage.EncryptionKey}
+		shared.storages[dir] = s
+	}
+	s.refs++
+	return &namespacedStorage{s, binary.BigEndian.AppendUint32(nil, id)}, nil
+}
+
+// release closes the storage once no namespace uses it.
+func (s *sharedStorage) release() error {
+	shared.Lock()
+	defer shared.Unlock()
+	if s.refs--; s.refs > 0 {
+		return nil
+	}
+	delete(shared.storages, s.dir)
+	return s.Storage.Close()
+}
+
+// namespacedStorage stores the rows of one namespace behind its prefix. The merger
+// strips the prefix again, see Merger.Bounds.
+type namespacedStorage struct {
+	*sharedStorage
+	prefix []byte
+}
+
+func (ns *namespacedStorage) NewInserter() Inserter {
+	return &namespacedInserter{ns.Storage.NewInserter(), ns.prefix}
+}
+
+func (ns *namespacedStorage) Iterate(m *Merger, fn func(res map[string]any) error) error {
+	m.namespace = ns.prefix
+	defer func() { m.namespace = nil }()
+	return ns.Storage.Iterate(m, fn)
+}
+
+// IterateReverse implements ReverseIterator for storages that do.
+func (ns *namespacedStorage) IterateReverse(m *Merger, fn func(res map[string]any) error) error {
+	r, ok := ns.Storage.(ReverseIterator)
+	if !ok {
+		return fmt.Errorf("storage %v can not iterate in reverse", ns.store)
+	}
+	m.namespace = ns.prefix
+	defer func() { m.namespace = nil }()
+	return r.IterateReverse(m, fn)
+}
+
+func (ns *namespacedStorage) Close() error {
+	return ns.release()
+}
+
+// DeletePrefix implements Deleter for storages that do.
+func (ns *namespacedStorage) DeletePrefix(prefix []byte) error {
+	d, ok := ns.Storage.(Deleter)
+	if !ok {
+		return fmt.Errorf("storage %v can not delete", ns.store)
+	}
+	return d.DeletePrefix(append(bytes.Clone(ns.prefix), prefix...))
+}
+
+// Snapshot implements Snapshotter for storages that do.
+func (ns *namespacedStorage) Snapshot() (View, error) {
+	s, ok := ns.Storage.(Snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("storage %v can not take snapshots", ns.store)
+	}
+	view, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &namespacedView{view, ns.prefix}, nil
+}
+
+// namespacedView is the view of a snapshot limited to one namespace.
+type namespacedView struct {
+	View
+	prefix []byte
+}
+
+func (nv *namespacedView) Iterate(m *Merger, fn func(res map[string]any) error) error {
+	m.namespace = nv.prefix
+	defer func() { m.namespace = nil }()
+	return nv.View.Iterate(m, fn)
+}
+
+// IterateReverse implements ReverseIterator for views that do.
+func (nv *namespacedView) IterateReverse(m *Merger, fn func(res map[string]any) error) error {
+	r, ok := nv.View.(ReverseIterator)
+	if !ok {
+		return fmt.Errorf("snapshot can not iterate in reverse")
+	}
+	m.namespace = nv.prefix
+	defer func() { m.namespace = nil }()
+	return r.IterateReverse(m, fn)
+}
+
+// Compact, RunGC and Shrink act on the whole storage, for every namespace.
+func (ns *namespacedStorage) Compact() error {
+	if s, ok := ns.Storage.(Compacter); ok {
+		return s.Compact()
+	}
+	return nil
+}
+
+func (ns *namespacedStorage) RunGC() error {
+	if s, ok := ns.Storage.(GarbageCollector); ok {
+		return s.RunGC()
+	}
+	return nil
+}
+
+func (ns *namespacedStorage) Shrink() error {
+	if s, ok := ns.Storage.(Shrinker); ok {
+		return s.Shrink()
+	}
+	return nil
+}
+
+func (ns *namespacedStorage) Encrypted() bool {
+	e, ok := ns.Storage.(Encrypter)
+	return ok && e.Encrypted()
+}
+
+// namespacedInserter prefixes the keys of its rows with the namespace.
+type namespacedInserter struct {
+	Inserter
+	prefix []byte
+}
+
+func (ni *namespacedInserter) Insert(keyPayload, valuePayload []byte) error {
+	return ni.Inserter.Insert(append(bytes.Clone(ni.prefix), keyPayload...), valuePayload)
+}
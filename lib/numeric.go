@@ -0,0 +1,178 @@
+package lib
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// NumericMode selects the arithmetic of sum and of aggregation expressions.
+type NumericMode string
+
+const (
+	// NumericAuto keeps integers exact as int64, switching to float64 or Decimal
+	// as soon as such values take part.
+	NumericAuto NumericMode = ""
+	// NumericInt64 truncates every operand to int64; division is integer division.
+	NumericInt64 NumericMode = "int64"
+	// NumericFloat64 computes with float64, the fastest and least exact.
+	NumericFloat64 NumericMode = "float64"
+	// NumericDecimal computes exactly with Decimal; quotients keep decimalQuotientScale digits.
+	NumericDecimal NumericMode = "decimal"
+)
+
+const decimalQuotientScale = 10
+
+// WithNumericMode creates an iterator option that sets the arithmetic used by
+// sum and aggregation expressions, trading speed for exactness without touching
+// the stored schema. An unknown mode makes Iter fail.
+func WithNumericMode(mode NumericMode) IteratorOpt {
+	return func(itW *IterWrapper) {
+		switch mode {
+		case NumericAuto, NumericInt64, NumericFloat64, NumericDecimal:
+			itW.numericMode = mode
+			return
+		}
+		itW.optErr = fmt.Errorf("unknown numeric mode %q", mode)
+	}
+}
+
+// withNumericMode returns agg computing in mode.
+func withNumericMode(agg aggregator, mode NumericMode) aggregator {
+	switch a := agg.(type) {
+	case sum:
+		a.mode = mode
+		return a
+	case mapSum:
+		a.mode = mode
+		return a
+	case binaryExpr:
+		a.mode = mode
+		a.left = withNumericMode(a.left, mode)
+		a.right = withNumericMode(a.right, mode)
+		return a
+	}
+	return agg
+}
+
+// modeKind reports the result kind of arithmetic in mode, or "" for NumericAuto.
+func modeKind(mode NumericMode) string {
+	if mode == NumericAuto {
+		return ""
+	}
+	return string(mode)
+}
+
+// sumIn adds the values of name with the arithmetic of mode, which must not be NumericAuto.
+func sumIn(mode NumericMode, name string, collection []map[string]any) any {
+	switch mode {
+	case NumericInt64:
+		var total int64
+		for _, item := range collection {
+			if v, ok := numericInt64(item[name]); ok {
+				total += v
+			}
+		}
+		return total
+	case NumericFloat64:
+		var total float64
+		for _, item := range collection {
+			if v, ok := toFloat64(item[name]); ok {
+				total += v
+			}
+		}
+		return total
+	}
+	total := Decimal{rat: new(big.Rat)}
+	for _, item := range collection {
+		if v := item[name]; v != nil {
+			if d, ok := toDecimal(v); ok {
+				total = total.Add(d)
+			}
+		}
+	}
+	return total
+}
+
+func numericInt64(v any) (int64, bool) {
+	if i, ok := toInt64(v); ok {
+		return i, true
+	}
+	if b, ok := v.(*big.Int); ok {
+		return b.Int64(), true
+	}
+	if f, ok := toFloat64(v); ok {
+		return int64(f), true
+	}
+	return 0, false
+}
+
+// arithmeticIn applies op to l and r with the arithmetic of mode, which must not be NumericAuto.
+func arithmeticIn(mode NumericMode, op byte, l, r any) any {
+	switch mode {
+	case NumericInt64:
+		li, lok := numericInt64(l)
+		ri, rok := numericInt64(r)
+		if !lok || !rok {
+			return nil
+		}
+		switch op {
+		case '+':
+			return li + ri
+		case '-':
+			return li - ri
+		case '*':
+			return li * ri
+		case '/':
+			if ri == 0 {
+				return nil
+			}
+			return li / ri
+		}
+	case NumericFloat64:
+		lf, lok := toFloat64(l)
+		rf, rok := toFloat64(r)
+		if !lok || !rok {
+			return nil
+		}
+		switch op {
+		case '+':
+			return lf + rf
+		case '-':
+			return lf - rf
+		case '*':
+			return lf * rf
+		case '/':
+			if rf == 0 {
+				return nil
+			}
+			return lf / rf
+		}
+	case NumericDecimal:
+		ld, lok := toDecimal(l)
+		rd, rok := toDecimal(r)
+		if !lok || !rok || ld.rat == nil || rd.rat == nil {
+			return nil
+		}
+		res := Decimal{rat: new(big.Rat), scale: ld.scale}
+		if rd.scale > res.scale {
+			res.scale = rd.scale
+		}
+		switch op {
+		case '+':
+			res.rat.Add(ld.rat, rd.rat)
+		case '-':
+			res.rat.Sub(ld.rat, rd.rat)
+		case '*':
+			res.rat.Mul(ld.rat, rd.rat)
+			res.scale = ld.scale + rd.scale
+		case '/':
+			if rd.rat.Sign() == 0 {
+				return nil
+			}
+			res.rat.Quo(ld.rat, rd.rat)
+			res.scale = decimalQuotientScale
+		}
+		return res
+	}
+	return nil
+}
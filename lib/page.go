@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Page is one page of merged groups.
+type Page struct {
+	Rows []map[string]any `json:"rows"`
+	// Next is the token of the page after this one, empty after the last page.
+	Next string `json:"next,omitempty"`
+}
+
+var errPageFull = errors.New("page full")
+
+// Page merges up to size groups, starting after the group of token or from the
+// first group when token is empty, so a UI can page through millions of groups
+// without anything holding the whole result. The token carries the stored key of
+// the last group of the previous page: resuming seeks past it, see Merger.Bounds,
+// instead of reading the earlier pages again, and rows ingested meanwhile show up
+// in later pages only. Options are kept between pages by building the iterator
+// with the same options for every page, as Page narrows its bounds. Key transforms
+// and merged states emit groups out of key order and can not be paged, nor can key
+// buckets or rollup subtotals, whose groups have no stored key of their own. The
+// token is built from the partial keys of the last group, so WithSelect has to keep
+// them all.
+func (itW *IterWrapper) Page(size int, token string) (Page, error) {
+	if size < 1 {
+		return Page{}, fmt.Errorf("bad page size %d", size)
+	}
+	if len(itW.transforms) > 0 {
+		return Page{}, fmt.Errorf("pages can not be combined with key transforms")
+	}
+	if len(itW.buckets) > 0 {
+		return Page{}, fmt.Errorf("pages can not be combined with key buckets")
+	}
+	if len(itW.stateMerge) > 0 {
+		return Page{}, fmt.Errorf("pages can not be combined with merged states")
+	}
+	if itW.limit > 0 || itW.offset > 0 {
+		return Page{}, fmt.Errorf("pages can not be combined with limit or offset")
+	}
+	if len(itW.sortBy) > 0 {
+		return Page{}, fmt.Errorf("pages can not be combined with sort")
+	}
+	if itW.rollup {
+		return Page{}, fmt.Errorf("pages can not be combined with rollup")
+	}
+	if len(itW.selected) > 0 {
+		for _, k := range itW.partialKeys {
+			if !slices.Contains(itW.selected, k.name) {
+				return Page{}, fmt.Errorf("pages need partial key %v, which is not selected", k.name)
+			}
+		}
+	}
+	if token != "" {
+		after, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil || len(after) == 0 {
+			return Page{}, fmt.Errorf("bad page token %q", token)
+		}
+		if itW.reverse {
+			if itW.upper == nil || bytes.Compare(after, itW.upper) < 0 {
+				itW.upper = after
+			}
+		} else {
+			next := PrefixEnd(after)
+			if next == nil {
+				return Page{}, nil
+			}
+			if itW.lower == nil || bytes.Compare(next, itW.lower) > 0 {
+				itW.lower = next
+			}
+		}
+		// past the first page an empty range is the end, not an empty result
+		itW.emitEmpty = false
+	}
+
+	var page Page
+	more := false
+	err := itW.Iter(func(res map[string]any) error {
+		if len(page.Rows) == size {
+			more = true
+			return errPageFull
+		}
+		page.Rows = append(page.Rows, res)
+		return nil
+	})
+	if err != nil && err != errPageFull {
+		return Page{}, err
+	}
+	if more {
+		next, err := itW.pageToken(page.Rows[size-1])
+		if err != nil {
+			return Page{}, err
+		}
+		page.Next = next
+	}
+	return page, nil
+}
+
+// pageToken encodes the stored key prefix of the group of res.
+func (itW *IterWrapper) pageToken(res map[string]any) (string, error) {
+	key := make(map[string]any, len(itW.partialKeys))
+	for _, k := range itW.partialKeys {
+		name := k.name
+		if alias, ok := itW.aliases[name]; ok {
+			name = alias
+		}
+		key[k.name] = res[name]
+	}
+	prefix, _, found, err := itW.keyPrefix(key)
+	if err != nil {
+		return "", fmt.Errorf("fail to build page token: %v", err)
+	}
+	if !found {
+		return "", fmt.Errorf("fail to build page token: unknown key %v", key)
+	}
+	return base64.RawURLEncoding.EncodeToString(prefix), nil
+}
@@ -0,0 +1,67 @@
+package lib_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+	_ "github.com/kill-2/badmerger/storage/bolt"
+)
+
+// openPages opens a database with one row for each of the groups a/x, a/y and b/x.
+func openPages(t *testing.T) *lib.DB {
+	db, err := lib.Open(lib.WithStorage("bolt"), lib.WithDir(t.TempDir()),
+		lib.WithKey("g", "string"), lib.WithKey("h", "string"), lib.WithValue("v", "int64"))
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ch := make(chan map[string]any, 3)
+	for _, gh := range [][2]string{{"a", "x"}, {"a", "y"}, {"b", "x"}} {
+		ch <- map[string]any{"g": gh[0], "h": gh[1], "v": int64(1)}
+	}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+	return db
+}
+
+func TestPageSelect(t *testing.T) {
+	db := openPages(t)
+	opts := func(selected ...string) []lib.IteratorOpt {
+		return []lib.IteratorOpt{lib.WithPartialKey("g"), lib.WithPartialKey("h"),
+			lib.WithAgg("n", "sum(v)"), lib.WithSelect(selected...)}
+	}
+
+	_, err := db.NewIterator(opts("g", "n")...).Page(2, "")
+	if err == nil || !strings.Contains(err.Error(), "partial key h") {
+		t.Errorf("got error %v, want partial key h not selected", err)
+	}
+
+	var got []map[string]any
+	token := ""
+	for {
+		page, err := db.NewIterator(opts("g", "h")...).Page(2, token)
+		if err != nil {
+			t.Fatalf("fail to page: %v", err)
+		}
+		got = append(got, page.Rows...)
+		if token = page.Next; token == "" {
+			break
+		}
+	}
+	want := []map[string]any{{"g": "a", "h": "x"}, {"g": "a", "h": "y"}, {"g": "b", "h": "x"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPageRollup(t *testing.T) {
+	db := openPages(t)
+	_, err := db.NewIterator(lib.WithPartialKey("g"), lib.WithAgg("n", "sum(v)"), lib.WithRollup()).Page(1, "")
+	if err == nil || !strings.Contains(err.Error(), "rollup") {
+		t.Errorf("got error %v, want pages refused with rollup", err)
+	}
+}
@@ -0,0 +1,31 @@
+package lib
+
+import "sync"
+
+var recordPool = sync.Pool{
+	New: func() any { return make(map[string]any, 16) },
+}
+
+// NewRecord returns an empty record map from a shared pool. With
+// WithRecycledRecords, Recv hands every record back to the pool once it is
+// inserted, so producers feeding Recv can use NewRecord instead of allocating a
+// fresh map per record.
+func NewRecord() map[string]any {
+	return recordPool.Get().(map[string]any)
+}
+
+// WithRecycledRecords returns a configuration function that lets Recv clear the
+// records it receives once they are inserted and recycle them through NewRecord.
+// Every record sent must then come from NewRecord and be left alone once sent.
+// Without it Recv leaves the maps of the caller as they are.
+func WithRecycledRecords() StorageOpt {
+	return func(w *DbWrapper) error {
+		w.settings.recycleRecords = true
+		return nil
+	}
+}
+
+func releaseRecord(record map[string]any) {
+	clear(record)
+	recordPool.Put(record)
+}
@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// keyTransform coarsens the value of a partial key at query time.
+type keyTransform func(v any) any
+
+// parseKeyTransform builds a transform from its spec:
+//   - mod:N maps integers to their non-negative remainder modulo N
+//   - prefix:P maps strings starting with P to P, leaving other strings alone
+//   - substr:START:END maps strings to their runes from START up to END
+func parseKeyTransform(spec string) (keyTransform, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	switch name {
+	case "mod":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("bad modulus %q in %v", arg, spec)
+		}
+		return func(v any) any {
+			i, ok := toInt64(v)
+			if !ok {
+				return v
+			}
+			return ((i % n) + n) % n
+		}, nil
+	case "prefix":
+		return func(v any) any {
+			if str, ok := v.(string); ok && strings.HasPrefix(str, arg) {
+				return arg
+			}
+			return v
+		}, nil
+	case "substr":
+		startArg, endArg, _ := strings.Cut(arg, ":")
+		start, err := strconv.Atoi(startArg)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("bad start %q in %v", startArg, spec)
+		}
+		end, err := strconv.Atoi(endArg)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("bad end %q in %v", endArg, spec)
+		}
+		return func(v any) any {
+			str, ok := v.(string)
+			if !ok {
+				return v
+			}
+			runes := []rune(str)
+			if start >= len(runes) {
+				return ""
+			}
+			if end > len(runes) {
+				return string(runes[start:])
+			}
+			return string(runes[start:end])
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown key transform %v", spec)
+}
+
+// WithPartialKeyTransform is like WithPartialKey, but groups by the key value
+// after a transform such as "mod:16", "prefix:/api/" or "substr:0:3", which
+// coarsens groups without re-ingesting. As transformed groups are no longer
+// contiguous in storage, they are buffered in memory until iteration ends and
+// emitted in key order. A bad transform makes Iter fail.
+func WithPartialKeyTransform(name, transform string) IteratorOpt {
+	return func(itW *IterWrapper) {
+		t, err := parseKeyTransform(transform)
+		if err != nil {
+			itW.optErr = err
+			return
+		}
+		WithPartialKey(name)(itW)
+		if itW.transforms == nil {
+			itW.transforms = make(map[string]keyTransform)
+		}
+		itW.transforms[name] = t
+	}
+}
+
+type pendingGroup struct {
+	key    map[string]any
+	values []map[string]any
+}
+
+// buffer adds a group read from storage to the transformed group it falls into.
+func (m *Merger) buffer(keyValue map[string]any, valueValues []map[string]any) {
+	for name, t := range m.transforms {
+		if v, ok := keyValue[name]; ok {
+			keyValue[name] = t(v)
+		}
+	}
+
+	var id strings.Builder
+	for _, k := range m.partialKeys {
+		fmt.Fprintf(&id, "%#v\x00", keyValue[k.name])
+	}
+	if m.pending == nil {
+		m.pending = make(map[string]*pendingGroup)
+	}
+	g, ok := m.pending[id.String()]
+	if !ok {
+		g = &pendingGroup{key: keyValue}
+		m.pending[id.String()] = g
+	}
+	// storages reuse their slice for the next group
+	g.values = append(g.values, valueValues...)
+}
+
+// flush emits the buffered groups in key order.
+func (m *Merger) flush(fn func(res map[string]any) error) error {
+	groups := make([]*pendingGroup, 0, len(m.pending))
+	for _, g := range m.pending {
+		groups = append(groups, g)
+	}
+	m.pending = nil
+
+	sort.Slice(groups, func(i, j int) bool {
+		return m.compareKeys(groups[i].key, groups[j].key) < 0
+	})
+	for _, g := range groups {
+		if err := m.emit(g.key, g.values, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareKeys orders two groups by their partial keys, descending in reverse.
+// Values of kinds compareValues does not know are compared as text.
+func (m *Merger) compareKeys(a, b map[string]any) int {
+	for _, k := range m.partialKeys {
+		c, ok := compareValues(a[k.name], b[k.name])
+		if !ok {
+			c = strings.Compare(fmt.Sprint(a[k.name]), fmt.Sprint(b[k.name]))
+		}
+		if m.reverse {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
@@ -0,0 +1,46 @@
+package lib
+
+import "fmt"
+
+// ReverseIterator is implemented by storages that can feed rows to the merger in
+// descending key order, see IterWrapper.Reverse. Like Iterate it should start and
+// stop at Merger.Bounds where it can, from upper down to lower.
+type ReverseIterator interface {
+	IterateReverse(*Merger, func(res map[string]any) error) error
+}
+
+// Reverse makes Iter emit the groups in descending key order, e.g. to read the
+// latest days first. Rows within a group are still aggregated in ascending order,
+// so first and last keep their meaning. The storage must implement ReverseIterator,
+// and spilling is not supported.
+func (itW *IterWrapper) Reverse() *IterWrapper {
+	itW.reverse = true
+	return itW
+}
+
+// Reversed reports whether rows are read in descending key order.
+func (m *Merger) Reversed() bool {
+	return m.reverse
+}
+
+// iterate runs the storage over the merger in the configured direction.
+func (itW *IterWrapper) iterate(fn func(res map[string]any) error) error {
+	if !itW.reverse {
+		return itW.db.Iterate(itW.Merger, fn)
+	}
+	r, ok := itW.db.(ReverseIterator)
+	if !ok {
+		return fmt.Errorf("storage %v can not iterate in reverse", itW.store)
+	}
+	if itW.spillRows > 0 {
+		return fmt.Errorf("reverse can not be combined with spill")
+	}
+	return r.IterateReverse(itW.Merger, fn)
+}
+
+// reverseRows restores the ascending order of the rows of a group read in reverse.
+func reverseRows(rows []map[string]any) {
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+}
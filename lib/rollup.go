@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// WithRollup creates an iterator option that emits subtotals along with the groups,
+// like GROUP BY ROLLUP: grouped by region and host, each region is followed by a
+// group over all its hosts, with host nil, and the scan ends with the grand total,
+// with every partial key nil. The subtotals are combined from the merged groups in
+// the same pass, so every aggregation must be one that spill can combine: first,
+// last, sum, count, min, max and collect with their variants. Subtotals pass through
+// WithHaving, WithSortBy and the other output options like any group. It can not be
+// combined with key transforms or merged states.
+func WithRollup() IteratorOpt {
+	return func(itW *IterWrapper) {
+		itW.rollup = true
+	}
+}
+
+// rollupLevel accumulates the subtotal of the groups sharing the first keys.
+type rollupLevel struct {
+	keys    []any
+	results []any
+	started bool
+}
+
+// withRollup passes the groups to fn, each subtotal once its last group is passed,
+// and returns the function that emits the subtotals still open at the end.
+func (itW *IterWrapper) withRollup(fn func(res map[string]any) error) (func(res map[string]any) error, func() error, error) {
+	if len(itW.transforms) > 0 {
+		return nil, nil, fmt.Errorf("rollup can not be combined with key transforms")
+	}
+	if itW.stateExport != nil || len(itW.stateMerge) > 0 {
+		return nil, nil, fmt.Errorf("rollup can not be combined with states")
+	}
+	for _, agg := range itW.aggs {
+		if !combinable(agg.aggregator) {
+			return nil, nil, fmt.Errorf("aggregation %v can not be rolled up", agg.name)
+		}
+	}
+
+	// levels[i] groups by the first i partial keys
+	levels := make([]rollupLevel, len(itW.partialKeys))
+	emitLevel := func(i int) error {
+		l := &levels[i]
+		if !l.started {
+			return nil
+		}
+		res := make(map[string]any, len(itW.partialKeys)+len(itW.aggs)+1)
+		for j, k := range itW.partialKeys {
+			res[k.name] = nil
+			if j < i {
+				res[k.name] = l.keys[j]
+			}
+		}
+		for j, agg := range itW.aggs {
+			res[agg.name] = l.results[j]
+		}
+		if itW.fingerprint != "" {
+			res[itW.fingerprint] = fingerprintOf(res)
+		}
+		l.started = false
+		return fn(res)
+	}
+
+	rollup := func(res map[string]any) error {
+		keys := make([]any, len(itW.partialKeys))
+		for i, k := range itW.partialKeys {
+			keys[i] = res[k.name]
+		}
+		// close the subtotals of the previous keys, innermost first
+		for i := len(levels) - 1; i > 0; i-- {
+			if levels[i].started && !reflect.DeepEqual(levels[i].keys, keys[:i]) {
+				if err := emitLevel(i); err != nil {
+					return err
+				}
+			}
+		}
+		for i := range levels {
+			l := &levels[i]
+			if !l.started {
+				l.keys = keys[:i]
+				l.results = make([]any, len(itW.aggs))
+				for j, agg := range itW.aggs {
+					l.results[j] = rollupStart(agg.aggregator, res[agg.name])
+				}
+				l.started = true
+				continue
+			}
+			for j, agg := range itW.aggs {
+				if itW.reverse {
+					l.results[j] = combine(agg.aggregator, rollupStart(agg.aggregator, res[agg.name]), l.results[j])
+				} else {
+					l.results[j] = combine(agg.aggregator, l.results[j], res[agg.name])
+				}
+			}
+		}
+		return fn(res)
+	}
+
+	emitRest := func() error {
+		for i := len(levels) - 1; i >= 0; i-- {
+			if err := emitLevel(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return rollup, emitRest, nil
+}
+
+// rollupStart copies the result of the first group of a subtotal, as combining
+// collect appends to it.
+func rollupStart(agg aggregator, v any) any {
+	if _, ok := agg.(collect); ok {
+		return combine(agg, nil, v)
+	}
+	return v
+}
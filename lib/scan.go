@@ -0,0 +1,55 @@
+package lib
+
+import "bytes"
+
+// rawKey and rawValue carry the payloads of a row through a raw merger, see Scan.
+const (
+	rawKey   = "_raw_key_"
+	rawValue = "_raw_value_"
+)
+
+// Scan calls fn with the key and value payloads of every row of s in key order,
+// without decoding them, e.g. to copy rows between storages or serve them remotely.
+// It drives the storage through its Iterate with a merger that makes every row its
+// own group. The payloads are copies fn may keep.
+func Scan(s Storage, fn func(keyPayload, valuePayload []byte) error) error {
+	return ScanRange(s, nil, nil, fn)
+}
+
+// ScanRange is Scan limited to the keys from lower up to but excluding upper,
+// either nil when open, which storages seek to, see Merger.Bounds.
+func ScanRange(s Storage, lower, upper []byte, fn func(keyPayload, valuePayload []byte) error) error {
+	m := &Merger{raw: true, lower: lower, upper: upper}
+	return s.Iterate(m, func(res map[string]any) error {
+		return fn(res[rawKey].([]byte), res[rawValue].([]byte))
+	})
+}
+
+func (m *Merger) restoreRawKey(keyBytes []byte) ([]byte, map[string]any) {
+	m.rowsRead++
+	m.bytesRead += int64(len(keyBytes))
+	if m.namespace != nil {
+		if !bytes.HasPrefix(keyBytes, m.namespace) {
+			return keyBytes, nil
+		}
+		keyBytes = keyBytes[len(m.namespace):]
+	}
+	return keyBytes, map[string]any{rawKey: append([]byte(nil), keyBytes...)}
+}
+
+func (m *Merger) restoreRawValue(valueBytes []byte) map[string]any {
+	m.bytesRead += int64(len(valueBytes))
+	return map[string]any{rawValue: append([]byte(nil), valueBytes...)}
+}
+
+func (m *Merger) emitRaw(keyValue map[string]any, valueValues []map[string]any, fn func(res map[string]any) error) error {
+	if keyValue == nil {
+		return nil
+	}
+	for _, v := range valueValues {
+		if err := fn(map[string]any{rawKey: keyValue[rawKey], rawValue: v[rawValue]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package lib
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Schema describes the key and value fields of a database and how records
+// are encoded into key and value payloads.
+type Schema struct {
+	keys   []key
+	values []value
+	masks  int
+	// format is the value format, 0 meaning Format1
+	format int
+	// compression of the value payloads, "" meaning none, see WithCompression
+	compression string
+	// cipher encrypts the value payloads, nil when they are stored in clear, see WithEncryptionKey
+	cipher *valueCipher
+	// keyCheck is the digest of the key the values are encrypted with
+	keyCheck string
+}
+
+// NewSchema builds a schema from WithKey, WithValue, WithFormat and WithCompression
+// options, ignoring any other option.
+func NewSchema(opts ...StorageOpt) (*Schema, error) {
+	w := &DbWrapper{}
+	for _, opt := range opts {
+		if err := opt(w); err != nil {
+			return nil, fmt.Errorf("fail to handle option: %v", err)
+		}
+	}
+	w.masks = maskSize(len(w.values))
+	w.applyFormat()
+	return &w.Schema, nil
+}
+
+// Keys describes the key fields in key order.
+func (s *Schema) Keys() []Column {
+	columns := make([]Column, len(s.keys))
+	for i, k := range s.keys {
+		columns[i] = Column{Name: k.name, Kind: k.kind}
+	}
+	return columns
+}
+
+// Values describes the value fields.
+func (s *Schema) Values() []Column {
+	columns := make([]Column, len(s.values))
+	for i, v := range s.values {
+		columns[i] = Column{Name: v.name, Kind: v.kind}
+	}
+	return columns
+}
+
+// Hash identifies the schema: databases with equal hashes store their rows identically.
+func (s *Schema) Hash() string {
+	h := fnv.New64a()
+	if s.format > Format1 {
+		fmt.Fprintf(h, "f %d\n", s.format)
+	}
+	if s.compression != "" {
+		fmt.Fprintf(h, "c %s\n", s.compression)
+	}
+	if s.keyCheck != "" {
+		fmt.Fprintf(h, "e %s\n", s.keyCheck)
+	}
+	for _, k := range s.keys {
+		fmt.Fprintf(h, "k %s %s\n", k.name, k.fullKind())
+	}
+	for _, v := range s.values {
+		fmt.Fprintf(h, "v %s %s\n", v.name, v.fullKind())
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func maskSize(values int) int {
+	return (values / 8) + 1
+}
+
+// EncodeRecord encodes record into the key and value payloads stored by the database.
+// Unlike ingestion through Recv, which stores unrepresentable values as best it can,
+// it returns an error when a key field is missing or a field value can not be stored
+// exactly in its kind, so every record it accepts is restored identically by DecodeRecord,
+// up to the Go type each kind decodes to.
+func EncodeRecord(s *Schema, record map[string]any) ([]byte, []byte, error) {
+	if s.bucketed() {
+		record = s.flatten(record)
+		s.applyBuckets(record)
+	}
+	for _, f := range s.keys {
+		v, ok := f.lookup(record)
+		if !ok || v == nil {
+			return nil, nil, fmt.Errorf("missing key field %v", f.name)
+		}
+		if err := f.validate(v); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, f := range s.values {
+		if v, ok := f.lookup(record); ok && v != nil {
+			if err := f.validate(v); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	keyPayload, valuePayload := s.encode(record)
+	return keyPayload, valuePayload, nil
+}
+
+// DecodeRecord decodes key and value payloads produced by EncodeRecord back into a record.
+// Null value fields are omitted. It returns an error when the payloads do not match the schema.
+func DecodeRecord(s *Schema, keyPayload, valuePayload []byte) (record map[string]any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			record, err = nil, fmt.Errorf("fail to decode record: %v", r)
+		}
+	}()
+
+	record = make(map[string]any, len(s.keys)+len(s.values))
+	offset := 0
+	for _, f := range s.keys {
+		v, step := f.decode(keyPayload[offset:])
+		record[f.name] = v
+		offset += step
+	}
+	if offset != len(keyPayload) {
+		return nil, fmt.Errorf("%d trailing bytes in key", len(keyPayload)-offset)
+	}
+
+	if len(s.values) == 0 {
+		return record, nil
+	}
+	valuePayload = decompressValue(s.compression, s.cipher.open(valuePayload))
+	valueHead := valuePayload[:s.masks]
+	valueBody := valuePayload[s.masks:]
+	offset = 0
+	for i, f := range s.values {
+		if (valueHead[i/8] & (1 << (7 - (i % 8)))) != 0 {
+			continue
+		}
+		v, step := f.decode(valueBody[offset:])
+		record[f.name] = v
+		offset += step
+	}
+	if offset != len(valueBody) {
+		return nil, fmt.Errorf("%d trailing bytes in value", len(valueBody)-offset)
+	}
+	return record, nil
+}
+
+// flatten copies the fields of the schema found in record into a new record,
+// keyed by their full dotted names.
+func (s *Schema) flatten(record map[string]any) map[string]any {
+	flat := make(map[string]any, len(s.keys)+len(s.values))
+	for _, f := range s.keys {
+		if v, ok := f.lookup(record); ok {
+			flat[f.name] = v
+		}
+	}
+	for _, f := range s.values {
+		if v, ok := f.lookup(record); ok {
+			flat[f.name] = v
+		}
+	}
+	return flat
+}
+
+func fieldPath(name string) []string {
+	if !strings.Contains(name, ".") {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// lookup finds the field in record, descending into nested objects along a
+// dotted name unless the record has a top-level field with that exact name.
+func (f field) lookup(record map[string]any) (any, bool) {
+	if v, ok := record[f.name]; ok || f.path == nil {
+		return v, ok
+	}
+	var cur any = record
+	for _, part := range f.path {
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// set replaces the field value found by lookup.
+func (f field) set(record map[string]any, v any) {
+	if _, ok := record[f.name]; ok || f.path == nil {
+		record[f.name] = v
+		return
+	}
+	cur := record
+	for _, part := range f.path[:len(f.path)-1] {
+		next, ok := cur[part].(map[string]any)
+		if !ok {
+			return
+		}
+		cur = next
+	}
+	cur[f.path[len(f.path)-1]] = v
+}
+
+func (f field) validate(v any) error {
+	if f.check == nil {
+		return nil
+	}
+	if err := f.check(v); err != nil {
+		return fmt.Errorf("field %v: %w", f.name, err)
+	}
+	return nil
+}
+
+func (s *Schema) encode(record map[string]any) ([]byte, []byte) {
+	keyPayload := make([]byte, 0)
+	for _, f := range s.keys {
+		fieldValue, _ := f.lookup(record)
+		fieldValueBin := f.encode(fieldValue)
+		keyPayload = append(keyPayload, fieldValueBin...)
+	}
+
+	var valuePayload []byte
+	if len(s.values) > 0 {
+		valuePayload = make([]byte, s.masks)
+		for i, f := range s.values {
+			fieldValue, ok := f.lookup(record)
+			if !ok || (fieldValue == nil) {
+				valuePayload[i/8] |= (1 << (7 - (i % 8)))
+				continue
+			}
+			fieldValueBin := f.encode(fieldValue)
+			valuePayload = append(valuePayload, fieldValueBin...)
+		}
+		valuePayload = s.cipher.seal(compressValue(s.compression, valuePayload))
+	}
+
+	return keyPayload, valuePayload
+}
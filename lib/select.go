@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"fmt"
+	"slices"
+)
+
+// WithSelect creates an iterator option that limits the merged output maps and
+// Columns to the partial keys and aggregations names, by their names before
+// WithAlias, e.g. to group and aggregate by fields that are only needed by
+// WithHaving or WithSortBy. Several WithSelect add up.
+func WithSelect(names ...string) IteratorOpt {
+	return func(itW *IterWrapper) {
+		itW.selected = append(itW.selected, names...)
+	}
+}
+
+// selectColumns keeps the columns of WithSelect, all without it.
+func (itW *IterWrapper) selectColumns(columns []Column) []Column {
+	if len(itW.selected) == 0 {
+		return columns
+	}
+	return slices.DeleteFunc(columns, func(c Column) bool {
+		return !slices.Contains(itW.selected, c.Name)
+	})
+}
+
+// withSelect drops the fields not selected from every output map before passing
+// it to fn.
+func (itW *IterWrapper) withSelect(fn func(res map[string]any) error) (func(res map[string]any) error, error) {
+	names := make(map[string]bool)
+	for _, c := range itW.Merger.Columns() {
+		names[c.Name] = true
+	}
+	for _, name := range itW.selected {
+		if !names[name] {
+			return nil, fmt.Errorf("no output field %v to select", name)
+		}
+	}
+	return func(res map[string]any) error {
+		for name := range res {
+			if !slices.Contains(itW.selected, name) {
+				delete(res, name)
+			}
+		}
+		return fn(res)
+	}, nil
+}
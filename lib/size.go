@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// SizePolicy decides what Recv does with string, bytes, json and array values too long
+// for their length header, which would otherwise be stored corrupted. Format1 headers
+// take 32767 bytes or elements, see WithFormat for wider ones.
+type SizePolicy string
+
+const (
+	// SizeError makes Recv fail on the offending record. It is the default.
+	SizeError SizePolicy = "error"
+	// SizeTruncate cuts strings at a character boundary, bytes to the bytes that fit
+	// and arrays to the first elements that fit, and stores json values as null since a cut would not parse.
+	SizeTruncate SizePolicy = "truncate"
+)
+
+// defaultMaxKeySize is the largest key badger accepts, other storages take at least as much.
+const defaultMaxKeySize = 65000
+
+// WithSizePolicy returns a configuration function that sets how values too long
+// for their kind are ingested. Either way they are counted in Usage.Oversized.
+func WithSizePolicy(policy SizePolicy) StorageOpt {
+	return func(w *DbWrapper) error {
+		switch policy {
+		case SizeError, SizeTruncate:
+			w.settings.size = policy
+			return nil
+		}
+		return fmt.Errorf("unknown size policy %q", policy)
+	}
+}
+
+// WithMaxKeySize returns a configuration function that caps the encoded size of the
+// keys of a row; Recv fails on records with larger keys instead of the storage failing
+// on them later. The default is 65000 bytes; lmdb for one takes only 511.
+func WithMaxKeySize(n int) StorageOpt {
+	return func(w *DbWrapper) error {
+		if n <= 0 {
+			return fmt.Errorf("max key size %d is not positive", n)
+		}
+		w.settings.maxKeySize = n
+		return nil
+	}
+}
+
+type sizedField struct {
+	field
+	limit int
+}
+
+func hasLengthHeader(kind string) bool {
+	_, isArray := arrayElemKind(kind)
+	return kind == "string" || kind == "bytes" || kind == "json" || kind == "map" || isArray
+}
+
+// checkSizes counts values too long for their length header and applies the size policy.
+func (db *DbWrapper) checkSizes(record map[string]any) error {
+	for _, f := range db.sizedFields {
+		v, ok := f.lookup(record)
+		if !ok || v == nil {
+			continue
+		}
+		size := sizeOf(f.kind, v)
+		if size <= f.limit {
+			continue
+		}
+
+		if db.usage.Oversized == nil {
+			db.usage.Oversized = make(map[string]int64)
+		}
+		db.usage.Oversized[f.name]++
+
+		if db.settings.size == SizeTruncate {
+			f.set(record, truncate(f.kind, v, f.limit))
+			continue
+		}
+		return fmt.Errorf("field %v: %v of %d exceeds %d", f.name, f.kind, size, f.limit)
+	}
+	return nil
+}
+
+func (db *DbWrapper) checkKeySize(keys []byte) error {
+	limit := db.settings.maxKeySize
+	if limit == 0 {
+		limit = defaultMaxKeySize
+	}
+	if len(keys) > limit {
+		return fmt.Errorf("key of %d bytes exceeds %d", len(keys), limit)
+	}
+	return nil
+}
+
+// sizeOf reports the length a value takes in its header: bytes for strings, bytes
+// and json, elements for arrays.
+func sizeOf(kind string, v any) int {
+	var size int
+	switch {
+	case kind == "string":
+		s, _ := v.(string)
+		size = len(s)
+	case kind == "bytes":
+		size = len(toBytesBinary(v)) - 2
+	case kind == "json", kind == "map":
+		body, _ := json.Marshal(v)
+		size = len(body)
+	default:
+		arr, _ := toAnySlice(v)
+		size = len(arr)
+	}
+	return size
+}
+
+func truncate(kind string, v any, limit int) any {
+	switch {
+	case kind == "string":
+		s := v.(string)
+		n := limit
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		return strings.Clone(s[:n])
+	case kind == "bytes":
+		return toBytesBinary(v)[2 : 2+limit]
+	case kind == "json", kind == "map":
+		return nil
+	}
+	arr, _ := toAnySlice(v)
+	return arr[:limit]
+}
@@ -0,0 +1,67 @@
+package lib
+
+import "fmt"
+
+// Snapshotter is implemented by storages that can pin a consistent view of their
+// rows, see DbWrapper.Snapshot.
+type Snapshotter interface {
+	Snapshot() (View, error)
+}
+
+// View is a read-only view of a storage as of the moment it was taken. It iterates
+// like the storage, rows committed later stay out of it, and Close releases it
+// without closing the storage. Views may implement ReverseIterator too.
+type View interface {
+	Iterate(*Merger, func(res map[string]any) error) error
+	Close() error
+}
+
+// Snapshot returns an iterator pinned to the rows committed so far, so a long
+// aggregation can run while Recv or other inserters keep ingesting, without seeing
+// groups half written. The iterator may run Iter any number of times over the same
+// view, which holds on to storage resources, e.g. badger keeps older versions of
+// rows, until Release. The storage must implement Snapshotter.
+func (db *DbWrapper) Snapshot(opts ...IteratorOpt) (*IterWrapper, error) {
+	s, ok := db.db.(Snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("storage %v can not take snapshots", db.store)
+	}
+	view, err := s.Snapshot()
+	if err != nil {
+		return nil, fmt.Errorf("fail to take snapshot %v", err)
+	}
+	pinned := *db
+	pinned.db = &snapshotStorage{view}
+	itW := pinned.NewIterator(opts...)
+	itW.release = view.Close
+	return itW, nil
+}
+
+// Release releases the view of an iterator returned by Snapshot. Iterators of
+// NewIterator have nothing to release.
+func (itW *IterWrapper) Release() error {
+	if itW.release == nil {
+		return nil
+	}
+	release := itW.release
+	itW.release = nil
+	return release()
+}
+
+// snapshotStorage serves the iterations of a snapshot from its view.
+type snapshotStorage struct {
+	View
+}
+
+func (ss *snapshotStorage) NewInserter() Inserter {
+	return readOnlyInserter{"a snapshot"}
+}
+
+// IterateReverse implements ReverseIterator for views that do.
+func (ss *snapshotStorage) IterateReverse(m *Merger, fn func(res map[string]any) error) error {
+	r, ok := ss.View.(ReverseIterator)
+	if !ok {
+		return fmt.Errorf("snapshot can not iterate in reverse")
+	}
+	return r.IterateReverse(m, fn)
+}
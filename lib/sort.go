@@ -0,0 +1,118 @@
+package lib
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+)
+
+// WithSortBy creates an iterator option that emits the merged groups ordered by
+// the output field name, a partial key or aggregation before WithAlias, descending
+// with desc, instead of in key order. Further WithSortBy break ties, remaining ties
+// keep key order, and groups without a value for the field come last. The groups are
+// held in memory until the scan ends; with WithLimit only the groups up to offset
+// plus limit are kept, so top-N queries stay small. Pages can not be sorted.
+func WithSortBy(name string, desc bool) IteratorOpt {
+	return func(itW *IterWrapper) {
+		itW.sortBy = append(itW.sortBy, sortColumn{name: name, desc: desc})
+	}
+}
+
+type sortColumn struct {
+	name string
+	desc bool
+}
+
+// sortedGroup is a merged group with its position in key order.
+type sortedGroup struct {
+	res map[string]any
+	seq int
+}
+
+// groupSorter collects merged groups to emit them sorted. With keep it holds only
+// the first keep groups in a heap whose root is the group sorting last.
+type groupSorter struct {
+	columns []sortColumn
+	groups  []sortedGroup
+	keep    int
+	seq     int
+}
+
+// before reports whether a sorts before b.
+func (s *groupSorter) before(a, b sortedGroup) bool {
+	for _, c := range s.columns {
+		av, bv := a.res[c.name], b.res[c.name]
+		if av == nil || bv == nil {
+			if (av == nil) != (bv == nil) {
+				return bv == nil
+			}
+			continue
+		}
+		cmp, ok := compareValues(av, bv)
+		if !ok || cmp == 0 {
+			continue
+		}
+		if c.desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+	return a.seq < b.seq
+}
+
+func (s *groupSorter) Len() int           { return len(s.groups) }
+func (s *groupSorter) Less(i, j int) bool { return s.before(s.groups[j], s.groups[i]) }
+func (s *groupSorter) Swap(i, j int)      { s.groups[i], s.groups[j] = s.groups[j], s.groups[i] }
+func (s *groupSorter) Push(x any)         { s.groups = append(s.groups, x.(sortedGroup)) }
+func (s *groupSorter) Pop() any {
+	g := s.groups[len(s.groups)-1]
+	s.groups = s.groups[:len(s.groups)-1]
+	return g
+}
+
+func (s *groupSorter) add(res map[string]any) error {
+	g := sortedGroup{res: res, seq: s.seq}
+	s.seq++
+	switch {
+	case s.keep == 0:
+		s.groups = append(s.groups, g)
+	case len(s.groups) < s.keep:
+		heap.Push(s, g)
+	case s.before(g, s.groups[0]):
+		s.groups[0] = g
+		heap.Fix(s, 0)
+	}
+	return nil
+}
+
+// emit passes the collected groups to fn in order.
+func (s *groupSorter) emit(fn func(res map[string]any) error) error {
+	groups := s.groups
+	s.groups = nil
+	sort.Slice(groups, func(i, j int) bool { return s.before(groups[i], groups[j]) })
+	for _, g := range groups {
+		if err := fn(g.res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withSort collects the output maps instead of passing them to fn, which the
+// returned emit does once the iteration is done.
+func (itW *IterWrapper) withSort(fn func(res map[string]any) error) (func(res map[string]any) error, func() error, error) {
+	names := make(map[string]bool)
+	for _, c := range itW.Merger.Columns() {
+		names[c.Name] = true
+	}
+	for _, c := range itW.sortBy {
+		if !names[c.name] {
+			return nil, nil, fmt.Errorf("no output field %v to sort by", c.name)
+		}
+	}
+	s := &groupSorter{columns: itW.sortBy}
+	if itW.limit > 0 {
+		s.keep = itW.offset + itW.limit
+	}
+	return s.add, func() error { return s.emit(fn) }, nil
+}
@@ -0,0 +1,326 @@
+package lib
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// WithSpill creates an iterator option that bounds the value rows a group keeps in
+// memory. Rows beyond maxRows are written to a temporary file and aggregated from
+// there chunk by chunk, so a giant group degrades to disk speed instead of running
+// out of memory. Spilled groups support the aggregations whose results over chunks
+// can be combined (first, last, sum, count, min, max and collect with their
+// variants) and median, which sorts externally; others fail the group, see Emit.
+// Spilling is off with key transforms, whose groups are buffered anyway, and it can
+// not be combined with a key bucketed before other partial keys.
+func WithSpill(maxRows int) IteratorOpt {
+	return func(itW *IterWrapper) {
+		if maxRows <= 0 {
+			itW.optErr = fmt.Errorf("spill threshold %d is not positive", maxRows)
+			return
+		}
+		itW.spillRows = maxRows
+	}
+}
+
+type spillFile struct {
+	f    *os.File
+	w    *bufio.Writer
+	rows int
+}
+
+// spillValue appends a raw value row of the current group to its spill file.
+func (m *Merger) spillValue(valueBytes []byte) error {
+	if m.spill == nil {
+		f, err := os.CreateTemp("", TempPrefix+"spill-")
+		if err != nil {
+			return err
+		}
+		m.spill = &spillFile{f: f, w: bufio.NewWriter(f)}
+	}
+	if _, err := m.spill.w.Write(binary.AppendUvarint(nil, uint64(len(valueBytes)))); err != nil {
+		return err
+	}
+	if _, err := m.spill.w.Write(valueBytes); err != nil {
+		return err
+	}
+	m.spill.rows++
+	return nil
+}
+
+// closeSpill forgets the current group, removing its spill file.
+func (m *Merger) closeSpill() {
+	m.groupRows = 0
+	if m.spill != nil {
+		m.spill.f.Close()
+		os.Remove(m.spill.f.Name())
+		m.spill = nil
+	}
+}
+
+func (m *Merger) readSpilled(r *bufio.Reader) (valueMap map[string]any, err error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	valueBytes := make([]byte, l)
+	if _, err := io.ReadFull(r, valueBytes); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("fail to decode value: %v", r)
+		}
+	}()
+	return m.decodeValue(valueBytes), nil
+}
+
+// mergeSpilled is Merge for a group whose rows beyond spillRows were spilled: the rows
+// in memory and every chunk of spilled rows are aggregated on their own and the
+// results combined.
+func (m *Merger) mergeSpilled(keyValue map[string]any, valueValues []map[string]any) (map[string]any, error) {
+	for _, agg := range m.aggs {
+		if _, ok := agg.aggregator.(median); !ok && !combinable(agg.aggregator) {
+			return nil, fmt.Errorf("aggregation %v can not run on a group of %d rows spilled to disk", agg.name, m.groupRows)
+		}
+	}
+	if err := m.spill.w.Flush(); err != nil {
+		return nil, fmt.Errorf("fail to spill: %v", err)
+	}
+	if _, err := m.spill.f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("fail to read spill: %v", err)
+	}
+
+	results := make([]any, len(m.aggs))
+	medians := make(map[int]*externalMedian)
+	defer func() {
+		for _, em := range medians {
+			em.close()
+		}
+	}()
+	rows := valueValues
+	if len(rows) > m.spillRows {
+		rows = rows[:m.spillRows]
+	}
+	for i, agg := range m.aggs {
+		if md, ok := agg.aggregator.(median); ok {
+			em, err := newExternalMedian()
+			if err != nil {
+				return nil, err
+			}
+			medians[i] = em
+			if err := em.addRun(md.name, rows); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		results[i] = agg.on(rows)
+	}
+
+	r := bufio.NewReader(m.spill.f)
+	chunk := make([]map[string]any, 0, m.spillRows)
+	for {
+		chunk = chunk[:0]
+		for len(chunk) < m.spillRows {
+			row, err := m.readSpilled(r)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			chunk = append(chunk, row)
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		for i, agg := range m.aggs {
+			if em, ok := medians[i]; ok {
+				if err := em.addRun(agg.aggregator.(median).name, chunk); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			results[i] = combine(agg.aggregator, results[i], agg.on(chunk))
+		}
+	}
+
+	for i, agg := range m.aggs {
+		if em, ok := medians[i]; ok {
+			res, err := em.result()
+			if err != nil {
+				return nil, err
+			}
+			results[i] = res
+		}
+		keyValue[agg.name] = results[i]
+	}
+	if m.fingerprint != "" {
+		keyValue[m.fingerprint] = fingerprintOf(keyValue)
+	}
+	return keyValue, nil
+}
+
+// combinable reports whether combine can join the results of agg over parts of a group.
+func combinable(agg aggregator) bool {
+	switch agg.(type) {
+	case first, firstNotNull, last, lastNotNull, sum, mapSum, count, groupSize, min, max, collect:
+		return true
+	}
+	return false
+}
+
+// combine joins the results of agg over two consecutive parts of a group into its
+// result over both. sum, map_sum, min and max simply run again over the partial results.
+func combine(agg aggregator, a, b any) any {
+	switch t := agg.(type) {
+	case first:
+		return a
+	case firstNotNull:
+		if a == nil {
+			return b
+		}
+		return a
+	case last:
+		return b
+	case lastNotNull:
+		if b == nil {
+			return a
+		}
+		return b
+	case sum:
+		return t.on([]map[string]any{{t.name: a}, {t.name: b}})
+	case mapSum:
+		return t.on([]map[string]any{{t.name: a}, {t.name: b}})
+	case min:
+		return t.on([]map[string]any{{t.name: a}, {t.name: b}})
+	case max:
+		return t.on([]map[string]any{{t.name: a}, {t.name: b}})
+	case count, groupSize:
+		ai, _ := toInt64(a)
+		bi, _ := toInt64(b)
+		return ai + bi
+	case collect:
+		av, _ := a.([]any)
+		bv, _ := b.([]any)
+		return append(av, bv...)
+	}
+	return nil
+}
+
+// externalMedian finds the median of more values than fit in memory: values are
+// written to a temporary file in sorted runs, which are merged when reading.
+type externalMedian struct {
+	f    *os.File
+	runs []medianRun
+	n    int64
+}
+
+type medianRun struct {
+	offset, count int64
+}
+
+func newExternalMedian() (*externalMedian, error) {
+	f, err := os.CreateTemp("", TempPrefix+"median-")
+	if err != nil {
+		return nil, err
+	}
+	return &externalMedian{f: f}, nil
+}
+
+func (e *externalMedian) addRun(name string, rows []map[string]any) error {
+	values := make([]float64, 0, len(rows))
+	for _, row := range rows {
+		if f, ok := toFloat64(row[name]); ok {
+			values = append(values, f)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Float64s(values)
+
+	b := make([]byte, 8*len(values))
+	for i, f := range values {
+		binary.BigEndian.PutUint64(b[8*i:], math.Float64bits(f))
+	}
+	if _, err := e.f.WriteAt(b, e.n*8); err != nil {
+		return fmt.Errorf("fail to spill median: %v", err)
+	}
+	e.runs = append(e.runs, medianRun{offset: e.n * 8, count: int64(len(values))})
+	e.n += int64(len(values))
+	return nil
+}
+
+func (e *externalMedian) result() (any, error) {
+	if e.n == 0 {
+		return nil, nil
+	}
+	h := &runHeap{}
+	for _, run := range e.runs {
+		it := &runIter{r: bufio.NewReader(io.NewSectionReader(e.f, run.offset, run.count*8)), left: run.count}
+		if err := it.next(); err != nil {
+			return nil, err
+		}
+		heap.Push(h, it)
+	}
+
+	lo, hi := (e.n-1)/2, e.n/2
+	var loVal float64
+	for i := int64(0); ; i++ {
+		it := (*h)[0]
+		if i == lo {
+			loVal = it.value
+		}
+		if i == hi {
+			return (loVal + it.value) / 2, nil
+		}
+		if it.left == 0 {
+			heap.Pop(h)
+			continue
+		}
+		if err := it.next(); err != nil {
+			return nil, err
+		}
+		heap.Fix(h, 0)
+	}
+}
+
+func (e *externalMedian) close() {
+	e.f.Close()
+	os.Remove(e.f.Name())
+}
+
+type runIter struct {
+	r     *bufio.Reader
+	left  int64
+	value float64
+}
+
+func (it *runIter) next() error {
+	var b [8]byte
+	if _, err := io.ReadFull(it.r, b[:]); err != nil {
+		return fmt.Errorf("fail to read median run: %v", err)
+	}
+	it.value = math.Float64frombits(binary.BigEndian.Uint64(b[:]))
+	it.left--
+	return nil
+}
+
+type runHeap []*runIter
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return h[i].value < h[j].value }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(*runIter)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return it
+}
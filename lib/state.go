@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// GroupState is the aggregation state of one group as computed by one run, tagged
+// with the window, such as a day, the run covered. States of successive runs can be
+// merged with WithStateMerge to assemble e.g. a rolling week from daily runs
+// without scanning the week's raw rows again.
+type GroupState struct {
+	Window string         `json:"window"`
+	Key    map[string]any `json:"key"`
+	State  map[string]any `json:"state"`
+}
+
+// WithStateExport creates an iterator option that passes the state of every group
+// computed by this run to fn, before any merge with WithStateMerge. Only aggregations
+// whose results can be combined are supported, see combinable; others make Iter fail.
+func WithStateExport(window string, fn func(GroupState) error) IteratorOpt {
+	return func(itW *IterWrapper) {
+		itW.stateWindow = window
+		itW.stateExport = fn
+	}
+}
+
+// WithStateMerge creates an iterator option that merges states exported by earlier
+// runs into the results, oldest first, so first and last keep their meaning across
+// windows. Groups only found in the states are emitted after the scan, sorted by key.
+// Values decoded from JSON are converted back to the kinds of their columns.
+func WithStateMerge(states ...GroupState) IteratorOpt {
+	return func(itW *IterWrapper) {
+		itW.stateMerge = append(itW.stateMerge, states...)
+	}
+}
+
+// withStates wraps fn to export and merge group states, returning the wrapped fn
+// and a function emitting the groups only found in merged states.
+func (itW *IterWrapper) withStates(fn func(res map[string]any) error) (func(res map[string]any) error, func() error, error) {
+	for _, agg := range itW.aggs {
+		if !combinable(agg.aggregator) {
+			return nil, nil, fmt.Errorf("aggregation %v can not be kept as state", agg.name)
+		}
+	}
+
+	kinds := make(map[string]string)
+	for _, c := range itW.Merger.Columns() {
+		kinds[c.Name] = c.Kind
+	}
+	prior := make(map[string]*pendingGroup)
+	for _, s := range itW.stateMerge {
+		res := make(map[string]any, len(s.Key)+len(s.State))
+		for _, k := range itW.partialKeys {
+			res[k.name] = fromState(kinds[k.name], s.Key[k.name])
+		}
+		id, err := itW.stateKey(res)
+		if err != nil {
+			return nil, nil, err
+		}
+		g, seen := prior[id]
+		for _, agg := range itW.aggs {
+			v := fromState(kinds[agg.name], s.State[agg.name])
+			if seen {
+				v = combine(agg.aggregator, g.key[agg.name], v)
+			}
+			res[agg.name] = v
+		}
+		prior[id] = &pendingGroup{key: res}
+	}
+
+	wrapped := func(res map[string]any) error {
+		id, err := itW.stateKey(res)
+		if err != nil {
+			return err
+		}
+		if itW.stateExport != nil {
+			state := GroupState{Window: itW.stateWindow, Key: make(map[string]any), State: make(map[string]any)}
+			for _, k := range itW.partialKeys {
+				state.Key[k.name] = res[k.name]
+			}
+			for _, agg := range itW.aggs {
+				state.State[agg.name] = res[agg.name]
+			}
+			if err := itW.stateExport(state); err != nil {
+				return err
+			}
+		}
+		if g, ok := prior[id]; ok {
+			for _, agg := range itW.aggs {
+				res[agg.name] = combine(agg.aggregator, g.key[agg.name], res[agg.name])
+			}
+			itW.refingerprint(res)
+			delete(prior, id)
+		}
+		return fn(res)
+	}
+
+	rest := func() error {
+		groups := make([]*pendingGroup, 0, len(prior))
+		for _, g := range prior {
+			groups = append(groups, g)
+		}
+		sort.Slice(groups, func(i, j int) bool {
+			return itW.compareKeys(groups[i].key, groups[j].key) < 0
+		})
+		for _, g := range groups {
+			itW.refingerprint(g.key)
+			if err := fn(g.key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return wrapped, rest, nil
+}
+
+// stateKey identifies the group of res by its partial keys.
+func (m *Merger) stateKey(res map[string]any) (string, error) {
+	key := make(map[string]any, len(m.partialKeys))
+	for _, k := range m.partialKeys {
+		key[k.name] = res[k.name]
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return "", fmt.Errorf("fail to marshal group key: %v", err)
+	}
+	return string(b), nil
+}
+
+func (m *Merger) refingerprint(res map[string]any) {
+	if m.fingerprint != "" {
+		delete(res, m.fingerprint)
+		res[m.fingerprint] = fingerprintOf(res)
+	}
+}
+
+// fromState converts a value read back from JSON to the given column kind.
+func fromState(kind string, v any) any {
+	if elem, ok := arrayElemKind(kind); ok {
+		if arr, ok := v.([]any); ok {
+			values := make([]any, len(arr))
+			for i := range arr {
+				values[i] = fromState(elem, arr[i])
+			}
+			return values
+		}
+		return v
+	}
+
+	text := fmt.Sprint(v)
+	switch v.(type) {
+	case json.Number, float64, string:
+	default:
+		return v
+	}
+	switch kind {
+	case "int8", "int16", "int32", "int64":
+		if f, ok := v.(float64); ok {
+			return int64(f)
+		}
+		var i int64
+		if _, err := fmt.Sscan(text, &i); err == nil {
+			return i
+		}
+	case "float32", "float64":
+		var f float64
+		if _, err := fmt.Sscan(text, &f); err == nil {
+			return f
+		}
+	case "decimal":
+		if d, err := ParseDecimal(text); err == nil {
+			return d
+		}
+	case "bigint":
+		if i, ok := new(big.Int).SetString(text, 10); ok {
+			return i
+		}
+	}
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	}
+	return v
+}
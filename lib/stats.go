@@ -0,0 +1,59 @@
+package lib
+
+import "fmt"
+
+// Counter is implemented by storages that can count their rows faster than a full
+// Iterate, e.g. from their own metadata, see Stats.
+type Counter interface {
+	// Count returns the number of rows, and whether the count is exact rather than
+	// an estimate.
+	Count() (n int64, exact bool, err error)
+}
+
+// Sizer is implemented by storages that know the bytes their rows take, where the
+// size of the directory would be wrong, e.g. for storages kept in memory.
+type Sizer interface {
+	Size() (int64, error)
+}
+
+// Stats describes how much a database holds.
+type Stats struct {
+	Storage string `json:"storage"`
+	Rows    int64  `json:"rows"`
+	Bytes   int64  `json:"bytes"`
+	// Approximate is set when Rows is an estimate of the storage.
+	Approximate bool `json:"approximate,omitempty"`
+}
+
+// Stats counts the rows of the database and the bytes they take, to check the
+// volume of an ingestion before running expensive aggregations. Storages
+// implementing Counter and Sizer answer from their metadata; others are scanned
+// without decoding the rows, and measured by the size of their directory.
+func (db *DbWrapper) Stats() (Stats, error) {
+	st := Stats{Storage: db.store}
+	if c, ok := db.db.(Counter); ok {
+		n, exact, err := c.Count()
+		if err != nil {
+			return st, fmt.Errorf("fail to count rows %v", err)
+		}
+		st.Rows, st.Approximate = n, !exact
+	} else {
+		err := Scan(db.db, func(keyPayload, valuePayload []byte) error {
+			st.Rows++
+			return nil
+		})
+		if err != nil {
+			return st, fmt.Errorf("fail to count rows %v", err)
+		}
+	}
+	if s, ok := db.db.(Sizer); ok {
+		n, err := s.Size()
+		if err != nil {
+			return st, fmt.Errorf("fail to measure size %v", err)
+		}
+		st.Bytes = n
+	} else {
+		st.Bytes = dirBytes(db.dir)
+	}
+	return st, nil
+}
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// WithStorageOption returns a configuration function that passes a tuning option
+// through to the storage builder, e.g. ("memtable_size", "256M") for badgerdb or
+// ("partition_num", "8") for lotus, so storages can be tuned without forking them.
+// The options each storage knows are listed with its builder; builders fail to open
+// on keys they do not know rather than ignore a typo. Setting a key again replaces it.
+func WithStorageOption(key, value string) StorageOpt {
+	return func(w *DbWrapper) error {
+		if key == "" {
+			return fmt.Errorf("storage option without a key")
+		}
+		if w.settings.storage.Options == nil {
+			w.settings.storage.Options = make(map[string]string)
+		}
+		w.settings.storage.Options[key] = value
+		return nil
+	}
+}
+
+// ParseSize parses a byte count with an optional K, M or G suffix, powers of 1024,
+// for the size options of storages.
+func ParseSize(s string) (int64, error) {
+	shift := 0
+	if s != "" {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			shift = 10
+		case "M":
+			shift = 20
+		case "G":
+			shift = 30
+		}
+	}
+	digits := s
+	if shift > 0 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n << shift, nil
+}
@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithPartialKeyBucketed is like WithPartialKey for a timestamp or date key, but
+// groups by the key truncated to buckets of size, e.g. "1h" or "1d", so one
+// database answers hourly and daily rollups without re-ingesting. size is a Go
+// duration or a number of days like "7d", whole days for dates. Buckets start at
+// the zero time: days start at midnight UTC and weeks on Monday. Keys are truncated
+// while they are read, see Merger.RestoreKey, so groups stream in key order when
+// the bucketed key is the last partial key; before others its groups are buffered
+// like with WithPartialKeyTransform, and it can not be combined with WithRollup,
+// WithGroupSample or WithSpill. Buckets can not be paged, see Page. A bad size or
+// key makes Iter fail.
+func WithPartialKeyBucketed(name, size string) IteratorOpt {
+	return func(itW *IterWrapper) {
+		d, err := parseBucketSize(size)
+		if err != nil {
+			itW.optErr = err
+			return
+		}
+		for _, k := range itW.keys {
+			if k.name != name {
+				continue
+			}
+			switch {
+			case k.kind != "timestamp" && k.kind != "date":
+				itW.optErr = fmt.Errorf("key %v of kind %v can not be bucketed", name, k.kind)
+				return
+			case k.kind == "date" && d%(24*time.Hour) != 0:
+				itW.optErr = fmt.Errorf("date key %v needs buckets of whole days, not %v", name, size)
+				return
+			}
+			WithPartialKey(name)(itW)
+			if itW.buckets == nil {
+				itW.buckets = make(map[string]time.Duration)
+			}
+			itW.buckets[name] = d
+			return
+		}
+		itW.optErr = fmt.Errorf("no key %v to bucket", name)
+	}
+}
+
+// parseBucketSize reads a duration such as "15m" or "1h", or days such as "7d".
+func parseBucketSize(size string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(size, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("bad bucket size %q", size)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(size); err != nil {
+			return 0, fmt.Errorf("bad bucket size %q", size)
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("bad bucket size %q", size)
+	}
+	return d, nil
+}
+
+// truncateToBucket maps a decoded timestamp or date to the start of its bucket.
+func truncateToBucket(v any, d time.Duration) any {
+	switch t := v.(type) {
+	case time.Time:
+		return t.UTC().Truncate(d)
+	case string:
+		day, err := time.Parse(time.DateOnly, t)
+		if err != nil {
+			return v
+		}
+		return day.Truncate(d).Format(time.DateOnly)
+	}
+	return v
+}
+
+// bucketBeforeKeys returns the first bucketed key that comes before other partial
+// keys, which applyBuckets turns into a key transform, or "" when there is none.
+func (itW *IterWrapper) bucketBeforeKeys() string {
+	for i, k := range itW.partialKeys {
+		if _, ok := itW.buckets[k.name]; ok && i < len(itW.partialKeys)-1 {
+			return k.name
+		}
+	}
+	return ""
+}
+
+// applyBuckets regroups through key transforms when a bucketed key comes before
+// other partial keys, whose values split its buckets in storage.
+func (itW *IterWrapper) applyBuckets() {
+	for i, k := range itW.partialKeys {
+		d, ok := itW.buckets[k.name]
+		if !ok || i == len(itW.partialKeys)-1 {
+			continue
+		}
+		if itW.transforms == nil {
+			itW.transforms = make(map[string]keyTransform)
+		}
+		itW.transforms[k.name] = func(v any) any { return truncateToBucket(v, d) }
+	}
+}
+
+// bucketKey truncates the bucketed keys of keyMap and returns the partial key
+// bytes with them encoded again, so the rows of a bucket make one group.
+func (m *Merger) bucketKey(keyBytes []byte, keyMap map[string]any) []byte {
+	currKeyBytes := make([]byte, 0, len(keyBytes))
+	offset := 0
+	for _, k := range m.partialKeys {
+		_, step := k.decode(keyBytes[offset:])
+		if d, ok := m.buckets[k.name]; ok {
+			keyMap[k.name] = truncateToBucket(keyMap[k.name], d)
+			currKeyBytes = append(currKeyBytes, k.encode(keyMap[k.name])...)
+		} else {
+			currKeyBytes = append(currKeyBytes, keyBytes[offset:offset+step]...)
+		}
+		offset += step
+	}
+	return currKeyBytes
+}
@@ -0,0 +1,48 @@
+package lib_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+	_ "github.com/kill-2/badmerger/storage/bolt"
+)
+
+func TestBucketBeforeKeys(t *testing.T) {
+	db, err := lib.Open(lib.WithStorage("bolt"), lib.WithDir(t.TempDir()),
+		lib.WithKey("ts", "timestamp"), lib.WithKey("g", "string"), lib.WithValue("v", "int64"))
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	defer db.Close()
+	ch := make(chan map[string]any, 2)
+	ch <- map[string]any{"ts": "2024-01-01T10:05:00Z", "g": "a", "v": int64(1)}
+	ch <- map[string]any{"ts": "2024-01-01T10:10:00Z", "g": "b", "v": int64(2)}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+
+	for name, opt := range map[string]lib.IteratorOpt{
+		"rollup":       lib.WithRollup(),
+		"group sample": lib.WithGroupSample(2),
+		"spill":        lib.WithSpill(10),
+	} {
+		it := db.NewIterator(lib.WithPartialKeyBucketed("ts", "1h"), lib.WithPartialKey("g"),
+			lib.WithAgg("v", "sum(v)"), opt)
+		err := it.Iter(func(map[string]any) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), "bucketed before other partial keys") {
+			t.Errorf("%v: got error %v, want the bucketed key refused", name, err)
+		}
+	}
+
+	// a bucketed last key is read in key order, so rollup works
+	var n int
+	it := db.NewIterator(lib.WithPartialKeyBucketed("ts", "1h"), lib.WithAgg("v", "sum(v)"), lib.WithRollup())
+	if err := it.Iter(func(map[string]any) error { n++; return nil }); err != nil {
+		t.Fatalf("fail to iterate: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("got %d groups and totals, want one bucket and the grand total", n)
+	}
+}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TempPrefix starts the names of the directories and files badmerger creates in
+// os.TempDir: databases opened without WithDir, and spills.
+const TempPrefix = "badmerger-"
+
+// WithJobID returns a configuration function that names the temporary directory of
+// a database opened without WithDir after id, badmerger-ID in os.TempDir, so the
+// leftovers of a crashed job can be told apart. Open fails while that directory
+// exists, e.g. from an earlier crashed run of the job; see OrphanedTemp.
+func WithJobID(id string) StorageOpt {
+	return func(w *DbWrapper) error {
+		if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+			return fmt.Errorf("bad job id %q", id)
+		}
+		w.settings.jobID = id
+		return nil
+	}
+}
+
+func createTempDir(jobID string) (string, error) {
+	if jobID == "" {
+		return os.MkdirTemp("", TempPrefix)
+	}
+	dir := filepath.Join(os.TempDir(), TempPrefix+jobID)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("%v of job %v exists, it may be left by a crashed run", dir, jobID)
+		}
+		return "", err
+	}
+	return dir, nil
+}
+
+// OrphanedTemp lists the badmerger directories and files in os.TempDir that were
+// last modified more than olderThan ago, taking a directory as modified when any of
+// its entries is. Nothing tells a crashed run from a stalled one, so olderThan
+// should exceed the longest run.
+func OrphanedTemp(olderThan time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(os.TempDir())
+	if err != nil {
+		return nil, fmt.Errorf("fail to read temp dir %v", err)
+	}
+	cutoff := time.Now().Add(-olderThan)
+	var orphans []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), TempPrefix) {
+			continue
+		}
+		path := filepath.Join(os.TempDir(), e.Name())
+		modified, err := lastModified(path)
+		if err != nil {
+			continue
+		}
+		if modified.Before(cutoff) {
+			orphans = append(orphans, path)
+		}
+	}
+	return orphans, nil
+}
+
+func lastModified(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return info.ModTime(), err
+	}
+	modified := info.ModTime()
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return modified, err
+	}
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
@@ -0,0 +1,177 @@
+package lib
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// HeavyHitter is one of the heaviest keys found by a SpaceSaving sketch. Its Weight
+// overestimates the true weight by at most Error, which is 0 for keys tracked
+// since their first row.
+type HeavyHitter struct {
+	Key    map[string]any `json:"key"`
+	Weight float64        `json:"weight"`
+	Error  float64        `json:"error"`
+}
+
+// SpaceSaving finds the heaviest keys of a stream in a fixed number of counters,
+// with the space-saving algorithm: a key without a counter takes over the lightest
+// one, inheriting its weight as error. Any key heavier than the total weight over
+// the number of counters is guaranteed to be tracked. It is safe for concurrent use.
+type SpaceSaving struct {
+	mu       sync.Mutex
+	size     int
+	counters map[string]*ssCounter
+	lightest ssHeap
+}
+
+type ssCounter struct {
+	id  string
+	hit HeavyHitter
+	pos int
+}
+
+// NewSpaceSaving returns a sketch keeping size counters.
+func NewSpaceSaving(size int) *SpaceSaving {
+	if size < 1 {
+		size = 1
+	}
+	return &SpaceSaving{size: size, counters: make(map[string]*ssCounter, size)}
+}
+
+// Add adds weight to key. Keys are told apart by their JSON text.
+func (s *SpaceSaving) Add(key map[string]any, weight float64) error {
+	b, err := json.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("fail to marshal key: %v", err)
+	}
+	id := string(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.counters[id]; ok {
+		c.hit.Weight += weight
+		heap.Fix(&s.lightest, c.pos)
+		return nil
+	}
+	if len(s.counters) < s.size {
+		c := &ssCounter{id: id, hit: HeavyHitter{Key: key, Weight: weight}}
+		s.counters[id] = c
+		heap.Push(&s.lightest, c)
+		return nil
+	}
+	c := s.lightest[0]
+	delete(s.counters, c.id)
+	c.id = id
+	c.hit = HeavyHitter{Key: key, Weight: c.hit.Weight + weight, Error: c.hit.Weight}
+	s.counters[id] = c
+	heap.Fix(&s.lightest, 0)
+	return nil
+}
+
+// Top returns the k heaviest keys tracked, heaviest first.
+func (s *SpaceSaving) Top(k int) []HeavyHitter {
+	s.mu.Lock()
+	hits := make([]HeavyHitter, 0, len(s.counters))
+	for _, c := range s.counters {
+		hits = append(hits, c.hit)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Weight != hits[j].Weight {
+			return hits[i].Weight > hits[j].Weight
+		}
+		return hits[i].Error < hits[j].Error
+	})
+	if k >= 0 && len(hits) > k {
+		hits = hits[:k]
+	}
+	return hits
+}
+
+type ssHeap []*ssCounter
+
+func (h ssHeap) Len() int           { return len(h) }
+func (h ssHeap) Less(i, j int) bool { return h[i].hit.Weight < h[j].hit.Weight }
+func (h ssHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+func (h *ssHeap) Push(x any) {
+	c := x.(*ssCounter)
+	c.pos = len(*h)
+	*h = append(*h, c)
+}
+func (h *ssHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// topKCounters is how many counters TopK keeps per key asked for, which makes the
+// k heaviest keys exact on all but very flat distributions.
+const topKCounters = 10
+
+// TopK finds the k heaviest values of the key fields names across the whole
+// database in one scan, without grouping by them, so e.g. the heaviest users can
+// be found when the key starts with the day. Rows weigh 1, or the numeric result
+// of the aggregation weight, such as "sum(bytes)", over the rows of each stored
+// key. The answer is approximate, see SpaceSaving, with 10 counters per key asked
+// for. opts may narrow the scan, e.g. WithKeyRange; their partial keys and
+// aggregations are replaced.
+func (db *DbWrapper) TopK(k int, names []string, weight string, opts ...IteratorOpt) ([]HeavyHitter, error) {
+	if k < 1 {
+		return nil, fmt.Errorf("bad top k %d", k)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no key field to rank")
+	}
+	for _, name := range names {
+		found := false
+		for _, key := range db.keys {
+			found = found || key.name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("no key field %v", name)
+		}
+	}
+
+	itW := db.NewIterator(opts...)
+	// every stored key is a group of its own
+	itW.partialKeys = db.keys
+	itW.aggs = nil
+	const weightName = "_weight_"
+	if weight != "" {
+		WithAgg(weightName, weight)(itW)
+		if len(itW.aggs) == 0 {
+			return nil, fmt.Errorf("bad weight %v: %v", weight, itW.optErr)
+		}
+		itW.aggs[0].aggregator = withNumericMode(itW.aggs[0].aggregator, NumericFloat64)
+	}
+
+	sketch := NewSpaceSaving(k * topKCounters)
+	err := itW.Iter(func(res map[string]any) error {
+		w := 1.0
+		if weight != "" {
+			f, ok := toFloat64(res[weightName])
+			if !ok {
+				return nil
+			}
+			w = f
+		}
+		key := make(map[string]any, len(names))
+		for _, name := range names {
+			key[name] = res[name]
+		}
+		return sketch.Add(key, w)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sketch.Top(k), nil
+}
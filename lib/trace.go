@@ -0,0 +1,54 @@
+package lib
+
+import "time"
+
+// Trace counts the work of one iteration, to measure what bounds and sampling
+// save and to spot queries that scan the whole database by accident.
+type Trace struct {
+	// FullScan is set when the iteration had no key bounds to seek to, see
+	// WithKeyRange and WithPartialKeyValue. In a namespace it scanned all of it.
+	FullScan bool `json:"full_scan"`
+	// RowsScanned counts the rows the storage handed over.
+	RowsScanned int64 `json:"rows_scanned"`
+	// RowsFiltered counts the rows skipped undecoded, out of bounds or of the group
+	// sample, and those dropped by WithFilter.
+	RowsFiltered int64 `json:"rows_filtered"`
+	// RowsDecoded counts the rows whose values were decoded.
+	RowsDecoded int64 `json:"rows_decoded"`
+	// GroupsEmitted counts the merged groups passed to the callback of Iter.
+	GroupsEmitted int64 `json:"groups_emitted"`
+	// BytesScanned counts the key and value bytes handed over by the storage.
+	BytesScanned int64 `json:"bytes_scanned"`
+	// BytesDecoded counts the value bytes decoded.
+	BytesDecoded int64         `json:"bytes_decoded"`
+	Duration     time.Duration `json:"duration_ns"`
+}
+
+// Trace returns the counters of the last Iter.
+func (itW *IterWrapper) Trace() Trace {
+	return itW.trace
+}
+
+// countEmitted counts the groups passed to fn.
+func (itW *IterWrapper) countEmitted(fn func(res map[string]any) error) func(res map[string]any) error {
+	return func(res map[string]any) error {
+		itW.groupsEmitted++
+		return fn(res)
+	}
+}
+
+// endTrace records the trace of an iteration started at start and resets the
+// counters for the next one.
+func (itW *IterWrapper) endTrace(start time.Time) {
+	itW.trace = Trace{
+		FullScan:      itW.lower == nil && itW.upper == nil,
+		RowsScanned:   itW.rowsRead,
+		RowsFiltered:  itW.rowsFiltered,
+		RowsDecoded:   itW.rowsDecoded,
+		GroupsEmitted: itW.groupsEmitted,
+		BytesScanned:  itW.bytesRead,
+		BytesDecoded:  itW.bytesDecoded,
+		Duration:      time.Since(start),
+	}
+	itW.rowsFiltered, itW.rowsDecoded, itW.bytesDecoded, itW.groupsEmitted = 0, 0, 0, 0
+}
@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ValueTransform turns a stored value into the value aggregations see. It is only
+// called with non-null values.
+type ValueTransform func(v any) (any, error)
+
+// ValueTransformBuilder builds a transform from the argument after its name, e.g.
+// "ms" in "rfc3339:ms", which is empty when there is none.
+type ValueTransformBuilder func(arg string) (ValueTransform, error)
+
+type valueTransformEntry struct {
+	build ValueTransformBuilder
+	entry Entry
+}
+
+var valueTransforms = map[string]valueTransformEntry{
+	"gunzip":  {buildGunzip, Entry{"gunzip", "gunzip", "decompress gzip bytes or strings"}},
+	"unzstd":  {buildUnzstd, Entry{"unzstd", "unzstd", "decompress zstd bytes or strings"}},
+	"json":    {buildParseJson, Entry{"json", "json", "parse bytes or strings as JSON"}},
+	"rfc3339": {buildRFC3339, Entry{"rfc3339", "rfc3339[:s|ms|us|ns]", "format epoch numbers, seconds by default, or timestamps as RFC 3339"}},
+}
+
+// RegisterValueTransform makes a transform usable in WithValueTransform. Like
+// RegisterKind it is meant to be called from init and panics when the name is
+// already taken.
+func RegisterValueTransform(name, doc string, build ValueTransformBuilder) {
+	if build == nil {
+		panic("lib: RegisterValueTransform with nil builder for " + name)
+	}
+	if strings.ContainsAny(name, "/:") {
+		panic("lib: RegisterValueTransform with reserved characters in " + name)
+	}
+	if _, ok := valueTransforms[name]; ok {
+		panic("lib: RegisterValueTransform called twice for " + name)
+	}
+	valueTransforms[name] = valueTransformEntry{build, Entry{name, name, doc}}
+}
+
+// ValueTransforms lists the builtin and registered value transforms.
+func ValueTransforms() []Entry {
+	entries := make([]Entry, 0, len(valueTransforms))
+	for _, t := range valueTransforms {
+		entries = append(entries, t.entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// parseValueTransform builds the transforms of a spec such as "gunzip/json",
+// applied from left to right.
+func parseValueTransform(spec string) (ValueTransform, error) {
+	var chain []ValueTransform
+	for _, part := range strings.Split(spec, "/") {
+		name, arg, _ := strings.Cut(part, ":")
+		t, ok := valueTransforms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown value transform %v", part)
+		}
+		fn, err := t.build(arg)
+		if err != nil {
+			return nil, fmt.Errorf("bad value transform %v: %v", part, err)
+		}
+		chain = append(chain, fn)
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return func(v any) (any, error) {
+		var err error
+		for _, fn := range chain {
+			if v == nil {
+				return nil, nil
+			}
+			if v, err = fn(v); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	}, nil
+}
+
+// WithValueTransform applies a transform to the values of a value field as they
+// are read, before any aggregation, so compactly stored values are aggregated on
+// what they stand for. Transforms are separated by slashes and applied from left to
+// right, e.g. "gunzip/json" or "rfc3339:ms". A bad transform makes Iter fail, and a
+// value it can not transform marks the group as bad, see WithSkipBadGroups.
+func WithValueTransform(name, transform string) IteratorOpt {
+	return func(itW *IterWrapper) {
+		t, err := parseValueTransform(transform)
+		if err != nil {
+			itW.optErr = err
+			return
+		}
+		for _, v := range itW.values {
+			if v.name == name {
+				if itW.valueTransforms == nil {
+					itW.valueTransforms = make(map[string]ValueTransform)
+				}
+				itW.valueTransforms[name] = t
+				return
+			}
+		}
+		itW.optErr = fmt.Errorf("no value field %v to transform", name)
+	}
+}
+
+// applyValueTransforms replaces the values of valueMap by their transforms. It panics
+// on failure, like the decoders it follows.
+func (m *Merger) applyValueTransforms(valueMap map[string]any) {
+	for name, t := range m.valueTransforms {
+		v, ok := valueMap[name]
+		if !ok || v == nil {
+			continue
+		}
+		transformed, err := t(v)
+		if err != nil {
+			panic(fmt.Sprintf("fail to transform %v: %v", name, err))
+		}
+		valueMap[name] = transformed
+	}
+}
+
+// blobOf returns the bytes of a bytes or string value, and whether it was a string.
+func blobOf(v any) ([]byte, bool, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, false, nil
+	case string:
+		return []byte(b), true, nil
+	}
+	return nil, false, fmt.Errorf("want bytes or string, got %T", v)
+}
+
+// sameBlob returns b as the type of the value it was made from.
+func sameBlob(b []byte, isString bool) any {
+	if isString {
+		return string(b)
+	}
+	return b
+}
+
+func buildGunzip(arg string) (ValueTransform, error) {
+	return func(v any) (any, error) {
+		b, isString, err := blobOf(v)
+		if err != nil {
+			return nil, err
+		}
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return sameBlob(out, isString), nil
+	}, nil
+}
+
+func buildUnzstd(arg string) (ValueTransform, error) {
+	return func(v any) (any, error) {
+		b, isString, err := blobOf(v)
+		if err != nil {
+			return nil, err
+		}
+		out, err := zstdDecoder().DecodeAll(b, nil)
+		if err != nil {
+			return nil, err
+		}
+		return sameBlob(out, isString), nil
+	}, nil
+}
+
+func buildParseJson(arg string) (ValueTransform, error) {
+	return func(v any) (any, error) {
+		b, _, err := blobOf(v)
+		if err != nil {
+			return nil, err
+		}
+		var parsed any
+		if err := json.Unmarshal(b, &parsed); err != nil {
+			return nil, err
+		}
+		return parsed, nil
+	}, nil
+}
+
+func buildRFC3339(arg string) (ValueTransform, error) {
+	var unit time.Duration
+	switch arg {
+	case "", "s":
+		unit = time.Second
+	case "ms":
+		unit = time.Millisecond
+	case "us":
+		unit = time.Microsecond
+	case "ns":
+		unit = time.Nanosecond
+	default:
+		return nil, fmt.Errorf("unknown unit %q", arg)
+	}
+	return func(v any) (any, error) {
+		if t, ok := v.(time.Time); ok {
+			return t.UTC().Format(time.RFC3339Nano), nil
+		}
+		if n, ok := toInt64(v); ok {
+			perSecond := int64(time.Second / unit)
+			t := time.Unix(n/perSecond, (n%perSecond)*int64(unit))
+			return t.UTC().Format(time.RFC3339Nano), nil
+		}
+		f, ok := toFloat64(v)
+		if !ok {
+			return nil, fmt.Errorf("want an epoch number, got %T", v)
+		}
+		return time.Unix(0, int64(f*float64(unit))).UTC().Format(time.RFC3339Nano), nil
+	}, nil
+}
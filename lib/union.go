@@ -0,0 +1,239 @@
+package lib
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// unionBatch is the number of rows a part hands over at a time.
+const unionBatch = 256
+
+// OpenUnion opens several databases with the same schema as one read-only database,
+// so data ingested in separate runs or shards is aggregated in one pass without
+// re-ingesting it. Iteration merges the rows of all dirs in key order; rows with
+// equal keys are all kept, those of earlier dirs first. Each dir is opened like Open
+// with opts, which should only carry settings as the schemas are recovered. Schemas
+// with dict_string fields can not be combined, as their codes differ between dirs.
+func OpenUnion(dirs []string, opts ...StorageOpt) (*DbWrapper, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no dirs to union")
+	}
+	parts := make([]*DbWrapper, 0, len(dirs))
+	closeParts := func() {
+		for _, p := range parts {
+			p.Close()
+		}
+	}
+	for _, dir := range dirs {
+		if !IsDatabase(dir) {
+			closeParts()
+			return nil, fmt.Errorf("%v is not a database", dir)
+		}
+		p, err := Open(append(opts, WithDir(dir))...)
+		if err != nil {
+			closeParts()
+			return nil, fmt.Errorf("fail to open %v: %v", dir, err)
+		}
+		parts = append(parts, p)
+		if p.Hash() != parts[0].Hash() {
+			closeParts()
+			return nil, fmt.Errorf("schema of %v differs from %v", dir, dirs[0])
+		}
+		if p.hasDictionaries() {
+			closeParts()
+			return nil, fmt.Errorf("schema of %v has dict_string fields", dir)
+		}
+	}
+
+	u := *parts[0]
+	u.store = "union"
+	u.dir = ""
+	union := &unionStorage{}
+	for _, p := range parts {
+		union.parts = append(union.parts, p.db)
+	}
+	u.db = union
+	return &u, nil
+}
+
+func (s *Schema) hasDictionaries() bool {
+	for _, k := range s.keys {
+		if k.dict != nil {
+			return true
+		}
+	}
+	for _, v := range s.values {
+		if v.dict != nil {
+			return true
+		}
+	}
+	return false
+}
+
+type unionStorage struct {
+	parts []Storage
+}
+
+func (us *unionStorage) NewInserter() Inserter {
+	return readOnlyInserter{"a union of databases"}
+}
+
+func (us *unionStorage) Close() error {
+	var errs []error
+	for _, p := range us.parts {
+		errs = append(errs, p.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// readOnlyInserter fails every insert into what it names.
+type readOnlyInserter struct {
+	what string
+}
+
+func (r readOnlyInserter) Insert(keyPayload, valuePayload []byte) error {
+	return fmt.Errorf("%v is read-only", r.what)
+}
+
+func (readOnlyInserter) Commit() error {
+	return nil
+}
+
+type unionRow struct {
+	key, value []byte
+}
+
+// unionPart scans one part in the background, handing over batches of rows.
+type unionPart struct {
+	index int
+	rows  chan []unionRow
+	err   chan error
+	batch []unionRow
+}
+
+func (p *unionPart) head() unionRow {
+	return p.batch[0]
+}
+
+// next drops the head, reporting false once the part is done.
+func (p *unionPart) next() (bool, error) {
+	if len(p.batch) > 0 {
+		p.batch = p.batch[1:]
+	}
+	for len(p.batch) == 0 {
+		batch, ok := <-p.rows
+		if !ok {
+			return false, <-p.err
+		}
+		p.batch = batch
+	}
+	return true, nil
+}
+
+type unionHeap []*unionPart
+
+func (h unionHeap) Len() int { return len(h) }
+func (h unionHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].head().key, h[j].head().key); c != 0 {
+		return c < 0
+	}
+	return h[i].index < h[j].index
+}
+func (h unionHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *unionHeap) Push(x any)   { *h = append(*h, x.(*unionPart)) }
+func (h *unionHeap) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// Iterate k-way merges the parts on their key bytes, each scanned by lib.Scan.
+func (us *unionStorage) Iterate(m *Merger, fn func(res map[string]any) error) error {
+	// the scans stop at done and are waited for, so the parts are not closed under them
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	h := make(unionHeap, 0, len(us.parts))
+	for i, s := range us.parts {
+		p := &unionPart{index: i, rows: make(chan []unionRow, 4), err: make(chan error, 1)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var batch []unionRow
+			send := func() bool {
+				select {
+				case p.rows <- batch:
+					batch = nil
+					return true
+				case <-done:
+					return false
+				}
+			}
+			errStop := errors.New("stop")
+			err := Scan(s, func(keyPayload, valuePayload []byte) error {
+				batch = append(batch, unionRow{keyPayload, valuePayload})
+				if len(batch) >= unionBatch && !send() {
+					return errStop
+				}
+				return nil
+			})
+			if err == nil && len(batch) > 0 {
+				send()
+			}
+			if err == errStop {
+				err = nil
+			}
+			p.err <- err
+			close(p.rows)
+		}()
+		ok, err := p.next()
+		if err != nil {
+			return fmt.Errorf("fail to scan part %d: %v", i, err)
+		}
+		if ok {
+			h = append(h, p)
+		}
+	}
+	heap.Init(&h)
+
+	var readErr error
+	var last *unionPart
+	err := GroupRows(m, func() ([]byte, []byte, bool) {
+		// the part of the previous row moves on only now, as its row stays in use
+		// until this call
+		if last != nil {
+			ok, err := last.next()
+			if err != nil {
+				readErr = fmt.Errorf("fail to scan part %d: %v", last.index, err)
+				return nil, nil, false
+			}
+			if ok {
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+		if h.Len() == 0 {
+			return nil, nil, false
+		}
+		last = h[0]
+		row := last.head()
+		return row.key, row.value, true
+	}, func(res map[string]any) error {
+		if readErr != nil {
+			return readErr
+		}
+		return fn(res)
+	})
+	if err != nil {
+		return err
+	}
+	return readErr
+}
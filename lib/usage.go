@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// Usage accounts for the work a database did during its lifetime.
+type Usage struct {
+	Storage        string        `json:"storage"`
+	RecordsWritten int64         `json:"records_written"`
+	BytesWritten   int64         `json:"bytes_written"`
+	RowsRead       int64         `json:"rows_read"`
+	BytesRead      int64         `json:"bytes_read"`
+	CompactionTime time.Duration `json:"compaction_ns"`
+	DirBytes       int64         `json:"dir_bytes"`
+	// OutOfRange counts, per integer field, ingested values its kind could not hold.
+	OutOfRange map[string]int64 `json:"out_of_range,omitempty"`
+	// Oversized counts, per field, ingested values too long for their kind.
+	Oversized map[string]int64 `json:"oversized,omitempty"`
+	// EarlyCommits counts the commits forced by WithMemoryWatermark.
+	EarlyCommits int64 `json:"early_commits,omitempty"`
+}
+
+// Usage reports the payload bytes written by Recv and read by iterations,
+// time spent compacting on Close and the current size of the database directory.
+func (db *DbWrapper) Usage() Usage {
+	u := db.usage
+	u.Storage = db.store
+	u.DirBytes = dirBytes(db.dir)
+	return u
+}
+
+// dirBytes sums the sizes of the regular files under dir.
+func dirBytes(dir string) int64 {
+	var n int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && d.Type().IsRegular() {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
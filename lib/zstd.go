@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdEncoder and zstdDecoder are shared, their EncodeAll and DecodeAll are safe
+// for concurrent use.
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		return dec
+	})
+)
+
+// json_zstd values are stored as zstd compressed JSON behind a 4 byte length header,
+// so unlike json they are not limited to 32KB.
+func toJsonZstdBinary(anyValue any) []byte {
+	body, _ := json.Marshal(anyValue)
+	b := make([]byte, 4, 4+len(body)/2)
+	b = zstdEncoder().EncodeAll(body, b)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+func fromJsonZstdBinary(b []byte) (any, int) {
+	limit := 4 + int(binary.BigEndian.Uint32(b))
+	body, err := zstdDecoder().DecodeAll(b[4:limit], nil)
+	if err != nil {
+		panic(fmt.Sprintf("fail to decompress json: %v", err))
+	}
+	return decodeJson(body), limit
+}
+
+func checkJsonZstd(v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(body) > math.MaxUint32/2 {
+		return fmt.Errorf("json of %d bytes is too large", len(body))
+	}
+	return nil
+}
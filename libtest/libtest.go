@@ -0,0 +1,75 @@
+// Package libtest helps applications embedding badmerger unit test their
+// schemas and aggregations against small literal datasets.
+//
+//	db := libtest.DB(t, []map[string]any{
+//		{"user": 1, "bytes": 10},
+//		{"user": 1, "bytes": 5},
+//	}, lib.WithKey("user", "int32"), lib.WithValue("bytes", "int64"))
+//	rows := libtest.Query(t, db, lib.WithPartialKey("user"), lib.WithAgg("total", "sum(bytes)"))
+package libtest
+
+import (
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+
+	_ "github.com/kill-2/badmerger/storage/memory"
+)
+
+// DB opens a database in a temporary directory with the given schema options,
+// ingests records and registers cleanup with tb. Records are copied, so the
+// literals can be reused. Storage defaults to the memory storage, which keeps the
+// rows out of the directory; pass lib.WithStorage to override.
+//
+// Records are inserted in order with an extra "_i_" int32 key holding their
+// index, so rows sharing the other key fields are all kept, like the CLI does.
+func DB(tb testing.TB, records []map[string]any, opts ...lib.StorageOpt) *lib.DbWrapper {
+	tb.Helper()
+
+	opts = append([]lib.StorageOpt{lib.WithStorage("memory"), lib.WithDir(tb.TempDir())}, opts...)
+	opts = append(opts, lib.WithKey("_i_", "int32"))
+	db, err := lib.Open(opts...)
+	if err != nil {
+		tb.Fatalf("fail to open db: %v", err)
+	}
+	tb.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			tb.Errorf("fail to close db: %v", err)
+		}
+		// the memory storage keeps rows for the dir until it is destroyed
+		if err := db.Destroy(); err != nil {
+			tb.Errorf("fail to destroy db: %v", err)
+		}
+	})
+
+	ch := make(chan map[string]any, len(records))
+	for i, record := range records {
+		copied := make(map[string]any, len(record)+1)
+		for k, v := range record {
+			copied[k] = v
+		}
+		copied["_i_"] = int32(i)
+		ch <- copied
+	}
+	close(ch)
+
+	if err := db.Recv(ch); err != nil {
+		tb.Fatalf("fail to ingest records: %v", err)
+	}
+	return db
+}
+
+// Query runs an iteration over db with the given options and returns all results in order.
+func Query(tb testing.TB, db *lib.DbWrapper, opts ...lib.IteratorOpt) []map[string]any {
+	tb.Helper()
+
+	var results []map[string]any
+	err := db.NewIterator(opts...).Iter(func(res map[string]any) error {
+		results = append(results, res)
+		return nil
+	})
+	if err != nil {
+		tb.Fatalf("fail to iterate: %v", err)
+	}
+	return results
+}
@@ -0,0 +1,29 @@
+package libtest_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+	"github.com/kill-2/badmerger/libtest"
+)
+
+func TestQuery(t *testing.T) {
+	records := []map[string]any{
+		{"user": 1, "bytes": 10},
+		{"user": 1, "bytes": 5},
+		{"user": 2, "bytes": 7},
+	}
+	db := libtest.DB(t, records, lib.WithKey("user", "int32"), lib.WithValue("bytes", "int64"))
+	got := libtest.Query(t, db, lib.WithPartialKey("user"), lib.WithAgg("total", "sum(bytes)"), lib.WithAgg("n", "count()"))
+	want := []map[string]any{
+		{"user": int32(1), "total": int64(15), "n": int64(2)},
+		{"user": int32(2), "total": int64(7), "n": int64(1)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, ok := records[0]["_i_"]; ok {
+		t.Errorf("DB changed the records of the caller")
+	}
+}
@@ -0,0 +1,223 @@
+// Package objstore copies database directories to and from object stores, so merge
+// results can be shared between machines and pipelines. URIs name a bucket and a
+// prefix, e.g. s3://bucket/merges/daily?region=eu-west-1, gs://bucket/merges/daily
+// or file:///srv/merges/daily, with credentials taken from the environment as the
+// SDKs of each cloud do.
+package objstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kill-2/badmerger/lib"
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/gcsblob"
+	_ "gocloud.dev/blob/s3blob"
+	"gocloud.dev/gcerrors"
+)
+
+// manifestName lists the files of an upload. It is written last, so a database
+// is only visible in the store once it is complete.
+const manifestName = "MANIFEST.json"
+
+type manifest struct {
+	Files []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// IsURI reports whether s names an object store location rather than a local dir.
+func IsURI(s string) bool {
+	scheme, _, ok := strings.Cut(s, "://")
+	return ok && (scheme == "s3" || scheme == "gs" || scheme == "file")
+}
+
+// openBucket opens the bucket of uri, returning it with the key prefix of the uri.
+func openBucket(ctx context.Context, uri string) (*blob.Bucket, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil || !IsURI(uri) {
+		return nil, "", fmt.Errorf("bad object store uri %q", uri)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if u.Scheme == "file" {
+		// file buckets are dirs, the whole path names the bucket
+		prefix = ""
+	} else {
+		u.Path = ""
+	}
+	if u.Scheme == "file" {
+		if err := os.MkdirAll(u.Path, 0755); err != nil {
+			return nil, "", fmt.Errorf("fail to create bucket dir %v", err)
+		}
+	}
+	bucket, err := blob.OpenBucket(ctx, u.String())
+	if err != nil {
+		return nil, "", fmt.Errorf("fail to open bucket %v", err)
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	return bucket, prefix, nil
+}
+
+// Upload copies the database in dir to uri, replacing the one there. The database
+// must be closed, or at least not written to, while it is copied.
+func Upload(ctx context.Context, dir, uri string) error {
+	if !lib.IsDatabase(dir) {
+		return fmt.Errorf("%v is not a database", dir)
+	}
+	bucket, prefix, err := openBucket(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+
+	// hide the previous upload while its files are overwritten
+	if err := bucket.Delete(ctx, prefix+manifestName); err != nil && !isNotFound(err) {
+		return fmt.Errorf("fail to delete manifest %v", err)
+	}
+	var m manifest
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		size, err := uploadFile(ctx, bucket, prefix+name, p)
+		if err != nil {
+			return fmt.Errorf("fail to upload %v: %v", name, err)
+		}
+		m.Files = append(m.Files, manifestFile{Name: name, Size: size})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := bucket.WriteAll(ctx, prefix+manifestName, data, nil); err != nil {
+		return fmt.Errorf("fail to write manifest %v", err)
+	}
+	return nil
+}
+
+func uploadFile(ctx context.Context, bucket *blob.Bucket, key, p string) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w, err := bucket.NewWriter(ctx, key, nil)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, f)
+	if err != nil {
+		w.Close()
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// Download copies the database at uri into dir, which must not hold a database.
+func Download(ctx context.Context, uri, dir string) error {
+	if lib.IsDatabase(dir) {
+		return fmt.Errorf("%v already holds a database", dir)
+	}
+	bucket, prefix, err := openBucket(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+
+	data, err := bucket.ReadAll(ctx, prefix+manifestName)
+	if isNotFound(err) {
+		return fmt.Errorf("no database at %v", uri)
+	}
+	if err != nil {
+		return fmt.Errorf("fail to read manifest %v", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("fail to parse manifest %v", err)
+	}
+
+	for _, f := range m.Files {
+		// names come from the store, keep them inside dir
+		clean := path.Clean(f.Name)
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("bad file name %q in manifest", f.Name)
+		}
+		if err := downloadFile(ctx, bucket, prefix+f.Name, filepath.Join(dir, filepath.FromSlash(clean)), f.Size); err != nil {
+			return fmt.Errorf("fail to download %v: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// Open downloads the database at uri into a temp dir and opens it with opts, which
+// should only carry settings as the schema is recovered. Destroy the database after
+// closing it to remove the copy.
+func Open(ctx context.Context, uri string, opts ...lib.StorageOpt) (*lib.DbWrapper, error) {
+	dir, err := os.MkdirTemp("", lib.TempPrefix+"download-")
+	if err != nil {
+		return nil, err
+	}
+	if err := Download(ctx, uri, dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	db, err := lib.Open(append(opts, lib.WithDir(dir))...)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return db, nil
+}
+
+func downloadFile(ctx context.Context, bucket *blob.Bucket, key, p string, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	r, err := bucket.NewReader(ctx, key, nil)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if n != size {
+		f.Close()
+		return fmt.Errorf("got %d bytes, want %d", n, size)
+	}
+	return f.Close()
+}
+
+func isNotFound(err error) bool {
+	return err != nil && gcerrors.Code(err) == gcerrors.NotFound
+}
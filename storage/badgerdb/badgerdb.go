@@ -1,23 +1,64 @@
 package badgerdb
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
 
 	badger "github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
+	"github.com/dgraph-io/ristretto/v2/z"
 	"github.com/kill-2/badmerger/lib"
 )
 
 func init() {
 	lib.Registration["badgerdb"] = NewBadger
+	lib.StorageDocs["badgerdb"] = "LSM-tree store on disk"
 }
 
 type badgerDb struct {
 	*badger.DB
 }
 
-func NewBadger(dir string) (lib.Storage, error) {
+// minOpenFiles covers the manifest, lock, discard stats, a value log, the
+// memtables and a few tables.
+const minOpenFiles = 12
+
+func NewBadger(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
 	badgerOpts := badger.DefaultOptions(dir).WithLogger(nil)
+	if cfg.InMemory {
+		// badger leaves the dir alone, but the schema still goes there
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("fail to create dir %v", err)
+		}
+		badgerOpts = badger.DefaultOptions("").WithLogger(nil).WithInMemory(true)
+	}
+	if cfg.MaxOpenFiles > 0 {
+		if cfg.MaxOpenFiles < minOpenFiles {
+			return nil, fmt.Errorf("badgerdb needs at least %d open files, got %d", minOpenFiles, cfg.MaxOpenFiles)
+		}
+		// Badger keeps every table open, so fewer, larger tables and fewer
+		// memtables keep the count down: roughly one more file per 64MB stored.
+		badgerOpts = badgerOpts.
+			WithNumMemtables(2).
+			WithNumLevelZeroTables(2).
+			WithNumLevelZeroTablesStall(4).
+			WithBaseTableSize(64 << 20).
+			WithBaseLevelSize(256 << 20)
+	}
+	if len(cfg.EncryptionKey) > 0 {
+		// badger needs an index cache to keep decrypted indexes in
+		badgerOpts = badgerOpts.
+			WithEncryptionKey(cfg.EncryptionKey).
+			WithIndexCacheSize(64 << 20)
+	}
+	badgerOpts, err := withOptions(badgerOpts, cfg.Options)
+	if err != nil {
+		return nil, err
+	}
 	db, err := badger.Open(badgerOpts)
 	if err != nil {
 		return nil, fmt.Errorf("fail to open db %v", err)
@@ -25,6 +66,76 @@ func NewBadger(dir string) (lib.Storage, error) {
 	return &badgerDb{DB: db}, nil
 }
 
+// withOptions applies the storage options of lib.WithStorageOption:
+//
+//	memtable_size        size of a memtable, e.g. 128M
+//	num_memtables        memtables kept before writes stall
+//	value_threshold      values from this size on go to the value log
+//	value_log_file_size  size of a value log file
+//	compression          none, snappy or zstd
+//	zstd_level           compression level of zstd
+//	block_cache_size     cache of table blocks, 0 turns it off
+//	num_compactors       compaction goroutines
+func withOptions(opts badger.Options, settings map[string]string) (badger.Options, error) {
+	for key, value := range settings {
+		var err error
+		switch key {
+		case "memtable_size":
+			var n int64
+			if n, err = lib.ParseSize(value); err == nil {
+				opts = opts.WithMemTableSize(n)
+			}
+		case "num_memtables":
+			var n int
+			if n, err = strconv.Atoi(value); err == nil {
+				opts = opts.WithNumMemtables(n)
+			}
+		case "value_threshold":
+			var n int64
+			if n, err = lib.ParseSize(value); err == nil {
+				opts = opts.WithValueThreshold(n)
+			}
+		case "value_log_file_size":
+			var n int64
+			if n, err = lib.ParseSize(value); err == nil {
+				opts = opts.WithValueLogFileSize(n)
+			}
+		case "compression":
+			switch value {
+			case "none":
+				opts = opts.WithCompression(options.None)
+			case "snappy":
+				opts = opts.WithCompression(options.Snappy)
+			case "zstd":
+				opts = opts.WithCompression(options.ZSTD)
+			default:
+				err = fmt.Errorf("unknown compression %q", value)
+			}
+		case "zstd_level":
+			var n int
+			if n, err = strconv.Atoi(value); err == nil {
+				opts = opts.WithZSTDCompressionLevel(n)
+			}
+		case "block_cache_size":
+			var n int64
+			if n, err = lib.ParseSize(value); err == nil {
+				opts = opts.WithBlockCacheSize(n)
+			}
+		case "num_compactors":
+			var n int
+			if n, err = strconv.Atoi(value); err == nil {
+				opts = opts.WithNumCompactors(n)
+			}
+		default:
+			return opts, fmt.Errorf("unknown badgerdb option %v", key)
+		}
+		if err != nil {
+			return opts, fmt.Errorf("bad badgerdb option %v: %v", key, err)
+		}
+	}
+	return opts, nil
+}
+
 func (bg *badgerDb) NewInserter() lib.Inserter {
 	return &badgerDbTxn{
 		db:  bg,
@@ -36,6 +147,92 @@ func (bg *badgerDb) Close() error {
 	return bg.DB.Close()
 }
 
+// Encrypted reports whether badger encrypts the files of the database.
+func (bg *badgerDb) Encrypted() bool {
+	return len(bg.DB.Opts().EncryptionKey) > 0
+}
+
+// Snapshot implements lib.Snapshotter with a read-only transaction, which sees
+// the rows committed before it started.
+func (bg *badgerDb) Snapshot() (lib.View, error) {
+	return &badgerView{txn: bg.DB.NewTransaction(false)}, nil
+}
+
+type badgerView struct {
+	txn *badger.Txn
+}
+
+func (v *badgerView) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	return iterateTxn(v.txn, m, fn, false)
+}
+
+// IterateReverse implements lib.ReverseIterator.
+func (v *badgerView) IterateReverse(m *lib.Merger, fn func(res map[string]any) error) error {
+	return iterateTxn(v.txn, m, fn, true)
+}
+
+func (v *badgerView) Close() error {
+	v.txn.Discard()
+	return nil
+}
+
+// Backup implements lib.Backuper with badger's stream backup.
+func (bg *badgerDb) Backup(w io.Writer) error {
+	_, err := bg.DB.Backup(w, 0)
+	return err
+}
+
+// Load implements lib.Backuper.
+func (bg *badgerDb) Load(r io.Reader) error {
+	return bg.DB.Load(r, 256)
+}
+
+// Compact flattens the tables into one level. Badger has no way to flush its
+// memtables short of Close, so rows written since the last flush stay in them;
+// Flatten runs safely alongside inserters and views, e.g. from the maintenance
+// of a grpc server.
+func (bg *badgerDb) Compact() error {
+	return bg.DB.Flatten(runtime.NumCPU())
+}
+
+func (bg *badgerDb) RunGC() error {
+	for {
+		if err := bg.DB.RunValueLogGC(0.5); err == badger.ErrNoRewrite {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Count implements lib.Counter by iterating the keys only, which leaves the value
+// log alone.
+func (bg *badgerDb) Count() (int64, bool, error) {
+	var n int64
+	err := bg.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+		return nil
+	})
+	return n, true, err
+}
+
+// Size implements lib.Sizer with the sizes badger keeps of its tables and value log.
+func (bg *badgerDb) Size() (int64, error) {
+	lsm, vlog := bg.DB.Size()
+	return lsm + vlog, nil
+}
+
+// DeletePrefix drops the rows whose key starts with prefix, blocking writes meanwhile.
+func (bg *badgerDb) DeletePrefix(prefix []byte) error {
+	return bg.DB.DropPrefix(prefix)
+}
+
 type badgerDbTxn struct {
 	db  *badgerDb
 	txn *badger.Txn
@@ -56,50 +253,94 @@ func (bgt *badgerDbTxn) Commit() error {
 }
 
 func (db *badgerDb) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
-	return db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		var lastKeyMap map[string]any
-		lastKeyBytes := []byte{}
-		valueMaps := []map[string]any{}
+	return db.iterate(m, fn, false)
+}
 
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-
-			currKeyBytes, keyMap := m.RestoreKey(item.Key())
-			if !bytes.Equal(lastKeyBytes, currKeyBytes) {
-				if len(lastKeyBytes) > 0 {
-					if err := fn(m.Merge(lastKeyMap, valueMaps)); err != nil {
-						return err
-					}
-				}
-				lastKeyBytes = lastKeyBytes[:0]
-				lastKeyBytes = append(lastKeyBytes, currKeyBytes...)
-				lastKeyMap = keyMap
-				valueMaps = valueMaps[:0]
+// Stream implements lib.Streamer with badger's Stream framework, which reads the
+// key ranges of the tables with several goroutines.
+func (db *badgerDb) Stream(prefix []byte, fn func(keyPayload, valuePayload []byte) error) error {
+	stream := db.NewStream()
+	stream.Prefix = prefix
+	stream.LogPrefix = "badmerger export"
+	stream.Send = func(buf *z.Buffer) error {
+		list, err := badger.BufferToKVList(buf)
+		if err != nil {
+			return err
+		}
+		for _, kv := range list.Kv {
+			if err := fn(kv.Key, kv.Value); err != nil {
+				return err
 			}
+		}
+		return nil
+	}
+	return stream.Orchestrate(context.Background())
+}
 
-			if m.NoValue() {
-				continue
-			}
+// IterateReverse implements lib.ReverseIterator.
+func (db *badgerDb) IterateReverse(m *lib.Merger, fn func(res map[string]any) error) error {
+	return db.iterate(m, fn, true)
+}
 
-			err := item.Value(func(valueBytes []byte) error {
-				valueMaps = append(valueMaps, m.RestoreValue(valueBytes))
-				return nil
-			})
+func (db *badgerDb) iterate(m *lib.Merger, fn func(res map[string]any) error, reverse bool) error {
+	return db.View(func(txn *badger.Txn) error {
+		return iterateTxn(txn, m, fn, reverse)
+	})
+}
 
-			if err != nil {
-				return err
-			}
-		}
+// iterateTxn feeds the rows visible to txn to the merger.
+func iterateTxn(txn *badger.Txn, m *lib.Merger, fn func(res map[string]any) error, reverse bool) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchSize = 10
+	if m.Prefetch() > 0 {
+		opts.PrefetchSize = m.Prefetch()
+	}
+	opts.PrefetchValues = !m.NoValue()
+	opts.Reverse = reverse
+	if !reverse {
+		// lets badger skip the tables without the prefix
+		opts.Prefix = m.Prefix()
+	}
+	it := txn.NewIterator(opts)
+	defer it.Close()
 
-		if err := fn(m.Merge(lastKeyMap, valueMaps)); err != nil {
-			return err
+	switch lower, upper := m.Bounds(); {
+	case !reverse && lower != nil:
+		it.Seek(lower)
+	case reverse && upper != nil:
+		// reverse seeks land on the last key at or before upper
+		it.Seek(upper)
+	default:
+		it.Rewind()
+	}
+	var value []byte
+	var readErr error
+	first := true
+	err := lib.GroupRows(m, func() ([]byte, []byte, bool) {
+		if !first {
+			it.Next()
 		}
-
-		return nil
+		first = false
+		if !it.Valid() {
+			return nil, nil, false
+		}
+		item := it.Item()
+		if m.NoValue() {
+			return item.Key(), nil, true
+		}
+		// the value is copied into a buffer reused for every row
+		if value, readErr = item.ValueCopy(value[:0]); readErr != nil {
+			return nil, nil, false
+		}
+		return item.Key(), value, true
+	}, func(res map[string]any) error {
+		if readErr != nil {
+			return readErr
+		}
+		return fn(res)
 	})
+	if err != nil {
+		return err
+	}
+	return readErr
 }
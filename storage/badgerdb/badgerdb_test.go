@@ -0,0 +1,70 @@
+//go:build !no_badgerdb
+
+package badgerdb
+
+import (
+	"fmt"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/kill-2/badmerger/lib"
+	"github.com/kill-2/badmerger/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, NewBadger)
+}
+
+func TestCompactWhileWriting(t *testing.T) {
+	s, err := NewBadger(t.TempDir(), lib.StorageConfig{})
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	bg := s.(*badgerDb)
+	defer bg.Close()
+	view, err := bg.Snapshot()
+	if err != nil {
+		t.Fatalf("fail to open view: %v", err)
+	}
+	defer view.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			ins := bg.NewInserter()
+			for j := 0; j < 50; j++ {
+				if err := ins.Insert([]byte(fmt.Sprintf("k%02d-%02d", i, j)), []byte("v")); err != nil {
+					errs <- err
+					return
+				}
+			}
+			if err := ins.Commit(); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	for i := 0; i < 5; i++ {
+		if err := bg.Compact(); err != nil {
+			t.Fatalf("fail to compact: %v", err)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("fail to write while compacting: %v", err)
+	}
+
+	n, _, err := bg.Count()
+	if err != nil {
+		t.Fatalf("fail to count: %v", err)
+	}
+	if n != 1000 {
+		t.Errorf("got %d rows, want 1000", n)
+	}
+	if err := bg.DB.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte("k19-49"))
+		return err
+	}); err != nil {
+		t.Errorf("fail to read row after compaction: %v", err)
+	}
+}
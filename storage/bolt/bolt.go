@@ -0,0 +1,193 @@
+package bolt
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kill-2/badmerger/lib"
+	bbolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	lib.Registration["bolt"] = NewBolt
+	lib.StorageDocs["bolt"] = "single-file B+tree store"
+}
+
+var rowsBucket = []byte("rows")
+
+// batchSize bounds the writes held in memory before they are committed.
+const batchSize = 10000
+
+var boltOptions = &bbolt.Options{NoFreelistSync: true}
+
+type boltDb struct {
+	*bbolt.DB
+}
+
+// NewBolt opens a bbolt database, a single B-tree file in dir, which is easier
+// to ship around than a multi-file directory for small to medium merges.
+func NewBolt(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("fail to create dir %v", err)
+	}
+	db, err := bbolt.Open(filepath.Join(dir, "data.bolt"), 0644, boltOptions)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open db %v", err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(rowsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("fail to create bucket %v", err)
+	}
+	return &boltDb{DB: db}, nil
+}
+
+func (bd *boltDb) NewInserter() lib.Inserter {
+	return &boltDbTxn{db: bd}
+}
+
+func (bd *boltDb) Close() error {
+	return bd.DB.Close()
+}
+
+// RunGC rewrites the file without its free pages, as bolt reuses the pages of
+// deleted and overwritten rows but never gives them back to the file system.
+func (bd *boltDb) RunGC() error {
+	path := bd.DB.Path()
+	tmp := path + ".compact"
+	dst, err := bbolt.Open(tmp, 0644, boltOptions)
+	if err != nil {
+		return fmt.Errorf("fail to create %v", err)
+	}
+	if err := bbolt.Compact(dst, bd.DB, 64<<20); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("fail to compact %v", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("fail to close %v", err)
+	}
+	if err := bd.DB.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("fail to close %v", err)
+	}
+	// reopen whichever file is in place, so the storage stays usable on failure
+	renameErr := os.Rename(tmp, path)
+	db, err := bbolt.Open(path, 0644, boltOptions)
+	if err != nil {
+		return fmt.Errorf("fail to reopen %v", err)
+	}
+	bd.DB = db
+	if renameErr != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("fail to replace %v", renameErr)
+	}
+	return nil
+}
+
+type boltDbTxn struct {
+	db    *boltDb
+	batch [][2][]byte
+}
+
+func (bdt *boltDbTxn) Insert(keyPayload, valuePayload []byte) error {
+	bdt.batch = append(bdt.batch, [2][]byte{
+		append([]byte(nil), keyPayload...),
+		append([]byte(nil), valuePayload...),
+	})
+	if len(bdt.batch) >= batchSize {
+		return bdt.Commit()
+	}
+	return nil
+}
+
+func (bdt *boltDbTxn) Commit() error {
+	batch := bdt.batch
+	bdt.batch = nil
+	if len(batch) == 0 {
+		return nil
+	}
+	return bdt.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(rowsBucket)
+		// sequential keys let bbolt fill pages instead of splitting them in half
+		b.FillPercent = 0.9
+		for _, kv := range batch {
+			if err := b.Put(kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Count implements lib.Counter with the key count of the bucket.
+func (bd *boltDb) Count() (int64, bool, error) {
+	var n int64
+	err := bd.View(func(tx *bbolt.Tx) error {
+		n = int64(tx.Bucket(rowsBucket).Stats().KeyN)
+		return nil
+	})
+	return n, true, err
+}
+
+// DeletePrefix deletes the rows whose key starts with prefix in one transaction.
+func (bd *boltDb) DeletePrefix(prefix []byte) error {
+	return bd.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(rowsBucket).Cursor()
+		// seek again after every delete, as deleting moves the cursor
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *boltDb) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	return db.iterate(m, fn, false)
+}
+
+// IterateReverse implements lib.ReverseIterator.
+func (db *boltDb) IterateReverse(m *lib.Merger, fn func(res map[string]any) error) error {
+	return db.iterate(m, fn, true)
+}
+
+func (db *boltDb) iterate(m *lib.Merger, fn func(res map[string]any) error, reverse bool) error {
+	return db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(rowsBucket).Cursor()
+
+		lower, upper := m.Bounds()
+		k, v := c.First()
+		step := c.Next
+		if lower != nil && !reverse {
+			k, v = c.Seek(lower)
+		}
+		if reverse {
+			step = c.Prev
+			k, v = c.Last()
+			if upper != nil {
+				// Seek lands on the first key at or after upper, the one before is in range
+				if k, v = c.Seek(upper); k == nil {
+					k, v = c.Last()
+				} else {
+					k, v = c.Prev()
+				}
+			}
+		}
+		first := true
+		return lib.GroupRows(m, func() ([]byte, []byte, bool) {
+			if !first {
+				k, v = step()
+			}
+			first = false
+			return k, v, k != nil
+		}, fn)
+	})
+}
@@ -0,0 +1,13 @@
+//go:build !no_bolt
+
+package bolt
+
+import (
+	"testing"
+
+	"github.com/kill-2/badmerger/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, NewBolt)
+}
@@ -0,0 +1,258 @@
+//go:build duckdb
+
+// Package duckdb stores rows in a DuckDB file, data.duckdb in the database dir.
+// Besides the encoded key and value the rows table has a column per schema field,
+// so the merged data can be queried with SQL right after ingestion, e.g.
+//
+//	duckdb data.duckdb -c 'SELECT page, count(*) FROM rows GROUP BY page'
+//
+// It needs cgo and is only built with the duckdb build tag.
+package duckdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kill-2/badmerger/lib"
+	"github.com/marcboeker/go-duckdb/v2"
+)
+
+func init() {
+	lib.Registration["duckdb"] = NewDuck
+	lib.StorageDocs["duckdb"] = "rows in a SQL-queryable data.duckdb"
+}
+
+// batchSize bounds the rows staged before they are merged into the rows table.
+const batchSize = 100000
+
+type duckDb struct {
+	db      *sql.DB
+	conn    *sql.Conn
+	schema  *lib.Schema
+	columns []column
+}
+
+type column struct {
+	name, kind string
+}
+
+// NewDuck opens data.duckdb in dir. The rows table is created once the schema is
+// known, see SetSchema.
+func NewDuck(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("fail to create dir %v", err)
+	}
+	connector, err := duckdb.NewConnector(filepath.Join(dir, "data.duckdb"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open db %v", err)
+	}
+	db := sql.OpenDB(connector)
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("fail to connect %v", err)
+	}
+	return &duckDb{db: db, conn: conn}, nil
+}
+
+// SetSchema creates the rows table, keyed by the encoded key, with a column per field.
+func (dd *duckDb) SetSchema(s *lib.Schema) error {
+	dd.schema = s
+	defs := []string{"_key BLOB PRIMARY KEY", "_value BLOB"}
+	for _, c := range append(s.Keys(), s.Values()...) {
+		dd.columns = append(dd.columns, column{name: c.Name, kind: c.Kind})
+		defs = append(defs, fmt.Sprintf("%v %v", quote(c.Name), sqlType(c.Kind)))
+	}
+	_, err := dd.conn.ExecContext(context.Background(), fmt.Sprintf("CREATE TABLE IF NOT EXISTS rows (%v)", strings.Join(defs, ", ")))
+	return err
+}
+
+func quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func sqlType(kind string) string {
+	switch kind {
+	case "int8":
+		return "TINYINT"
+	case "int16":
+		return "SMALLINT"
+	case "int32":
+		return "INTEGER"
+	case "int64":
+		return "BIGINT"
+	case "float32":
+		return "FLOAT"
+	case "float64":
+		return "DOUBLE"
+	case "bool":
+		return "BOOLEAN"
+	case "timestamp":
+		return "TIMESTAMP"
+	case "date":
+		return "DATE"
+	case "bytes":
+		return "BLOB"
+	case "json", "json_zstd", "map":
+		return "JSON"
+	}
+	return "VARCHAR"
+}
+
+// sqlValue converts a decoded value to what the column of kind takes.
+func sqlValue(kind string, v any) driver.Value {
+	if v == nil {
+		return nil
+	}
+	switch sqlType(kind) {
+	case "VARCHAR", "JSON":
+		if s, ok := v.(string); ok && kind != "json" && kind != "json_zstd" && kind != "map" {
+			return s
+		}
+		if str, ok := v.(fmt.Stringer); ok {
+			return str.String()
+		}
+		b, _ := json.Marshal(v)
+		return string(b)
+	case "DATE":
+		d, _ := time.Parse(time.DateOnly, v.(string))
+		return d
+	}
+	return v
+}
+
+func (dd *duckDb) NewInserter() lib.Inserter {
+	return &duckDbTxn{db: dd}
+}
+
+func (dd *duckDb) Close() error {
+	dd.conn.Close()
+	return dd.db.Close()
+}
+
+type duckDbTxn struct {
+	db    *duckDb
+	batch [][2][]byte
+}
+
+func (ddt *duckDbTxn) Insert(keyPayload, valuePayload []byte) error {
+	ddt.batch = append(ddt.batch, [2][]byte{
+		append([]byte(nil), keyPayload...),
+		append([]byte(nil), valuePayload...),
+	})
+	if len(ddt.batch) >= batchSize {
+		return ddt.Commit()
+	}
+	return nil
+}
+
+// Commit appends the batch to a staging table and merges it into rows, later rows
+// replacing earlier ones with an equal key.
+func (ddt *duckDbTxn) Commit() error {
+	batch := ddt.batch
+	ddt.batch = nil
+	if len(batch) == 0 {
+		return nil
+	}
+	dd := ddt.db
+	ctx := context.Background()
+
+	if _, err := dd.conn.ExecContext(ctx, "CREATE OR REPLACE TEMP TABLE staging AS SELECT 0::BIGINT AS _seq, * FROM rows LIMIT 0"); err != nil {
+		return err
+	}
+	err := dd.conn.Raw(func(dc any) error {
+		appender, err := duckdb.NewAppenderFromConn(dc.(driver.Conn), "", "staging")
+		if err != nil {
+			return err
+		}
+		row := make([]driver.Value, 3+len(dd.columns))
+		for i, kv := range batch {
+			record, err := lib.DecodeRecord(dd.schema, kv[0], kv[1])
+			if err != nil {
+				appender.Close()
+				return err
+			}
+			row[0], row[1], row[2] = int64(i), kv[0], kv[1]
+			for j, c := range dd.columns {
+				row[3+j] = sqlValue(c.kind, record[c.name])
+			}
+			if err := appender.AppendRow(row...); err != nil {
+				appender.Close()
+				return err
+			}
+		}
+		return appender.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("fail to stage rows %v", err)
+	}
+
+	_, err = dd.conn.ExecContext(ctx, `INSERT OR REPLACE INTO rows
+		SELECT * EXCLUDE (_seq) FROM staging
+		QUALIFY row_number() OVER (PARTITION BY _key ORDER BY _seq DESC) = 1`)
+	if err != nil {
+		return fmt.Errorf("fail to merge rows %v", err)
+	}
+	_, err = dd.conn.ExecContext(ctx, "DROP TABLE staging")
+	return err
+}
+
+// DeletePrefix deletes the rows whose key starts with prefix.
+func (dd *duckDb) DeletePrefix(prefix []byte) error {
+	ctx := context.Background()
+	if upper := lib.PrefixEnd(prefix); upper != nil {
+		_, err := dd.conn.ExecContext(ctx, "DELETE FROM rows WHERE _key >= ? AND _key < ?", prefix, upper)
+		return err
+	}
+	_, err := dd.conn.ExecContext(ctx, "DELETE FROM rows WHERE _key >= ?", prefix)
+	return err
+}
+
+func (dd *duckDb) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	query, args := "SELECT _key, _value FROM rows", []any{}
+	lower, upper := m.Bounds()
+	switch {
+	case lower != nil && upper != nil:
+		query, args = query+" WHERE _key >= ? AND _key < ?", append(args, lower, upper)
+	case lower != nil:
+		query, args = query+" WHERE _key >= ?", append(args, lower)
+	case upper != nil:
+		query, args = query+" WHERE _key < ?", append(args, upper)
+	}
+	rows, err := dd.conn.QueryContext(context.Background(), query+" ORDER BY _key", args...)
+	if err != nil {
+		return fmt.Errorf("fail to scan %v", err)
+	}
+	defer rows.Close()
+
+	var k, v []byte
+	var scanErr error
+	err = lib.GroupRows(m, func() ([]byte, []byte, bool) {
+		if !rows.Next() {
+			return nil, nil, false
+		}
+		if scanErr = rows.Scan(&k, &v); scanErr != nil {
+			return nil, nil, false
+		}
+		return k, v, true
+	}, func(res map[string]any) error {
+		if scanErr != nil {
+			return scanErr
+		}
+		return fn(res)
+	})
+	if err != nil {
+		return err
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+	return rows.Err()
+}
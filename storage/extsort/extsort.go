@@ -0,0 +1,452 @@
+// Package extsort keeps rows in sorted run files and merges them when iterating,
+// an external sort without any key-value store. One-shot merges write every row
+// once and read it once, which an LSM tree can not beat, and the package has no
+// dependencies.
+package extsort
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+func init() {
+	lib.Registration["extsort"] = NewExtsort
+	lib.StorageDocs["extsort"] = "sorted run files merged on read, no key-value store"
+}
+
+const (
+	// runBytes bounds the rows an inserter sorts in memory before writing a run.
+	runBytes = 64 << 20
+	// defaultFanIn is the most runs merged at once without a MaxOpenFiles limit.
+	defaultFanIn = 64
+	// minOpenFiles allows merging two runs into a third.
+	minOpenFiles = 3
+	runSuffix    = ".run"
+	tmpSuffix    = ".tmp"
+)
+
+type row struct {
+	key, value []byte
+}
+
+type extsortDb struct {
+	dir   string
+	fanIn int
+
+	// mu orders the runs, the newest last, and is held while writing or merging them.
+	mu   sync.Mutex
+	runs []string
+	seq  int
+}
+
+// NewExtsort opens the run files in dir. Every commit writes a sorted run, and
+// Iterate merges the runs, first merging the oldest ones into one while there are
+// more than fit in cfg.MaxOpenFiles. Equal keys in later runs replace earlier ones.
+func NewExtsort(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
+	fanIn := defaultFanIn
+	if cfg.MaxOpenFiles > 0 {
+		if cfg.MaxOpenFiles < minOpenFiles {
+			return nil, fmt.Errorf("extsort needs at least %d open files, got %d", minOpenFiles, cfg.MaxOpenFiles)
+		}
+		// one file is left for the output of a merge
+		fanIn = cfg.MaxOpenFiles - 1
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("fail to create dir %v", err)
+	}
+
+	// runs and merges not renamed into place were cut off by a crash
+	tmps, err := filepath.Glob(filepath.Join(dir, "*"+runSuffix+tmpSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil {
+			return nil, fmt.Errorf("fail to remove %v", err)
+		}
+	}
+	runs, err := filepath.Glob(filepath.Join(dir, "*"+runSuffix))
+	if err != nil {
+		return nil, err
+	}
+	// names are zero-padded sequence numbers, so they sort oldest first
+	slices.Sort(runs)
+	ed := &extsortDb{dir: dir, fanIn: fanIn, runs: runs}
+	if len(runs) > 0 {
+		last := strings.TrimSuffix(filepath.Base(runs[len(runs)-1]), runSuffix)
+		if ed.seq, err = strconv.Atoi(last); err != nil {
+			return nil, fmt.Errorf("bad run file %v", runs[len(runs)-1])
+		}
+	}
+	return ed, nil
+}
+
+func (ed *extsortDb) NewInserter() lib.Inserter {
+	return &extsortTxn{db: ed}
+}
+
+func (ed *extsortDb) Close() error {
+	return nil
+}
+
+// Compact merges all runs into one, so later iterations only read one file.
+func (ed *extsortDb) Compact() error {
+	ed.mu.Lock()
+	defer ed.mu.Unlock()
+	return ed.reduce(1)
+}
+
+type extsortTxn struct {
+	db    *extsortDb
+	batch []row
+	size  int
+}
+
+func (et *extsortTxn) Insert(keyPayload, valuePayload []byte) error {
+	et.batch = append(et.batch, row{
+		key:   append([]byte(nil), keyPayload...),
+		value: append([]byte(nil), valuePayload...),
+	})
+	et.size += len(keyPayload) + len(valuePayload)
+	if et.size >= runBytes {
+		return et.Commit()
+	}
+	return nil
+}
+
+// Commit writes the batch as a new run, keeping the last row of equal keys.
+func (et *extsortTxn) Commit() error {
+	batch := et.batch
+	et.batch, et.size = nil, 0
+	if len(batch) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(batch, func(a, b row) int { return bytes.Compare(a.key, b.key) })
+
+	ed := et.db
+	ed.mu.Lock()
+	defer ed.mu.Unlock()
+	ed.seq++
+	path := filepath.Join(ed.dir, fmt.Sprintf("%010d%s", ed.seq, runSuffix))
+	w, err := createRun(path + tmpSuffix)
+	if err != nil {
+		return err
+	}
+	for i, r := range batch {
+		if i+1 < len(batch) && bytes.Equal(batch[i+1].key, r.key) {
+			continue
+		}
+		if err := w.write(r.key, r.value); err != nil {
+			w.abort()
+			return fmt.Errorf("fail to write run %v", err)
+		}
+	}
+	if err := w.finish(path); err != nil {
+		return err
+	}
+	ed.runs = append(ed.runs, path)
+	return nil
+}
+
+// reduce merges the oldest runs until at most limit are left.
+func (ed *extsortDb) reduce(limit int) error {
+	for len(ed.runs) > limit {
+		n := min(len(ed.runs)-limit+1, ed.fanIn)
+		if err := ed.merge(n, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merge merges the oldest n runs into one, leaving out the rows of keys starting
+// with drop unless it is nil.
+func (ed *extsortDb) merge(n int, drop []byte) error {
+	merged := ed.runs[:n]
+	// the merge takes the place of its newest run, keeping the order of the runs
+	path := merged[n-1]
+	w, err := createRun(path + tmpSuffix)
+	if err != nil {
+		return err
+	}
+	err = mergeRuns(merged, func(key, value []byte) error {
+		if drop != nil && bytes.HasPrefix(key, drop) {
+			return nil
+		}
+		return w.write(key, value)
+	})
+	if err != nil {
+		w.abort()
+		return fmt.Errorf("fail to merge runs %v", err)
+	}
+	if err := w.finish(path); err != nil {
+		return err
+	}
+	// older runs left by a crash only hold rows the merge replaces
+	for _, p := range merged[:n-1] {
+		if err := os.Remove(p); err != nil {
+			return fmt.Errorf("fail to remove run %v", err)
+		}
+	}
+	ed.runs = ed.runs[n-1:]
+	return nil
+}
+
+// DeletePrefix rewrites the runs into one without the rows whose key starts with
+// prefix, as runs are never changed in place. Deleted rows come back if a crash
+// leaves the older runs behind.
+func (ed *extsortDb) DeletePrefix(prefix []byte) error {
+	ed.mu.Lock()
+	defer ed.mu.Unlock()
+	if err := ed.reduce(ed.fanIn); err != nil {
+		return err
+	}
+	if len(ed.runs) == 0 {
+		return nil
+	}
+	return ed.merge(len(ed.runs), prefix)
+}
+
+func (ed *extsortDb) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	ed.mu.Lock()
+	defer ed.mu.Unlock()
+	if err := ed.reduce(ed.fanIn); err != nil {
+		return err
+	}
+
+	rm, err := openRuns(ed.runs)
+	if err != nil {
+		return err
+	}
+	defer rm.close()
+	var readErr error
+	err = lib.GroupRows(m, func() ([]byte, []byte, bool) {
+		key, value, ok, err := rm.next()
+		readErr = err
+		return key, value, ok
+	}, func(res map[string]any) error {
+		if readErr != nil {
+			return readErr
+		}
+		return fn(res)
+	})
+	if err != nil {
+		return err
+	}
+	return readErr
+}
+
+// runWriter writes a run to a temp file, which finish renames into place.
+type runWriter struct {
+	f   *os.File
+	w   *bufio.Writer
+	buf []byte
+}
+
+func createRun(tmp string) (*runWriter, error) {
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create run %v", err)
+	}
+	return &runWriter{f: f, w: bufio.NewWriterSize(f, 1<<20)}, nil
+}
+
+// write appends a row as the length of its key, the key, the length of its
+// value and the value, the lengths as uvarints.
+func (rw *runWriter) write(key, value []byte) error {
+	rw.buf = binary.AppendUvarint(rw.buf[:0], uint64(len(key)))
+	rw.buf = append(rw.buf, key...)
+	rw.buf = binary.AppendUvarint(rw.buf, uint64(len(value)))
+	rw.buf = append(rw.buf, value...)
+	_, err := rw.w.Write(rw.buf)
+	return err
+}
+
+func (rw *runWriter) finish(path string) error {
+	if err := rw.w.Flush(); err != nil {
+		rw.abort()
+		return fmt.Errorf("fail to write run %v", err)
+	}
+	if err := rw.f.Sync(); err != nil {
+		rw.abort()
+		return fmt.Errorf("fail to sync run %v", err)
+	}
+	if err := rw.f.Close(); err != nil {
+		os.Remove(rw.f.Name())
+		return fmt.Errorf("fail to close run %v", err)
+	}
+	if err := os.Rename(rw.f.Name(), path); err != nil {
+		os.Remove(rw.f.Name())
+		return fmt.Errorf("fail to rename run %v", err)
+	}
+	return nil
+}
+
+func (rw *runWriter) abort() {
+	rw.f.Close()
+	os.Remove(rw.f.Name())
+}
+
+// runReader reads the rows of a run, holding the next one.
+type runReader struct {
+	f     *os.File
+	r     *bufio.Reader
+	index int
+	row   row
+}
+
+// next reads the next row, reporting false at the end of the run.
+func (rr *runReader) next() (bool, error) {
+	key, err := rr.readBytes()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	value, err := rr.readBytes()
+	if err != nil {
+		return false, truncated(err)
+	}
+	rr.row = row{key: key, value: value}
+	return true, nil
+}
+
+func (rr *runReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, b); err != nil {
+		return nil, truncated(err)
+	}
+	return b, nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// runHeap orders readers on their row, the newest run first among equal keys.
+type runHeap []*runReader
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].row.key, h[j].row.key); c != 0 {
+		return c < 0
+	}
+	return h[i].index > h[j].index
+}
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)   { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// mergeRuns calls fn with the rows of runs, oldest first, in key order, only the
+// row of the newest run among equal keys. The rows are fresh slices fn may keep.
+func mergeRuns(runs []string, fn func(key, value []byte) error) error {
+	rm, err := openRuns(runs)
+	if err != nil {
+		return err
+	}
+	defer rm.close()
+	for {
+		key, value, ok, err := rm.next()
+		if err != nil || !ok {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+}
+
+// runMerger reads the rows of several runs in key order, see mergeRuns.
+type runMerger struct {
+	h runHeap
+}
+
+func openRuns(runs []string) (*runMerger, error) {
+	rm := &runMerger{h: make(runHeap, 0, len(runs))}
+	for i, path := range runs {
+		f, err := os.Open(path)
+		if err != nil {
+			rm.close()
+			return nil, fmt.Errorf("fail to open run %v", err)
+		}
+		r := &runReader{f: f, r: bufio.NewReaderSize(f, 256<<10), index: i}
+		ok, err := r.next()
+		if err != nil {
+			f.Close()
+			rm.close()
+			return nil, fmt.Errorf("fail to read %v: %v", path, err)
+		}
+		if !ok {
+			f.Close()
+			continue
+		}
+		rm.h = append(rm.h, r)
+	}
+	heap.Init(&rm.h)
+	return rm, nil
+}
+
+// next returns the row with the smallest key, skipping the rows of older runs
+// with the same key.
+func (rm *runMerger) next() (key, value []byte, ok bool, err error) {
+	if rm.h.Len() == 0 {
+		return nil, nil, false, nil
+	}
+	head := rm.h[0].row
+	if err := rm.advance(); err != nil {
+		return nil, nil, false, err
+	}
+	for rm.h.Len() > 0 && bytes.Equal(rm.h[0].row.key, head.key) {
+		if err := rm.advance(); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	return head.key, head.value, true, nil
+}
+
+// advance moves the head to its next row, dropping it at the end of its run.
+func (rm *runMerger) advance() error {
+	r := rm.h[0]
+	ok, err := r.next()
+	if err != nil {
+		return fmt.Errorf("fail to read %v: %v", r.f.Name(), err)
+	}
+	if ok {
+		heap.Fix(&rm.h, 0)
+	} else {
+		heap.Pop(&rm.h)
+		r.f.Close()
+	}
+	return nil
+}
+
+func (rm *runMerger) close() {
+	for _, r := range rm.h {
+		r.f.Close()
+	}
+}
@@ -0,0 +1,198 @@
+// Package faulty provides a Storage wrapper that injects faults on demand, so
+// code embedding badmerger can exercise its error handling deterministically.
+//
+// Wrap any storage and register the result under a name of your choice:
+//
+//	f := faulty.New(inner)
+//	f.FailCommit(errors.New("disk full"))
+//	lib.Registration["faulty"] = f.Builder()
+package faulty
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// ErrPartialWrite is returned by Commit when only part of a batch was written.
+var ErrPartialWrite = errors.New("faulty: partial write")
+
+type write struct {
+	key, value []byte
+}
+
+type Storage struct {
+	inner lib.Storage
+
+	mu           sync.Mutex
+	insertBudget int
+	insertErr    error
+	commitErr    error
+	iterateErr   error
+	partial      int
+	reorder      bool
+	deferred     [][]write
+}
+
+// New wraps inner. Without configured faults it behaves exactly like inner,
+// except that inserts are buffered until Commit.
+func New(inner lib.Storage) *Storage {
+	return &Storage{inner: inner, insertBudget: -1, partial: -1}
+}
+
+// Builder returns a storage builder suitable for lib.Registration that always
+// yields this storage, ignoring the directory.
+func (s *Storage) Builder() func(string, lib.StorageConfig) (lib.Storage, error) {
+	return func(string, lib.StorageConfig) (lib.Storage, error) {
+		return s, nil
+	}
+}
+
+// FailInsertAfter makes every Insert after the next n succeed ones return err.
+func (s *Storage) FailInsertAfter(n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.insertBudget, s.insertErr = n, err
+}
+
+// FailCommit makes every Commit drop its batch and return err.
+func (s *Storage) FailCommit(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commitErr = err
+}
+
+// FailIterate makes Iterate return err without visiting anything.
+func (s *Storage) FailIterate(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.iterateErr = err
+}
+
+// PartialWrites makes every Commit write only the first n inserts of its batch
+// and return ErrPartialWrite.
+func (s *Storage) PartialWrites(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partial = n
+}
+
+// ReorderCommits holds committed batches back and applies them in reverse
+// commit order right before the next Iterate or Close.
+func (s *Storage) ReorderCommits() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reorder = true
+}
+
+// Reset removes all configured faults.
+func (s *Storage) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.insertBudget, s.insertErr = -1, nil
+	s.commitErr, s.iterateErr = nil, nil
+	s.partial, s.reorder = -1, false
+}
+
+func (s *Storage) NewInserter() lib.Inserter {
+	return &inserter{s: s}
+}
+
+func (s *Storage) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	if err := s.flushDeferred(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	err := s.iterateErr
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.inner.Iterate(m, fn)
+}
+
+func (s *Storage) Close() error {
+	if err := s.flushDeferred(); err != nil {
+		s.inner.Close()
+		return err
+	}
+	return s.inner.Close()
+}
+
+func (s *Storage) flushDeferred() error {
+	s.mu.Lock()
+	deferred := s.deferred
+	s.deferred = nil
+	s.mu.Unlock()
+
+	for i := len(deferred) - 1; i >= 0; i-- {
+		if err := s.apply(deferred[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) apply(batch []write) error {
+	ins := s.inner.NewInserter()
+	for _, w := range batch {
+		if err := ins.Insert(w.key, w.value); err != nil {
+			ins.Commit()
+			return err
+		}
+	}
+	return ins.Commit()
+}
+
+type inserter struct {
+	s     *Storage
+	batch []write
+}
+
+func (ins *inserter) Insert(keyPayload, valuePayload []byte) error {
+	s := ins.s
+	s.mu.Lock()
+	if s.insertBudget == 0 {
+		err := s.insertErr
+		s.mu.Unlock()
+		return err
+	} else if s.insertBudget > 0 {
+		s.insertBudget--
+	}
+	s.mu.Unlock()
+
+	ins.batch = append(ins.batch, write{
+		key:   append([]byte(nil), keyPayload...),
+		value: append([]byte(nil), valuePayload...),
+	})
+	return nil
+}
+
+func (ins *inserter) Commit() error {
+	s := ins.s
+	batch := ins.batch
+	ins.batch = nil
+
+	s.mu.Lock()
+	commitErr, partial, reorder := s.commitErr, s.partial, s.reorder
+	s.mu.Unlock()
+
+	if commitErr != nil {
+		return commitErr
+	}
+	if partial >= 0 && partial < len(batch) {
+		if err := s.apply(batch[:partial]); err != nil {
+			return err
+		}
+		return ErrPartialWrite
+	}
+	if reorder {
+		s.mu.Lock()
+		s.deferred = append(s.deferred, batch)
+		s.mu.Unlock()
+		return nil
+	}
+	return s.apply(batch)
+}
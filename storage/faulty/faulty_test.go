@@ -0,0 +1,66 @@
+package faulty_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+	"github.com/kill-2/badmerger/storage/faulty"
+	"github.com/kill-2/badmerger/storage/memory"
+)
+
+// open wraps a fresh memory storage, applies the fault and ingests two records,
+// returning the database along with the error of Recv.
+func open(t *testing.T, fault func(f *faulty.Storage)) (*lib.DbWrapper, error) {
+	inner, err := memory.NewMemory("", lib.StorageConfig{})
+	if err != nil {
+		t.Fatalf("fail to open memory storage: %v", err)
+	}
+	f := faulty.New(inner)
+	fault(f)
+	lib.Registration["faulty-"+t.Name()] = f.Builder()
+	db, err := lib.Open(lib.WithStorage("faulty-"+t.Name()), lib.WithDir(t.TempDir()),
+		lib.WithKey("g", "string"), lib.WithValue("v", "int64"))
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ch := make(chan map[string]any, 2)
+	ch <- map[string]any{"g": "a", "v": int64(1)}
+	ch <- map[string]any{"g": "b", "v": int64(2)}
+	close(ch)
+	return db, db.Recv(ch)
+}
+
+func TestFailInsert(t *testing.T) {
+	injected := errors.New("insert failed")
+	if _, err := open(t, func(f *faulty.Storage) { f.FailInsertAfter(1, injected) }); !errors.Is(err, injected) {
+		t.Errorf("got error %v, want %v", err, injected)
+	}
+}
+
+func TestFailCommit(t *testing.T) {
+	injected := errors.New("disk full")
+	if _, err := open(t, func(f *faulty.Storage) { f.FailCommit(injected) }); !errors.Is(err, injected) {
+		t.Errorf("got error %v, want %v", err, injected)
+	}
+}
+
+func TestPartialWrites(t *testing.T) {
+	if _, err := open(t, func(f *faulty.Storage) { f.PartialWrites(1) }); !errors.Is(err, faulty.ErrPartialWrite) {
+		t.Errorf("got error %v, want %v", err, faulty.ErrPartialWrite)
+	}
+}
+
+func TestFailIterate(t *testing.T) {
+	injected := errors.New("read failed")
+	db, err := open(t, func(f *faulty.Storage) { f.FailIterate(injected) })
+	if err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+	err = db.NewIterator(lib.WithPartialKey("g"), lib.WithAgg("v", "sum(v)")).Iter(func(map[string]any) error { return nil })
+	if !errors.Is(err, injected) {
+		t.Errorf("got error %v, want %v", err, injected)
+	}
+}
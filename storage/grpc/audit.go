@@ -0,0 +1,89 @@
+package grpc
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	gogrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// AuditEntry records one call served, see Server.SetAudit.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	Database string    `json:"database"`
+	// Caller is the address of the client, followed by its user agent, which
+	// grpc storages set to user@host.
+	Caller   string        `json:"caller"`
+	Batch    int32         `json:"batch,omitempty"`
+	Rows     int64         `json:"rows"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// SetAudit makes the server pass an AuditEntry to audit after every call, e.g.
+// AuditTo(f) to keep them in a file. It must be called before Serve.
+func (s *Server) SetAudit(audit func(AuditEntry)) {
+	s.audit = audit
+}
+
+// AuditTo returns an audit writing every entry to w as a JSON line. Failed
+// writes are dropped rather than failing the calls.
+func AuditTo(w io.Writer) func(AuditEntry) {
+	var mu sync.Mutex
+	return func(e AuditEntry) {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write(append(b, '\n'))
+	}
+}
+
+// startAudit starts the entry of a call, to be finished by endAudit.
+func (s *Server) startAudit(method string, stream gogrpc.ServerStream) *AuditEntry {
+	if s.audit == nil {
+		return nil
+	}
+	e := &AuditEntry{Time: time.Now(), Method: method}
+	ctx := stream.Context()
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		e.Caller = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if agent := md.Get("user-agent"); len(agent) > 0 {
+			e.Caller = strings.TrimSpace(e.Caller + " " + agent[0])
+		}
+	}
+	return e
+}
+
+func (s *Server) endAudit(e *AuditEntry, err error) {
+	if e == nil {
+		return
+	}
+	e.Duration = time.Since(e.Time)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.audit(*e)
+}
+
+// callerName names the client to servers, as user@host.
+func callerName() string {
+	host, _ := os.Hostname()
+	user := os.Getenv("USER")
+	if user == "" {
+		user = os.Getenv("USERNAME")
+	}
+	return user + "@" + host
+}
@@ -0,0 +1,141 @@
+//go:build !no_grpc
+
+package grpc
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+	_ "github.com/kill-2/badmerger/storage/memory"
+	"github.com/kill-2/badmerger/storage/storagetest"
+)
+
+// serve starts a server keeping its databases in memory and returns its address.
+// audit, when not nil, is passed the entry of every call.
+func serve(t *testing.T, audit func(AuditEntry)) string {
+	t.Helper()
+	srv, err := NewServer(t.TempDir(), "memory", lib.StorageConfig{})
+	if err != nil {
+		t.Fatalf("fail to create server: %v", err)
+	}
+	if audit != nil {
+		srv.SetAudit(audit)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen: %v", err)
+	}
+	go srv.Serve(lis)
+	t.Cleanup(func() { srv.Close() })
+	return lis.Addr().String()
+}
+
+// remote opens the database named after the whole dir, as the test dirs of the
+// suite share their base name.
+func remote(addr string) storagetest.Builder {
+	return func(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
+		cfg.URI = "grpc://" + addr + "/" + strings.ReplaceAll(strings.Trim(dir, "/"), "/", "_")
+		return NewRemote(dir, cfg)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, remote(serve(t, nil)))
+}
+
+func TestIterateBounds(t *testing.T) {
+	var sent atomic.Int64
+	addr := serve(t, func(e AuditEntry) {
+		if e.Method == "iterate" {
+			sent.Store(e.Rows)
+		}
+	})
+	lib.Registration["grpc-test"] = remote(addr)
+	defer delete(lib.Registration, "grpc-test")
+
+	db, err := lib.Open(lib.WithStorage("grpc-test"), lib.WithDir(t.TempDir()),
+		lib.WithKey("g", "string"), lib.WithKey("i", "int32"), lib.WithValue("v", "int64"))
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	defer db.Close()
+	ch := make(chan map[string]any, 100)
+	for i := int32(0); i < 100; i++ {
+		ch <- map[string]any{"g": string(rune('a' + i%10)), "i": i, "v": int64(i)}
+	}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+
+	got, err := db.Get(map[string]any{"g": "c"}, lib.WithAgg("s", "sum(v)"))
+	if err != nil {
+		t.Fatalf("fail to get: %v", err)
+	}
+	if got["s"] != int64(470) {
+		t.Errorf("got sum %v, want 470", got["s"])
+	}
+	if n := sent.Load(); n != 10 {
+		t.Errorf("server sent %d rows for one group of 10", n)
+	}
+
+	// a value no row has reads nothing
+	err = db.NewIterator(lib.WithPartialKeyValue("g", "zz")).Iter(func(map[string]any) error { return nil })
+	if err != nil {
+		t.Fatalf("fail to iterate: %v", err)
+	}
+	if n := sent.Load(); n != 0 {
+		t.Errorf("server sent %d rows for a key without rows", n)
+	}
+}
+
+func TestPage(t *testing.T) {
+	entries := make(chan AuditEntry, 10)
+	addr := serve(t, func(e AuditEntry) {
+		if e.Method == "iterate" {
+			entries <- e
+		}
+	})
+	lib.Registration["grpc-test"] = remote(addr)
+	defer delete(lib.Registration, "grpc-test")
+
+	db, err := lib.Open(lib.WithStorage("grpc-test"), lib.WithDir(t.TempDir()),
+		lib.WithKey("g", "string"), lib.WithKey("i", "int32"), lib.WithValue("v", "int64"))
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	defer db.Close()
+	ch := make(chan map[string]any, 100)
+	for i := int32(0); i < 100; i++ {
+		ch <- map[string]any{"g": string(rune('a' + i%10)), "i": i, "v": int64(i)}
+	}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+
+	var got []any
+	token := ""
+	for page := 0; ; page++ {
+		p, err := db.NewIterator(lib.WithPartialKey("g"), lib.WithAgg("n", "count(v)")).Page(4, token)
+		if err != nil {
+			t.Fatalf("fail to page: %v", err)
+		}
+		for _, row := range p.Rows {
+			got = append(got, row["g"])
+		}
+		// the server starts past the groups of the earlier pages
+		if e := <-entries; e.Rows > int64(100-40*page) {
+			t.Errorf("server sent %d rows for page %d", e.Rows, page)
+		}
+		if token = p.Next; token == "" {
+			break
+		}
+	}
+	if len(got) != 10 || got[0] != "a" || got[9] != "j" {
+		t.Errorf("got groups %v, want a to j", got)
+	}
+}
@@ -0,0 +1,171 @@
+package grpc
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// Maintenance sets the periodic upkeep of the databases of a long-running server,
+// which otherwise keep every overwritten value and grow their directories without
+// bound. A zero interval turns its task off.
+type Maintenance struct {
+	// GCInterval runs value log GC on storages implementing lib.GarbageCollector.
+	GCInterval time.Duration
+	// FlattenInterval compacts storages implementing lib.Compacter, e.g. badger's
+	// Flatten. It rewrites whole levels, so it is best run rarely.
+	FlattenInterval time.Duration
+	// TrimInterval shrinks storages implementing lib.Shrinker and returns freed
+	// memory to the OS.
+	TrimInterval time.Duration
+	// Report, when set, is called after every task on every database.
+	Report func(task, database string, took time.Duration, err error)
+}
+
+// Maintenance tasks, as named in MaintenanceStats and Report.
+const (
+	TaskGC      = "gc"
+	TaskFlatten = "flatten"
+	TaskTrim    = "trim"
+)
+
+// TaskStats counts the runs of one maintenance task over all databases.
+type TaskStats struct {
+	Runs      int64         `json:"runs"`
+	Failures  int64         `json:"failures"`
+	Total     time.Duration `json:"total_ns"`
+	LastRun   time.Time     `json:"last_run"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+type maintainer struct {
+	cfg  Maintenance
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	mu    sync.Mutex
+	stats map[string]TaskStats
+}
+
+// StartMaintenance runs the tasks of cfg in the background until Close, each on
+// its own ticker. Tasks run on one database at a time, alongside the calls of
+// clients. It may be called once, before or after Serve.
+func (s *Server) StartMaintenance(cfg Maintenance) {
+	m := &maintainer{cfg: cfg, stop: make(chan struct{}), stats: make(map[string]TaskStats)}
+	s.mu.Lock()
+	s.maint = m
+	s.mu.Unlock()
+
+	m.every(cfg.GCInterval, func() { s.maintain(TaskGC, runGC) })
+	m.every(cfg.FlattenInterval, func() { s.maintain(TaskFlatten, flatten) })
+	m.every(cfg.TrimInterval, func() {
+		s.maintain(TaskTrim, trim)
+		debug.FreeOSMemory()
+	})
+}
+
+// MaintenanceStats returns the counters of the maintenance tasks run so far, by task.
+func (s *Server) MaintenanceStats() map[string]TaskStats {
+	s.mu.Lock()
+	m := s.maint
+	s.mu.Unlock()
+	stats := make(map[string]TaskStats)
+	if m == nil {
+		return stats
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for task, st := range m.stats {
+		stats[task] = st
+	}
+	return stats
+}
+
+func (m *maintainer) every(interval time.Duration, task func()) {
+	if interval <= 0 {
+		return
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-t.C:
+				task()
+			}
+		}
+	}()
+}
+
+// close stops the tickers and waits for running tasks.
+func (m *maintainer) close() {
+	close(m.stop)
+	m.wg.Wait()
+}
+
+// maintain runs task on every open database, skipping storages without the ability.
+func (s *Server) maintain(task string, run func(lib.Storage) (bool, error)) {
+	s.mu.Lock()
+	m := s.maint
+	dbs := make(map[string]*served, len(s.dbs))
+	for name, db := range s.dbs {
+		db.calls.Add(1)
+		dbs[name] = db
+	}
+	s.mu.Unlock()
+
+	for name, db := range dbs {
+		start := time.Now()
+		ran, err := run(db.Storage)
+		db.done()
+		if !ran {
+			continue
+		}
+		took := time.Since(start)
+		m.mu.Lock()
+		st := m.stats[task]
+		st.Runs++
+		st.Total += took
+		st.LastRun = start
+		st.LastError = ""
+		if err != nil {
+			st.Failures++
+			st.LastError = err.Error()
+		}
+		m.stats[task] = st
+		m.mu.Unlock()
+		if m.cfg.Report != nil {
+			m.cfg.Report(task, name, took, err)
+		}
+	}
+}
+
+func runGC(db lib.Storage) (bool, error) {
+	gc, ok := db.(lib.GarbageCollector)
+	if !ok {
+		return false, nil
+	}
+	return true, gc.RunGC()
+}
+
+func flatten(db lib.Storage) (bool, error) {
+	c, ok := db.(lib.Compacter)
+	if !ok {
+		return false, nil
+	}
+	return true, c.Compact()
+}
+
+func trim(db lib.Storage) (bool, error) {
+	sh, ok := db.(lib.Shrinker)
+	if !ok {
+		return false, nil
+	}
+	return true, sh.Shrink()
+}
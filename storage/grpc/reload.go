@@ -0,0 +1,84 @@
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// served is an open database along with the calls using it, which Reload drains.
+type served struct {
+	lib.Storage
+	// dir is where the database was opened, after symlinks
+	dir   string
+	calls sync.WaitGroup
+}
+
+// done ends a use of the database started by open.
+func (d *served) done() {
+	d.calls.Done()
+}
+
+// Reload swaps databases for the directory ROOT/NAME points to now, e.g. after a
+// nightly rebuild into a new directory and switching the symlink ROOT/NAME to it.
+// New calls go to the refreshed database right away, while calls already running
+// finish against the previous one, which Reload then closes, so clients see no
+// downtime. Rows inserted into the previous one meanwhile stay there. Without names
+// every open database is reloaded; the others pick up their new directory when
+// first used anyway. A database whose symlink did not move fails to reload and
+// keeps being served.
+func (s *Server) Reload(names ...string) error {
+	if len(names) == 0 {
+		s.mu.Lock()
+		for name := range s.dbs {
+			names = append(names, name)
+		}
+		s.mu.Unlock()
+	}
+	var errs []error
+	for _, name := range names {
+		if err := s.reload(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) reload(name string) error {
+	s.mu.Lock()
+	old, ok := s.dbs[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(s.root, name))
+	if err != nil {
+		return fmt.Errorf("fail to reload %v: %v", name, err)
+	}
+	if dir == old.dir {
+		return fmt.Errorf("fail to reload %v: it still points to %v", name, dir)
+	}
+
+	// open outside the lock, calls keep going to the old database meanwhile
+	db, err := s.openDir(name)
+	if err != nil {
+		return fmt.Errorf("fail to reload %v: %v", name, err)
+	}
+	s.mu.Lock()
+	if s.dbs[name] != old {
+		s.mu.Unlock()
+		db.Close()
+		return fmt.Errorf("fail to reload %v: it was reloaded or closed meanwhile", name)
+	}
+	s.dbs[name] = db
+	s.mu.Unlock()
+
+	old.calls.Wait()
+	if err := old.Close(); err != nil {
+		return fmt.Errorf("fail to close the previous %v: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+// Package grpc keeps rows on a badmerger-server, so that ingestion can run on many
+// machines while aggregation runs centrally. The protocol is in storage.proto.
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kill-2/badmerger/lib"
+	gogrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func init() {
+	lib.Registration["grpc"] = NewRemote
+	lib.StorageDocs["grpc"] = "rows on a badmerger-server, as -s grpc://host:port[/database]"
+}
+
+// batchSize bounds the rows sent per message.
+const batchSize = 1000
+
+type remoteDb struct {
+	conn     *gogrpc.ClientConn
+	database string
+}
+
+// NewRemote opens the database of a badmerger-server given as grpc://host:port/database
+// in cfg.URI. Without a database in the URI it is named after the base name of dir,
+// which otherwise only keeps the schema. Clients feeding one database from several
+// machines overwrite each other's rows with equal keys, so they should differ in
+// some key field, e.g. their name. Connections are not encrypted.
+func NewRemote(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
+	u, err := url.Parse(cfg.URI)
+	if err != nil || u.Scheme != "grpc" || u.Host == "" {
+		return nil, fmt.Errorf("want grpc://host:port[/database], got %q", cfg.URI)
+	}
+	database := strings.Trim(u.Path, "/")
+	if database == "" {
+		database = filepath.Base(filepath.Clean(dir))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("fail to create dir %v", err)
+	}
+	conn, err := gogrpc.NewClient(u.Host,
+		gogrpc.WithTransportCredentials(insecure.NewCredentials()),
+		gogrpc.WithUserAgent(callerName()),
+		gogrpc.WithDefaultCallOptions(
+			gogrpc.ForceCodec(codec{}),
+			gogrpc.MaxCallRecvMsgSize(maxMessageSize),
+			gogrpc.MaxCallSendMsgSize(maxMessageSize),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("fail to connect %v", err)
+	}
+	return &remoteDb{conn: conn, database: database}, nil
+}
+
+func (rd *remoteDb) NewInserter() lib.Inserter {
+	return &remoteTxn{db: rd}
+}
+
+func (rd *remoteDb) Close() error {
+	return rd.conn.Close()
+}
+
+// remoteTxn streams its rows to the server as they come, in one Insert call per commit.
+type remoteTxn struct {
+	db     *remoteDb
+	stream gogrpc.ClientStream
+	cancel context.CancelFunc
+	rows   Rows
+	size   int
+}
+
+func (rt *remoteTxn) Insert(keyPayload, valuePayload []byte) error {
+	rt.rows.Keys = append(rt.rows.Keys, append([]byte(nil), keyPayload...))
+	rt.rows.Values = append(rt.rows.Values, append([]byte(nil), valuePayload...))
+	rt.size += len(keyPayload) + len(valuePayload)
+	if len(rt.rows.Keys) >= batchSize || rt.size >= batchBytes {
+		return rt.send()
+	}
+	return nil
+}
+
+func (rt *remoteTxn) send() error {
+	if rt.stream == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := rt.db.conn.NewStream(ctx, &serviceDesc.Streams[0], insertMethod)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("fail to start insert %v", err)
+		}
+		rt.stream, rt.cancel = stream, cancel
+		rt.rows.Database = rt.db.database
+	}
+	err := rt.stream.SendMsg(&rt.rows)
+	rt.rows, rt.size = Rows{}, 0
+	if err != nil {
+		return rt.abort(err)
+	}
+	return nil
+}
+
+// abort drops the stream, recovering the reason the server gave for breaking it.
+func (rt *remoteTxn) abort(err error) error {
+	if err == io.EOF {
+		err = rt.stream.RecvMsg(&Committed{})
+	}
+	rt.cancel()
+	rt.stream = nil
+	return fmt.Errorf("fail to insert %v", err)
+}
+
+func (rt *remoteTxn) Commit() error {
+	if len(rt.rows.Keys) > 0 {
+		if err := rt.send(); err != nil {
+			return err
+		}
+	}
+	if rt.stream == nil {
+		return nil
+	}
+	if err := rt.stream.CloseSend(); err != nil {
+		return rt.abort(err)
+	}
+	if err := rt.stream.RecvMsg(&Committed{}); err != nil {
+		return rt.abort(err)
+	}
+	rt.cancel()
+	rt.stream = nil
+	return nil
+}
+
+func (rd *remoteDb) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := rd.conn.NewStream(ctx, &serviceDesc.Streams[1], iterateMethod)
+	if err != nil {
+		return fmt.Errorf("fail to start iterate %v", err)
+	}
+	// the server seeks to the bounds, GroupRows checks them again for older servers
+	lower, upper := m.Bounds()
+	req := &IterateRequest{Database: rd.database, Batch: int32(m.Prefetch()), Lower: lower, Upper: upper}
+	if err := stream.SendMsg(req); err != nil {
+		return fmt.Errorf("fail to start iterate %v", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return fmt.Errorf("fail to start iterate %v", err)
+	}
+
+	rows := &Rows{}
+	i := 0
+	var recvErr error
+	err = lib.GroupRows(m, func() ([]byte, []byte, bool) {
+		for i == len(rows.Keys) {
+			rows, i = &Rows{}, 0
+			if err := stream.RecvMsg(rows); err == io.EOF {
+				return nil, nil, false
+			} else if err != nil {
+				recvErr = fmt.Errorf("fail to iterate %v", err)
+				return nil, nil, false
+			}
+		}
+		i++
+		if m.NoValue() {
+			return rows.Keys[i-1], nil, true
+		}
+		return rows.Keys[i-1], rows.Values[i-1], true
+	}, func(res map[string]any) error {
+		if recvErr != nil {
+			return recvErr
+		}
+		return fn(res)
+	})
+	if err != nil {
+		return err
+	}
+	return recvErr
+}
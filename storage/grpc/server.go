@@ -0,0 +1,217 @@
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kill-2/badmerger/lib"
+	gogrpc "google.golang.org/grpc"
+)
+
+// defaultBatch is the most rows per Rows message when the client leaves it open.
+const defaultBatch = 1000
+
+// Server serves the databases under a root directory to grpc storages, keeping each
+// in a local storage. Ingestion can then run on many machines while the merge runs
+// centrally, against the server or against its root. It has no query call, as it
+// never sees the schemas: clients page through groups with IterWrapper.Page on a
+// grpc storage, whose token bounds Iterate, so the server streams from the token
+// on and stops when the client has a full page.
+type Server struct {
+	root  string
+	store string
+	cfg   lib.StorageConfig
+	grpc  *gogrpc.Server
+
+	mu  sync.Mutex
+	dbs map[string]*served
+	// maint runs the upkeep of the databases, see StartMaintenance
+	maint *maintainer
+	audit func(AuditEntry)
+}
+
+// NewServer returns a server keeping databases in root/DATABASE with the
+// registered storage store. Storages that need the schema, like duckdb, can not
+// serve as the server only sees encoded rows.
+func NewServer(root, store string, cfg lib.StorageConfig) (*Server, error) {
+	if _, ok := lib.Registration[store]; !ok {
+		return nil, fmt.Errorf("no such storage: %v", store)
+	}
+	s := &Server{root: root, store: store, cfg: cfg, dbs: make(map[string]*served)}
+	s.grpc = gogrpc.NewServer(
+		gogrpc.ForceServerCodec(codec{}),
+		gogrpc.MaxRecvMsgSize(maxMessageSize),
+		gogrpc.MaxSendMsgSize(maxMessageSize),
+	)
+	s.grpc.RegisterService(&serviceDesc, s)
+	return s, nil
+}
+
+// Serve accepts connections on lis until Close.
+func (s *Server) Serve(lis net.Listener) error {
+	return s.grpc.Serve(lis)
+}
+
+// Close waits for the running calls and maintenance and closes every database.
+func (s *Server) Close() error {
+	s.grpc.GracefulStop()
+	s.mu.Lock()
+	m := s.maint
+	s.mu.Unlock()
+	if m != nil {
+		m.close()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for name, db := range s.dbs {
+		if err := db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("fail to close %v: %v", name, err))
+		}
+	}
+	s.dbs = nil
+	return errors.Join(errs...)
+}
+
+// open returns the storage of a database, opening it on first use. The caller
+// must call done once it no longer uses it, see Reload.
+func (s *Server) open(name string) (*served, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("bad database name %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dbs == nil {
+		return nil, fmt.Errorf("server is closed")
+	}
+	db, ok := s.dbs[name]
+	if !ok {
+		var err error
+		if db, err = s.openDir(name); err != nil {
+			return nil, err
+		}
+		s.dbs[name] = db
+	}
+	db.calls.Add(1)
+	return db, nil
+}
+
+// openDir opens the storage of a database in the directory ROOT/NAME points to.
+func (s *Server) openDir(name string) (*served, error) {
+	dir := filepath.Join(s.root, name)
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	db, err := lib.Registration[s.store](dir, s.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open %v: %v", name, err)
+	}
+	if _, ok := db.(lib.SchemaReceiver); ok {
+		db.Close()
+		return nil, fmt.Errorf("storage %v needs the schema, which the server does not know", s.store)
+	}
+	return &served{Storage: db, dir: dir}, nil
+}
+
+// insert writes the rows of one Insert stream and commits them at its end. A stream
+// broken off by the client is not committed, though storages that commit in batches
+// may keep part of it.
+func (s *Server) insert(stream gogrpc.ServerStream) (err error) {
+	var db *served
+	var ins lib.Inserter
+	var n, size int64
+	var database string
+	audit := s.startAudit("insert", stream)
+	defer func() {
+		if audit != nil {
+			audit.Database, audit.Rows, audit.Bytes = database, n, size
+		}
+		s.endAudit(audit, err)
+		if db != nil {
+			db.done()
+		}
+	}()
+	for {
+		rows := &Rows{}
+		err := stream.RecvMsg(rows)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if ins == nil {
+			database = rows.Database
+			if db, err = s.open(rows.Database); err != nil {
+				return err
+			}
+			ins = db.NewInserter()
+		}
+		if len(rows.Keys) != len(rows.Values) {
+			return fmt.Errorf("%d keys but %d values", len(rows.Keys), len(rows.Values))
+		}
+		for i := range rows.Keys {
+			if err := ins.Insert(rows.Keys[i], rows.Values[i]); err != nil {
+				return fmt.Errorf("fail to insert %v", err)
+			}
+			size += int64(len(rows.Keys[i]) + len(rows.Values[i]))
+		}
+		n += int64(len(rows.Keys))
+	}
+	if ins != nil {
+		if err := ins.Commit(); err != nil {
+			return fmt.Errorf("fail to commit %v", err)
+		}
+	}
+	return stream.SendMsg(&Committed{Rows: n})
+}
+
+func (s *Server) iterate(req *IterateRequest, stream gogrpc.ServerStream) (err error) {
+	var n, sent int64
+	audit := s.startAudit("iterate", stream)
+	defer func() {
+		if audit != nil {
+			audit.Database, audit.Batch, audit.Rows, audit.Bytes = req.Database, req.Batch, n, sent
+		}
+		s.endAudit(audit, err)
+	}()
+	db, err := s.open(req.Database)
+	if err != nil {
+		return err
+	}
+	defer db.done()
+	batch := int(req.Batch)
+	if batch <= 0 {
+		batch = defaultBatch
+	}
+
+	rows := &Rows{}
+	size := 0
+	err = lib.ScanRange(db.Storage, req.Lower, req.Upper, func(keyPayload, valuePayload []byte) error {
+		rows.Keys = append(rows.Keys, keyPayload)
+		rows.Values = append(rows.Values, valuePayload)
+		size += len(keyPayload) + len(valuePayload)
+		n++
+		sent += int64(len(keyPayload) + len(valuePayload))
+		if len(rows.Keys) < batch && size < batchBytes {
+			return nil
+		}
+		if err := stream.SendMsg(rows); err != nil {
+			return err
+		}
+		rows, size = &Rows{}, 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(rows.Keys) == 0 {
+		return nil
+	}
+	return stream.SendMsg(rows)
+}
@@ -0,0 +1,220 @@
+package grpc
+
+import (
+	"fmt"
+	"math"
+
+	gogrpc "google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Rows, Committed and IterateRequest are the messages of storage.proto, encoded in
+// the protobuf wire format by hand to spare a generated package for three messages.
+type Rows struct {
+	Database string
+	Keys     [][]byte
+	Values   [][]byte
+}
+
+type Committed struct {
+	Rows int64
+}
+
+// IterateRequest bounds are nil when unset, see storage.proto.
+type IterateRequest struct {
+	Database string
+	Batch    int32
+	Lower    []byte
+	Upper    []byte
+}
+
+type message interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+func (r *Rows) marshal() []byte {
+	var b []byte
+	if r.Database != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, r.Database)
+	}
+	for _, k := range r.Keys {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, k)
+	}
+	for _, v := range r.Values {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	}
+	return b
+}
+
+func (r *Rows) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num < 1 || num > 3 || typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, b)
+		}
+		v, n := protowire.ConsumeBytes(b)
+		switch num {
+		case 1:
+			r.Database = string(v)
+		case 2:
+			r.Keys = append(r.Keys, append([]byte(nil), v...))
+		case 3:
+			r.Values = append(r.Values, append([]byte(nil), v...))
+		}
+		return n
+	})
+}
+
+func (c *Committed) marshal() []byte {
+	var b []byte
+	if c.Rows != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(c.Rows))
+	}
+	return b
+}
+
+func (c *Committed) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if num != 1 || typ != protowire.VarintType {
+			return protowire.ConsumeFieldValue(num, typ, b)
+		}
+		v, n := protowire.ConsumeVarint(b)
+		c.Rows = int64(v)
+		return n
+	})
+}
+
+func (r *IterateRequest) marshal() []byte {
+	var b []byte
+	if r.Database != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, r.Database)
+	}
+	if r.Batch != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(r.Batch))
+	}
+	// bounds are sent whenever set, as an empty bound is not an open one
+	if r.Lower != nil {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.Lower)
+	}
+	if r.Upper != nil {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, r.Upper)
+	}
+	return b
+}
+
+func (r *IterateRequest) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			r.Database = v
+			return n
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			r.Batch = int32(v)
+			return n
+		case (num == 3 || num == 4) && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if num == 3 {
+				r.Lower = append([]byte{}, v...)
+			} else {
+				r.Upper = append([]byte{}, v...)
+			}
+			return n
+		}
+		return protowire.ConsumeFieldValue(num, typ, b)
+	})
+}
+
+// consumeFields calls field with the value of every field in b, skipping unknown
+// ones the way protobuf does, until b is used up.
+func consumeFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if n = field(num, typ, b); n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// codec is forced on both ends, named proto so that clients generated from
+// storage.proto talk to badmerger-server as well.
+type codec struct{}
+
+func (codec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("can not marshal %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (codec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("can not unmarshal %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+// storageServer is what serviceDesc dispatches to, see Server.
+type storageServer interface {
+	insert(stream gogrpc.ServerStream) error
+	iterate(req *IterateRequest, stream gogrpc.ServerStream) error
+}
+
+var serviceDesc = gogrpc.ServiceDesc{
+	ServiceName: "badmerger.Storage",
+	HandlerType: (*storageServer)(nil),
+	Streams: []gogrpc.StreamDesc{
+		{
+			StreamName:    "Insert",
+			ClientStreams: true,
+			Handler: func(srv any, stream gogrpc.ServerStream) error {
+				return srv.(storageServer).insert(stream)
+			},
+		},
+		{
+			StreamName:    "Iterate",
+			ServerStreams: true,
+			Handler: func(srv any, stream gogrpc.ServerStream) error {
+				req := &IterateRequest{}
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(storageServer).iterate(req, stream)
+			},
+		},
+	},
+	Metadata: "storage.proto",
+}
+
+const (
+	insertMethod  = "/badmerger.Storage/Insert"
+	iterateMethod = "/badmerger.Storage/Iterate"
+)
+
+// Messages are batched up to batchBytes, but a single row can be far larger, so
+// both ends take messages of any size protobuf allows.
+const (
+	batchBytes     = 1 << 20
+	maxMessageSize = math.MaxInt32
+)
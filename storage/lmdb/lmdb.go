@@ -0,0 +1,207 @@
+//go:build cgo
+
+// Package lmdb stores rows in LMDB. Iterate reads keys and values straight from the
+// memory map without copying them, which pays off when a database is queried many
+// times. It needs cgo; the LMDB sources are bundled.
+package lmdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	"github.com/kill-2/badmerger/lib"
+)
+
+func init() {
+	lib.Registration["lmdb"] = NewLmdb
+	lib.StorageDocs["lmdb"] = "memory-mapped B+tree store"
+}
+
+// MapSize is the largest size a database may grow to. The map is sparse, so a
+// large value costs address space only.
+var MapSize int64 = 1 << 40
+
+// batchSize bounds the writes held in memory before they are committed.
+const batchSize = 10000
+
+type lmdbDb struct {
+	env *lmdb.Env
+	dbi lmdb.DBI
+}
+
+// NewLmdb opens an LMDB environment in dir. Commits are not synced to disk, as
+// merges are rerun rather than recovered; the map is synced on Close.
+func NewLmdb(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("fail to create dir %v", err)
+	}
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return nil, fmt.Errorf("fail to create env %v", err)
+	}
+	if err := env.SetMapSize(MapSize); err != nil {
+		env.Close()
+		return nil, fmt.Errorf("fail to set map size %v", err)
+	}
+	if err := env.Open(dir, lmdb.NoSync|lmdb.NoTLS, 0644); err != nil {
+		env.Close()
+		return nil, fmt.Errorf("fail to open db %v", err)
+	}
+
+	ld := &lmdbDb{env: env}
+	err = env.Update(func(txn *lmdb.Txn) (err error) {
+		ld.dbi, err = txn.OpenRoot(lmdb.Create)
+		return err
+	})
+	if err != nil {
+		env.Close()
+		return nil, fmt.Errorf("fail to open root %v", err)
+	}
+	return ld, nil
+}
+
+func (ld *lmdbDb) NewInserter() lib.Inserter {
+	return &lmdbTxn{db: ld}
+}
+
+func (ld *lmdbDb) Close() error {
+	if err := ld.env.Sync(true); err != nil {
+		ld.env.Close()
+		return fmt.Errorf("fail to sync %v", err)
+	}
+	return ld.env.Close()
+}
+
+type lmdbTxn struct {
+	db    *lmdbDb
+	batch [][2][]byte
+}
+
+func (lt *lmdbTxn) Insert(keyPayload, valuePayload []byte) error {
+	lt.batch = append(lt.batch, [2][]byte{
+		append([]byte(nil), keyPayload...),
+		append([]byte(nil), valuePayload...),
+	})
+	if len(lt.batch) >= batchSize {
+		return lt.Commit()
+	}
+	return nil
+}
+
+func (lt *lmdbTxn) Commit() error {
+	batch := lt.batch
+	lt.batch = nil
+	if len(batch) == 0 {
+		return nil
+	}
+	return lt.db.env.Update(func(txn *lmdb.Txn) error {
+		for _, kv := range batch {
+			if err := txn.Put(lt.db.dbi, kv[0], kv[1], 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Count implements lib.Counter with the entry count of the database.
+func (ld *lmdbDb) Count() (int64, bool, error) {
+	st, err := ld.stat()
+	if err != nil {
+		return 0, false, err
+	}
+	return int64(st.Entries), true, nil
+}
+
+// Size implements lib.Sizer with the pages in use, as the map file is as large
+// as the map whatever it holds.
+func (ld *lmdbDb) Size() (int64, error) {
+	st, err := ld.stat()
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.BranchPages+st.LeafPages+st.OverflowPages) * int64(st.PSize), nil
+}
+
+func (ld *lmdbDb) stat() (*lmdb.Stat, error) {
+	var st *lmdb.Stat
+	err := ld.env.View(func(txn *lmdb.Txn) error {
+		var err error
+		st, err = txn.Stat(ld.dbi)
+		return err
+	})
+	return st, err
+}
+
+// DeletePrefix deletes the rows whose key starts with prefix in one transaction.
+func (ld *lmdbDb) DeletePrefix(prefix []byte) error {
+	return ld.env.Update(func(txn *lmdb.Txn) error {
+		cur, err := txn.OpenCursor(ld.dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+		for {
+			k, _, err := cur.Get(prefix, nil, lmdb.SetRange)
+			if lmdb.IsNotFound(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !bytes.HasPrefix(k, prefix) {
+				return nil
+			}
+			if err := cur.Del(0); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func (ld *lmdbDb) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	return ld.iterate(m, fn, lmdb.First, lmdb.Next)
+}
+
+// IterateReverse implements lib.ReverseIterator.
+func (ld *lmdbDb) IterateReverse(m *lib.Merger, fn func(res map[string]any) error) error {
+	return ld.iterate(m, fn, lmdb.Last, lmdb.Prev)
+}
+
+// iterate walks the cursor from the row of first on with next.
+func (ld *lmdbDb) iterate(m *lib.Merger, fn func(res map[string]any) error, first, next uint) error {
+	return ld.env.View(func(txn *lmdb.Txn) error {
+		txn.RawRead = true
+		cur, err := txn.OpenCursor(ld.dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		var seek []byte
+		if lower, _ := m.Bounds(); first == lmdb.First && lower != nil {
+			// SetRange lands on the first key at or after lower
+			first, seek = lmdb.SetRange, lower
+		}
+		op := first
+		var readErr error
+		err = lib.GroupRows(m, func() ([]byte, []byte, bool) {
+			k, v, err := cur.Get(seek, nil, op)
+			op, seek = next, nil
+			if err != nil && !lmdb.IsNotFound(err) {
+				readErr = err
+			}
+			return k, v, err == nil
+		}, func(res map[string]any) error {
+			if readErr != nil {
+				return readErr
+			}
+			return fn(res)
+		})
+		if err != nil {
+			return err
+		}
+		return readErr
+	})
+}
@@ -0,0 +1,13 @@
+//go:build cgo && !no_lmdb
+
+package lmdb
+
+import (
+	"testing"
+
+	"github.com/kill-2/badmerger/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, NewLmdb)
+}
@@ -1,8 +1,9 @@
 package lotus
 
 import (
-	"bytes"
 	"fmt"
+	"math"
+	"strconv"
 
 	"github.com/kill-2/badmerger/lib"
 	"github.com/lotusdblabs/lotusdb/v2"
@@ -10,16 +11,44 @@ import (
 
 func init() {
 	lib.Registration["lotus"] = NewLotus
+	lib.StorageDocs["lotus"] = "lotusdb store on disk"
 }
 
 type lotusDb struct {
 	*lotusdb.DB
 }
 
-func NewLotus(dir string) (lib.Storage, error) {
+// minOpenFiles covers two memtable WALs and one partition.
+const minOpenFiles = 8
+
+// filesPerPartition is the index and value log of a partition plus room for rotation.
+const filesPerPartition = 4
+
+func NewLotus(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
 
 	lotusOpts := lotusdb.DefaultOptions
 	lotusOpts.DirPath = dir
+	if cfg.MaxOpenFiles > 0 {
+		if cfg.MaxOpenFiles < minOpenFiles {
+			return nil, fmt.Errorf("lotus needs at least %d open files, got %d", minOpenFiles, cfg.MaxOpenFiles)
+		}
+		// Every memtable has its own WAL and every partition its own files.
+		partitions := cfg.MaxOpenFiles / (2 * filesPerPartition)
+		if partitions > lotusOpts.PartitionNum {
+			partitions = lotusOpts.PartitionNum
+		}
+		if partitions < 1 {
+			partitions = 1
+		}
+		memtables := cfg.MaxOpenFiles - partitions*filesPerPartition
+		if memtables > lotusOpts.MemtableNums {
+			memtables = lotusOpts.MemtableNums
+		}
+		lotusOpts.PartitionNum, lotusOpts.MemtableNums = partitions, memtables
+	}
+	if err := withOptions(&lotusOpts, cfg.Options); err != nil {
+		return nil, err
+	}
 
 	db, err := lotusdb.Open(lotusOpts)
 	if err != nil {
@@ -28,6 +57,48 @@ func NewLotus(dir string) (lib.Storage, error) {
 	return &lotusDb{DB: db}, nil
 }
 
+// withOptions applies the storage options of lib.WithStorageOption:
+//
+//	partition_num        partitions of the index and value log, fixed once created
+//	memtable_size        size of a memtable, e.g. 64M
+//	memtable_nums        memtables kept before writes wait
+//	block_cache          cache of value log blocks, 0 turns it off
+//	value_log_file_size  size of a value log file
+func withOptions(opts *lotusdb.Options, settings map[string]string) error {
+	for key, value := range settings {
+		var n int64
+		var err error
+		switch key {
+		case "partition_num", "memtable_nums":
+			n, err = strconv.ParseInt(value, 10, 0)
+		case "memtable_size", "block_cache":
+			if n, err = lib.ParseSize(value); err == nil && n > math.MaxUint32 {
+				err = fmt.Errorf("%v exceeds 4G", value)
+			}
+		case "value_log_file_size":
+			n, err = lib.ParseSize(value)
+		default:
+			return fmt.Errorf("unknown lotus option %v", key)
+		}
+		if err != nil {
+			return fmt.Errorf("bad lotus option %v: %v", key, err)
+		}
+		switch key {
+		case "partition_num":
+			opts.PartitionNum = int(n)
+		case "memtable_nums":
+			opts.MemtableNums = int(n)
+		case "memtable_size":
+			opts.MemtableSize = uint32(n)
+		case "block_cache":
+			opts.BlockCache = uint32(n)
+		case "value_log_file_size":
+			opts.ValueLogFileSize = n
+		}
+	}
+	return nil
+}
+
 func (ld *lotusDb) NewInserter() lib.Inserter {
 	return &lotusDbTxn{
 		db:    ld,
@@ -36,9 +107,47 @@ func (ld *lotusDb) NewInserter() lib.Inserter {
 }
 
 func (ld *lotusDb) Close() error {
+	if err := ld.DB.Sync(); err != nil {
+		ld.DB.Close()
+		return fmt.Errorf("fail to sync db %v", err)
+	}
 	return ld.DB.Close()
 }
 
+// Compact syncs the memtable WALs, the index and the value log. Lotus flushes
+// memtables on its own and has no compaction besides the value log rewrite of
+// RunGC.
+func (ld *lotusDb) Compact() error {
+	return ld.DB.Sync()
+}
+
+// RunGC rewrites the value log without the values of overwritten and deleted keys.
+func (ld *lotusDb) RunGC() error {
+	return ld.DB.Compact()
+}
+
+// DeletePrefix deletes the rows whose key starts with prefix. Their keys are collected
+// first, as lotus iterators lock the database until they are closed.
+func (ld *lotusDb) DeletePrefix(prefix []byte) error {
+	iter, err := ld.DB.NewIterator(lotusdb.IteratorOptions{Prefix: prefix})
+	if err != nil {
+		return err
+	}
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+	}
+	iter.Close()
+
+	batch := ld.DB.NewBatch(lotusdb.DefaultBatchOptions)
+	for _, k := range keys {
+		if err := batch.Delete(k); err != nil {
+			return err
+		}
+	}
+	return batch.Commit()
+}
+
 type lotusDbTxn struct {
 	db    *lotusDb
 	batch *lotusdb.Batch
@@ -58,37 +167,34 @@ func (lt *lotusDbTxn) Commit() error {
 }
 
 func (db *lotusDb) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
-	iter, _ := db.DB.NewIterator(lotusdb.IteratorOptions{})
-	defer iter.Close()
+	return db.iterate(m, fn, false)
+}
 
-	var lastKeyMap map[string]any
-	lastKeyBytes := []byte{}
-	valueMaps := []map[string]any{}
+// IterateReverse implements lib.ReverseIterator.
+func (db *lotusDb) IterateReverse(m *lib.Merger, fn func(res map[string]any) error) error {
+	return db.iterate(m, fn, true)
+}
 
-	for iter.Rewind(); iter.Valid(); iter.Next() {
-		currKeyBytes, keyMap := m.RestoreKey(iter.Key())
-		if !bytes.Equal(lastKeyBytes, currKeyBytes) {
-			if len(lastKeyBytes) > 0 {
-				if err := fn(m.Merge(lastKeyMap, valueMaps)); err != nil {
-					return err
-				}
-			}
-			lastKeyBytes = lastKeyBytes[:0]
-			lastKeyBytes = append(lastKeyBytes, currKeyBytes...)
-			lastKeyMap = keyMap
-			valueMaps = valueMaps[:0]
-		}
+func (db *lotusDb) iterate(m *lib.Merger, fn func(res map[string]any) error, reverse bool) error {
+	iter, _ := db.DB.NewIterator(lotusdb.IteratorOptions{Prefix: m.Prefix(), Reverse: reverse})
+	defer iter.Close()
 
+	iter.Rewind()
+	if lower, _ := m.Bounds(); lower != nil && !reverse {
+		iter.Seek(lower)
+	}
+	first := true
+	return lib.GroupRows(m, func() ([]byte, []byte, bool) {
+		if !first {
+			iter.Next()
+		}
+		first = false
+		if !iter.Valid() {
+			return nil, nil, false
+		}
 		if m.NoValue() {
-			continue
+			return iter.Key(), nil, true
 		}
-
-		valueMaps = append(valueMaps, m.RestoreValue(iter.Value()))
-	}
-
-	if err := fn(m.Merge(lastKeyMap, valueMaps)); err != nil {
-		return err
-	}
-
-	return nil
+		return iter.Key(), iter.Value(), true
+	}, fn)
 }
@@ -0,0 +1,13 @@
+//go:build !no_lotus
+
+package lotus
+
+import (
+	"testing"
+
+	"github.com/kill-2/badmerger/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, NewLotus)
+}
@@ -0,0 +1,228 @@
+// Package memory keeps rows in a sorted slice in process memory, without any
+// files, for small merges in tests and CI where creating a directory of storage
+// files is pure overhead.
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+func init() {
+	lib.Registration["memory"] = NewMemory
+	lib.StorageDocs["memory"] = "process-local store, lost on exit"
+}
+
+// stores keeps the rows of every dir opened in this process, so a database can be
+// closed and opened again like with the other storages. Rows are lost on exit.
+var (
+	storesMu sync.Mutex
+	stores   = make(map[string]*store)
+)
+
+type row struct {
+	key, value []byte
+}
+
+type store struct {
+	mu   sync.RWMutex
+	rows []row
+}
+
+type memoryDb struct {
+	*store
+	dir string
+}
+
+// NewMemory opens the in-memory storage of dir, shared by every open of the same dir
+// within the process. Without a dir every open starts empty. The dir is only created
+// for the schema, the rows never reach it, and rows kept for a dir that no longer
+// exists, e.g. after lib.Destroy, are dropped.
+func NewMemory(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
+	if dir == "" {
+		return &memoryDb{store: &store{}}, nil
+	}
+	dir = filepath.Clean(dir)
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		delete(stores, dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("fail to create dir %v", err)
+	}
+	s, ok := stores[dir]
+	if !ok {
+		s = &store{}
+		stores[dir] = s
+	}
+	return &memoryDb{store: s, dir: dir}, nil
+}
+
+func (md *memoryDb) NewInserter() lib.Inserter {
+	return &memoryTxn{s: md.store}
+}
+
+func (md *memoryDb) Close() error {
+	return nil
+}
+
+// Destroy implements lib.Destroyer, forgetting the rows of the dir.
+func (md *memoryDb) Destroy() error {
+	if md.dir == "" {
+		return nil
+	}
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if stores[md.dir] == md.store {
+		delete(stores, md.dir)
+	}
+	return nil
+}
+
+type memoryTxn struct {
+	s     *store
+	batch []row
+}
+
+func (mt *memoryTxn) Insert(keyPayload, valuePayload []byte) error {
+	mt.batch = append(mt.batch, row{
+		key:   append([]byte(nil), keyPayload...),
+		value: append([]byte(nil), valuePayload...),
+	})
+	return nil
+}
+
+// Commit sorts the batch and merges it into the rows in one pass, later rows
+// replacing earlier ones with an equal key.
+func (mt *memoryTxn) Commit() error {
+	batch := mt.batch
+	mt.batch = nil
+	if len(batch) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(batch, func(a, b row) int { return bytes.Compare(a.key, b.key) })
+
+	s := mt.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	merged := make([]row, 0, len(s.rows)+len(batch))
+	i := 0
+	for j, r := range batch {
+		if j+1 < len(batch) && bytes.Equal(batch[j+1].key, r.key) {
+			continue
+		}
+		for i < len(s.rows) && bytes.Compare(s.rows[i].key, r.key) < 0 {
+			merged = append(merged, s.rows[i])
+			i++
+		}
+		if i < len(s.rows) && bytes.Equal(s.rows[i].key, r.key) {
+			i++
+		}
+		merged = append(merged, r)
+	}
+	s.rows = append(merged, s.rows[i:]...)
+	return nil
+}
+
+// Count implements lib.Counter.
+func (md *memoryDb) Count() (int64, bool, error) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	return int64(len(md.rows)), true, nil
+}
+
+// Size implements lib.Sizer with the bytes of the keys and values held.
+func (md *memoryDb) Size() (int64, error) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	var n int64
+	for _, r := range md.rows {
+		n += int64(len(r.key) + len(r.value))
+	}
+	return n, nil
+}
+
+// DeletePrefix drops the rows whose key starts with prefix.
+func (md *memoryDb) DeletePrefix(prefix []byte) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	compare := func(r row, k []byte) int { return bytes.Compare(r.key, k) }
+	start, _ := slices.BinarySearchFunc(md.rows, prefix, compare)
+	end := len(md.rows)
+	if upper := lib.PrefixEnd(prefix); upper != nil {
+		end, _ = slices.BinarySearchFunc(md.rows, upper, compare)
+	}
+	// a new slice, as snapshots may still iterate the old one
+	md.rows = append(md.rows[:start:start], md.rows[end:]...)
+	return nil
+}
+
+func (md *memoryDb) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	return md.iterate(m, fn, false)
+}
+
+// IterateReverse implements lib.ReverseIterator.
+func (md *memoryDb) IterateReverse(m *lib.Merger, fn func(res map[string]any) error) error {
+	return md.iterate(m, fn, true)
+}
+
+func (md *memoryDb) iterate(m *lib.Merger, fn func(res map[string]any) error, reverse bool) error {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	return iterateRows(md.rows, m, fn, reverse)
+}
+
+// Snapshot implements lib.Snapshotter. Commit and DeletePrefix replace the rows
+// rather than change them, so a view keeps the slice they were in.
+func (md *memoryDb) Snapshot() (lib.View, error) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	return memoryView(md.rows), nil
+}
+
+type memoryView []row
+
+func (v memoryView) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	return iterateRows(v, m, fn, false)
+}
+
+// IterateReverse implements lib.ReverseIterator.
+func (v memoryView) IterateReverse(m *lib.Merger, fn func(res map[string]any) error) error {
+	return iterateRows(v, m, fn, true)
+}
+
+func (v memoryView) Close() error {
+	return nil
+}
+
+func iterateRows(rows []row, m *lib.Merger, fn func(res map[string]any) error, reverse bool) error {
+	lower, upper := m.Bounds()
+	if lower != nil {
+		start, _ := slices.BinarySearchFunc(rows, lower, func(r row, k []byte) int { return bytes.Compare(r.key, k) })
+		rows = rows[start:]
+	}
+	if upper != nil {
+		end, _ := slices.BinarySearchFunc(rows, upper, func(r row, k []byte) int { return bytes.Compare(r.key, k) })
+		rows = rows[:end]
+	}
+
+	i := 0
+	return lib.GroupRows(m, func() ([]byte, []byte, bool) {
+		if i == len(rows) {
+			return nil, nil, false
+		}
+		r := rows[i]
+		if reverse {
+			r = rows[len(rows)-1-i]
+		}
+		i++
+		return r.key, r.value, true
+	}, fn)
+}
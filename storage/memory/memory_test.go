@@ -0,0 +1,87 @@
+//go:build !no_memory
+
+package memory
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+	"github.com/kill-2/badmerger/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, NewMemory)
+}
+
+func TestDestroy(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	open := func() *lib.DB {
+		db, err := lib.Open(lib.WithStorage("memory"), lib.WithDir(dir), lib.WithKey("g", "string"), lib.WithValue("v", "int64"))
+		if err != nil {
+			t.Fatalf("fail to open db: %v", err)
+		}
+		return db
+	}
+	count := func(db *lib.DB) int {
+		n := 0
+		err := db.NewIterator(lib.WithPartialKey("g")).Iter(func(map[string]any) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("fail to iterate: %v", err)
+		}
+		return n
+	}
+
+	db := open()
+	ch := make(chan map[string]any, 2)
+	ch <- map[string]any{"g": "a", "v": int64(1)}
+	ch <- map[string]any{"g": "b", "v": int64(1)}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("fail to close db: %v", err)
+	}
+	if err := db.Destroy(); err != nil {
+		t.Fatalf("fail to destroy db: %v", err)
+	}
+	if _, ok := stores[dir]; ok {
+		t.Errorf("rows of %v kept after Destroy", dir)
+	}
+
+	db = open()
+	defer db.Close()
+	if n := count(db); n != 0 {
+		t.Errorf("%d groups after reopening a destroyed db, want 0", n)
+	}
+}
+
+func TestDestroyDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+	db, err := lib.Open(lib.WithStorage("memory"), lib.WithDir(dir), lib.WithKey("g", "string"), lib.WithValue("v", "int64"))
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	ch := make(chan map[string]any, 1)
+	ch <- map[string]any{"g": "a", "v": int64(1)}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+	db.Close()
+	if err := lib.Destroy(dir); err != nil {
+		t.Fatalf("fail to destroy db: %v", err)
+	}
+
+	s, err := NewMemory(dir, lib.StorageConfig{})
+	if err != nil {
+		t.Fatalf("fail to open storage: %v", err)
+	}
+	if n, _, _ := s.(*memoryDb).Count(); n != 0 {
+		t.Errorf("%d rows after reopening a dir removed by lib.Destroy, want 0", n)
+	}
+}
@@ -0,0 +1,214 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/kill-2/badmerger/lib"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+func init() {
+	lib.Registration["redis"] = NewRedis
+	lib.StorageDocs["redis"] = "shared store in a Redis server, see BADMERGER_REDIS_URL"
+}
+
+// URL locates the Redis server. BADMERGER_REDIS_URL overrides it, e.g.
+// redis://:password@merge-host:6379/2.
+var URL = "redis://localhost:6379/0"
+
+// batchSize bounds the writes held in memory before they are committed.
+const batchSize = 10000
+
+// pageSize is the number of rows Iterate reads per round trip unless the
+// merger asks for another prefetch.
+const pageSize = 1000
+
+type redisDb struct {
+	client *goredis.Client
+	// keys is a sorted set of every key with score 0, so ZRANGE BYLEX returns
+	// them in byte order, and values maps each key to its value.
+	keys   string
+	values string
+}
+
+// NewRedis opens a storage in a Redis server, letting invocations of badmerger on
+// several hosts feed one merge target. The rows live under the absolute path of
+// dir, so every host passes the same dir; the dir itself only keeps the schema.
+// Rows with equal keys overwrite each other whichever host wrote them, so hosts
+// should differ in some key field, e.g. their name.
+func NewRedis(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("fail to create dir %v", err)
+	}
+	url := URL
+	if env := os.Getenv("BADMERGER_REDIS_URL"); env != "" {
+		url = env
+	}
+	opts, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("fail to parse url %v", err)
+	}
+	client := goredis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("fail to reach redis %v", err)
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("fail to resolve dir %v", err)
+	}
+	// the hash tag keeps both keys in one slot of a cluster
+	name := "badmerger:{" + abs + "}"
+	return &redisDb{client: client, keys: name + ":keys", values: name + ":values"}, nil
+}
+
+func (rd *redisDb) NewInserter() lib.Inserter {
+	return &redisTxn{db: rd}
+}
+
+func (rd *redisDb) Close() error {
+	return rd.client.Close()
+}
+
+type redisTxn struct {
+	db    *redisDb
+	batch [][2][]byte
+}
+
+func (rt *redisTxn) Insert(keyPayload, valuePayload []byte) error {
+	rt.batch = append(rt.batch, [2][]byte{
+		append([]byte(nil), keyPayload...),
+		append([]byte(nil), valuePayload...),
+	})
+	if len(rt.batch) >= batchSize {
+		return rt.Commit()
+	}
+	return nil
+}
+
+// Commit writes the batch in one MULTI/EXEC transaction, so readers never see a
+// key without its value.
+func (rt *redisTxn) Commit() error {
+	batch := rt.batch
+	rt.batch = nil
+	if len(batch) == 0 {
+		return nil
+	}
+
+	members := make([]goredis.Z, len(batch))
+	fields := make([]any, 0, 2*len(batch))
+	for i, kv := range batch {
+		members[i] = goredis.Z{Member: string(kv[0])}
+		fields = append(fields, string(kv[0]), kv[1])
+	}
+	ctx := context.Background()
+	_, err := rt.db.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.ZAdd(ctx, rt.db.keys, members...)
+		pipe.HSet(ctx, rt.db.values, fields...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("fail to commit %v", err)
+	}
+	return nil
+}
+
+// DeletePrefix deletes the rows whose key starts with prefix, a page at a time.
+func (rd *redisDb) DeletePrefix(prefix []byte) error {
+	ctx := context.Background()
+	stop := "+"
+	if upper := lib.PrefixEnd(prefix); upper != nil {
+		stop = "(" + string(upper)
+	}
+	for {
+		keys, err := rd.client.ZRangeArgs(ctx, goredis.ZRangeArgs{
+			Key: rd.keys, Start: "[" + string(prefix), Stop: stop, ByLex: true, Count: pageSize,
+		}).Result()
+		if err != nil {
+			return fmt.Errorf("fail to read keys %v", err)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		members := make([]any, len(keys))
+		for i, k := range keys {
+			members[i] = k
+		}
+		_, err = rd.client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+			pipe.ZRem(ctx, rd.keys, members...)
+			pipe.HDel(ctx, rd.values, keys...)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("fail to delete %v", err)
+		}
+	}
+}
+
+func (rd *redisDb) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	ctx := context.Background()
+	size := int64(pageSize)
+	if n := m.Prefetch(); n > 0 {
+		size = int64(n)
+	}
+
+	from, to := "-", "+"
+	lower, upper := m.Bounds()
+	if lower != nil {
+		from = "[" + string(lower)
+	}
+	if upper != nil {
+		to = "(" + string(upper)
+	}
+	var keys []string
+	var values []any
+	var readErr error
+	i, done := 0, false
+	err := lib.GroupRows(m, func() ([]byte, []byte, bool) {
+		if i == len(keys) {
+			if done {
+				return nil, nil, false
+			}
+			// read the next page of keys and their values
+			keys, readErr = rd.client.ZRangeArgs(ctx, goredis.ZRangeArgs{
+				Key: rd.keys, Start: from, Stop: to, ByLex: true, Count: size,
+			}).Result()
+			if readErr != nil {
+				readErr = fmt.Errorf("fail to read keys %v", readErr)
+				return nil, nil, false
+			}
+			if !m.NoValue() && len(keys) > 0 {
+				if values, readErr = rd.client.HMGet(ctx, rd.values, keys...).Result(); readErr != nil {
+					readErr = fmt.Errorf("fail to read values %v", readErr)
+					return nil, nil, false
+				}
+			}
+			i, done = 0, int64(len(keys)) < size
+			if len(keys) == 0 {
+				return nil, nil, false
+			}
+			from = "(" + keys[len(keys)-1]
+		}
+		k := keys[i]
+		i++
+		if m.NoValue() {
+			return []byte(k), nil, true
+		}
+		v, _ := values[i-1].(string)
+		return []byte(k), []byte(v), true
+	}, func(res map[string]any) error {
+		if readErr != nil {
+			return readErr
+		}
+		return fn(res)
+	})
+	if err != nil {
+		return err
+	}
+	return readErr
+}
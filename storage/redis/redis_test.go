@@ -0,0 +1,15 @@
+//go:build !no_redis
+
+package redis
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/kill-2/badmerger/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	t.Setenv("BADMERGER_REDIS_URL", "redis://"+miniredis.RunT(t).Addr())
+	storagetest.Run(t, NewRedis)
+}
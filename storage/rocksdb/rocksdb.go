@@ -0,0 +1,188 @@
+//go:build rocksdb
+
+// Package rocksdb stores rows in RocksDB through cgo. It needs librocksdb and is
+// only built with the rocksdb build tag.
+package rocksdb
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/kill-2/badmerger/lib"
+	"github.com/linxGnu/grocksdb"
+)
+
+func init() {
+	lib.Registration["rocksdb"] = NewRocks
+	lib.StorageDocs["rocksdb"] = "RocksDB store on disk"
+}
+
+// batchSize bounds the writes held in memory before they are committed.
+const batchSize = 10000
+
+// Tune, when set, is called with the options of every database before it is
+// opened, to adjust compaction, compression and the like for very large merges.
+var Tune func(opts *grocksdb.Options)
+
+type rocksDb struct {
+	*grocksdb.DB
+	opts *grocksdb.Options
+	wo   *grocksdb.WriteOptions
+}
+
+// NewRocks opens a RocksDB database in dir. Rows are written without a WAL, as
+// merges are rerun rather than recovered; memtables are flushed on Close. Blocks
+// are compressed with LZ4 and the last level with ZSTD unless Tune says otherwise.
+func NewRocks(dir string, cfg lib.StorageConfig) (lib.Storage, error) {
+	opts := grocksdb.NewDefaultOptions()
+	opts.SetCreateIfMissing(true)
+	opts.SetLevelCompactionDynamicLevelBytes(true)
+	opts.SetCompression(grocksdb.LZ4Compression)
+	opts.SetBottommostCompression(grocksdb.ZSTDCompression)
+	if cfg.MaxOpenFiles > 0 {
+		opts.SetMaxOpenFiles(cfg.MaxOpenFiles)
+	}
+	if Tune != nil {
+		Tune(opts)
+	}
+
+	db, err := grocksdb.OpenDb(opts, dir)
+	if err != nil {
+		opts.Destroy()
+		return nil, fmt.Errorf("fail to open db %v", err)
+	}
+	wo := grocksdb.NewDefaultWriteOptions()
+	wo.DisableWAL(true)
+	return &rocksDb{DB: db, opts: opts, wo: wo}, nil
+}
+
+func (rd *rocksDb) NewInserter() lib.Inserter {
+	return &rocksDbTxn{db: rd, batch: grocksdb.NewWriteBatch()}
+}
+
+func (rd *rocksDb) Close() error {
+	rd.DB.Close()
+	rd.wo.Destroy()
+	rd.opts.Destroy()
+	return nil
+}
+
+// Shrink flushes the memtables, releasing the memory they hold.
+func (rd *rocksDb) Shrink() error {
+	fo := grocksdb.NewDefaultFlushOptions()
+	defer fo.Destroy()
+	fo.SetWait(true)
+	return rd.DB.Flush(fo)
+}
+
+// Count implements lib.Counter with the key estimate of rocksdb, which counts
+// overwritten keys until they are compacted away.
+func (rd *rocksDb) Count() (int64, bool, error) {
+	n, err := strconv.ParseInt(rd.DB.GetProperty("rocksdb.estimate-num-keys"), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("fail to read key estimate %v", err)
+	}
+	return n, false, nil
+}
+
+// DeletePrefix deletes the rows whose key starts with prefix, in batches.
+func (rd *rocksDb) DeletePrefix(prefix []byte) error {
+	ro := grocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+	it := rd.NewIterator(ro)
+	defer it.Close()
+
+	batch := grocksdb.NewWriteBatch()
+	defer batch.Destroy()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Key()
+		batch.Delete(key.Data())
+		key.Free()
+		if batch.Count() >= batchSize {
+			if err := rd.Write(rd.wo, batch); err != nil {
+				return err
+			}
+			batch.Clear()
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return rd.Write(rd.wo, batch)
+}
+
+type rocksDbTxn struct {
+	db    *rocksDb
+	batch *grocksdb.WriteBatch
+}
+
+func (rdt *rocksDbTxn) Insert(keyPayload, valuePayload []byte) error {
+	rdt.batch.Put(keyPayload, valuePayload)
+	if rdt.batch.Count() >= batchSize {
+		return rdt.flush()
+	}
+	return nil
+}
+
+func (rdt *rocksDbTxn) flush() error {
+	if rdt.batch.Count() == 0 {
+		return nil
+	}
+	defer rdt.batch.Clear()
+	return rdt.db.Write(rdt.db.wo, rdt.batch)
+}
+
+func (rdt *rocksDbTxn) Commit() error {
+	defer rdt.batch.Destroy()
+	return rdt.flush()
+}
+
+func (rd *rocksDb) Iterate(m *lib.Merger, fn func(res map[string]any) error) error {
+	ro := grocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+	it := rd.NewIterator(ro)
+	defer it.Close()
+
+	if lower, _ := m.Bounds(); lower != nil {
+		it.Seek(lower)
+	} else {
+		it.SeekToFirst()
+	}
+	var key, value *grocksdb.Slice
+	free := func() {
+		if key != nil {
+			key.Free()
+		}
+		if value != nil {
+			value.Free()
+		}
+		key, value = nil, nil
+	}
+	defer free()
+	first := true
+	err := lib.GroupRows(m, func() ([]byte, []byte, bool) {
+		free()
+		if !first {
+			it.Next()
+		}
+		first = false
+		if !it.Valid() {
+			return nil, nil, false
+		}
+		key = it.Key()
+		if m.NoValue() {
+			return key.Data(), nil, true
+		}
+		value = it.Value()
+		return key.Data(), value.Data(), true
+	}, fn)
+	if err != nil {
+		return err
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("fail to iterate %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Package storagetest is a conformance suite for storages. A new backend proves it
+// satisfies the Storage contract with a test such as
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, NewPebble)
+//	}
+package storagetest
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kill-2/badmerger/lib"
+)
+
+// Builder opens a storage in a directory, as registered in lib.Registration.
+type Builder func(dir string, cfg lib.StorageConfig) (lib.Storage, error)
+
+var registered atomic.Int64
+
+// Run exercises builder through lib.Open, checking that the storage iterates rows
+// in the byte order of their keys, groups them by partial key, keeps null masks and large values
+// intact, makes committed rows visible and durable across reopening, overwrites
+// equal keys and emits nothing when empty.
+func Run(t *testing.T, builder Builder) {
+	name := fmt.Sprintf("storagetest-%d", registered.Add(1))
+	lib.Registration[name] = builder
+	t.Cleanup(func() { delete(lib.Registration, name) })
+
+	t.Run("Ordering", func(t *testing.T) { testOrdering(t, name) })
+	t.Run("Grouping", func(t *testing.T) { testGrouping(t, name) })
+	t.Run("NullMasks", func(t *testing.T) { testNullMasks(t, name) })
+	t.Run("LargeValues", func(t *testing.T) { testLargeValues(t, name) })
+	t.Run("Commit", func(t *testing.T) { testCommit(t, name) })
+	t.Run("Overwrite", func(t *testing.T) { testOverwrite(t, name) })
+	t.Run("Empty", func(t *testing.T) { testEmpty(t, name) })
+}
+
+func open(t *testing.T, store, dir string, opts ...lib.StorageOpt) *lib.DB {
+	t.Helper()
+	db, err := lib.Open(append([]lib.StorageOpt{lib.WithStorage(store), lib.WithDir(dir)}, opts...)...)
+	if err != nil {
+		t.Fatalf("fail to open db: %v", err)
+	}
+	return db
+}
+
+func write(t *testing.T, db *lib.DB, records ...map[string]any) {
+	t.Helper()
+	ch := make(chan map[string]any, len(records))
+	for _, r := range records {
+		ch <- r
+	}
+	close(ch)
+	if err := db.Recv(ch); err != nil {
+		t.Fatalf("fail to Recv: %v", err)
+	}
+}
+
+func query(t *testing.T, db *lib.DB, opts ...lib.IteratorOpt) []map[string]any {
+	t.Helper()
+	var results []map[string]any
+	err := db.NewIterator(opts...).Iter(func(res map[string]any) error {
+		results = append(results, res)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("fail to iterate: %v", err)
+	}
+	return results
+}
+
+func testOrdering(t *testing.T, store string) {
+	db := open(t, store, t.TempDir(), lib.WithKey("n", "int32"), lib.WithKey("s", "string"), lib.WithValue("v", "int64"))
+	defer db.Close()
+
+	// storages order rows by the bytes of their keys, which for non-negative
+	// integers and strings of equal length is the order of their values
+	var want []map[string]any
+	var records []map[string]any
+	for n := int32(0); n <= 300; n += 50 {
+		for _, s := range []string{"aa", "ab", "ba", "bb"} {
+			want = append(want, map[string]any{"n": n, "s": s})
+			records = append(records, map[string]any{"n": n, "s": s, "v": int64(n)})
+		}
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(records), func(i, j int) { records[i], records[j] = records[j], records[i] })
+	write(t, db, records...)
+
+	got := query(t, db, lib.WithPartialKey("n"), lib.WithPartialKey("s"))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rows out of key order:\n got %v\nwant %v", got, want)
+	}
+}
+
+func testGrouping(t *testing.T, store string) {
+	db := open(t, store, t.TempDir(), lib.WithKey("g", "string"), lib.WithKey("i", "int32"), lib.WithValue("v", "int64"))
+	defer db.Close()
+
+	var records []map[string]any
+	for i := int32(0); i < 100; i++ {
+		records = append(records, map[string]any{"g": fmt.Sprint("g", i%3), "i": i, "v": int64(i)})
+	}
+	write(t, db, records...)
+
+	got := query(t, db, lib.WithPartialKey("g"), lib.WithAgg("c", "count(v)"), lib.WithAgg("s", "sum(v)"), lib.WithAgg("f", "first(v)"), lib.WithAgg("l", "last(v)"))
+	want := []map[string]any{
+		{"g": "g0", "c": int64(34), "s": int64(1683), "f": int64(0), "l": int64(99)},
+		{"g": "g1", "c": int64(33), "s": int64(1617), "f": int64(1), "l": int64(97)},
+		{"g": "g2", "c": int64(33), "s": int64(1650), "f": int64(2), "l": int64(98)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bad groups:\n got %v\nwant %v", got, want)
+	}
+}
+
+func testNullMasks(t *testing.T, store string) {
+	db := open(t, store, t.TempDir(), lib.WithKey("i", "int32"), lib.WithValue("a", "int64"), lib.WithValue("b", "string"))
+	defer db.Close()
+
+	write(t, db,
+		map[string]any{"i": int32(0), "a": int64(1)},
+		map[string]any{"i": int32(1), "b": "x"},
+		map[string]any{"i": int32(2)},
+		map[string]any{"i": int32(3), "a": int64(4), "b": "y"},
+	)
+
+	got := query(t, db, lib.WithPartialKey("i"), lib.WithAgg("a", "last(a)"), lib.WithAgg("b", "last(b)"))
+	want := []map[string]any{
+		{"i": int32(0), "a": int64(1), "b": nil},
+		{"i": int32(1), "a": nil, "b": "x"},
+		{"i": int32(2), "a": nil, "b": nil},
+		{"i": int32(3), "a": int64(4), "b": "y"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("null masks not kept:\n got %v\nwant %v", got, want)
+	}
+}
+
+func testLargeValues(t *testing.T, store string) {
+	db := open(t, store, t.TempDir(), lib.WithKey("i", "int32"), lib.WithValue("doc", "json_zstd"), lib.WithValue("s", "string"))
+	defer db.Close()
+
+	rng := rand.New(rand.NewSource(1))
+	large := make([]byte, 4<<20)
+	for i := range large {
+		large[i] = "abcdefghijklmnopqrstuvwxyz"[rng.Intn(26)]
+	}
+	long := strings.Repeat("s", 30000)
+	write(t, db, map[string]any{"i": int32(0), "doc": string(large), "s": long})
+
+	got := query(t, db, lib.WithPartialKey("i"), lib.WithAgg("doc", "last(doc)"), lib.WithAgg("s", "last(s)"))
+	if len(got) != 1 || got[0]["doc"] != string(large) || got[0]["s"] != long {
+		t.Errorf("large values not kept intact")
+	}
+}
+
+func testCommit(t *testing.T, store string) {
+	dir := t.TempDir()
+	db := open(t, store, dir, lib.WithKey("i", "int32"), lib.WithValue("v", "int64"))
+
+	var records []map[string]any
+	for i := int32(0); i < 25000; i++ {
+		records = append(records, map[string]any{"i": i, "v": int64(1)})
+	}
+	write(t, db, records...)
+	count := func(db *lib.DB) any {
+		got := query(t, db, lib.WithAgg("c", "count(v)"), lib.WithEmitEmpty())
+		return got[0]["c"]
+	}
+	if c := count(db); c != int64(25000) {
+		t.Errorf("%v rows visible after Recv, want 25000", c)
+	}
+	write(t, db, map[string]any{"i": int32(25000), "v": int64(1)})
+	if err := db.Close(); err != nil {
+		t.Fatalf("fail to close db: %v", err)
+	}
+
+	db = open(t, store, dir)
+	defer db.Close()
+	if c := count(db); c != int64(25001) {
+		t.Errorf("%v rows after reopening, want 25001", c)
+	}
+}
+
+func testOverwrite(t *testing.T, store string) {
+	db := open(t, store, t.TempDir(), lib.WithKey("i", "int32"), lib.WithValue("v", "int64"))
+	defer db.Close()
+
+	write(t, db, map[string]any{"i": int32(0), "v": int64(1)})
+	write(t, db, map[string]any{"i": int32(0), "v": int64(2)})
+
+	got := query(t, db, lib.WithPartialKey("i"), lib.WithAgg("c", "count(v)"), lib.WithAgg("v", "last(v)"))
+	want := []map[string]any{{"i": int32(0), "c": int64(1), "v": int64(2)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("equal keys not overwritten:\n got %v\nwant %v", got, want)
+	}
+}
+
+func testEmpty(t *testing.T, store string) {
+	db := open(t, store, t.TempDir(), lib.WithKey("i", "int32"), lib.WithValue("v", "int64"))
+	defer db.Close()
+
+	if got := query(t, db, lib.WithPartialKey("i"), lib.WithAgg("c", "count(v)")); len(got) != 0 {
+		t.Errorf("empty storage emitted %v", got)
+	}
+}